@@ -7,6 +7,7 @@
 // @BasePath /api/v1
 // @SubApi Cluster State [/cluster]
 // @SubApi Monitor Configuration [/monitor]
+// @SubApi Heartbeats [/heartbeat]
 
 package api
 
@@ -126,6 +127,12 @@ func (a *Api) Run() {
 			a.MonitorDeleteHandler,
 		})).Methods("DELETE")
 
+	// Heartbeat handlers
+	routes.Handle(setupHandler(a.MWHandler,
+		"/api/v1/heartbeat/{check}", []rye.Handler{
+			a.HeartbeatHandler,
+		})).Methods("POST")
+
 	// Alerter handlers (route order matters!)
 	routes.Handle(setupHandler(a.MWHandler,
 		"/api/v1/alerter", []rye.Handler{
@@ -0,0 +1,119 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/InVisionApp/rye"
+	"github.com/coreos/etcd/client"
+	"github.com/gorilla/mux"
+
+	"github.com/9corp/9volt/monitor"
+)
+
+// Optional heartbeat request body
+type heartbeatRequest struct {
+	Status  string `json:"status"` // 'ok' (default), 'warning' or 'critical'
+	Message string `json:"message"`
+}
+
+// @Title Record Heartbeat
+// @Description Record a ping (optionally carrying a status and message) for a 'heartbeat' check via any cluster member
+// @Accept  json
+// @Param   check     path    string     true        "Heartbeat check name"
+// @Success 200 {object} rye.JSONStatus
+// @Failure 400 {object} rye.JSONStatus
+// @Failure 404 {object} rye.JSONStatus
+// @Failure 500 {object} rye.JSONStatus
+// @Router /heartbeat/{check} [post]
+func (a *Api) HeartbeatHandler(rw http.ResponseWriter, r *http.Request) *rye.Response {
+	defer r.Body.Close()
+
+	checkName := mux.Vars(r)["check"]
+
+	if checkName == "" {
+		return &rye.Response{
+			Err:        errors.New("Check name not found. Bug?"),
+			StatusCode: http.StatusInternalServerError,
+		}
+	}
+
+	fullPath := fmt.Sprintf("monitor/%v", checkName)
+
+	entry, err := a.Config.DalClient.Get(fullPath, nil)
+	if err != nil {
+		if client.IsKeyNotFound(err) {
+			return &rye.Response{
+				Err:        fmt.Errorf("Unable to find any check named '%v'", checkName),
+				StatusCode: http.StatusNotFound,
+			}
+		}
+
+		return &rye.Response{
+			Err:        fmt.Errorf("Unexpected etcd error: %v", err),
+			StatusCode: http.StatusInternalServerError,
+		}
+	}
+
+	var monitorConfig monitor.MonitorConfig
+
+	if err := json.Unmarshal([]byte(entry[fullPath]), &monitorConfig); err != nil {
+		return &rye.Response{
+			Err:        fmt.Errorf("Unable to unmarshal config for check '%v': %v", checkName, err),
+			StatusCode: http.StatusInternalServerError,
+		}
+	}
+
+	if monitorConfig.Type != "heartbeat" {
+		return &rye.Response{
+			Err:        fmt.Errorf("Check '%v' is not a heartbeat check (type: '%v')", checkName, monitorConfig.Type),
+			StatusCode: http.StatusBadRequest,
+		}
+	}
+
+	// The body is optional; plain 'curl -X POST' pings are 'ok'
+	var request heartbeatRequest
+
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil && err != io.EOF {
+		return &rye.Response{
+			Err:        fmt.Errorf("Unable to parse heartbeat request: %v", err),
+			StatusCode: http.StatusBadRequest,
+		}
+	}
+
+	status, err := monitor.ValidateHeartbeatStatus(request.Status)
+	if err != nil {
+		return &rye.Response{
+			Err:        err,
+			StatusCode: http.StatusBadRequest,
+		}
+	}
+
+	heartbeat, err := json.Marshal(&monitor.Heartbeat{
+		Date:     time.Now(),
+		Status:   status,
+		Message:  request.Message,
+		MemberID: a.MemberID,
+	})
+	if err != nil {
+		return &rye.Response{
+			Err:        fmt.Errorf("Unable to marshal heartbeat: %v", err),
+			StatusCode: http.StatusInternalServerError,
+		}
+	}
+
+	if err := a.Config.DalClient.Set(monitor.HEARTBEAT_PREFIX+"/"+checkName, string(heartbeat), nil); err != nil {
+		return &rye.Response{
+			Err:        fmt.Errorf("Unable to save heartbeat for check '%v': %v", checkName, err),
+			StatusCode: http.StatusInternalServerError,
+		}
+	}
+
+	rye.WriteJSONStatus(rw, "ok", fmt.Sprintf("Recorded '%v' heartbeat for check '%v'", status, checkName), http.StatusOK)
+
+	return nil
+}
@@ -8,6 +8,7 @@ import (
 	"strconv"
 
 	"github.com/InVisionApp/rye"
+	log "github.com/Sirupsen/logrus"
 	"github.com/coreos/etcd/client"
 	"github.com/gorilla/mux"
 
@@ -168,6 +169,11 @@ func (a *Api) MonitorDeleteHandler(rw http.ResponseWriter, r *http.Request) *rye
 		}
 	}
 
+	// Heartbeat checks leave their last ping behind; best effort
+	if err := a.Config.DalClient.Delete(fmt.Sprintf("%v/%v", monitor.HEARTBEAT_PREFIX, checkName), false); err != nil && !client.IsKeyNotFound(err) {
+		log.Warningf("%v: Unable to remove heartbeat for check '%v': %v", a.Identifier, checkName, err)
+	}
+
 	rye.WriteJSONStatus(rw, "ok", fmt.Sprintf("Successfully removed check '%v'", checkName), http.StatusOK)
 
 	return nil
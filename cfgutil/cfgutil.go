@@ -98,7 +98,7 @@ func (c *CfgUtil) Parse(files []string) (*dal.FullConfigs, error) {
 
 		configTypes, yamlData, err := c.containsConfigs(data)
 		if err != nil {
-			log.Warningf("Unable to determine if '%v' contains configs: %v", err.Error())
+			log.Warningf("Unable to determine if '%v' contains configs: %v", file, err.Error())
 			continue
 		}
 
@@ -75,7 +75,7 @@ func New(memberID, listenAddress, etcdPrefix, etcdUserPass string, etcdMembers,
 }
 
 func (c *Config) ValidateDirs() []string {
-	dirs := []string{"cluster", "cluster/members", "monitor", "alerter", "event", "state"}
+	dirs := []string{"cluster", "cluster/members", "monitor", "alerter", "event", "state", "heartbeat"}
 
 	var errorList []string
 
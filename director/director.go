@@ -398,7 +398,9 @@ func (d *Director) verifyMemberExistence() error {
 
 	// Let's wait a `heartbeatInterval`*2 to ensure that at least 1 active member
 	// is in the cluster (if not - there's either a bug or the system is *massively* overloaded)
-	tmpCtx, _ := context.WithTimeout(context.Background(), time.Duration(d.Config.HeartbeatInterval)*2)
+	tmpCtx, cancel := context.WithTimeout(context.Background(), time.Duration(d.Config.HeartbeatInterval)*2)
+	defer cancel()
+
 	tmpWatcher := d.DalClient.NewWatcher("cluster/members/", true)
 
 	for {
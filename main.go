@@ -19,6 +19,7 @@ import (
 	"github.com/9corp/9volt/director"
 	"github.com/9corp/9volt/event"
 	"github.com/9corp/9volt/manager"
+	"github.com/9corp/9volt/monitor"
 	"github.com/9corp/9volt/overwatch"
 	"github.com/9corp/9volt/state"
 	"github.com/9corp/9volt/util"
@@ -34,6 +35,7 @@ var (
 	listenAddress = server.Flag("listen", "Address for 9volt's API to listen on").Short('l').Default("0.0.0.0:8080").Envar("NINEV_LISTEN_ADDRESS").String()
 	tags          = server.Flag("tags", "Specify one or more member tags this instance has; see MONITOR_CONFIGS.md for details").Short('t').Envar("NINEV_MEMBER_TAGS").String()
 	accessTokens  = server.Flag("access-tokens", "Specify required access tokens in the header for API requests").Short('a').PlaceHolder("token1,token2").Envar("NINEV_ACCESS_TOKENS").String()
+	plugins       = server.Flag("plugins", "Register monitor types provided by external plugins; see MONITOR_CONFIGS.md for details").PlaceHolder("type=/path/to/plugin,...").Envar("NINEV_PLUGINS").String()
 
 	cfg         = kingpin.Command("cfg", "9volt configuration utility")
 	dirArg      = cfg.Arg("dir", "Directory to search for 9volt YAML files").Required().String()
@@ -119,6 +121,18 @@ func runServer() {
 		log.WithField("errorList", strings.Join(errorList, "; ")).Fatal("Unable to complete etcd layout validation")
 	}
 
+	// Register plugin provided monitor types before the monitor engine is created
+	for _, plugin := range util.SplitTags(*plugins) {
+		parts := strings.SplitN(plugin, "=", 2)
+		if len(parts) != 2 {
+			log.WithField("plugin", plugin).Fatal("Plugins must be specified as 'type=/path/to/plugin'")
+		}
+
+		if err := monitor.RegisterPlugin(parts[0], parts[1]); err != nil {
+			log.WithField("err", err).Fatal("Unable to register plugin")
+		}
+	}
+
 	// Create necessary channels
 	clusterStateChannel := make(chan bool)
 	distributeChannel := make(chan bool)
@@ -0,0 +1,482 @@
+package monitor
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+const (
+	DEFAULT_AMQP_PORT     = 5672
+	DEFAULT_AMQP_TLS_PORT = 5671
+	DEFAULT_AMQP_USER     = "guest"
+	DEFAULT_AMQP_PASSWORD = "guest"
+	DEFAULT_AMQP_VHOST    = "/"
+
+	amqpFrameMethod    = 1
+	amqpFrameHeader    = 2
+	amqpFrameBody      = 3
+	amqpFrameHeartbeat = 8
+	amqpFrameEnd       = 0xce
+
+	// Largest frame we accept (and propose to the server)
+	amqpMaxFrameSize = 128 * 1024
+
+	// Content beyond this size is not kept; probes are tiny
+	amqpMaxBodySize = 1024 * 1024
+
+	amqpChannel    = 1
+	amqpClassBasic = 60
+
+	// Methods (class ID << 16 | method ID)
+	amqpConnectionStart   = 10<<16 | 10
+	amqpConnectionStartOk = 10<<16 | 11
+	amqpConnectionTune    = 10<<16 | 30
+	amqpConnectionTuneOk  = 10<<16 | 31
+	amqpConnectionOpen    = 10<<16 | 40
+	amqpConnectionOpenOk  = 10<<16 | 41
+	amqpConnectionClose   = 10<<16 | 50
+	amqpChannelOpen       = 20<<16 | 10
+	amqpChannelOpenOk     = 20<<16 | 11
+	amqpChannelClose      = 20<<16 | 40
+	amqpQueueDeclare      = 50<<16 | 10
+	amqpQueueDeclareOk    = 50<<16 | 11
+	amqpQueueBind         = 50<<16 | 20
+	amqpQueueBindOk       = 50<<16 | 21
+	amqpBasicConsume      = 60<<16 | 20
+	amqpBasicConsumeOk    = 60<<16 | 21
+	amqpBasicPublish      = 60<<16 | 40
+	amqpBasicReturn       = 60<<16 | 50
+	amqpBasicDeliver      = 60<<16 | 60
+	amqpBasicAck          = 60<<16 | 80
+
+	// Queue.Declare flags
+	amqpQueuePassive    = 0x01
+	amqpQueueExclusive  = 0x04
+	amqpQueueAutoDelete = 0x08
+
+	amqpPublishMandatory = 0x01
+)
+
+var amqpProtocolHeader = []byte("AMQP\x00\x00\x09\x01")
+
+type AMQPMonitor struct {
+	BrokerMonitor
+}
+
+// A connection exchanging AMQP 0-9-1 frames
+type amqpConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+func NewAMQPMonitor(rmc *RootMonitorConfig) *AMQPMonitor {
+	a := &AMQPMonitor{
+		BrokerMonitor: newBrokerMonitor(rmc, "amqp", DEFAULT_AMQP_PORT, DEFAULT_AMQP_TLS_PORT),
+	}
+
+	a.MonitorFunc = a.amqpCheck
+
+	return a
+}
+
+func (a *AMQPMonitor) Validate() error {
+	if err := a.BrokerMonitor.Validate(); err != nil {
+		return err
+	}
+
+	if len(a.RMC.Config.BrokerTopic) > 255 {
+		return errors.New("'broker-topic' cannot be longer than 255 characters")
+	}
+
+	if len(a.RMC.Config.BrokerExchange) > 255 {
+		return errors.New("'broker-exchange' cannot be longer than 255 characters")
+	}
+
+	return nil
+}
+
+func (a *AMQPMonitor) amqpCheck() (*CheckResult, error) {
+	return a.brokerCheck(a.roundTrip)
+}
+
+// Open a connection and channel, start consuming, publish the probe and wait
+// for it to be delivered. Without 'broker-exchange' the probe is published to
+// the (existing) queue 'broker-topic' via the default exchange; otherwise it is
+// published to the exchange with 'broker-topic' as routing key and consumed
+// from a temporary queue bound to it.
+func (a *AMQPMonitor) roundTrip(conn net.Conn, deadline time.Time, probe []byte) (time.Duration, error) {
+	cfg := a.RMC.Config
+	c := &amqpConn{conn: conn, reader: bufio.NewReader(conn)}
+
+	if err := c.open(a.user(), a.password(), a.vhost()); err != nil {
+		return 0, err
+	}
+
+	defer c.close()
+
+	if err := c.send(amqpChannel, amqpChannelOpen, amqpShortString("")); err != nil {
+		return 0, err
+	}
+
+	if _, err := c.expect(amqpChannelOpenOk); err != nil {
+		return 0, err
+	}
+
+	queue, err := a.declareQueue(c)
+	if err != nil {
+		return 0, err
+	}
+
+	// Deliveries are acknowledged by hand so that other messages on the queue
+	// are requeued once the channel is closed
+	if err := c.send(amqpChannel, amqpBasicConsume,
+		brokerUint16(0), amqpShortString(queue), amqpShortString(""), []byte{0}, amqpTable()); err != nil {
+		return 0, err
+	}
+
+	if _, err := c.expect(amqpBasicConsumeOk); err != nil {
+		return 0, err
+	}
+
+	start := time.Now()
+
+	if err := c.send(amqpChannel, amqpBasicPublish,
+		brokerUint16(0), amqpShortString(cfg.BrokerExchange), amqpShortString(cfg.BrokerTopic), []byte{amqpPublishMandatory}); err != nil {
+		return 0, err
+	}
+
+	header := bytes.Join([][]byte{brokerUint16(amqpClassBasic), brokerUint16(0), brokerUint64(uint64(len(probe))), brokerUint16(0)}, nil)
+
+	if err := c.writeFrame(amqpFrameHeader, amqpChannel, header); err != nil {
+		return 0, err
+	}
+
+	if err := c.writeFrame(amqpFrameBody, amqpChannel, probe); err != nil {
+		return 0, err
+	}
+
+	for {
+		method, d, err := c.readMethod()
+		if err != nil {
+			return 0, fmt.Errorf("probe not received: %v", err.Error())
+		}
+
+		switch method {
+		case amqpBasicReturn:
+			code, text := d.uint16(), amqpReadShortString(d)
+
+			return 0, fmt.Errorf("probe returned as unroutable: %v %v", code, text)
+		case amqpBasicDeliver:
+			amqpReadShortString(d) // consumer tag
+			deliveryTag := d.uint64()
+
+			body, err := c.readContent()
+			if err != nil {
+				return 0, err
+			}
+
+			if !a.isProbe(body) {
+				continue
+			}
+
+			latency := time.Since(start)
+
+			// Also acknowledges probes left over from timed out checks
+			if err := c.send(amqpChannel, amqpBasicAck, brokerUint64(deliveryTag), []byte{0}); err != nil {
+				return 0, err
+			}
+
+			if bytes.Equal(body, probe) {
+				return latency, nil
+			}
+		}
+	}
+}
+
+// Returns the queue to consume from
+func (a *AMQPMonitor) declareQueue(c *amqpConn) (string, error) {
+	cfg := a.RMC.Config
+
+	if cfg.BrokerExchange == "" {
+		if err := c.send(amqpChannel, amqpQueueDeclare,
+			brokerUint16(0), amqpShortString(cfg.BrokerTopic), []byte{amqpQueuePassive}, amqpTable()); err != nil {
+			return "", err
+		}
+
+		if _, err := c.expect(amqpQueueDeclareOk); err != nil {
+			return "", err
+		}
+
+		return cfg.BrokerTopic, nil
+	}
+
+	if err := c.send(amqpChannel, amqpQueueDeclare,
+		brokerUint16(0), amqpShortString(""), []byte{amqpQueueExclusive | amqpQueueAutoDelete}, amqpTable()); err != nil {
+		return "", err
+	}
+
+	d, err := c.expect(amqpQueueDeclareOk)
+	if err != nil {
+		return "", err
+	}
+
+	queue := amqpReadShortString(d)
+
+	if err := c.send(amqpChannel, amqpQueueBind,
+		brokerUint16(0), amqpShortString(queue), amqpShortString(cfg.BrokerExchange), amqpShortString(cfg.BrokerTopic), []byte{0}, amqpTable()); err != nil {
+		return "", err
+	}
+
+	if _, err := c.expect(amqpQueueBindOk); err != nil {
+		return "", err
+	}
+
+	return queue, nil
+}
+
+func (a *AMQPMonitor) user() string {
+	if a.RMC.Config.BrokerUser == "" {
+		return DEFAULT_AMQP_USER
+	}
+
+	return a.RMC.Config.BrokerUser
+}
+
+func (a *AMQPMonitor) password() string {
+	if a.RMC.Config.BrokerUser == "" {
+		return DEFAULT_AMQP_PASSWORD
+	}
+
+	return a.RMC.Config.BrokerPassword
+}
+
+func (a *AMQPMonitor) vhost() string {
+	if a.RMC.Config.BrokerVHost == "" {
+		return DEFAULT_AMQP_VHOST
+	}
+
+	return a.RMC.Config.BrokerVHost
+}
+
+// Protocol header, authentication (PLAIN), tuning and opening the vhost
+func (c *amqpConn) open(user, password, vhost string) error {
+	if _, err := c.conn.Write(amqpProtocolHeader); err != nil {
+		return err
+	}
+
+	// Servers not supporting 0-9-1 reply with the protocol header they support
+	if header, err := c.reader.Peek(len(amqpProtocolHeader)); err == nil && bytes.HasPrefix(header, []byte("AMQP")) {
+		return fmt.Errorf("server does not support AMQP 0-9-1 (offered: %v)", header[4:])
+	}
+
+	d, err := c.expect(amqpConnectionStart)
+	if err != nil {
+		return err
+	}
+
+	d.bytes(2)               // version
+	d.bytes(int(d.uint32())) // server properties
+	mechanisms := amqpReadLongString(d)
+
+	if d.err != nil {
+		return fmt.Errorf("invalid Connection.Start: %v", d.err.Error())
+	}
+
+	if !containsFold(strings.Fields(mechanisms), "PLAIN") {
+		return fmt.Errorf("server does not support PLAIN authentication (offered: %v)", mechanisms)
+	}
+
+	clientProperties := amqpTable(amqpShortString("product"), []byte{'S'}, amqpLongString([]byte("9volt")))
+
+	if err := c.send(0, amqpConnectionStartOk,
+		clientProperties, amqpShortString("PLAIN"), amqpLongString(brokerPlainAuth(user, password)), amqpShortString("en_US")); err != nil {
+		return err
+	}
+
+	// Servers close the connection if authentication fails
+	d, err = c.expect(amqpConnectionTune)
+	if err != nil {
+		return fmt.Errorf("authentication as '%v' failed: %v", user, err.Error())
+	}
+
+	channelMax, frameMax := d.uint16(), d.uint32()
+
+	if frameMax == 0 || frameMax > amqpMaxFrameSize {
+		frameMax = amqpMaxFrameSize
+	}
+
+	if err := c.send(0, amqpConnectionTuneOk, brokerUint16(channelMax), brokerUint32(frameMax), brokerUint16(0)); err != nil {
+		return err
+	}
+
+	if err := c.send(0, amqpConnectionOpen, amqpShortString(vhost), amqpShortString(""), []byte{0}); err != nil {
+		return err
+	}
+
+	if _, err := c.expect(amqpConnectionOpenOk); err != nil {
+		return fmt.Errorf("unable to open vhost '%v': %v", vhost, err.Error())
+	}
+
+	return nil
+}
+
+// Best effort; the connection is closed right after
+func (c *amqpConn) close() {
+	c.send(0, amqpConnectionClose, brokerUint16(200), amqpShortString(""), brokerUint16(0), brokerUint16(0))
+}
+
+func (c *amqpConn) send(channel uint16, method uint32, args ...[]byte) error {
+	return c.writeFrame(amqpFrameMethod, channel, bytes.Join(append([][]byte{brokerUint32(method)}, args...), nil))
+}
+
+func (c *amqpConn) writeFrame(frameType byte, channel uint16, payload []byte) error {
+	frame := bytes.Join([][]byte{{frameType}, brokerUint16(channel), brokerUint32(uint32(len(payload))), payload, {amqpFrameEnd}}, nil)
+
+	_, err := c.conn.Write(frame)
+
+	return err
+}
+
+// Read the next frame, skipping heartbeats
+func (c *amqpConn) readFrame() (byte, []byte, error) {
+	for {
+		header := make([]byte, 7)
+
+		if _, err := io.ReadFull(c.reader, header); err != nil {
+			return 0, nil, err
+		}
+
+		d := &brokerDecoder{data: header}
+		frameType := d.uint8()
+		d.uint16() // channel
+		size := d.uint32()
+
+		if size > amqpMaxFrameSize {
+			return 0, nil, fmt.Errorf("frame size %v exceeds limit of %v bytes", size, amqpMaxFrameSize)
+		}
+
+		payload := make([]byte, size+1)
+
+		if _, err := io.ReadFull(c.reader, payload); err != nil {
+			return 0, nil, err
+		}
+
+		if payload[size] != amqpFrameEnd {
+			return 0, nil, errors.New("invalid frame end")
+		}
+
+		if frameType != amqpFrameHeartbeat {
+			return frameType, payload[:size], nil
+		}
+	}
+}
+
+// Read the next method; Connection.Close and Channel.Close sent by the server
+// are returned as errors
+func (c *amqpConn) readMethod() (uint32, *brokerDecoder, error) {
+	for {
+		frameType, payload, err := c.readFrame()
+		if err != nil {
+			return 0, nil, err
+		}
+
+		if frameType != amqpFrameMethod {
+			continue
+		}
+
+		d := &brokerDecoder{data: payload}
+		method := d.uint32()
+
+		if d.err != nil {
+			return 0, nil, fmt.Errorf("invalid method frame: %v", d.err.Error())
+		}
+
+		switch method {
+		case amqpConnectionClose:
+			return 0, nil, fmt.Errorf("connection closed by server: %v %v", d.uint16(), amqpReadShortString(d))
+		case amqpChannelClose:
+			return 0, nil, fmt.Errorf("channel closed by server: %v %v", d.uint16(), amqpReadShortString(d))
+		}
+
+		return method, d, nil
+	}
+}
+
+// Read the next method, failing unless it is 'method'
+func (c *amqpConn) expect(method uint32) (*brokerDecoder, error) {
+	actual, d, err := c.readMethod()
+	if err != nil {
+		return nil, err
+	}
+
+	if actual != method {
+		return nil, fmt.Errorf("unexpected method %v.%v (expected %v.%v)", actual>>16, actual&0xffff, method>>16, method&0xffff)
+	}
+
+	return d, nil
+}
+
+// Read the content header and body frames following Basic.Deliver; bodies
+// larger than 'amqpMaxBodySize' are dropped
+func (c *amqpConn) readContent() ([]byte, error) {
+	frameType, payload, err := c.readFrame()
+	if err != nil {
+		return nil, err
+	}
+
+	d := &brokerDecoder{data: payload}
+	d.bytes(4) // class, weight
+	size := d.uint64()
+
+	if frameType != amqpFrameHeader || d.err != nil {
+		return nil, errors.New("invalid content header")
+	}
+
+	var body []byte
+
+	for received := uint64(0); received < size; {
+		frameType, payload, err := c.readFrame()
+		if err != nil {
+			return nil, err
+		}
+
+		if frameType != amqpFrameBody {
+			return nil, errors.New("invalid content body")
+		}
+
+		received += uint64(len(payload))
+
+		if size <= amqpMaxBodySize {
+			body = append(body, payload...)
+		}
+	}
+
+	return body, nil
+}
+
+func amqpShortString(s string) []byte {
+	return append([]byte{byte(len(s))}, s...)
+}
+
+func amqpLongString(data []byte) []byte {
+	return append(brokerUint32(uint32(len(data))), data...)
+}
+
+// Field table from already encoded 'name, type, value' triplets
+func amqpTable(fields ...[]byte) []byte {
+	return amqpLongString(bytes.Join(fields, nil))
+}
+
+func amqpReadShortString(d *brokerDecoder) string {
+	return string(d.bytes(int(d.uint8())))
+}
+
+func amqpReadLongString(d *brokerDecoder) string {
+	return string(d.bytes(int(d.uint32())))
+}
@@ -0,0 +1,256 @@
+package monitor
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/9corp/9volt/util"
+)
+
+// Minimal in-process AMQP 0-9-1 broker for a single channel: accepts
+// guest/guest on vhost '/', knows the queues in 'queues' and the exchange
+// 'events'. A foreign message is delivered ahead of every routed publish.
+type testAMQPBroker struct {
+	listener net.Listener
+	queues   map[string]bool
+
+	acks chan uint64
+}
+
+func startTestAMQPBroker() (*testAMQPBroker, int) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	Expect(err).To(BeNil())
+
+	broker := &testAMQPBroker{
+		listener: listener,
+		queues:   map[string]bool{"probes": true},
+		acks:     make(chan uint64, 10),
+	}
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			go broker.serve(conn)
+		}
+	}()
+
+	return broker, listener.Addr().(*net.TCPAddr).Port
+}
+
+func (b *testAMQPBroker) serve(conn net.Conn) {
+	defer conn.Close()
+
+	c := &amqpConn{conn: conn, reader: bufio.NewReader(conn)}
+
+	header := make([]byte, len(amqpProtocolHeader))
+	if _, err := c.reader.Read(header); err != nil || !bytes.Equal(header, amqpProtocolHeader) {
+		return
+	}
+
+	c.send(0, amqpConnectionStart, []byte{0, 9}, amqpTable(), amqpLongString([]byte("AMQPLAIN PLAIN")), amqpLongString([]byte("en_US")))
+
+	bindings := make(map[string]string) // routing key -> queue
+	var consumer, deliveryTag uint64
+
+	deliver := func(exchange, key string, body []byte) {
+		deliveryTag++
+		c.send(amqpChannel, amqpBasicDeliver, amqpShortString("ctag"), brokerUint64(deliveryTag), []byte{0}, amqpShortString(exchange), amqpShortString(key))
+		c.writeFrame(amqpFrameHeader, amqpChannel, bytes.Join([][]byte{brokerUint16(amqpClassBasic), brokerUint16(0), brokerUint64(uint64(len(body))), brokerUint16(0)}, nil))
+		c.writeFrame(amqpFrameBody, amqpChannel, body)
+	}
+
+	for {
+		method, d, err := c.readMethod()
+		if err != nil {
+			return
+		}
+
+		switch method {
+		case amqpConnectionStartOk:
+			d.bytes(int(d.uint32())) // client properties
+			amqpReadShortString(d)   // mechanism
+
+			if amqpReadLongString(d) != "\x00guest\x00guest" {
+				c.send(0, amqpConnectionClose, brokerUint16(403), amqpShortString("ACCESS_REFUSED - Login was refused"), brokerUint16(0), brokerUint16(0))
+				return
+			}
+
+			c.send(0, amqpConnectionTune, brokerUint16(2047), brokerUint32(131072), brokerUint16(60))
+		case amqpConnectionOpen:
+			if vhost := amqpReadShortString(d); vhost != "/" {
+				c.send(0, amqpConnectionClose, brokerUint16(530), amqpShortString("NOT_ALLOWED - vhost "+vhost+" not found"), brokerUint16(10), brokerUint16(40))
+				return
+			}
+
+			c.send(0, amqpConnectionOpenOk, amqpShortString(""))
+		case amqpChannelOpen:
+			c.send(amqpChannel, amqpChannelOpenOk, amqpLongString(nil))
+		case amqpQueueDeclare:
+			d.uint16()
+			queue := amqpReadShortString(d)
+
+			if d.uint8()&amqpQueuePassive != 0 && !b.queues[queue] {
+				c.send(amqpChannel, amqpChannelClose, brokerUint16(404), amqpShortString("NOT_FOUND - no queue '"+queue+"' in vhost '/'"), brokerUint16(50), brokerUint16(10))
+				return
+			}
+
+			if queue == "" {
+				queue = "amq.gen-1"
+			}
+
+			c.send(amqpChannel, amqpQueueDeclareOk, amqpShortString(queue), brokerUint32(0), brokerUint32(0))
+		case amqpQueueBind:
+			d.uint16()
+			queue, exchange, key := amqpReadShortString(d), amqpReadShortString(d), amqpReadShortString(d)
+
+			if exchange == "events" {
+				bindings[key] = queue
+			}
+
+			c.send(amqpChannel, amqpQueueBindOk)
+		case amqpBasicConsume:
+			consumer++
+			c.send(amqpChannel, amqpBasicConsumeOk, amqpShortString("ctag"))
+		case amqpBasicPublish:
+			d.uint16()
+			exchange, key := amqpReadShortString(d), amqpReadShortString(d)
+
+			body, err := c.readContent()
+			if err != nil {
+				return
+			}
+
+			routed := (exchange == "" && b.queues[key]) || (exchange == "events" && bindings[key] != "")
+
+			if !routed {
+				c.send(amqpChannel, amqpBasicReturn, brokerUint16(312), amqpShortString("NO_ROUTE"), amqpShortString(exchange), amqpShortString(key))
+				c.writeFrame(amqpFrameHeader, amqpChannel, bytes.Join([][]byte{brokerUint16(amqpClassBasic), brokerUint16(0), brokerUint64(uint64(len(body))), brokerUint16(0)}, nil))
+				c.writeFrame(amqpFrameBody, amqpChannel, body)
+				continue
+			}
+
+			if consumer > 0 {
+				deliver(exchange, key, []byte("order #1234"))
+				deliver(exchange, key, body)
+			}
+		case amqpBasicAck:
+			b.acks <- d.uint64()
+		}
+	}
+}
+
+var _ = Describe("amqp_monitor", func() {
+	var (
+		monitor *AMQPMonitor
+		config  *RootMonitorConfig
+		broker  *testAMQPBroker
+	)
+
+	start := func() {
+		broker, config.Config.Port = startTestAMQPBroker()
+		monitor = NewAMQPMonitor(config)
+		Expect(monitor.Validate()).To(BeNil())
+	}
+
+	BeforeEach(func() {
+		config = &RootMonitorConfig{
+			ConfigName: "amqp-probe",
+			Config: &MonitorConfig{
+				Host:        "127.0.0.1",
+				Interval:    util.CustomDuration(10 * time.Second),
+				Timeout:     util.CustomDuration(time.Second),
+				BrokerTopic: "probes",
+			},
+			Log: log.New(),
+		}
+
+		monitor = NewAMQPMonitor(config)
+	})
+
+	AfterEach(func() {
+		if broker != nil {
+			broker.listener.Close()
+			broker = nil
+		}
+	})
+
+	Context("NewAMQPMonitor", func() {
+		It("returns a properly configured instance with defaults", func() {
+			Expect(monitor.Port).To(Equal(DEFAULT_AMQP_PORT))
+			Expect(monitor.user()).To(Equal(DEFAULT_AMQP_USER))
+			Expect(monitor.vhost()).To(Equal(DEFAULT_AMQP_VHOST))
+			Expect(monitor.MonitorFunc).NotTo(BeNil())
+		})
+	})
+
+	Context("Validate", func() {
+		It("errors with invalid settings", func() {
+			config.Config.Host = ""
+			Expect(monitor.Validate().Error()).To(ContainSubstring("'host' must be set"))
+
+			config.Config.Host = "127.0.0.1"
+			config.Config.Timeout = util.CustomDuration(10 * time.Second)
+			monitor = NewAMQPMonitor(config)
+			Expect(monitor.Validate().Error()).To(ContainSubstring("cannot equal or exceed 'interval'"))
+		})
+	})
+
+	Context("amqpCheck", func() {
+		It("publishes and consumes a probe via a queue", func() {
+			start()
+
+			result, err := monitor.amqpCheck()
+			Expect(err).To(BeNil())
+			Expect(<-broker.acks).To(Equal(uint64(2)))
+			Expect(broker.acks).To(BeEmpty())
+			Expect(result.Output).To(HavePrefix("Probe consumed from 'probes' after "))
+			Expect(result.Metrics[0].Name).To(Equal("latency"))
+		})
+
+		It("publishes and consumes a probe via an exchange", func() {
+			config.Config.BrokerExchange = "events"
+			config.Config.BrokerTopic = "9volt.probe"
+			start()
+
+			_, err := monitor.amqpCheck()
+			Expect(err).To(BeNil())
+
+			config.Config.BrokerExchange = "missing"
+			_, err = monitor.amqpCheck()
+			Expect(err).ToNot(BeNil())
+			Expect(err.Error()).To(ContainSubstring("probe returned as unroutable: 312 NO_ROUTE"))
+		})
+
+		It("reports errors sent by the server", func() {
+			config.Config.BrokerTopic = "missing"
+			start()
+
+			_, err := monitor.amqpCheck()
+			Expect(err).ToNot(BeNil())
+			Expect(err.Error()).To(ContainSubstring("channel closed by server: 404 NOT_FOUND - no queue 'missing'"))
+
+			config.Config.BrokerTopic = "probes"
+			config.Config.BrokerVHost = "/staging"
+			_, err = monitor.amqpCheck()
+			Expect(err).ToNot(BeNil())
+			Expect(err.Error()).To(ContainSubstring("unable to open vhost '/staging': connection closed by server: 530"))
+
+			config.Config.BrokerVHost = ""
+			config.Config.BrokerUser = "monitor"
+			config.Config.BrokerPassword = "secret"
+			_, err = monitor.amqpCheck()
+			Expect(err).ToNot(BeNil())
+			Expect(err.Error()).To(ContainSubstring("authentication as 'monitor' failed: connection closed by server: 403 ACCESS_REFUSED"))
+		})
+	})
+})
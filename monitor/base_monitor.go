@@ -21,20 +21,67 @@ const (
 	WARNING
 	// CRITICAL when the number of failed attempts passes the CriticalThreshold
 	CRITICAL
+	// UNKNOWN when the monitor is unable to determine the state (only set via StateError)
+	UNKNOWN
 )
 
 var (
-	okNextStates       = [2]int{WARNING, CRITICAL}
-	warningNextStates  = [2]int{CRITICAL, OK}
-	criticalNextStates = [2]int{WARNING, OK}
-	stateTransition    = [3][2]int{okNextStates, warningNextStates, criticalNextStates}
+	okNextStates       = [3]int{WARNING, CRITICAL, UNKNOWN}
+	warningNextStates  = [3]int{CRITICAL, OK, UNKNOWN}
+	criticalNextStates = [3]int{WARNING, OK, UNKNOWN}
+	unknownNextStates  = [3]int{OK, WARNING, CRITICAL}
+	stateTransition    = [4][3]int{okNextStates, warningNextStates, criticalNextStates, unknownNextStates}
 )
 
+// StateError allows a monitor to report the state it should be in (WARNING,
+// CRITICAL or UNKNOWN) instead of having it derived from the attempt count thresholds
+//
+// If Capped is set, the attempt count thresholds still apply and State is only
+// the most severe state they can lead to (UNKNOWN is reported as UNKNOWN once
+// the warning threshold is reached).
+type StateError struct {
+	State  int
+	Err    error
+	Capped bool
+}
+
+func (s *StateError) Error() string {
+	return s.Err.Error()
+}
+
+// Helper for returning a check failure that goes straight to WARNING
+func NewWarningError(format string, args ...interface{}) error {
+	return &StateError{State: WARNING, Err: fmt.Errorf(format, args...)}
+}
+
+// Helper for returning a check failure that goes straight to CRITICAL
+func NewCriticalError(format string, args ...interface{}) error {
+	return &StateError{State: CRITICAL, Err: fmt.Errorf(format, args...)}
+}
+
+// Helper for returning a check failure that is subject to the attempt count
+// thresholds but never leads past WARNING
+func NewCappedWarningError(format string, args ...interface{}) error {
+	return &StateError{State: WARNING, Err: fmt.Errorf(format, args...), Capped: true}
+}
+
+// Details reported by a single check run in addition to its outcome; included
+// in the state message
+type CheckResult struct {
+	Duration time.Duration     // defaults to how long the check function took
+	Output   string            // state message while the check passes
+	Metrics  []*state.Metric   // ie. response times, sizes or counts
+	Labels   map[string]string // ie. the server that answered
+}
+
 // Base monitor to embed into monitors that do real work
+//
+// MonitorFunc performs a single check; the result is optional and may
+// accompany a check failure (ie. metrics that could still be measured).
 type Base struct {
 	RMC         *RootMonitorConfig
 	Identifier  string
-	MonitorFunc func() error
+	MonitorFunc func() (*CheckResult, error)
 
 	attemptCount      int
 	criticalAlertSent bool
@@ -68,7 +115,7 @@ Mainloop:
 		select {
 		case <-b.RMC.Ticker.C:
 			llog.Debug("Monitor tick")
-			if err := b.handle(b.MonitorFunc()); err != nil {
+			if err := b.handle(b.runCheck()); err != nil {
 				log.Errorf("Unable to complete check handler: %v", err.Error())
 			}
 		case <-b.RMC.StopChannel:
@@ -81,11 +128,27 @@ Mainloop:
 	return nil
 }
 
+// Run the check and record how long it took (unless the check reported it)
+func (b *Base) runCheck() (*CheckResult, error) {
+	start := time.Now()
+
+	result, err := b.MonitorFunc()
+	if result == nil {
+		result = &CheckResult{}
+	}
+
+	if result.Duration == 0 {
+		result.Duration = time.Since(start)
+	}
+
+	return result, err
+}
+
 // Handle triggering/resolving alerts based on check results
-func (b *Base) handle(monitorErr error) error {
+func (b *Base) handle(result *CheckResult, monitorErr error) error {
 	var err error
 	// Update state every run
-	defer b.updateState(monitorErr)
+	defer b.updateState(result, monitorErr)
 
 	// No problems, reset counter
 	if monitorErr == nil {
@@ -96,13 +159,33 @@ func (b *Base) handle(monitorErr error) error {
 
 	// Increase attempt count
 	b.attemptCount++
+
+	stateErr, isStateErr := monitorErr.(*StateError)
+
+	// Monitor told us exactly which state it should be in
+	if isStateErr && !stateErr.Capped {
+		return b.transitionStateTo(stateErr.State, monitorErr.Error())
+	}
+
+	newState := OK
+
 	if b.attemptCount >= b.RMC.Config.CriticalThreshold {
-		err = b.transitionStateTo(CRITICAL, monitorErr.Error())
+		newState = CRITICAL
 	} else if b.attemptCount >= b.RMC.Config.WarningThreshold {
-		err = b.transitionStateTo(WARNING, monitorErr.Error())
+		newState = WARNING
 	}
 
-	if err != nil {
+	// Thresholds not reached yet
+	if newState == OK {
+		return nil
+	}
+
+	// Never go beyond the state the monitor reported
+	if isStateErr && (stateErr.State == UNKNOWN || stateErr.State < newState) {
+		newState = stateErr.State
+	}
+
+	if err = b.transitionStateTo(newState, monitorErr.Error()); err != nil {
 		return err
 	}
 	return nil
@@ -110,8 +193,9 @@ func (b *Base) handle(monitorErr error) error {
 
 // Construct a new alert message, send down the message channel and update alert state
 func (b *Base) sendMessage(curState int, titleMessage, alertMessage, errorDetails string) error {
-	var alertType = [3]string{"resolve", "warning", "critical"}
-	var alertKey = [3][]string{[]string{}, b.RMC.Config.WarningAlerter, b.RMC.Config.CriticalAlerter}
+	// UNKNOWN is alerted on as a warning
+	var alertType = [4]string{"resolve", "warning", "critical", "warning"}
+	var alertKey = [4][]string{[]string{}, b.RMC.Config.WarningAlerter, b.RMC.Config.CriticalAlerter, b.RMC.Config.WarningAlerter}
 
 	log.Debugf("%v-%v: (%v) %v", b.Identifier, b.RMC.GID, b.RMC.Name, alertMessage)
 
@@ -163,18 +247,26 @@ func (b *Base) sendMessage(curState int, titleMessage, alertMessage, errorDetail
 //
 // `updateState()` is intended to be ran *every* time `handle()` is ran; raw config
 // is included for convenience.
-func (b *Base) updateState(monitorErr error) error {
-	var status = [3]string{"ok", "warning", "critical"}
-	jsonConfig, err := json.Marshal(b.RMC.Config)
+func (b *Base) updateState(result *CheckResult, monitorErr error) error {
+	var status = [4]string{"ok", "warning", "critical", "unknown"}
+	jsonConfig, err := json.Marshal(b.RMC.Config.redacted())
 	if err != nil {
 		errorMessage := fmt.Sprintf("Unable to marshal monitor config to JSON: %v", err.Error())
 		jsonConfig = []byte(fmt.Sprintf(`{"error": "%v"}`, errorMessage))
 		log.Error(errorMessage)
 	}
 
-	// If no error is set, set it to N/A for display purposes
+	if result == nil {
+		result = &CheckResult{}
+	}
+
+	// If no error is set, use the check output (or N/A) for display purposes
 	if monitorErr == nil {
 		monitorErr = errors.New("N/A")
+
+		if result.Output != "" {
+			monitorErr = errors.New(result.Output)
+		}
 	}
 
 	b.RMC.StateChannel <- &state.Message{
@@ -185,6 +277,10 @@ func (b *Base) updateState(monitorErr error) error {
 		Message: monitorErr.Error(),
 		Date:    time.Now(),
 		Config:  jsonConfig,
+
+		Duration: result.Duration.Seconds(),
+		Metrics:  result.Metrics,
+		Labels:   result.Labels,
 	}
 
 	b.RMC.Log.WithField("configName", b.RMC.ConfigName).Debug("Successfully sent state message")
@@ -193,7 +289,7 @@ func (b *Base) updateState(monitorErr error) error {
 }
 
 func (b *Base) stateEvent(curState int, monitorErr string) {
-	var stateStr = [3]string{"", "warning", "critical"}
+	var stateStr = [4]string{"", "warning", "critical", "unknown"}
 	if curState == OK {
 		for alert, resolve := range b.resolveMessages {
 			// If we've resolved then let's send all those resolve messages
@@ -230,6 +326,6 @@ func (b *Base) transitionStateTo(state int, monitorErr string) error {
 }
 
 // setStateTransition is really only meant to be used in tests
-func setStateTransition(idx int, transition [2]int) {
+func setStateTransition(idx int, transition [3]int) {
 	stateTransition[idx] = transition
 }
@@ -0,0 +1,330 @@
+package monitor
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Minimal BER (X.690) encoding and decoding as used by SNMP and LDAP messages
+const (
+	berTagBoolean     = 0x01
+	berTagInteger     = 0x02
+	berTagOctetString = 0x04
+	berTagNull        = 0x05
+	berTagOID         = 0x06
+	berTagEnumerated  = 0x0a
+	berTagSequence    = 0x30
+	berTagSet         = 0x31
+
+	// Upper limit for elements read from a stream
+	berMaxElementSize = 16 * 1024 * 1024
+)
+
+// A decoded BER element
+type berValue struct {
+	Tag  byte
+	Data []byte
+
+	offset int // position of 'Data' within the buffer it was decoded from
+}
+
+// Encode a single TLV
+func berEncode(tag byte, data []byte) []byte {
+	out := append([]byte{tag}, berEncodeLength(len(data))...)
+
+	return append(out, data...)
+}
+
+// Encode a constructed TLV (ie. SEQUENCE or PDU) from already encoded elements
+func berEncodeSequence(tag byte, elements ...[]byte) []byte {
+	return berEncode(tag, berConcat(elements...))
+}
+
+func berConcat(elements ...[]byte) []byte {
+	var data []byte
+
+	for _, element := range elements {
+		data = append(data, element...)
+	}
+
+	return data
+}
+
+// Two's complement, minimum number of octets
+func berEncodeInteger(tag byte, value int64) []byte {
+	data := []byte{byte(value)}
+
+	for value > 127 || value < -128 {
+		value >>= 8
+		data = append([]byte{byte(value)}, data...)
+	}
+
+	return berEncode(tag, data)
+}
+
+// Unsigned application types (Counter32, Gauge32, ...) must not appear negative
+func berEncodeUnsigned(tag byte, value uint64) []byte {
+	data := []byte{byte(value)}
+
+	for value > 0xff {
+		value >>= 8
+		data = append([]byte{byte(value)}, data...)
+	}
+
+	if data[0]&0x80 != 0 {
+		data = append([]byte{0}, data...)
+	}
+
+	return berEncode(tag, data)
+}
+
+func berEncodeLength(length int) []byte {
+	if length < 0x80 {
+		return []byte{byte(length)}
+	}
+
+	var data []byte
+
+	for ; length > 0; length >>= 8 {
+		data = append([]byte{byte(length)}, data...)
+	}
+
+	return append([]byte{0x80 | byte(len(data))}, data...)
+}
+
+// Encode a dotted OID ('1.3.6.1.2.1.1.3.0'; a leading dot is allowed)
+func berEncodeOID(oid string) ([]byte, error) {
+	parts := strings.Split(strings.TrimPrefix(oid, "."), ".")
+	if len(parts) < 2 {
+		return nil, fmt.Errorf("OID '%v' must have at least two components", oid)
+	}
+
+	components := make([]uint64, len(parts))
+
+	for i, part := range parts {
+		value, err := strconv.ParseUint(part, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("OID '%v' contains invalid component '%v'", oid, part)
+		}
+
+		components[i] = value
+	}
+
+	if components[0] > 2 || (components[0] < 2 && components[1] > 39) {
+		return nil, fmt.Errorf("OID '%v' does not start with a valid arc", oid)
+	}
+
+	data := berEncodeBase128(components[0]*40 + components[1])
+
+	for _, component := range components[2:] {
+		data = append(data, berEncodeBase128(component)...)
+	}
+
+	return berEncode(berTagOID, data), nil
+}
+
+func berEncodeBase128(value uint64) []byte {
+	data := []byte{byte(value & 0x7f)}
+
+	for value >>= 7; value > 0; value >>= 7 {
+		data = append([]byte{byte(value&0x7f) | 0x80}, data...)
+	}
+
+	return data
+}
+
+// Decode the first TLV in 'data', returning it and the remaining data
+func berDecode(data []byte) (*berValue, []byte, error) {
+	if len(data) < 2 {
+		return nil, nil, errors.New("truncated BER element")
+	}
+
+	length, header := int(data[1]), 2
+
+	if data[1]&0x80 != 0 {
+		octets := int(data[1] & 0x7f)
+
+		if octets == 0 || octets > 4 || len(data) < 2+octets {
+			return nil, nil, errors.New("invalid BER length")
+		}
+
+		length = 0
+
+		for _, b := range data[2 : 2+octets] {
+			length = length<<8 | int(b)
+		}
+
+		header += octets
+	}
+
+	if length < 0 || len(data)-header < length {
+		return nil, nil, errors.New("truncated BER element")
+	}
+
+	value := &berValue{
+		Tag:    data[0],
+		Data:   data[header : header+length],
+		offset: header,
+	}
+
+	return value, data[header+length:], nil
+}
+
+// Decode all TLVs contained in 'data' (ie. the contents of a SEQUENCE)
+func berDecodeAll(data []byte) ([]*berValue, error) {
+	var values []*berValue
+
+	for position := 0; position < len(data); {
+		value, rest, err := berDecode(data[position:])
+		if err != nil {
+			return nil, err
+		}
+
+		value.offset += position
+		values = append(values, value)
+
+		position = len(data) - len(rest)
+	}
+
+	return values, nil
+}
+
+// Decode a SEQUENCE (or other constructed type) expecting exactly 'tag' and at
+// least 'min' elements
+func berDecodeSequence(value *berValue, tag byte, min int) ([]*berValue, error) {
+	if value.Tag != tag {
+		return nil, fmt.Errorf("unexpected BER tag 0x%02x (expected 0x%02x)", value.Tag, tag)
+	}
+
+	elements, err := berDecodeAll(value.Data)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(elements) < min {
+		return nil, fmt.Errorf("expected at least %v elements in BER sequence (got %v)", min, len(elements))
+	}
+
+	return elements, nil
+}
+
+func (v *berValue) Int() (int64, error) {
+	if len(v.Data) == 0 || len(v.Data) > 8 {
+		return 0, fmt.Errorf("invalid integer length (%v)", len(v.Data))
+	}
+
+	value := int64(int8(v.Data[0]))
+
+	for _, b := range v.Data[1:] {
+		value = value<<8 | int64(b)
+	}
+
+	return value, nil
+}
+
+func (v *berValue) Uint() (uint64, error) {
+	data := v.Data
+
+	// Strip the leading zero keeping values with the high bit set positive
+	if len(data) > 1 && data[0] == 0 {
+		data = data[1:]
+	}
+
+	if len(data) == 0 || len(data) > 8 {
+		return 0, fmt.Errorf("invalid unsigned integer length (%v)", len(v.Data))
+	}
+
+	var value uint64
+
+	for _, b := range data {
+		value = value<<8 | uint64(b)
+	}
+
+	return value, nil
+}
+
+func (v *berValue) OID() (string, error) {
+	if len(v.Data) == 0 {
+		return "", errors.New("empty OID")
+	}
+
+	var (
+		components []string
+		value      uint64
+	)
+
+	for i, b := range v.Data {
+		value = value<<7 | uint64(b&0x7f)
+
+		if b&0x80 != 0 {
+			if i == len(v.Data)-1 {
+				return "", errors.New("truncated OID")
+			}
+
+			continue
+		}
+
+		if len(components) == 0 {
+			first := value / 40
+			if first > 2 {
+				first = 2
+			}
+
+			components = append(components, strconv.FormatUint(first, 10), strconv.FormatUint(value-first*40, 10))
+		} else {
+			components = append(components, strconv.FormatUint(value, 10))
+		}
+
+		value = 0
+	}
+
+	return strings.Join(components, "."), nil
+}
+
+// Read a single TLV from a stream (ie. an LDAP message) and return its encoding
+func readBER(r *bufio.Reader) ([]byte, error) {
+	header := make([]byte, 2)
+
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+
+	length := int(header[1])
+
+	if header[1]&0x80 != 0 {
+		octets := int(header[1] & 0x7f)
+		if octets == 0 || octets > 4 {
+			return nil, errors.New("invalid BER length")
+		}
+
+		lengthBytes := make([]byte, octets)
+
+		if _, err := io.ReadFull(r, lengthBytes); err != nil {
+			return nil, err
+		}
+
+		header = append(header, lengthBytes...)
+		length = 0
+
+		for _, b := range lengthBytes {
+			length = length<<8 | int(b)
+		}
+	}
+
+	if length < 0 || length > berMaxElementSize {
+		return nil, fmt.Errorf("BER element too large (%v bytes)", length)
+	}
+
+	data := make([]byte, len(header)+length)
+	copy(data, header)
+
+	if _, err := io.ReadFull(r, data[len(header):]); err != nil {
+		return nil, err
+	}
+
+	return data, nil
+}
@@ -0,0 +1,268 @@
+package monitor
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/9corp/9volt/state"
+	"github.com/9corp/9volt/util"
+)
+
+const (
+	DEFAULT_BROKER_TIMEOUT = time.Duration(10) * time.Second
+
+	brokerProbePrefix = "9volt-probe"
+)
+
+// Shared settings and logic for the 'mqtt', 'amqp' and 'kafka' monitors
+type BrokerMonitor struct {
+	Base
+
+	Timeout   time.Duration
+	Port      int
+	TLSConfig *tls.Config // used for 'tls'
+}
+
+// Publishes 'probe' and consumes it back on an established connection; returns
+// the time from publishing until the probe was received. 'deadline' applies to
+// any additional connection the protocol needs.
+type brokerRoundTripFunc func(conn net.Conn, deadline time.Time, probe []byte) (time.Duration, error)
+
+func newBrokerMonitor(rmc *RootMonitorConfig, identifier string, defaultPort, defaultTLSPort int) BrokerMonitor {
+	b := BrokerMonitor{
+		Base: Base{
+			RMC:        rmc,
+			Identifier: identifier,
+		},
+		Timeout: DEFAULT_BROKER_TIMEOUT,
+		Port:    defaultPort,
+	}
+
+	if rmc.Config.TCPTLS {
+		b.Port = defaultTLSPort
+	}
+
+	if rmc.Config.Timeout != util.CustomDuration(0) {
+		b.Timeout = time.Duration(rmc.Config.Timeout)
+	}
+
+	if rmc.Config.Port != 0 {
+		b.Port = rmc.Config.Port
+	}
+
+	return b
+}
+
+func (b *BrokerMonitor) Validate() error {
+	b.RMC.Log.WithField("configName", b.RMC.ConfigName).Debug("Performing monitor config validation")
+
+	if b.RMC.Config.Host == "" {
+		return errors.New("'host' must be set")
+	}
+
+	if b.Timeout >= time.Duration(b.RMC.Config.Interval) {
+		return fmt.Errorf("'timeout' (%v) cannot equal or exceed 'interval' (%v)", b.Timeout.String(), b.RMC.Config.Interval.String())
+	}
+
+	if b.RMC.Config.BrokerTopic == "" {
+		return errors.New("'broker-topic' must be set")
+	}
+
+	if b.RMC.Config.BrokerPassword != "" && b.RMC.Config.BrokerUser == "" {
+		return errors.New("'broker-password' requires 'broker-user' to be set")
+	}
+
+	if b.RMC.Config.TCPTLS {
+		tlsConfig, err := newTLSClientConfig(b.RMC.Config)
+		if err != nil {
+			return err
+		}
+
+		if tlsConfig.ServerName == "" {
+			tlsConfig.ServerName = b.RMC.Config.Host
+		}
+
+		b.TLSConfig = tlsConfig
+	}
+
+	return nil
+}
+
+// Connect, publish a uniquely tagged probe and consume it back via 'roundTrip';
+// the whole exchange has to complete within 'timeout'
+func (b *BrokerMonitor) brokerCheck(roundTrip brokerRoundTripFunc) (*CheckResult, error) {
+	fullAddress := net.JoinHostPort(b.RMC.Config.Host, strconv.Itoa(b.Port))
+	deadline := time.Now().Add(b.Timeout)
+
+	b.RMC.Log.WithField("address", fullAddress).Debugf("Performing %v check", b.Identifier)
+
+	probe, err := b.newProbe()
+	if err != nil {
+		return nil, fmt.Errorf("Unable to generate probe message: %v", err.Error())
+	}
+
+	conn, err := dialWithDeadline(fullAddress, b.TLSConfig, deadline)
+	if err != nil {
+		return nil, err
+	}
+
+	defer conn.Close()
+
+	latency, err := roundTrip(conn, deadline, probe)
+	if err != nil {
+		return nil, fmt.Errorf("%v round trip via %v failed: %v", b.Identifier, fullAddress, err.Error())
+	}
+
+	return &CheckResult{
+		Output:  fmt.Sprintf("Probe consumed from '%v' after %v", b.RMC.Config.BrokerTopic, latency),
+		Metrics: []*state.Metric{{Name: "latency", Value: latency.Seconds(), Unit: "s"}},
+	}, nil
+}
+
+// Dial another broker of the same cluster (ie. a partition leader) using the
+// same TLS settings
+func (b *BrokerMonitor) dial(address string, deadline time.Time) (net.Conn, error) {
+	var tlsConfig *tls.Config
+
+	if b.TLSConfig != nil {
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			return nil, err
+		}
+
+		tlsConfig = b.TLSConfig.Clone()
+
+		if b.RMC.Config.TLSServerName == "" {
+			tlsConfig.ServerName = host
+		}
+	}
+
+	return dialWithDeadline(address, tlsConfig, deadline)
+}
+
+// '9volt-probe <config name> <random hex>'; unique per check
+func (b *BrokerMonitor) newProbe() ([]byte, error) {
+	tag := make([]byte, 16)
+
+	if _, err := rand.Read(tag); err != nil {
+		return nil, err
+	}
+
+	return []byte(fmt.Sprintf("%v %v %v", brokerProbePrefix, b.RMC.ConfigName, hex.EncodeToString(tag))), nil
+}
+
+// Whether 'message' is a probe published by this check (possibly a previous,
+// timed out one)
+func (b *BrokerMonitor) isProbe(message []byte) bool {
+	return bytes.HasPrefix(message, []byte(fmt.Sprintf("%v %v ", brokerProbePrefix, b.RMC.ConfigName)))
+}
+
+// SASL PLAIN (RFC 4616) initial response
+func brokerPlainAuth(user, password string) []byte {
+	return []byte("\x00" + user + "\x00" + password)
+}
+
+// Sequential big-endian decoding of broker responses; the first read past the
+// end sets 'err' and all further reads return zero values
+type brokerDecoder struct {
+	data []byte
+	err  error
+}
+
+func (d *brokerDecoder) bytes(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+
+	if n < 0 || n > len(d.data) {
+		d.err = errors.New("truncated response")
+		d.data = nil
+
+		return nil
+	}
+
+	b := d.data[:n]
+	d.data = d.data[n:]
+
+	return b
+}
+
+func (d *brokerDecoder) uint8() uint8 {
+	if b := d.bytes(1); b != nil {
+		return b[0]
+	}
+
+	return 0
+}
+
+func (d *brokerDecoder) uint16() uint16 {
+	if b := d.bytes(2); b != nil {
+		return binary.BigEndian.Uint16(b)
+	}
+
+	return 0
+}
+
+func (d *brokerDecoder) uint32() uint32 {
+	if b := d.bytes(4); b != nil {
+		return binary.BigEndian.Uint32(b)
+	}
+
+	return 0
+}
+
+func (d *brokerDecoder) uint64() uint64 {
+	if b := d.bytes(8); b != nil {
+		return binary.BigEndian.Uint64(b)
+	}
+
+	return 0
+}
+
+// Zig-zag encoded variable length integer (as used by Kafka records)
+func (d *brokerDecoder) varint() int64 {
+	if d.err != nil {
+		return 0
+	}
+
+	value, n := binary.Varint(d.data)
+	if n <= 0 {
+		d.err = errors.New("invalid varint")
+		d.data = nil
+
+		return 0
+	}
+
+	d.data = d.data[n:]
+
+	return value
+}
+
+func brokerUint16(value uint16) []byte {
+	b := make([]byte, 2)
+	binary.BigEndian.PutUint16(b, value)
+
+	return b
+}
+
+func brokerUint32(value uint32) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, value)
+
+	return b
+}
+
+func brokerUint64(value uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, value)
+
+	return b
+}
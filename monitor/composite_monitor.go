@@ -0,0 +1,292 @@
+package monitor
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/9corp/9volt/dal"
+	"github.com/9corp/9volt/state"
+	"github.com/9corp/9volt/util"
+)
+
+const (
+	COMPOSITE_STATE_OK       = "ok"
+	COMPOSITE_STATE_WARNING  = "warning"
+	COMPOSITE_STATE_CRITICAL = "critical"
+	COMPOSITE_STATE_UNKNOWN  = "unknown"
+)
+
+var (
+	compositeStates     = []string{COMPOSITE_STATE_OK, COMPOSITE_STATE_WARNING, COMPOSITE_STATE_CRITICAL, COMPOSITE_STATE_UNKNOWN}
+	compositeRuleStates = []string{COMPOSITE_STATE_WARNING, COMPOSITE_STATE_CRITICAL}
+)
+
+// A single composite rule, ie. "critical if at least 2 of 'web-*' are critical"
+type CompositeRule struct {
+	State      string   `json:"state"`                 // resulting state: 'warning' or 'critical'
+	Checks     []string `json:"checks,omitempty"`      // check names or glob patterns; defaults to 'composite-checks'
+	Match      []string `json:"match,omitempty"`       // states to count; defaults to 'state'
+	Min        int      `json:"min,omitempty"`         // defaults to 1 (ie. 'any')
+	MinPercent float64  `json:"min-percent,omitempty"` // alternative to 'min'; 100 == 'all'
+}
+
+type CompositeMonitor struct {
+	Base
+}
+
+func NewCompositeMonitor(rmc *RootMonitorConfig) *CompositeMonitor {
+	c := &CompositeMonitor{
+		Base: Base{
+			RMC:        rmc,
+			Identifier: "composite",
+		},
+	}
+
+	c.MonitorFunc = c.compositeCheck
+
+	return c
+}
+
+func (c *CompositeMonitor) Validate() error {
+	c.RMC.Log.WithField("configName", c.RMC.ConfigName).Debug("Performing monitor config validation")
+
+	cfg := c.RMC.Config
+
+	if len(cfg.CompositeRules) == 0 {
+		return errors.New("At least one 'composite-rules' entry must be set")
+	}
+
+	for i, r := range cfg.CompositeRules {
+		if r == nil {
+			return fmt.Errorf("Rule #%v: rule cannot be empty", i)
+		}
+
+		if !util.StringSliceContains(compositeRuleStates, r.State) {
+			return fmt.Errorf("Rule #%v: unknown 'state' '%v' (supported: warning, critical)", i, r.State)
+		}
+
+		for _, s := range r.Match {
+			if !util.StringSliceContains(compositeStates, s) {
+				return fmt.Errorf("Rule #%v: unknown 'match' state '%v' (supported: %v)", i, s, strings.Join(compositeStates, ", "))
+			}
+		}
+
+		if r.Min < 0 {
+			return fmt.Errorf("Rule #%v: 'min' must be larger or equal to 0", i)
+		}
+
+		if r.MinPercent < 0 || r.MinPercent > 100 {
+			return fmt.Errorf("Rule #%v: 'min-percent' (%v) must be between 0 and 100", i, r.MinPercent)
+		}
+
+		if r.Min != 0 && r.MinPercent != 0 {
+			return fmt.Errorf("Rule #%v: 'min' and 'min-percent' are mutually exclusive", i)
+		}
+
+		checks := c.ruleChecks(r)
+		if len(checks) == 0 {
+			return fmt.Errorf("Rule #%v: no 'checks' set and 'composite-checks' is empty", i)
+		}
+
+		for _, check := range checks {
+			if _, err := path.Match(check, ""); err != nil {
+				return fmt.Errorf("Rule #%v: invalid check pattern '%v': %v", i, check, err.Error())
+			}
+
+			if check == c.RMC.ConfigName {
+				return fmt.Errorf("Rule #%v: a composite check cannot reference itself", i)
+			}
+		}
+	}
+
+	if c.RMC.DalClient == nil {
+		return errors.New("No dal client available for fetching check states (bug?)")
+	}
+
+	return nil
+}
+
+// Derive state from the last known states of other checks; the most severe
+// matching rule sets the state directly (bypassing thresholds), as the
+// referenced checks already applied their own thresholds. Failing to fetch the
+// states is counted against the thresholds like any other check failure.
+func (c *CompositeMonitor) compositeCheck() (*CheckResult, error) {
+	states, err := c.fetchStates()
+	if err != nil {
+		return nil, fmt.Errorf("Unable to fetch check states: %v", err.Error())
+	}
+
+	var warningErr error
+	seen := make(map[string]string, 0)
+
+	for i, r := range c.RMC.Config.CompositeRules {
+		checks := c.resolveChecks(c.ruleChecks(r), states)
+		if len(checks) == 0 {
+			return nil, &StateError{
+				State: UNKNOWN,
+				Err:   fmt.Errorf("Rule #%v: no checks matching '%v' found", i, strings.Join(c.ruleChecks(r), ", ")),
+			}
+		}
+
+		match := r.Match
+		if len(match) == 0 {
+			match = []string{r.State}
+		}
+
+		var matched []string
+
+		for _, check := range checks {
+			seen[check] = states[check]
+
+			if util.StringSliceContains(match, c.checkState(check, states)) {
+				matched = append(matched, check)
+			}
+		}
+
+		required := r.required(len(checks))
+
+		if len(matched) < required {
+			continue
+		}
+
+		ruleErr := fmt.Errorf("%v of %v checks are %v (%v); rule #%v requires at least %v",
+			len(matched), len(checks), strings.Join(match, "/"), strings.Join(matched, ", "), i, required)
+
+		if r.State == COMPOSITE_STATE_CRITICAL {
+			return nil, &StateError{State: CRITICAL, Err: ruleErr}
+		}
+
+		if warningErr == nil {
+			warningErr = &StateError{State: WARNING, Err: ruleErr}
+		}
+	}
+
+	if warningErr != nil {
+		return nil, warningErr
+	}
+
+	return &CheckResult{Output: summarizeCompositeStates(seen)}, nil
+}
+
+// Fetch the last known state of every check (by check name)
+func (c *CompositeMonitor) fetchStates() (map[string]string, error) {
+	states := make(map[string]string, 0)
+
+	data, err := c.RMC.DalClient.Get(state.STATE_PREFIX, &dal.GetOptions{
+		Recurse: true,
+	})
+	if err != nil {
+		if c.RMC.DalClient.IsKeyNotFound(err) {
+			return states, nil
+		}
+
+		return nil, err
+	}
+
+	for k, v := range data {
+		var msg state.Message
+
+		if err := json.Unmarshal([]byte(v), &msg); err != nil {
+			c.RMC.Log.WithField("key", k).Warningf("Unable to unmarshal state message: %v", err)
+			continue
+		}
+
+		if msg.Check == "" {
+			msg.Check = path.Base(k)
+		}
+
+		states[msg.Check] = msg.Status
+	}
+
+	return states, nil
+}
+
+// Expand glob patterns against known check states; explicitly named checks are
+// always included (and treated as 'unknown' if no state is available)
+func (c *CompositeMonitor) resolveChecks(patterns []string, states map[string]string) []string {
+	found := make(map[string]bool, 0)
+
+	for _, pattern := range patterns {
+		if !strings.ContainsAny(pattern, `*?[\`) {
+			found[pattern] = true
+			continue
+		}
+
+		for check := range states {
+			if check == c.RMC.ConfigName {
+				continue
+			}
+
+			if ok, _ := path.Match(pattern, check); ok {
+				found[check] = true
+			}
+		}
+	}
+
+	checks := make([]string, 0, len(found))
+
+	for check := range found {
+		checks = append(checks, check)
+	}
+
+	sort.Strings(checks)
+
+	return checks
+}
+
+func (c *CompositeMonitor) ruleChecks(r *CompositeRule) []string {
+	if len(r.Checks) != 0 {
+		return r.Checks
+	}
+
+	return c.RMC.Config.CompositeChecks
+}
+
+// Checks without state (never ran or state expired) are 'unknown'
+func (c *CompositeMonitor) checkState(check string, states map[string]string) string {
+	if s, ok := states[check]; ok && s != "" {
+		return s
+	}
+
+	return COMPOSITE_STATE_UNKNOWN
+}
+
+// Number of matching checks required for a rule to trigger
+func (r *CompositeRule) required(total int) int {
+	switch {
+	case r.MinPercent != 0:
+		return int(math.Ceil(r.MinPercent / 100 * float64(total)))
+	case r.Min != 0:
+		return r.Min
+	default:
+		return 1
+	}
+}
+
+// Summarize check states, ie. '4 checks: 3 ok, 1 warning'
+func summarizeCompositeStates(states map[string]string) string {
+	counts := make(map[string]int, 0)
+
+	for _, s := range states {
+		if s == "" {
+			s = COMPOSITE_STATE_UNKNOWN
+		}
+
+		counts[s]++
+	}
+
+	var parts []string
+
+	for _, s := range compositeStates {
+		if counts[s] != 0 {
+			parts = append(parts, fmt.Sprintf("%v %v", counts[s], s))
+		}
+	}
+
+	return fmt.Sprintf("%v checks: %v", len(states), strings.Join(parts, ", "))
+}
@@ -0,0 +1,181 @@
+package monitor
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/9corp/9volt/dal"
+	"github.com/9corp/9volt/fakes/dalfakes"
+	"github.com/9corp/9volt/state"
+	"github.com/9corp/9volt/util"
+)
+
+var _ = Describe("composite_monitor", func() {
+	var (
+		monitor *CompositeMonitor
+		config  *RootMonitorConfig
+		fakeDAL *dalfakes.FakeIDal
+	)
+
+	notFound := errors.New("key not found")
+
+	setStates := func(states map[string]string) {
+		data := make(map[string]string, 0)
+
+		for check, status := range states {
+			msg, _ := json.Marshal(&state.Message{Check: check, Status: status, Date: time.Now()})
+			data["/9volt/state/"+check] = string(msg)
+		}
+
+		fakeDAL.GetReturns(data, nil)
+	}
+
+	BeforeEach(func() {
+		fakeDAL = &dalfakes.FakeIDal{}
+		fakeDAL.IsKeyNotFoundStub = func(err error) bool { return err == notFound }
+
+		setStates(map[string]string{
+			"web-1":       "ok",
+			"web-2":       "ok",
+			"web-3":       "ok",
+			"web-4":       "ok",
+			"db-primary":  "ok",
+			"db-replica":  "ok",
+			"web-cluster": "critical",
+		})
+
+		config = &RootMonitorConfig{
+			ConfigName: "web-cluster",
+			Config: &MonitorConfig{
+				Type:            "composite",
+				Interval:        util.CustomDuration(30 * time.Second),
+				CompositeChecks: []string{"web-*"},
+				CompositeRules: []*CompositeRule{
+					{State: "critical", Min: 2},
+					{State: "warning", Match: []string{"warning", "critical"}},
+				},
+			},
+			DalClient: fakeDAL,
+			Log:       log.New(),
+		}
+
+		monitor = NewCompositeMonitor(config)
+	})
+
+	Context("Validate", func() {
+		It("returns nil with correct settings", func() {
+			Expect(monitor.Validate()).To(BeNil())
+		})
+
+		It("requires at least one rule", func() {
+			config.Config.CompositeRules = nil
+			Expect(monitor.Validate().Error()).To(ContainSubstring("At least one 'composite-rules' entry"))
+		})
+
+		It("verifies rule settings", func() {
+			config.Config.CompositeRules[0].State = "ok"
+			Expect(monitor.Validate().Error()).To(ContainSubstring("Rule #0: unknown 'state' 'ok'"))
+
+			config.Config.CompositeRules[0].State = "critical"
+			config.Config.CompositeRules[1].Match = []string{"broken"}
+			Expect(monitor.Validate().Error()).To(ContainSubstring("Rule #1: unknown 'match' state 'broken'"))
+
+			config.Config.CompositeRules[1].Match = nil
+			config.Config.CompositeRules[1].MinPercent = 50
+			config.Config.CompositeRules[1].Min = 2
+			Expect(monitor.Validate().Error()).To(ContainSubstring("mutually exclusive"))
+
+			config.Config.CompositeRules[1].Min = 0
+			config.Config.CompositeRules[1].Checks = []string{"web-[1"}
+			Expect(monitor.Validate().Error()).To(ContainSubstring("invalid check pattern 'web-[1'"))
+
+			config.Config.CompositeRules[1].Checks = []string{"web-cluster"}
+			Expect(monitor.Validate().Error()).To(ContainSubstring("cannot reference itself"))
+		})
+
+		It("requires checks for every rule", func() {
+			config.Config.CompositeChecks = nil
+			Expect(monitor.Validate().Error()).To(ContainSubstring("Rule #0: no 'checks' set"))
+		})
+	})
+
+	Context("compositeCheck", func() {
+		It("fetches states recursively", func() {
+			_, err := monitor.compositeCheck()
+			Expect(err).To(BeNil())
+
+			key, opts := fakeDAL.GetArgsForCall(0)
+			Expect(key).To(Equal("state"))
+			Expect(opts).To(Equal(&dal.GetOptions{Recurse: true}))
+		})
+
+		It("is ok if no rule matches, excluding itself from patterns", func() {
+			setStates(map[string]string{"web-1": "ok", "web-2": "ok", "web-cluster": "critical"})
+			result, err := monitor.compositeCheck()
+			Expect(err).To(BeNil())
+			Expect(result.Output).To(Equal("2 checks: 2 ok"))
+		})
+
+		It("uses the most severe matching rule", func() {
+			setStates(map[string]string{"web-1": "critical", "web-2": "ok", "web-3": "ok", "web-4": "ok"})
+
+			_, err := monitor.compositeCheck()
+			Expect(err).To(BeAssignableToTypeOf(&StateError{}))
+			Expect(err.(*StateError).State).To(Equal(WARNING))
+			Expect(err.Error()).To(Equal("1 of 4 checks are warning/critical (web-1); rule #1 requires at least 1"))
+
+			setStates(map[string]string{"web-1": "critical", "web-2": "ok", "web-3": "critical", "web-4": "ok"})
+
+			_, err = monitor.compositeCheck()
+			Expect(err.(*StateError).State).To(Equal(CRITICAL))
+			Expect(err.Error()).To(Equal("2 of 4 checks are critical (web-1, web-3); rule #0 requires at least 2"))
+		})
+
+		It("supports percentages and explicit checks", func() {
+			config.Config.CompositeRules = []*CompositeRule{
+				{State: "critical", Checks: []string{"db-primary", "db-replica"}, MinPercent: 100},
+			}
+
+			setStates(map[string]string{"db-primary": "critical", "db-replica": "ok"})
+			_, err := monitor.compositeCheck()
+			Expect(err).To(BeNil())
+
+			setStates(map[string]string{"db-primary": "critical", "db-replica": "critical"})
+			_, err = monitor.compositeCheck()
+			Expect(err.(*StateError).State).To(Equal(CRITICAL))
+		})
+
+		It("treats checks without state as unknown", func() {
+			config.Config.CompositeRules = []*CompositeRule{
+				{State: "warning", Checks: []string{"db-primary", "db-replica"}, Match: []string{"unknown"}},
+			}
+
+			setStates(map[string]string{"db-primary": "ok"})
+
+			_, err := monitor.compositeCheck()
+			Expect(err.(*StateError).State).To(Equal(WARNING))
+			Expect(err.Error()).To(ContainSubstring("(db-replica)"))
+		})
+
+		It("is unknown if no checks match a pattern", func() {
+			config.Config.CompositeChecks = []string{"api-*"}
+
+			_, err := monitor.compositeCheck()
+			Expect(err.(*StateError).State).To(Equal(UNKNOWN))
+			Expect(err.Error()).To(ContainSubstring("no checks matching 'api-*' found"))
+		})
+
+		It("leaves failures to fetch states to the thresholds", func() {
+			fakeDAL.GetReturns(nil, errors.New("etcd is down"))
+
+			_, err := monitor.compositeCheck()
+			Expect(err).NotTo(BeAssignableToTypeOf(&StateError{}))
+			Expect(err.Error()).To(Equal("Unable to fetch check states: etcd is down"))
+		})
+	})
+})
@@ -0,0 +1,186 @@
+package monitor
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/9corp/9volt/util"
+)
+
+const (
+	DEFAULT_DB_TIMEOUT = time.Duration(5) * time.Second
+)
+
+// A single assertion on the result of a database query/command
+type DBAssertion struct {
+	Field    string `json:"field,omitempty"`    // column name (postgres, mysql) or 'INFO' field (redis); blank = first value
+	Operator string `json:"operator,omitempty"` // '==' (default), '!=', '<', '<=', '>', '>=', 'regex', '!regex', 'exists', 'absent'
+	Value    string `json:"value,omitempty"`
+}
+
+func (a *DBAssertion) operator() string {
+	if a.Operator != "" {
+		return a.Operator
+	}
+
+	return "=="
+}
+
+func (a *DBAssertion) String() string {
+	field := a.Field
+	if field == "" {
+		field = "<value>"
+	}
+
+	return fmt.Sprintf("'%v' %v '%v'", field, a.operator(), a.Value)
+}
+
+// Query result as seen by assertions: 'Value' is the first column of the first
+// row (or the raw reply for redis), 'Fields' maps column names (or redis
+// 'INFO' style 'key:value' lines) to values from the first row.
+type DBResult struct {
+	Value  string
+	Fields map[string]string
+	Rows   int // a blank 'field' is only found if there is at least one row
+}
+
+// Shared settings and logic for the 'postgres', 'mysql' and 'redis' monitors
+type DBMonitor struct {
+	Base
+
+	Timeout time.Duration
+	Port    int
+	Query   string
+}
+
+// Performs the protocol specific handshake, authentication and query on an
+// established connection
+type dbQueryFunc func(conn net.Conn) (*DBResult, error)
+
+func newDBMonitor(rmc *RootMonitorConfig, identifier string, defaultPort int, defaultQuery string) DBMonitor {
+	d := DBMonitor{
+		Base: Base{
+			RMC:        rmc,
+			Identifier: identifier,
+		},
+		Timeout: DEFAULT_DB_TIMEOUT,
+		Port:    defaultPort,
+		Query:   defaultQuery,
+	}
+
+	if rmc.Config.Timeout != util.CustomDuration(0) {
+		d.Timeout = time.Duration(rmc.Config.Timeout)
+	}
+
+	if rmc.Config.Port != 0 {
+		d.Port = rmc.Config.Port
+	}
+
+	if rmc.Config.DBQuery != "" {
+		d.Query = rmc.Config.DBQuery
+	}
+
+	return d
+}
+
+func (d *DBMonitor) Validate() error {
+	d.RMC.Log.WithField("configName", d.RMC.ConfigName).Debug("Performing monitor config validation")
+
+	if d.RMC.Config.Host == "" {
+		return errors.New("'host' must be set")
+	}
+
+	if d.Timeout >= time.Duration(d.RMC.Config.Interval) {
+		return fmt.Errorf("'timeout' (%v) cannot equal or exceed 'interval' (%v)", d.Timeout.String(), d.RMC.Config.Interval.String())
+	}
+
+	for i, a := range d.RMC.Config.DBAssertions {
+		if a == nil {
+			return fmt.Errorf("Assertion #%v is empty", i)
+		}
+
+		if !util.StringSliceContains(assertionOperators, a.operator()) {
+			return fmt.Errorf("Assertion #%v: unknown operator '%v'", i, a.Operator)
+		}
+
+		if a.operator() == "regex" || a.operator() == "!regex" {
+			if _, err := regexp.Compile(a.Value); err != nil {
+				return fmt.Errorf("Assertion #%v: unable to compile regex: %v", i, err.Error())
+			}
+		}
+	}
+
+	return nil
+}
+
+// Connect, run the query via 'query' and evaluate the assertions; the whole
+// exchange has to complete within 'timeout'
+func (d *DBMonitor) dbCheck(query dbQueryFunc) error {
+	fullAddress := net.JoinHostPort(d.RMC.Config.Host, strconv.Itoa(d.Port))
+
+	d.RMC.Log.WithField("address", fullAddress).Debugf("Performing %v check", d.Identifier)
+
+	conn, err := net.DialTimeout("tcp", fullAddress, d.Timeout)
+	if err != nil {
+		return fmt.Errorf("Unable to open connection to %v: %v", fullAddress, err.Error())
+	}
+
+	defer conn.Close()
+
+	if err := conn.SetDeadline(time.Now().Add(d.Timeout)); err != nil {
+		return fmt.Errorf("Unable to set timeout (%v): %v", d.Timeout, err.Error())
+	}
+
+	result, err := query(conn)
+	if err != nil {
+		return fmt.Errorf("%v check against %v failed: %v", d.Identifier, fullAddress, err.Error())
+	}
+
+	return evaluateDBAssertions(d.RMC.Config.DBAssertions, result)
+}
+
+// Evaluate all assertions against a result; first failing assertion wins
+func evaluateDBAssertions(assertions []*DBAssertion, result *DBResult) error {
+	for _, a := range assertions {
+		actual, found := result.Value, result.Rows > 0
+
+		if a.Field != "" {
+			actual, found = result.Fields[a.Field]
+		}
+
+		if err := compareValue(a.operator(), a.Value, actual, found); err != nil {
+			return fmt.Errorf("Assertion %v failed: %v", a, err.Error())
+		}
+	}
+
+	return nil
+}
+
+// Build a result from column names and (text) rows; NULL values (nil) are
+// treated as not found by assertions
+func newDBResult(columns []string, rows [][]*string) *DBResult {
+	result := &DBResult{
+		Fields: make(map[string]string),
+		Rows:   len(rows),
+	}
+
+	if len(rows) == 0 {
+		return result
+	}
+
+	for i, column := range columns {
+		if i < len(rows[0]) && rows[0][i] != nil {
+			result.Fields[column] = *rows[0][i]
+		}
+	}
+
+	if len(rows[0]) > 0 && rows[0][0] != nil {
+		result.Value = *rows[0][0]
+	}
+
+	return result
+}
@@ -0,0 +1,104 @@
+package monitor
+
+import (
+	"fmt"
+	"path/filepath"
+
+	"github.com/9corp/9volt/state"
+)
+
+const (
+	DEFAULT_DISK_PATH = "/"
+)
+
+type DiskMonitor struct {
+	Base
+
+	Path string
+}
+
+// Filesystem usage (in bytes) as reported by statfs
+type diskStats struct {
+	Used       uint64
+	Available  uint64 // available to unprivileged users
+	Inodes     uint64
+	InodesFree uint64
+}
+
+// Same as 'df': space reserved for root counts as neither used nor available
+func (d *diskStats) usedPercent() float64 {
+	if d.Used+d.Available == 0 {
+		return 0
+	}
+
+	return float64(d.Used) / float64(d.Used+d.Available) * 100
+}
+
+// Some filesystems do not have a fixed number of inodes and report 0
+func (d *diskStats) inodesUsedPercent() float64 {
+	if d.Inodes == 0 {
+		return 0
+	}
+
+	return float64(d.Inodes-d.InodesFree) / float64(d.Inodes) * 100
+}
+
+func NewDiskMonitor(rmc *RootMonitorConfig) *DiskMonitor {
+	d := &DiskMonitor{
+		Base: Base{
+			RMC:        rmc,
+			Identifier: "disk",
+		},
+		Path: DEFAULT_DISK_PATH,
+	}
+
+	if rmc.Config.DiskPath != "" {
+		d.Path = rmc.Config.DiskPath
+	}
+
+	d.MonitorFunc = d.diskCheck
+
+	return d
+}
+
+func (d *DiskMonitor) Validate() error {
+	d.RMC.Log.WithField("configName", d.RMC.ConfigName).Debug("Performing monitor config validation")
+
+	cfg := d.RMC.Config
+
+	if !filepath.IsAbs(d.Path) {
+		return fmt.Errorf("'disk-path' (%v) must be an absolute path", d.Path)
+	}
+
+	if err := validateLocalThresholds("disk-", cfg.DiskWarning, cfg.DiskCritical, COMPARISON_ABOVE, 100); err != nil {
+		return err
+	}
+
+	return validateLocalThresholds("disk-inodes-", cfg.DiskInodesWarning, cfg.DiskInodesCritical, COMPARISON_ABOVE, 100)
+}
+
+// Compare filesystem space and inode usage (in percent) against the configured thresholds
+func (d *DiskMonitor) diskCheck() (*CheckResult, error) {
+	cfg := d.RMC.Config
+
+	stats, err := getDiskStats(d.Path)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to fetch filesystem stats for '%v': %v", d.Path, err.Error())
+	}
+
+	used, inodesUsed := roundLocalValue(stats.usedPercent()), roundLocalValue(stats.inodesUsedPercent())
+
+	result := &CheckResult{
+		Output: fmt.Sprintf("'%v': %.2f%% used (%v MB available), %.2f%% inodes used",
+			d.Path, used, stats.Available/1024/1024, inodesUsed),
+		Metrics: []*state.Metric{
+			thresholdMetric("used", used, "%", cfg.DiskWarning, cfg.DiskCritical),
+			thresholdMetric("inodes_used", inodesUsed, "%", cfg.DiskInodesWarning, cfg.DiskInodesCritical),
+		},
+	}
+
+	return result, mostSevere(
+		checkThresholds(fmt.Sprintf("Disk usage of '%v'", d.Path), used, "%", cfg.DiskWarning, cfg.DiskCritical, COMPARISON_ABOVE),
+		checkThresholds(fmt.Sprintf("Inode usage of '%v'", d.Path), inodesUsed, "%", cfg.DiskInodesWarning, cfg.DiskInodesCritical, COMPARISON_ABOVE),
+	)
+}
@@ -0,0 +1,89 @@
+package monitor
+
+import (
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/9corp/9volt/util"
+)
+
+var _ = Describe("disk_monitor", func() {
+	var (
+		monitor *DiskMonitor
+		config  *RootMonitorConfig
+	)
+
+	float := func(f float64) *float64 {
+		return &f
+	}
+
+	BeforeEach(func() {
+		config = &RootMonitorConfig{
+			Config: &MonitorConfig{
+				Interval:     util.CustomDuration(time.Minute),
+				DiskWarning:  float(80),
+				DiskCritical: float(90),
+			},
+			Log: log.New(),
+		}
+
+		monitor = NewDiskMonitor(config)
+	})
+
+	Context("Validate", func() {
+		It("returns nil with correct settings", func() {
+			Expect(monitor.Validate()).To(BeNil())
+			Expect(monitor.Path).To(Equal(DEFAULT_DISK_PATH))
+		})
+
+		It("verifies path and thresholds", func() {
+			config.Config.DiskPath = "var/lib"
+			monitor = NewDiskMonitor(config)
+			Expect(monitor.Validate().Error()).To(ContainSubstring("'disk-path' (var/lib) must be an absolute path"))
+
+			monitor = NewDiskMonitor(config)
+			monitor.Path = "/"
+			config.Config.DiskCritical = float(70)
+			Expect(monitor.Validate().Error()).To(ContainSubstring("'disk-warning' (80) cannot exceed 'disk-critical' (70)"))
+
+			config.Config.DiskCritical = nil
+			config.Config.DiskInodesCritical = float(101)
+			Expect(monitor.Validate().Error()).To(ContainSubstring("'disk-inodes-critical' (101) cannot exceed 100"))
+		})
+	})
+
+	Context("diskCheck", func() {
+		It("reports usage as metrics", func() {
+			config.Config.DiskWarning = float(0)
+			config.Config.DiskCritical = float(100)
+
+			// Any usage crosses a 0% threshold
+			result, err := monitor.diskCheck()
+			Expect(err.(*StateError).State).To(Equal(WARNING))
+			Expect(err.Error()).To(ContainSubstring("is above warning threshold (0%)"))
+			Expect(result.Output).To(ContainSubstring("'/': "))
+			Expect(result.Metrics).To(HaveLen(2))
+			Expect(result.Metrics[0].Name).To(Equal("used"))
+			Expect(result.Metrics[0].Warning).To(Equal("0"))
+			Expect(result.Metrics[0].Critical).To(Equal("100"))
+		})
+
+		It("fails for missing paths", func() {
+			monitor.Path = "/does/not/exist"
+			_, err := monitor.diskCheck()
+			Expect(err.Error()).To(ContainSubstring("Unable to fetch filesystem stats for '/does/not/exist'"))
+		})
+	})
+
+	Context("diskStats", func() {
+		It("calculates usage like df", func() {
+			stats := &diskStats{Used: 30, Available: 70, Inodes: 200, InodesFree: 150}
+			Expect(stats.usedPercent()).To(Equal(float64(30)))
+			Expect(stats.inodesUsedPercent()).To(Equal(float64(25)))
+			Expect((&diskStats{}).inodesUsedPercent()).To(Equal(float64(0)))
+		})
+	})
+})
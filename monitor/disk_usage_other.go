@@ -0,0 +1,13 @@
+//go:build !linux && !darwin
+// +build !linux,!darwin
+
+package monitor
+
+import (
+	"fmt"
+	"runtime"
+)
+
+func getDiskStats(path string) (*diskStats, error) {
+	return nil, fmt.Errorf("Disk usage checks are not supported on %v", runtime.GOOS)
+}
@@ -0,0 +1,26 @@
+//go:build linux || darwin
+// +build linux darwin
+
+package monitor
+
+import (
+	"syscall"
+)
+
+// Fetch block and inode usage for the filesystem containing 'path'
+func getDiskStats(path string) (*diskStats, error) {
+	var fs syscall.Statfs_t
+
+	if err := syscall.Statfs(path, &fs); err != nil {
+		return nil, err
+	}
+
+	blockSize := uint64(fs.Bsize)
+
+	return &diskStats{
+		Used:       (uint64(fs.Blocks) - uint64(fs.Bfree)) * blockSize,
+		Available:  uint64(fs.Bavail) * blockSize,
+		Inodes:     uint64(fs.Files),
+		InodesFree: uint64(fs.Ffree),
+	}, nil
+}
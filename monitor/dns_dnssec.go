@@ -0,0 +1,365 @@
+package monitor
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	resolver "github.com/miekg/dns"
+)
+
+const (
+	DEFAULT_DNSSEC_UDP_SIZE = 4096
+
+	// RFC 1982 serial arithmetic window used for RRSIG timestamps
+	rrsigYear68 = 1 << 31
+)
+
+var (
+	// Root zone KSK-2017; see https://data.iana.org/root-anchors/root-anchors.xml
+	DEFAULT_DNSSEC_TRUST_ANCHORS = []string{
+		". IN DS 20326 8 2 E06D44B80B8F1D39A95C0B0D7C65D08458E880409BBC683457104237C7F8EC8D",
+	}
+)
+
+// Parse 'dns-trust-anchors' (DS or DNSKEY records in zone file format)
+func parseTrustAnchors(anchors []string) ([]resolver.RR, error) {
+	parsed := make([]resolver.RR, 0, len(anchors))
+
+	for _, anchor := range anchors {
+		rr, err := resolver.NewRR(anchor)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to parse trust anchor '%v': %v", anchor, err.Error())
+		}
+
+		switch rr.(type) {
+		case *resolver.DS, *resolver.DNSKEY:
+			parsed = append(parsed, rr)
+		default:
+			return nil, fmt.Errorf("Trust anchor '%v' must be a DS or DNSKEY record", anchor)
+		}
+	}
+
+	return parsed, nil
+}
+
+// Remove RRSIGs from an answer section, returning them separately
+func splitRRSIGs(answer []resolver.RR) ([]resolver.RR, []*resolver.RRSIG) {
+	records := make([]resolver.RR, 0, len(answer))
+	sigs := make([]*resolver.RRSIG, 0)
+
+	for _, rr := range answer {
+		if sig, ok := rr.(*resolver.RRSIG); ok {
+			sigs = append(sigs, sig)
+			continue
+		}
+
+		records = append(records, rr)
+	}
+
+	return records, sigs
+}
+
+// Convert an RRSIG timestamp to an absolute time relative to 'now'
+func rrsigTime(ts uint32, now time.Time) time.Time {
+	utc := now.UTC().Unix()
+	mod := (int64(ts) - utc) / rrsigYear68
+
+	return time.Unix(int64(ts)+(mod*rrsigYear68), 0).UTC()
+}
+
+// Failure to fetch DNSKEY/DS records (as opposed to records that fail
+// validation); these are left to the attempt thresholds
+type dnssecLookupError struct {
+	msg string
+}
+
+func (e *dnssecLookupError) Error() string {
+	return e.msg
+}
+
+// Validates answers from a single server up to the configured trust anchors.
+// Validated zone keys are cached for the duration of a single check.
+type dnssecValidator struct {
+	dns      *DnsMonitor
+	server   string
+	now      time.Time
+	keys     map[string][]*resolver.DNSKEY
+	expiry   time.Time
+	expiring string
+}
+
+func newDNSSECValidator(dns *DnsMonitor, server string) *dnssecValidator {
+	return &dnssecValidator{
+		dns:    dns,
+		server: server,
+		now:    time.Now(),
+		keys:   make(map[string][]*resolver.DNSKEY),
+	}
+}
+
+// Validate every RRset in the answer and check how soon the earliest
+// signature in the chain expires
+func (v *dnssecValidator) validate(answer []resolver.RR, sigs []*resolver.RRSIG) error {
+	for _, rrset := range groupRRsets(answer) {
+		if err := v.verifyRRset(rrset, sigs); err != nil {
+			if _, ok := err.(*dnssecLookupError); ok {
+				return fmt.Errorf("DNSSEC validation of %v against DNS server %v failed: %v",
+					v.dns.RMC.Config.DnsTarget, v.server, err.Error())
+			}
+
+			return NewCriticalError("DNSSEC validation of %v against DNS server %v failed: %v",
+				v.dns.RMC.Config.DnsTarget, v.server, err.Error())
+		}
+	}
+
+	if v.expiry.IsZero() {
+		return nil
+	}
+
+	remaining := v.expiry.Sub(v.now)
+
+	if critical := time.Duration(v.dns.RMC.Config.DnsRRSIGCritical); critical > 0 && remaining < critical {
+		return NewCriticalError("RRSIG for %v expires in %v (%v)", v.expiring, remaining, v.expiry)
+	}
+
+	if warning := time.Duration(v.dns.RMC.Config.DnsRRSIGWarning); warning > 0 && remaining < warning {
+		return NewWarningError("RRSIG for %v expires in %v (%v)", v.expiring, remaining, v.expiry)
+	}
+
+	return nil
+}
+
+// Verify an RRset against one of its signatures; the signing zone's keys
+// are validated (recursively) along the way
+func (v *dnssecValidator) verifyRRset(rrset []resolver.RR, sigs []*resolver.RRSIG) error {
+	hdr := rrset[0].Header()
+	desc := fmt.Sprintf("%v %v", hdr.Name, resolver.TypeToString[hdr.Rrtype])
+
+	var lastErr error
+
+	for _, sig := range sigs {
+		if !strings.EqualFold(sig.Hdr.Name, hdr.Name) || sig.TypeCovered != hdr.Rrtype {
+			continue
+		}
+
+		// A zone can only sign records at or below its apex
+		if !resolver.IsSubDomain(sig.SignerName, hdr.Name) {
+			lastErr = fmt.Errorf("RRSIG for %v was made by out-of-zone signer %v", desc, sig.SignerName)
+			continue
+		}
+
+		// DS records live in the parent zone
+		if hdr.Rrtype == resolver.TypeDS && strings.EqualFold(sig.SignerName, hdr.Name) {
+			lastErr = fmt.Errorf("RRSIG for %v was made by the child zone", desc)
+			continue
+		}
+
+		keys, err := v.zoneKeys(sig.SignerName)
+		if err != nil {
+			return err
+		}
+
+		if err := v.verifySignature(desc, sig, keys, rrset); err != nil {
+			lastErr = err
+			continue
+		}
+
+		return nil
+	}
+
+	if lastErr != nil {
+		return lastErr
+	}
+
+	return fmt.Errorf("No RRSIG found for %v", desc)
+}
+
+func (v *dnssecValidator) verifySignature(desc string, sig *resolver.RRSIG, keys []*resolver.DNSKEY, rrset []resolver.RR) error {
+	for _, key := range keys {
+		if key.KeyTag() != sig.KeyTag || key.Algorithm != sig.Algorithm {
+			continue
+		}
+
+		if err := sig.Verify(key, rrset); err != nil {
+			return fmt.Errorf("Invalid RRSIG for %v (key tag %v): %v", desc, sig.KeyTag, err.Error())
+		}
+
+		if !sig.ValidityPeriod(v.now) {
+			return fmt.Errorf("RRSIG for %v is outside of its validity period (%v - %v)",
+				desc, rrsigTime(sig.Inception, v.now), rrsigTime(sig.Expiration, v.now))
+		}
+
+		if expiration := rrsigTime(sig.Expiration, v.now); v.expiry.IsZero() || expiration.Before(v.expiry) {
+			v.expiry = expiration
+			v.expiring = desc
+		}
+
+		return nil
+	}
+
+	return fmt.Errorf("No DNSKEY with key tag %v found for %v", sig.KeyTag, sig.SignerName)
+}
+
+// Fetch and validate the DNSKEY set for a zone. The set must be signed by a
+// key that either matches a trust anchor or a (validated) DS record in the parent.
+func (v *dnssecValidator) zoneKeys(zone string) ([]*resolver.DNSKEY, error) {
+	zone = strings.ToLower(resolver.Fqdn(zone))
+
+	if keys, ok := v.keys[zone]; ok {
+		return keys, nil
+	}
+
+	resp, err := v.lookup(zone, resolver.TypeDNSKEY)
+	if err != nil {
+		return nil, err
+	}
+
+	records, sigs := splitRRSIGs(resp.Answer)
+
+	keySet := make([]resolver.RR, 0)
+	keys := make([]*resolver.DNSKEY, 0)
+
+	for _, rr := range records {
+		if key, ok := rr.(*resolver.DNSKEY); ok && strings.EqualFold(key.Hdr.Name, zone) {
+			keySet = append(keySet, key)
+			keys = append(keys, key)
+		}
+	}
+
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("No DNSKEY records found for zone %v", zone)
+	}
+
+	trusted := v.anchorsFor(zone)
+
+	if len(trusted) == 0 {
+		if zone == "." {
+			return nil, fmt.Errorf("No trust anchor configured for the root zone")
+		}
+
+		trusted, err = v.delegationSigners(zone)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for _, sig := range sigs {
+		if sig.TypeCovered != resolver.TypeDNSKEY || !strings.EqualFold(sig.SignerName, zone) {
+			continue
+		}
+
+		for _, key := range keys {
+			if key.KeyTag() != sig.KeyTag || !matchesTrustedKey(key, trusted) {
+				continue
+			}
+
+			if err := v.verifySignature(zone+" DNSKEY", sig, []*resolver.DNSKEY{key}, keySet); err != nil {
+				return nil, err
+			}
+
+			v.keys[zone] = keys
+
+			return keys, nil
+		}
+	}
+
+	return nil, fmt.Errorf("DNSKEY set for zone %v is not signed by a trusted key", zone)
+}
+
+// Fetch and validate the DS records for a zone from its parent
+func (v *dnssecValidator) delegationSigners(zone string) ([]resolver.RR, error) {
+	resp, err := v.lookup(zone, resolver.TypeDS)
+	if err != nil {
+		return nil, err
+	}
+
+	records, sigs := splitRRSIGs(resp.Answer)
+
+	dsSet := make([]resolver.RR, 0)
+
+	for _, rr := range records {
+		if ds, ok := rr.(*resolver.DS); ok && strings.EqualFold(ds.Hdr.Name, zone) {
+			dsSet = append(dsSet, ds)
+		}
+	}
+
+	if len(dsSet) == 0 {
+		return nil, fmt.Errorf("No DS records found for zone %v (insecure delegation?)", zone)
+	}
+
+	if err := v.verifyRRset(dsSet, sigs); err != nil {
+		return nil, err
+	}
+
+	return dsSet, nil
+}
+
+// Query the server for records needed to validate the chain
+func (v *dnssecValidator) lookup(name string, qType uint16) (*resolver.Msg, error) {
+	resp, _, err := v.dns.query(v.server, name, qType)
+	if err != nil {
+		return nil, &dnssecLookupError{fmt.Sprintf("%v query for %v failed: %v", resolver.TypeToString[qType], name, err.Error())}
+	}
+
+	if resp.Rcode != resolver.RcodeSuccess {
+		return nil, &dnssecLookupError{fmt.Sprintf("%v query for %v returned %v", resolver.TypeToString[qType], name, resolver.RcodeToString[resp.Rcode])}
+	}
+
+	return resp, nil
+}
+
+func (v *dnssecValidator) anchorsFor(zone string) []resolver.RR {
+	anchors := make([]resolver.RR, 0)
+
+	for _, anchor := range v.dns.TrustAnchors {
+		if strings.EqualFold(anchor.Header().Name, zone) {
+			anchors = append(anchors, anchor)
+		}
+	}
+
+	return anchors
+}
+
+// Does the key match one of the trusted DS or DNSKEY records?
+func matchesTrustedKey(key *resolver.DNSKEY, trusted []resolver.RR) bool {
+	for _, rr := range trusted {
+		switch t := rr.(type) {
+		case *resolver.DS:
+			ds := key.ToDS(t.DigestType)
+			if ds != nil && ds.KeyTag == t.KeyTag && ds.Algorithm == t.Algorithm &&
+				strings.EqualFold(ds.Digest, t.Digest) {
+
+				return true
+			}
+		case *resolver.DNSKEY:
+			if key.Flags == t.Flags && key.Protocol == t.Protocol &&
+				key.Algorithm == t.Algorithm && key.PublicKey == t.PublicKey {
+
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// Group records into RRsets (same name and type), preserving order
+func groupRRsets(records []resolver.RR) [][]resolver.RR {
+	rrsets := make([][]resolver.RR, 0)
+	index := make(map[string]int)
+
+	for _, rr := range records {
+		key := strings.ToLower(rr.Header().Name) + "/" + resolver.TypeToString[rr.Header().Rrtype]
+
+		if i, ok := index[key]; ok {
+			rrsets[i] = append(rrsets[i], rr)
+			continue
+		}
+
+		index[key] = len(rrsets)
+		rrsets = append(rrsets, []resolver.RR{rr})
+	}
+
+	return rrsets
+}
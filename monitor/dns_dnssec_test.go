@@ -0,0 +1,315 @@
+package monitor
+
+import (
+	"crypto"
+	"net"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	resolver "github.com/miekg/dns"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/9corp/9volt/util"
+)
+
+type testZoneKey struct {
+	key  *resolver.DNSKEY
+	priv crypto.Signer
+}
+
+func newTestZoneKey(zone string) *testZoneKey {
+	key := &resolver.DNSKEY{
+		Hdr:       resolver.RR_Header{Name: zone, Rrtype: resolver.TypeDNSKEY, Class: resolver.ClassINET, Ttl: 3600},
+		Flags:     257,
+		Protocol:  3,
+		Algorithm: resolver.ECDSAP256SHA256,
+	}
+
+	priv, err := key.Generate(256)
+	Expect(err).To(BeNil())
+
+	return &testZoneKey{key: key, priv: priv.(crypto.Signer)}
+}
+
+func (z *testZoneKey) sign(rrset []resolver.RR, inception, expiration time.Time) *resolver.RRSIG {
+	sig := &resolver.RRSIG{
+		Hdr:        resolver.RR_Header{Name: rrset[0].Header().Name, Rrtype: resolver.TypeRRSIG, Class: resolver.ClassINET, Ttl: 3600},
+		KeyTag:     z.key.KeyTag(),
+		SignerName: z.key.Hdr.Name,
+		Algorithm:  z.key.Algorithm,
+		Inception:  uint32(inception.Unix()),
+		Expiration: uint32(expiration.Unix()),
+	}
+
+	Expect(sig.Sign(z.priv, rrset)).To(BeNil())
+
+	return sig
+}
+
+// Answers queries from a static 'name/type' -> records map over UDP and TCP
+// (on the same port); unknown names get SERVFAIL. With 'truncate', every UDP
+// answer is truncated so that clients have to retry over TCP.
+func startStaticDNSServer(zone map[string][]resolver.RR, truncate bool) (func(), string) {
+	var (
+		pc  net.PacketConn
+		ln  net.Listener
+		err error
+	)
+
+	// The TCP port picked by the kernel may be taken for UDP; try a few
+	for i := 0; i < 10; i++ {
+		ln, err = net.Listen("tcp", "127.0.0.1:0")
+		Expect(err).To(BeNil())
+
+		if pc, err = net.ListenPacket("udp", ln.Addr().String()); err == nil {
+			break
+		}
+
+		ln.Close()
+	}
+
+	Expect(err).To(BeNil())
+
+	handler := resolver.HandlerFunc(func(w resolver.ResponseWriter, req *resolver.Msg) {
+		resp := &resolver.Msg{}
+		resp.SetReply(req)
+
+		q := req.Question[0]
+		records, ok := zone[q.Name+"/"+resolver.TypeToString[q.Qtype]]
+
+		_, udp := w.RemoteAddr().(*net.UDPAddr)
+
+		switch {
+		case !ok:
+			resp.Rcode = resolver.RcodeServerFailure
+		case truncate && udp:
+			resp.Truncated = true
+		default:
+			resp.Answer = records
+		}
+
+		w.WriteMsg(resp)
+	})
+
+	servers := []*resolver.Server{
+		{PacketConn: pc, Handler: handler},
+		{Listener: ln, Handler: handler},
+	}
+
+	for _, server := range servers {
+		started := make(chan struct{})
+		server.NotifyStartedFunc = func() { close(started) }
+
+		go server.ActivateAndServe()
+		<-started
+	}
+
+	stop := func() {
+		for _, server := range servers {
+			server.Shutdown()
+		}
+	}
+
+	return stop, pc.LocalAddr().String()
+}
+
+var _ = Describe("dns_dnssec", func() {
+	var (
+		monitor    *DnsMonitor
+		config     *RootMonitorConfig
+		stop       func()
+		tldKey     *testZoneKey
+		zoneKey    *testZoneKey
+		answer     []resolver.RR
+		inception  time.Time
+		expiration time.Time
+		tamper     bool
+		unsigned   bool
+		truncate   bool
+	)
+
+	// Signed chain: test. (trust anchor) -> example.test. -> www.example.test. A
+	buildZone := func() map[string][]resolver.RR {
+		dnskey := func(z *testZoneKey) []resolver.RR {
+			set := []resolver.RR{z.key}
+			return append(set, z.sign(set, inception, expiration))
+		}
+
+		ds := []resolver.RR{zoneKey.key.ToDS(resolver.SHA256)}
+		ds = append(ds, tldKey.sign(ds, inception, expiration))
+
+		a, _ := resolver.NewRR("www.example.test. 60 IN A 10.0.0.1")
+		answer = []resolver.RR{a}
+
+		if !unsigned {
+			answer = append(answer, zoneKey.sign([]resolver.RR{a}, inception, expiration))
+		}
+
+		if tamper {
+			answer[0], _ = resolver.NewRR("www.example.test. 60 IN A 10.6.6.6")
+		}
+
+		return map[string][]resolver.RR{
+			"test./DNSKEY":         dnskey(tldKey),
+			"example.test./DNSKEY": dnskey(zoneKey),
+			"example.test./DS":     ds,
+			"www.example.test./A":  answer,
+		}
+	}
+
+	start := func() {
+		stop, config.Config.Host = startStaticDNSServer(buildZone(), truncate)
+		monitor = NewDnsMonitor(config)
+		Expect(monitor.Validate()).To(BeNil())
+	}
+
+	BeforeEach(func() {
+		tldKey = newTestZoneKey("test.")
+		zoneKey = newTestZoneKey("example.test.")
+		inception = time.Now().Add(-time.Hour)
+		expiration = time.Now().Add(14 * 24 * time.Hour)
+		tamper = false
+		unsigned = false
+		truncate = false
+
+		config = &RootMonitorConfig{
+			Config: &MonitorConfig{
+				DnsTarget:       "www.example.test",
+				DnsRecordType:   "A",
+				DnsDNSSEC:       true,
+				DnsTrustAnchors: []string{tldKey.key.ToDS(resolver.SHA256).String()},
+				Expect:          "10.0.0.1",
+				Interval:        util.CustomDuration(3 * time.Second),
+			},
+			Log: log.New(),
+		}
+	})
+
+	AfterEach(func() {
+		if stop != nil {
+			stop()
+			stop = nil
+		}
+	})
+
+	Context("Validate", func() {
+		It("defaults to the root trust anchor", func() {
+			config.Config.Host = "127.0.0.1"
+			config.Config.DnsTrustAnchors = nil
+			monitor = NewDnsMonitor(config)
+
+			Expect(monitor.Validate()).To(BeNil())
+			Expect(monitor.TrustAnchors).To(HaveLen(1))
+			Expect(monitor.TrustAnchors[0].Header().Name).To(Equal("."))
+		})
+
+		It("rejects bad trust anchors and expiry windows", func() {
+			config.Config.Host = "127.0.0.1"
+			config.Config.DnsTrustAnchors = []string{"test. IN A 10.0.0.1"}
+			monitor = NewDnsMonitor(config)
+			Expect(monitor.Validate().Error()).To(ContainSubstring("must be a DS or DNSKEY"))
+
+			config.Config.DnsTrustAnchors = []string{"garbage"}
+			Expect(monitor.Validate().Error()).To(ContainSubstring("Unable to parse trust anchor"))
+
+			config.Config.DnsTrustAnchors = nil
+			config.Config.DnsRRSIGWarning = util.CustomDuration(time.Hour)
+			config.Config.DnsRRSIGCritical = util.CustomDuration(2 * time.Hour)
+			Expect(monitor.Validate().Error()).To(ContainSubstring("cannot be smaller than"))
+		})
+	})
+
+	Context("dnsCheck", func() {
+		It("validates the chain up to the trust anchor", func() {
+			start()
+			_, err := monitor.dnsCheck()
+			Expect(err).To(BeNil())
+		})
+
+		It("accepts a DNSKEY trust anchor", func() {
+			config.Config.DnsTrustAnchors = []string{tldKey.key.String()}
+			start()
+			_, err := monitor.dnsCheck()
+			Expect(err).To(BeNil())
+		})
+
+		It("fails critical when signatures are missing", func() {
+			unsigned = true
+			start()
+
+			_, err := monitor.dnsCheck()
+			Expect(err).To(BeAssignableToTypeOf(&StateError{}))
+			Expect(err.(*StateError).State).To(Equal(CRITICAL))
+			Expect(err.Error()).To(ContainSubstring("No RRSIG found for www.example.test. A"))
+		})
+
+		It("retries over TCP when UDP answers are truncated", func() {
+			truncate = true
+			start()
+
+			_, err := monitor.dnsCheck()
+			Expect(err).To(BeNil())
+		})
+
+		It("leaves DNSKEY/DS lookup failures to the thresholds", func() {
+			zone := buildZone()
+			delete(zone, "example.test./DNSKEY")
+
+			stop, config.Config.Host = startStaticDNSServer(zone, false)
+			monitor = NewDnsMonitor(config)
+			Expect(monitor.Validate()).To(BeNil())
+
+			_, err := monitor.dnsCheck()
+			Expect(err).NotTo(BeNil())
+			Expect(err).NotTo(BeAssignableToTypeOf(&StateError{}))
+			Expect(err.Error()).To(ContainSubstring("DNSKEY query for example.test. returned SERVFAIL"))
+		})
+
+		It("fails when a signature is invalid", func() {
+			tamper = true
+			config.Config.Expect = "."
+			start()
+
+			_, err := monitor.dnsCheck()
+			Expect(err).NotTo(BeNil())
+			Expect(err.Error()).To(ContainSubstring("Invalid RRSIG for www.example.test. A"))
+		})
+
+		It("fails when the chain does not lead to the trust anchor", func() {
+			config.Config.DnsTrustAnchors = []string{newTestZoneKey("test.").key.ToDS(resolver.SHA256).String()}
+			start()
+
+			_, err := monitor.dnsCheck()
+			Expect(err).NotTo(BeNil())
+			Expect(err.Error()).To(ContainSubstring("DNSKEY set for zone test. is not signed by a trusted key"))
+		})
+
+		It("fails when signatures have expired", func() {
+			inception = time.Now().Add(-48 * time.Hour)
+			expiration = time.Now().Add(-time.Hour)
+			start()
+
+			_, err := monitor.dnsCheck()
+			Expect(err).NotTo(BeNil())
+			Expect(err.Error()).To(ContainSubstring("outside of its validity period"))
+		})
+
+		It("warns or goes critical when signatures are about to expire", func() {
+			expiration = time.Now().Add(36 * time.Hour)
+			config.Config.DnsRRSIGWarning = util.CustomDuration(72 * time.Hour)
+			start()
+
+			_, err := monitor.dnsCheck()
+			Expect(err).To(BeAssignableToTypeOf(&StateError{}))
+			Expect(err.(*StateError).State).To(Equal(WARNING))
+			Expect(err.Error()).To(ContainSubstring("expires in"))
+
+			config.Config.DnsRRSIGCritical = util.CustomDuration(48 * time.Hour)
+
+			_, err = monitor.dnsCheck()
+			Expect(err).To(BeAssignableToTypeOf(&StateError{}))
+			Expect(err.(*StateError).State).To(Equal(CRITICAL))
+		})
+	})
+})
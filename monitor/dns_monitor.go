@@ -1,19 +1,35 @@
 package monitor
 
 import (
+	"errors"
 	"fmt"
+	"net"
 	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 
 	resolver "github.com/miekg/dns"
 
+	"github.com/9corp/9volt/state"
 	"github.com/9corp/9volt/util"
 )
 
 const (
 	DEFAULT_DNS_TIMEOUT     = time.Duration(2) * time.Second
 	DEFAULT_DNS_RECORD_TYPE = "A"
+	DEFAULT_DNS_PORT        = 53
+	DEFAULT_DNS_TLS_PORT    = 853
+)
+
+var (
+	// 9volt transport name : miekg/dns client net
+	dnsTransports = map[string]string{
+		"udp": "udp",
+		"tcp": "tcp",
+		"tls": "tcp-tls",
+	}
 )
 
 type DnsMonitor struct {
@@ -22,6 +38,10 @@ type DnsMonitor struct {
 	Client     *resolver.Client
 	Expect     *regexp.Regexp
 	RecordType string
+	Port       int
+
+	// Parsed 'dns-trust-anchors' (only used with 'dns-dnssec')
+	TrustAnchors []resolver.RR
 }
 
 func NewDnsMonitor(rmc *RootMonitorConfig) *DnsMonitor {
@@ -33,6 +53,7 @@ func NewDnsMonitor(rmc *RootMonitorConfig) *DnsMonitor {
 		Client:     &resolver.Client{},
 		Timeout:    DEFAULT_DNS_TIMEOUT,
 		RecordType: "A",
+		Port:       DEFAULT_DNS_PORT,
 	}
 
 	// Override the default with the setting if we have one
@@ -44,6 +65,22 @@ func NewDnsMonitor(rmc *RootMonitorConfig) *DnsMonitor {
 	// https://godoc.org/github.com/miekg/dns#Client
 	dns.Client.Timeout = dns.Timeout
 
+	if rmc.Config.DnsTransport != "" {
+		dns.Client.Net = dnsTransports[strings.ToLower(rmc.Config.DnsTransport)]
+	}
+
+	if dns.Client.Net == "tcp-tls" {
+		dns.Port = DEFAULT_DNS_TLS_PORT
+	}
+
+	if rmc.Config.Port != 0 {
+		dns.Port = rmc.Config.Port
+	}
+
+	if rmc.Config.DnsEDNS0Size != 0 {
+		dns.Client.UDPSize = uint16(rmc.Config.DnsEDNS0Size)
+	}
+
 	if len(rmc.Config.DnsRecordType) > 0 {
 		dns.RecordType = rmc.Config.DnsRecordType
 	}
@@ -70,6 +107,60 @@ func (dns *DnsMonitor) Validate() error {
 		return fmt.Errorf("No DNS target configured!")
 	}
 
+	if dns.RMC.Config.Host == "" && len(dns.RMC.Config.DnsServers) == 0 {
+		return errors.New("Either 'host' or 'dns-servers' must be set")
+	}
+
+	if len(dns.RMC.Config.DnsServers) == 1 {
+		return errors.New("'dns-servers' must contain at least two servers to compare")
+	}
+
+	if dns.RMC.Config.DnsTransport != "" {
+		if _, ok := dnsTransports[strings.ToLower(dns.RMC.Config.DnsTransport)]; !ok {
+			return fmt.Errorf("Unknown DNS transport: %s (supported: udp, tcp, tls)", dns.RMC.Config.DnsTransport)
+		}
+	}
+
+	if dns.RMC.Config.DnsEDNS0Size < 0 || dns.RMC.Config.DnsEDNS0Size > 65535 {
+		return errors.New("'dns-edns0-size' must be between 0 and 65535")
+	}
+
+	if dns.RMC.Config.DnsExpectedRcode != "" {
+		if _, ok := resolver.StringToRcode[strings.ToUpper(dns.RMC.Config.DnsExpectedRcode)]; !ok {
+			return fmt.Errorf("Unknown rcode: %s", dns.RMC.Config.DnsExpectedRcode)
+		}
+	}
+
+	if dns.RMC.Config.DnsDNSSEC {
+		anchors := dns.RMC.Config.DnsTrustAnchors
+		if len(anchors) == 0 {
+			anchors = DEFAULT_DNSSEC_TRUST_ANCHORS
+		}
+
+		trustAnchors, err := parseTrustAnchors(anchors)
+		if err != nil {
+			return err
+		}
+
+		dns.TrustAnchors = trustAnchors
+
+		warning := dns.RMC.Config.DnsRRSIGWarning
+		critical := dns.RMC.Config.DnsRRSIGCritical
+
+		if warning > 0 && critical > warning {
+			return fmt.Errorf("'dns-rrsig-warning' (%v) cannot be smaller than 'dns-rrsig-critical' (%v)", warning, critical)
+		}
+	}
+
+	if dns.Client.Net == "tcp-tls" {
+		tlsConfig, err := newTLSClientConfig(dns.RMC.Config)
+		if err != nil {
+			return err
+		}
+
+		dns.Client.TLSConfig = tlsConfig
+	}
+
 	if dns.Timeout >= time.Duration(dns.RMC.Config.Interval) {
 		return fmt.Errorf(
 			"'timeout' (%v) cannot equal or exceed 'interval' (%v)",
@@ -90,24 +181,219 @@ func (dns *DnsMonitor) Validate() error {
 // Do a full DNS check on a particular hostname against a particular
 // DNS server. In this check 'target' is the thing we're looking up
 // and 'host' is the DNS server we're talking to do the looking.
-func (dns *DnsMonitor) dnsCheck() error {
-	msg := &resolver.Msg{}
-
+//
+// If 'dns-servers' is set, every server is checked and their answers (and
+// optionally SOA serials) must agree.
+//
+// The query time and answer count are reported for every received response.
+func (dns *DnsMonitor) dnsCheck() (*CheckResult, error) {
 	qType, ok := resolver.StringToType[strings.ToUpper(dns.RecordType)]
 	if !ok {
-		return fmt.Errorf("Unknown record type: %s! Aborting.", dns.RecordType)
+		return nil, fmt.Errorf("Unknown record type: %s! Aborting.", dns.RecordType)
 	}
 
-	target := resolver.Fqdn(dns.RMC.Config.DnsTarget)
-	server := dns.RMC.Config.Host + ":53" // Only support port 53 at least for now
+	if len(dns.RMC.Config.DnsServers) == 0 {
+		resp, elapsed, err := dns.checkServer(dns.RMC.Config.Host, qType)
+		return dnsResult(dns.RMC.Config.Host, resp, elapsed), err
+	}
 
-	dns.RMC.Log.Debugf("Resolving %s against %s", target, server)
+	return dns.consistencyCheck(qType)
+}
+
+// Query every server in 'dns-servers' and compare their answers; reports the
+// slowest response
+func (dns *DnsMonitor) consistencyCheck(qType uint16) (*CheckResult, error) {
+	answers := make(map[string]string)
+	serials := make(map[string]uint32)
+
+	var result *CheckResult
+	var slowest time.Duration
+
+	for _, server := range dns.RMC.Config.DnsServers {
+		resp, elapsed, err := dns.checkServer(server, qType)
+
+		if resp != nil && (result == nil || elapsed > slowest) {
+			result, slowest = dnsResult(server, resp, elapsed), elapsed
+		}
+
+		if err != nil {
+			return result, err
+		}
 
-	msg.SetQuestion(target, qType)
+		answers[server] = answerFingerprint(resp)
 
-	resp, elapsed, err := dns.Client.Exchange(msg, server)
+		if dns.RMC.Config.DnsCompareSOA {
+			serial, err := dns.soaSerial(server)
+			if err != nil {
+				return result, err
+			}
+
+			serials[server] = serial
+		}
+	}
+
+	first := dns.RMC.Config.DnsServers[0]
+
+	for _, server := range dns.RMC.Config.DnsServers[1:] {
+		if answers[server] != answers[first] {
+			return result, fmt.Errorf(
+				"DNS servers %s and %s disagree on %s: [%s] vs [%s]",
+				first, server, dns.RMC.Config.DnsTarget, answers[first], answers[server],
+			)
+		}
+
+		if dns.RMC.Config.DnsCompareSOA && serials[server] != serials[first] {
+			return result, fmt.Errorf(
+				"DNS servers %s and %s disagree on SOA serial for %s: %d vs %d",
+				first, server, dns.soaZone(), serials[first], serials[server],
+			)
+		}
+	}
+
+	return result, nil
+}
+
+// Fetch the SOA serial for 'dns-soa-zone' (or 'dns-target') from a server
+func (dns *DnsMonitor) soaSerial(server string) (uint32, error) {
+	resp, _, err := dns.query(server, dns.soaZone(), resolver.TypeSOA)
 	if err != nil {
-		return fmt.Errorf("DNS query failed: %s", err.Error())
+		return 0, fmt.Errorf("SOA query for %s against %s failed: %s", dns.soaZone(), server, err.Error())
+	}
+
+	// SOA may show up in the authority section when querying a non-apex name
+	for _, rr := range append(resp.Answer, resp.Ns...) {
+		if soa, ok := rr.(*resolver.SOA); ok {
+			return soa.Serial, nil
+		}
+	}
+
+	return 0, fmt.Errorf("No SOA record received for %s from DNS server %s", dns.soaZone(), server)
+}
+
+func (dns *DnsMonitor) soaZone() string {
+	if dns.RMC.Config.DnsSOAZone != "" {
+		return dns.RMC.Config.DnsSOAZone
+	}
+
+	return dns.RMC.Config.DnsTarget
+}
+
+// Build and send a query to a single server
+func (dns *DnsMonitor) query(server, target string, qType uint16) (*resolver.Msg, time.Duration, error) {
+	msg := &resolver.Msg{}
+	msg.SetQuestion(resolver.Fqdn(target), qType)
+
+	msg.RecursionDesired = !dns.RMC.Config.DnsDisableRecursion
+
+	udpSize := uint16(dns.RMC.Config.DnsEDNS0Size)
+
+	if dns.RMC.Config.DnsDNSSEC {
+		if udpSize == 0 {
+			udpSize = DEFAULT_DNSSEC_UDP_SIZE
+		}
+
+		// We validate ourselves, so ask the resolver to hand over the data
+		// even if it fails its own validation
+		msg.CheckingDisabled = true
+	}
+
+	if udpSize != 0 {
+		msg.SetEdns0(udpSize, dns.RMC.Config.DnsDNSSEC)
+	}
+
+	address := dns.serverAddress(server)
+
+	dns.RMC.Log.Debugf("Resolving %s against %s", target, address)
+
+	resp, elapsed, err := dns.Client.Exchange(msg, address)
+
+	// Answers that do not fit in a UDP datagram have to be fetched over TCP
+	if (dns.Client.Net == "" || dns.Client.Net == "udp") &&
+		(err == resolver.ErrTruncated || (err == nil && resp.Truncated)) {
+
+		dns.RMC.Log.Debugf("Response for %s from %s was truncated, retrying over TCP", target, address)
+
+		tcpClient := &resolver.Client{Net: "tcp", Timeout: dns.Client.Timeout}
+
+		tcpResp, tcpElapsed, err := tcpClient.Exchange(msg, address)
+
+		return tcpResp, elapsed + tcpElapsed, err
+	}
+
+	return resp, elapsed, err
+}
+
+// Servers may include their own port, otherwise 'port' (or the transport default) is used
+func (dns *DnsMonitor) serverAddress(server string) string {
+	if _, _, err := net.SplitHostPort(server); err == nil {
+		return server
+	}
+
+	return net.JoinHostPort(server, strconv.Itoa(dns.Port))
+}
+
+// Query a server and verify the response; the response (and its query time) is
+// returned even if it fails verification
+func (dns *DnsMonitor) checkServer(server string, qType uint16) (*resolver.Msg, time.Duration, error) {
+	resp, elapsed, err := dns.query(server, dns.RMC.Config.DnsTarget, qType)
+	if err != nil {
+		return nil, 0, fmt.Errorf("DNS query failed: %s", err.Error())
+	}
+
+	var sigs []*resolver.RRSIG
+
+	if dns.RMC.Config.DnsDNSSEC {
+		resp.Answer, sigs = splitRRSIGs(resp.Answer)
+	}
+
+	if err := dns.verifyResponse(server, resp, elapsed); err != nil {
+		return resp, elapsed, err
+	}
+
+	// Authenticated denial of existence (NSEC/NSEC3) is not validated
+	if dns.RMC.Config.DnsDNSSEC && len(resp.Answer) > 0 {
+		if err := newDNSSECValidator(dns, server).validate(resp.Answer, sigs); err != nil {
+			return resp, elapsed, err
+		}
+	}
+
+	return resp, elapsed, nil
+}
+
+// Query time, answer count and rcode of a response from 'server'
+func dnsResult(server string, resp *resolver.Msg, elapsed time.Duration) *CheckResult {
+	if resp == nil {
+		return nil
+	}
+
+	return &CheckResult{
+		Metrics: []*state.Metric{
+			{Name: "query_time", Value: elapsed.Seconds(), Unit: "s"},
+			{Name: "answers", Value: float64(len(resp.Answer))},
+		},
+		Labels: map[string]string{
+			"server": server,
+			"rcode":  resolver.RcodeToString[resp.Rcode],
+		},
+	}
+}
+
+func (dns *DnsMonitor) verifyResponse(server string, resp *resolver.Msg, elapsed time.Duration) error {
+	if dns.RMC.Config.DnsExpectedRcode != "" {
+		expectedRcode := resolver.StringToRcode[strings.ToUpper(dns.RMC.Config.DnsExpectedRcode)]
+
+		if resp.Rcode != expectedRcode {
+			return fmt.Errorf(
+				"Unexpected rcode %s (expected %s) received for %s against DNS server %s",
+				resolver.RcodeToString[resp.Rcode], resolver.RcodeToString[expectedRcode],
+				dns.RMC.Config.DnsTarget, server,
+			)
+		}
+
+		// Nothing else to verify if we expected an error (ie. NXDOMAIN)
+		if expectedRcode != resolver.RcodeSuccess {
+			return nil
+		}
 	}
 
 	expectedCount := dns.RMC.Config.DnsExpectedCount
@@ -116,7 +402,7 @@ func (dns *DnsMonitor) dnsCheck() error {
 	if expectedCount != 0 && len(resp.Answer) != expectedCount {
 		return fmt.Errorf(
 			"Unexpected result count (%d) received for %s against DNS server %s",
-			len(resp.Answer), dns.RMC.Config.DnsTarget, dns.RMC.Config.Host,
+			len(resp.Answer), dns.RMC.Config.DnsTarget, server,
 		)
 	}
 
@@ -124,7 +410,7 @@ func (dns *DnsMonitor) dnsCheck() error {
 	if len(resp.Answer) == 0 {
 		return fmt.Errorf(
 			"No results received for %s against DNS server %s",
-			dns.RMC.Config.DnsTarget, dns.RMC.Config.Host,
+			dns.RMC.Config.DnsTarget, server,
 		)
 	}
 
@@ -134,7 +420,7 @@ func (dns *DnsMonitor) dnsCheck() error {
 
 		return fmt.Errorf(
 			"DNS check of %s against %s server took longer than %s allowed: %s",
-			dns.RMC.Config.DnsTarget, dns.RMC.Config.Host,
+			dns.RMC.Config.DnsTarget, server,
 			time.Duration(dns.RMC.Config.DnsMaxTime), elapsed,
 		)
 	}
@@ -163,14 +449,31 @@ func (dns *DnsMonitor) dnsCheck() error {
 	if foundCount > 0 && foundCount < expectedCount {
 		return fmt.Errorf(
 			"DNS check of %s against %s had %d records. Only %d matched",
-			dns.RMC.Config.DnsTarget, dns.RMC.Config.Host,
+			dns.RMC.Config.DnsTarget, server,
 			len(resp.Answer), foundCount,
 		)
 	}
 
 	return fmt.Errorf(
 		"DNS check of %s against %s had %d records. None matched expected regex '%s'",
-		dns.RMC.Config.DnsTarget, dns.RMC.Config.Host,
+		dns.RMC.Config.DnsTarget, server,
 		len(resp.Answer), dns.RMC.Config.Expect,
 	)
 }
+
+// Order-independent representation of an answer section; TTLs are ignored
+// since they differ between servers (and over time)
+func answerFingerprint(resp *resolver.Msg) string {
+	records := make([]string, 0, len(resp.Answer))
+
+	for _, ans := range resp.Answer {
+		hdr := ans.Header()
+		rdata := strings.TrimPrefix(ans.String(), hdr.String())
+
+		records = append(records, fmt.Sprintf("%s %s %s", strings.ToLower(hdr.Name), resolver.TypeToString[hdr.Rrtype], strings.TrimSpace(rdata)))
+	}
+
+	sort.Strings(records)
+
+	return strings.Join(records, ", ")
+}
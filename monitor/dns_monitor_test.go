@@ -1,15 +1,63 @@
 package monitor
 
 import (
+	"net"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
+	resolver "github.com/miekg/dns"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 
 	"github.com/9corp/9volt/util"
 )
 
+// Start an in-process DNS server answering 'A' queries from 'records' (name : rr)
+// and SOA queries with 'serial'; unknown names get NXDOMAIN
+func startTestDNSServer(records map[string][]string, serial uint32) (*resolver.Server, string) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	Expect(err).To(BeNil())
+
+	handler := resolver.HandlerFunc(func(w resolver.ResponseWriter, req *resolver.Msg) {
+		resp := &resolver.Msg{}
+		resp.SetReply(req)
+
+		q := req.Question[0]
+
+		switch {
+		case q.Qtype == resolver.TypeSOA:
+			rr, _ := resolver.NewRR(q.Name + " 300 IN SOA ns1.example.com. admin.example.com. 1 3600 600 86400 300")
+			rr.(*resolver.SOA).Serial = serial
+			resp.Answer = append(resp.Answer, rr)
+		case records[q.Name] != nil:
+			for _, record := range records[q.Name] {
+				rr, _ := resolver.NewRR(record)
+				resp.Answer = append(resp.Answer, rr)
+			}
+		default:
+			resp.SetRcode(req, resolver.RcodeNameError)
+		}
+
+		// Let tests verify that the recursion flag made it through
+		resp.RecursionAvailable = req.RecursionDesired
+
+		w.WriteMsg(resp)
+	})
+
+	started := make(chan struct{})
+
+	server := &resolver.Server{
+		PacketConn:        pc,
+		Handler:           handler,
+		NotifyStartedFunc: func() { close(started) },
+	}
+
+	go server.ActivateAndServe()
+	<-started
+
+	return server, pc.LocalAddr().String()
+}
+
 var _ = Describe("dns_monitor", func() {
 	var (
 		monitor *DnsMonitor
@@ -84,4 +132,172 @@ var _ = Describe("dns_monitor", func() {
 			})
 		})
 	})
+
+	Context("transport and port settings", func() {
+		It("defaults to udp on port 53", func() {
+			Expect(monitor.Port).To(Equal(DEFAULT_DNS_PORT))
+			Expect(monitor.Client.Net).To(Equal(""))
+			Expect(monitor.serverAddress("beowulf")).To(Equal("beowulf:53"))
+		})
+
+		It("uses port 853 for DNS-over-TLS", func() {
+			config.Config.DnsTransport = "tls"
+			monitor = NewDnsMonitor(config)
+
+			Expect(monitor.Client.Net).To(Equal("tcp-tls"))
+			Expect(monitor.Port).To(Equal(DEFAULT_DNS_TLS_PORT))
+			Expect(monitor.Validate()).To(BeNil())
+			Expect(monitor.Client.TLSConfig).NotTo(BeNil())
+		})
+
+		It("prefers an explicit port, and a port on the server itself", func() {
+			config.Config.Port = 5353
+			monitor = NewDnsMonitor(config)
+
+			Expect(monitor.serverAddress("beowulf")).To(Equal("beowulf:5353"))
+			Expect(monitor.serverAddress("10.0.0.1:54")).To(Equal("10.0.0.1:54"))
+			Expect(monitor.serverAddress("::1")).To(Equal("[::1]:5353"))
+		})
+
+		It("rejects unknown transports, rcodes and EDNS0 sizes", func() {
+			config.Config.DnsTransport = "carrier-pigeon"
+			Expect(monitor.Validate().Error()).To(ContainSubstring("Unknown DNS transport"))
+
+			config.Config.DnsTransport = "tcp"
+			config.Config.DnsExpectedRcode = "MAYBE"
+			Expect(monitor.Validate().Error()).To(ContainSubstring("Unknown rcode"))
+
+			config.Config.DnsExpectedRcode = "nxdomain"
+			config.Config.DnsEDNS0Size = 70000
+			Expect(monitor.Validate().Error()).To(ContainSubstring("'dns-edns0-size'"))
+		})
+
+		It("requires at least two servers for consistency checks", func() {
+			config.Config.DnsServers = []string{"ns1"}
+			Expect(monitor.Validate().Error()).To(ContainSubstring("at least two"))
+
+			config.Config.Host = ""
+			config.Config.DnsServers = nil
+			Expect(monitor.Validate().Error()).To(ContainSubstring("'dns-servers'"))
+		})
+	})
+
+	Context("dnsCheck", func() {
+		var (
+			server  *resolver.Server
+			address string
+		)
+
+		BeforeEach(func() {
+			server, address = startTestDNSServer(map[string][]string{
+				"grendel.": {"grendel. 60 IN A 10.0.0.1", "grendel. 60 IN A 10.0.0.2"},
+			}, 10)
+
+			config.Config.Host = address
+			monitor = NewDnsMonitor(config)
+		})
+
+		AfterEach(func() {
+			server.Shutdown()
+		})
+
+		It("succeeds against a non-standard port", func() {
+			result, err := monitor.dnsCheck()
+			Expect(err).To(BeNil())
+			Expect(result.Metrics).To(HaveLen(2))
+			Expect(result.Metrics[0].Name).To(Equal("query_time"))
+			Expect(result.Metrics[1].Value).To(Equal(float64(2)))
+			Expect(result.Labels).To(Equal(map[string]string{"server": address, "rcode": "NOERROR"}))
+		})
+
+		It("verifies the expected count", func() {
+			config.Config.DnsExpectedCount = 3
+
+			result, err := monitor.dnsCheck()
+			Expect(result.Metrics[1].Value).To(Equal(float64(2)))
+			Expect(err).NotTo(BeNil())
+			Expect(err.Error()).To(ContainSubstring("Unexpected result count (2)"))
+			Expect(err.Error()).To(ContainSubstring(address))
+		})
+
+		It("sends the recursion desired flag unless disabled", func() {
+			resp, _, err := monitor.query(address, "grendel", resolver.TypeA)
+			Expect(err).To(BeNil())
+			Expect(resp.RecursionAvailable).To(BeTrue())
+
+			config.Config.DnsDisableRecursion = true
+			config.Config.DnsEDNS0Size = 4096
+
+			resp, _, err = monitor.query(address, "grendel", resolver.TypeA)
+			Expect(err).To(BeNil())
+			Expect(resp.RecursionAvailable).To(BeFalse())
+		})
+
+		It("supports expecting NXDOMAIN", func() {
+			config.Config.DnsTarget = "hrothgar"
+			_, err := monitor.dnsCheck()
+			Expect(err).NotTo(BeNil())
+
+			config.Config.DnsExpectedRcode = "NXDOMAIN"
+			_, err = monitor.dnsCheck()
+			Expect(err).To(BeNil())
+
+			config.Config.DnsTarget = "grendel"
+			_, err = monitor.dnsCheck()
+			Expect(err).NotTo(BeNil())
+			Expect(err.Error()).To(ContainSubstring("Unexpected rcode NOERROR (expected NXDOMAIN)"))
+		})
+
+		Context("with multiple servers", func() {
+			var (
+				other        *resolver.Server
+				otherAddress string
+			)
+
+			startOther := func(records map[string][]string, serial uint32) {
+				other, otherAddress = startTestDNSServer(records, serial)
+				config.Config.DnsServers = []string{address, otherAddress}
+			}
+
+			AfterEach(func() {
+				other.Shutdown()
+			})
+
+			It("succeeds when answers match regardless of order and TTL", func() {
+				startOther(map[string][]string{
+					"grendel.": {"grendel. 5 IN A 10.0.0.2", "grendel. 3600 IN A 10.0.0.1"},
+				}, 10)
+
+				_, err := monitor.dnsCheck()
+				Expect(err).To(BeNil())
+			})
+
+			It("fails when answers differ", func() {
+				startOther(map[string][]string{
+					"grendel.": {"grendel. 60 IN A 10.0.0.1", "grendel. 60 IN A 10.0.0.3"},
+				}, 10)
+
+				_, err := monitor.dnsCheck()
+				Expect(err).NotTo(BeNil())
+				Expect(err.Error()).To(ContainSubstring("disagree on grendel"))
+				Expect(err.Error()).To(ContainSubstring("10.0.0.3"))
+			})
+
+			It("compares SOA serials when asked to", func() {
+				startOther(map[string][]string{
+					"grendel.": {"grendel. 60 IN A 10.0.0.1", "grendel. 60 IN A 10.0.0.2"},
+				}, 11)
+
+				_, err := monitor.dnsCheck()
+				Expect(err).To(BeNil())
+
+				config.Config.DnsCompareSOA = true
+				config.Config.DnsSOAZone = "example.com"
+
+				_, err = monitor.dnsCheck()
+				Expect(err).NotTo(BeNil())
+				Expect(err.Error()).To(ContainSubstring("SOA serial for example.com: 10 vs 11"))
+			})
+		})
+	})
 })
@@ -5,13 +5,29 @@ import (
 	"errors"
 	"fmt"
 	"os/exec"
+	"regexp"
+	"strconv"
 	"strings"
 	"syscall"
 	"time"
+
+	"github.com/9corp/9volt/state"
 )
 
 const (
 	DEFAULT_CMD_TIMEOUT = time.Duration(3) * time.Second
+
+	EXEC_MODE_NAGIOS_PLUGIN = "nagios-plugin"
+)
+
+var (
+	// Nagios plugin exit codes -> monitor states
+	nagiosStates = map[int]int{0: OK, 1: WARNING, 2: CRITICAL, 3: UNKNOWN}
+
+	nagiosStateNames = [4]string{"OK", "WARNING", "CRITICAL", "UNKNOWN"}
+
+	// value[UOM]; UOM is anything that is not part of the number
+	perfdataValueRegex = regexp.MustCompile(`^([-+]?[0-9]*\.?[0-9]+(?:[eE][-+]?[0-9]+)?)(.*)$`)
 )
 
 type ExecMonitor struct {
@@ -39,6 +55,10 @@ func NewExecMonitor(rmc *RootMonitorConfig) *ExecMonitor {
 	e.FullCmd = e.getFullCmd()
 	e.MonitorFunc = e.execCheck
 
+	if e.RMC.Config.ExecMode == EXEC_MODE_NAGIOS_PLUGIN {
+		e.MonitorFunc = e.nagiosCheck
+	}
+
 	return e
 }
 
@@ -49,6 +69,10 @@ func (e *ExecMonitor) Validate() error {
 		return errors.New("'command' cannot be blank")
 	}
 
+	if e.RMC.Config.ExecMode != "" && e.RMC.Config.ExecMode != EXEC_MODE_NAGIOS_PLUGIN {
+		return fmt.Errorf("Unknown 'exec-mode' '%v' (supported: %v)", e.RMC.Config.ExecMode, EXEC_MODE_NAGIOS_PLUGIN)
+	}
+
 	if e.Timeout >= time.Duration(e.RMC.Config.Interval) {
 		return fmt.Errorf("'timeout' (%v) cannot equal or exceed 'interval' (%v)", e.Timeout.String(), e.RMC.Config.Interval.String())
 	}
@@ -56,7 +80,7 @@ func (e *ExecMonitor) Validate() error {
 	return nil
 }
 
-func (e *ExecMonitor) execCheck() error {
+func (e *ExecMonitor) execCheck() (*CheckResult, error) {
 	e.RMC.Log.WithField("configName", e.RMC.ConfigName).Debug("Performing check")
 
 	ctx, cancel := context.WithTimeout(context.Background(), e.Timeout)
@@ -67,7 +91,7 @@ func (e *ExecMonitor) execCheck() error {
 	if err != nil {
 		// Did we timeout?
 		if err.Error() == "signal: killed" {
-			return fmt.Errorf("Command '%v' exceeded run timeout (%v)", e.FullCmd, e.RMC.Config.Timeout.String())
+			return nil, fmt.Errorf("Command '%v' exceeded run timeout (%v)", e.FullCmd, e.RMC.Config.Timeout.String())
 		}
 
 		// Did we exit non-zero?
@@ -75,34 +99,184 @@ func (e *ExecMonitor) execCheck() error {
 			// what return code did we get?
 			if status, ok := exiterr.Sys().(syscall.WaitStatus); ok {
 				if status.ExitStatus() != e.RMC.Config.ExecReturnCode {
-					return fmt.Errorf("Command '%v' exited with '%v', expected '%v'. Output: %v",
+					return nil, fmt.Errorf("Command '%v' exited with '%v', expected '%v'. Output: %v",
 						e.FullCmd, status.ExitStatus(), e.RMC.Config.ExecReturnCode,
 						strings.Replace(string(output), "\n", "\\n", -1))
 				}
 			} else {
-				return fmt.Errorf("Unable to fetch return code for command '%v'. Full error: %v", e.FullCmd, err.Error())
+				return nil, fmt.Errorf("Unable to fetch return code for command '%v'. Full error: %v", e.FullCmd, err.Error())
 			}
 		} else {
 			// Something else went bad
-			return fmt.Errorf("Unexpected error during command '%v' execution: %v", e.FullCmd, err.Error())
+			return nil, fmt.Errorf("Unexpected error during command '%v' execution: %v", e.FullCmd, err.Error())
 		}
 	} else {
 		// Got a 0 return code; let's verify that we're okay with 0
 		if e.RMC.Config.ExecReturnCode != 0 {
-			return fmt.Errorf("Command '%v' exited with a '0' return code, expected '%v'", e.FullCmd, e.RMC.Config.ExecReturnCode)
+			return nil, fmt.Errorf("Command '%v' exited with a '0' return code, expected '%v'", e.FullCmd, e.RMC.Config.ExecReturnCode)
 		}
 	}
 
 	if e.RMC.Config.Expect == "" {
-		return nil
+		return nil, nil
 	}
 
 	if !strings.Contains(string(output), e.RMC.Config.Expect) {
-		return fmt.Errorf("Command '%v' output does not contain expected output. Expected: %v Output: %v",
+		return nil, fmt.Errorf("Command '%v' output does not contain expected output. Expected: %v Output: %v",
 			e.FullCmd, e.RMC.Config.Expect, strings.Replace(string(output), "\n", "\\n", -1))
 	}
 
-	return nil
+	return nil, nil
+}
+
+// Run a nagios plugin; exit code determines the state, the first line of output
+// becomes the state message and perfdata is attached to the state as metrics.
+//
+// Unless 'exec-bypass-thresholds' is set, warning/critical thresholds still apply
+// to non-OK exit codes but never lead past the state the plugin reported.
+func (e *ExecMonitor) nagiosCheck() (*CheckResult, error) {
+	e.RMC.Log.WithField("configName", e.RMC.ConfigName).Debug("Performing nagios plugin check")
+
+	ctx, cancel := context.WithTimeout(context.Background(), e.Timeout)
+	defer cancel()
+
+	// Plugins report via stdout only
+	output, err := exec.CommandContext(ctx, e.RMC.Config.ExecCommand, e.RMC.Config.ExecArgs...).Output()
+
+	exitCode := 0
+
+	if err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			return nil, e.nagiosError(UNKNOWN, fmt.Sprintf("Plugin '%v' exceeded run timeout (%v)", e.FullCmd, e.Timeout))
+		}
+
+		exitErr, ok := err.(*exec.ExitError)
+		if !ok {
+			return nil, e.nagiosError(UNKNOWN, fmt.Sprintf("Unable to execute plugin '%v': %v", e.FullCmd, err.Error()))
+		}
+
+		exitCode = exitErr.ExitCode()
+	}
+
+	text, metrics := parseNagiosOutput(string(output))
+
+	result := &CheckResult{Metrics: metrics}
+
+	monitorState, ok := nagiosStates[exitCode]
+	if !ok {
+		monitorState = UNKNOWN
+	}
+
+	if text == "" {
+		text = fmt.Sprintf("Plugin '%v' exited with '%v' (%v) and no output", e.FullCmd, exitCode, nagiosStateNames[monitorState])
+	}
+
+	if monitorState == OK {
+		result.Output = text
+		return result, nil
+	}
+
+	return result, e.nagiosError(monitorState, text)
+}
+
+func (e *ExecMonitor) nagiosError(monitorState int, message string) error {
+	return &StateError{State: monitorState, Err: errors.New(message), Capped: !e.RMC.Config.ExecBypassThresholds}
+}
+
+// Split plugin output into the first line of text and parsed perfdata; perfdata
+// can follow a '|' on the first line and/or on any of the following lines.
+func parseNagiosOutput(output string) (string, []*state.Metric) {
+	lines := strings.SplitN(strings.TrimRight(output, "\n"), "\n", 2)
+
+	text, perfdata := lines[0], ""
+
+	if idx := strings.Index(text, "|"); idx != -1 {
+		text, perfdata = text[:idx], text[idx+1:]
+	}
+
+	if len(lines) > 1 {
+		if idx := strings.Index(lines[1], "|"); idx != -1 {
+			perfdata += " " + strings.Replace(lines[1][idx+1:], "\n", " ", -1)
+		}
+	}
+
+	return strings.TrimSpace(text), parsePerfdata(perfdata)
+}
+
+// Parse nagios perfdata: 'label'=value[UOM];[warn];[crit];[min];[max] ...
+// Invalid entries are skipped.
+func parsePerfdata(perfdata string) []*state.Metric {
+	var metrics []*state.Metric
+
+	for _, entry := range splitPerfdata(perfdata) {
+		idx := strings.LastIndex(entry, "=")
+		if idx < 1 {
+			continue
+		}
+
+		label := entry[:idx]
+		if len(label) > 1 && strings.HasPrefix(label, "'") && strings.HasSuffix(label, "'") {
+			label = strings.Replace(label[1:len(label)-1], "''", "'", -1)
+		}
+
+		fields := strings.Split(entry[idx+1:], ";")
+
+		match := perfdataValueRegex.FindStringSubmatch(fields[0])
+		if match == nil {
+			continue
+		}
+
+		value, err := strconv.ParseFloat(match[1], 64)
+		if err != nil {
+			continue
+		}
+
+		// Pad so that optional fields can be referenced directly
+		for len(fields) < 5 {
+			fields = append(fields, "")
+		}
+
+		metrics = append(metrics, &state.Metric{
+			Name:     label,
+			Value:    value,
+			Unit:     match[2],
+			Warning:  fields[1],
+			Critical: fields[2],
+			Min:      fields[3],
+			Max:      fields[4],
+		})
+	}
+
+	return metrics
+}
+
+// Split perfdata on whitespace, keeping single-quoted labels intact
+func splitPerfdata(perfdata string) []string {
+	var entries []string
+	var current []rune
+
+	quoted := false
+
+	for _, r := range perfdata {
+		switch {
+		case r == '\'':
+			quoted = !quoted
+			current = append(current, r)
+		case (r == ' ' || r == '\t' || r == '\n') && !quoted:
+			if len(current) > 0 {
+				entries = append(entries, string(current))
+				current = nil
+			}
+		default:
+			current = append(current, r)
+		}
+	}
+
+	if len(current) > 0 {
+		entries = append(entries, string(current))
+	}
+
+	return entries
 }
 
 // Helper for displaying full cmd
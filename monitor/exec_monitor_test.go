@@ -0,0 +1,147 @@
+package monitor
+
+import (
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/9corp/9volt/alerter"
+	"github.com/9corp/9volt/state"
+	"github.com/9corp/9volt/util"
+)
+
+var _ = Describe("exec_monitor", func() {
+	var (
+		monitor *ExecMonitor
+		config  *RootMonitorConfig
+	)
+
+	BeforeEach(func() {
+		config = &RootMonitorConfig{
+			Config: &MonitorConfig{
+				ExecCommand: "/bin/sh",
+				ExecMode:    EXEC_MODE_NAGIOS_PLUGIN,
+				Interval:    util.CustomDuration(5 * time.Second),
+			},
+			Log: log.New(),
+		}
+
+		monitor = NewExecMonitor(config)
+	})
+
+	Context("Validate", func() {
+		It("returns nil with correct settings", func() {
+			Expect(monitor.Validate()).To(BeNil())
+		})
+
+		It("errors with unknown exec mode", func() {
+			config.Config.ExecMode = "icinga"
+			err := monitor.Validate()
+
+			Expect(err).NotTo(BeNil())
+			Expect(err.Error()).To(ContainSubstring("Unknown 'exec-mode'"))
+		})
+	})
+
+	Context("nagiosCheck", func() {
+		plugin := func(script string) {
+			config.Config.ExecArgs = []string{"-c", script}
+			monitor = NewExecMonitor(config)
+		}
+
+		It("passes on exit code 0 and keeps output + perfdata", func() {
+			plugin("echo 'DISK OK - free space: / 3326 MB (56%) | /=2643MB;5948;5958;0;5968'")
+
+			result, err := monitor.MonitorFunc()
+			Expect(err).To(BeNil())
+			Expect(result.Output).To(Equal("DISK OK - free space: / 3326 MB (56%)"))
+			Expect(result.Metrics).To(HaveLen(1))
+			Expect(result.Metrics[0]).To(Equal(&state.Metric{
+				Name: "/", Value: 2643, Unit: "MB", Warning: "5948", Critical: "5958", Min: "0", Max: "5968",
+			}))
+		})
+
+		It("applies thresholds up to the plugin state by default", func() {
+			config.Config.WarningThreshold = 1
+			config.Config.CriticalThreshold = 2
+			config.StateChannel = make(chan *state.Message, 3)
+			config.MessageChannel = make(chan *alerter.Message, 3)
+			plugin("echo 'LOAD WARNING - load average: 5.1'; exit 1")
+
+			_, err := monitor.MonitorFunc()
+			Expect(err).NotTo(BeNil())
+			Expect(err.Error()).To(Equal("LOAD WARNING - load average: 5.1"))
+			Expect(err.(*StateError).Capped).To(BeTrue())
+
+			for i := 0; i < 3; i++ {
+				Expect(monitor.handle(monitor.MonitorFunc())).To(BeNil())
+				Expect(monitor.currentState).To(Equal(WARNING))
+			}
+		})
+
+		It("maps exit codes to states when bypassing thresholds", func() {
+			config.Config.ExecBypassThresholds = true
+
+			for exitCode, expectedState := range map[string]int{"1": WARNING, "2": CRITICAL, "3": UNKNOWN, "42": UNKNOWN} {
+				plugin("echo 'something is off'; exit " + exitCode)
+
+				_, err := monitor.MonitorFunc()
+				Expect(err).NotTo(BeNil())
+				Expect(err.(*StateError).State).To(Equal(expectedState))
+				Expect(err.(*StateError).Capped).To(BeFalse())
+			}
+		})
+
+		It("reports plugins without output", func() {
+			plugin("exit 2")
+
+			_, err := monitor.MonitorFunc()
+			Expect(err).NotTo(BeNil())
+			Expect(err.Error()).To(ContainSubstring("exited with '2' (CRITICAL) and no output"))
+		})
+
+		It("reports timeouts as unknown", func() {
+			config.Config.ExecBypassThresholds = true
+			config.Config.Timeout = util.CustomDuration(50 * time.Millisecond)
+			plugin("exec sleep 1")
+
+			_, err := monitor.MonitorFunc()
+			Expect(err).NotTo(BeNil())
+			Expect(err.(*StateError).State).To(Equal(UNKNOWN))
+			Expect(err.Error()).To(ContainSubstring("exceeded run timeout"))
+		})
+	})
+
+	Context("parseNagiosOutput", func() {
+		It("parses perfdata from the first and following lines", func() {
+			text, metrics := parseNagiosOutput("PING OK - Packet loss = 0%|rta=0.5ms;100;500;0\nlong text\n| pl=0%;20;60 'rx bytes'=1c\n")
+
+			Expect(text).To(Equal("PING OK - Packet loss = 0%"))
+			Expect(metrics).To(HaveLen(3))
+			Expect(metrics[0].Name).To(Equal("rta"))
+			Expect(metrics[0].Unit).To(Equal("ms"))
+			Expect(metrics[1].Name).To(Equal("pl"))
+			Expect(metrics[1].Unit).To(Equal("%"))
+			Expect(metrics[2].Name).To(Equal("rx bytes"))
+			Expect(metrics[2].Value).To(Equal(float64(1)))
+			Expect(metrics[2].Unit).To(Equal("c"))
+		})
+
+		It("handles output without perfdata", func() {
+			text, metrics := parseNagiosOutput("HTTP OK\n")
+
+			Expect(text).To(Equal("HTTP OK"))
+			Expect(metrics).To(BeEmpty())
+		})
+
+		It("skips invalid perfdata entries", func() {
+			_, metrics := parseNagiosOutput("OK | garbage time=U;1;2 'it''s'=-1.5e2")
+
+			Expect(metrics).To(HaveLen(1))
+			Expect(metrics[0].Name).To(Equal("it's"))
+			Expect(metrics[0].Value).To(Equal(float64(-150)))
+		})
+	})
+})
@@ -0,0 +1,136 @@
+package monitor
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/9corp/9volt/util"
+)
+
+const (
+	// Only the beginning of large files is searched for 'expect'
+	FILE_MAX_READ_SIZE = 10 * 1024 * 1024
+)
+
+type FileMonitor struct {
+	Base
+
+	Matcher *PayloadMatcher
+}
+
+func NewFileMonitor(rmc *RootMonitorConfig) *FileMonitor {
+	f := &FileMonitor{
+		Base: Base{
+			RMC:        rmc,
+			Identifier: "file",
+		},
+	}
+
+	f.MonitorFunc = f.fileCheck
+
+	return f
+}
+
+func (f *FileMonitor) Validate() error {
+	f.RMC.Log.WithField("configName", f.RMC.ConfigName).Debug("Performing monitor config validation")
+
+	cfg := f.RMC.Config
+
+	if cfg.FilePath == "" {
+		return errors.New("'file-path' must be set")
+	}
+
+	if !filepath.IsAbs(cfg.FilePath) {
+		return fmt.Errorf("'file-path' (%v) must be an absolute path", cfg.FilePath)
+	}
+
+	if cfg.FileMaxAge < util.CustomDuration(0) {
+		return fmt.Errorf("'file-max-age' (%v) cannot be negative", cfg.FileMaxAge.String())
+	}
+
+	if cfg.FileMinSize < 0 || cfg.FileMaxSize < 0 {
+		return errors.New("'file-min-size' and 'file-max-size' must be larger or equal to 0")
+	}
+
+	if cfg.FileMaxSize != 0 && cfg.FileMinSize > cfg.FileMaxSize {
+		return fmt.Errorf("'file-min-size' (%v) cannot exceed 'file-max-size' (%v)", cfg.FileMinSize, cfg.FileMaxSize)
+	}
+
+	matcher, err := newPayloadMatcher(cfg)
+	if err != nil {
+		return err
+	}
+
+	f.Matcher = matcher
+
+	return nil
+}
+
+// Verify that 'file-path' exists and optionally, that it was modified within
+// 'file-max-age', that its size is within 'file-min-size' and 'file-max-size'
+// and that its contents match 'expect'
+func (f *FileMonitor) fileCheck() (*CheckResult, error) {
+	cfg := f.RMC.Config
+
+	if cfg.Expect != "" && f.Matcher == nil {
+		if err := f.Validate(); err != nil {
+			return nil, err
+		}
+	}
+
+	info, err := os.Stat(cfg.FilePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("'%v' does not exist", cfg.FilePath)
+		}
+
+		return nil, fmt.Errorf("Unable to stat '%v': %v", cfg.FilePath, err.Error())
+	}
+
+	age := time.Since(info.ModTime())
+
+	if cfg.FileMaxAge != util.CustomDuration(0) && age > time.Duration(cfg.FileMaxAge) {
+		return nil, fmt.Errorf("'%v' was last modified %v ago at %v (allowed age: %v)",
+			cfg.FilePath, age.Truncate(time.Second), info.ModTime().UTC().Format(time.RFC3339), cfg.FileMaxAge.String())
+	}
+
+	if !info.IsDir() {
+		if info.Size() < cfg.FileMinSize {
+			return nil, fmt.Errorf("'%v' is %v bytes (expected at least %v bytes)", cfg.FilePath, info.Size(), cfg.FileMinSize)
+		}
+
+		if cfg.FileMaxSize != 0 && info.Size() > cfg.FileMaxSize {
+			return nil, fmt.Errorf("'%v' is %v bytes (expected at most %v bytes)", cfg.FilePath, info.Size(), cfg.FileMaxSize)
+		}
+	}
+
+	if f.Matcher != nil {
+		if info.IsDir() {
+			return nil, fmt.Errorf("'%v' is a directory; cannot match contents against 'expect'", cfg.FilePath)
+		}
+
+		file, err := os.Open(cfg.FilePath)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to open '%v': %v", cfg.FilePath, err.Error())
+		}
+		defer file.Close()
+
+		data, err := ioutil.ReadAll(io.LimitReader(file, FILE_MAX_READ_SIZE))
+		if err != nil {
+			return nil, fmt.Errorf("Unable to read '%v': %v", cfg.FilePath, err.Error())
+		}
+
+		if !f.Matcher.Match(data) {
+			return nil, fmt.Errorf("Contents of '%v' do not match %v", cfg.FilePath, f.Matcher)
+		}
+	}
+
+	return &CheckResult{
+		Output: fmt.Sprintf("'%v' is %v bytes, last modified %v ago", cfg.FilePath, info.Size(), age.Truncate(time.Second)),
+	}, nil
+}
@@ -0,0 +1,124 @@
+package monitor
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/9corp/9volt/util"
+)
+
+var _ = Describe("file_monitor", func() {
+	var (
+		monitor *FileMonitor
+		config  *RootMonitorConfig
+		dir     string
+		marker  string
+	)
+
+	start := func() {
+		monitor = NewFileMonitor(config)
+		Expect(monitor.Validate()).To(BeNil())
+	}
+
+	BeforeEach(func() {
+		var err error
+
+		dir, err = ioutil.TempDir("", "9volt-file")
+		Expect(err).To(BeNil())
+
+		marker = filepath.Join(dir, "backup.done")
+		Expect(ioutil.WriteFile(marker, []byte("status=success\nsize=42G\n"), 0644)).To(BeNil())
+
+		config = &RootMonitorConfig{
+			Config: &MonitorConfig{
+				Interval: util.CustomDuration(time.Minute),
+				FilePath: marker,
+			},
+			Log: log.New(),
+		}
+
+		monitor = NewFileMonitor(config)
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	Context("Validate", func() {
+		It("returns nil with correct settings", func() {
+			Expect(monitor.Validate()).To(BeNil())
+		})
+
+		It("verifies path and limits", func() {
+			config.Config.FilePath = "backup.done"
+			Expect(monitor.Validate().Error()).To(ContainSubstring("must be an absolute path"))
+
+			config.Config.FilePath = marker
+			config.Config.FileMinSize = 10
+			config.Config.FileMaxSize = 5
+			Expect(monitor.Validate().Error()).To(ContainSubstring("'file-min-size' (10) cannot exceed 'file-max-size' (5)"))
+		})
+	})
+
+	Context("fileCheck", func() {
+		It("verifies the file exists", func() {
+			start()
+			_, err := monitor.fileCheck()
+			Expect(err).To(BeNil())
+
+			config.Config.FilePath = filepath.Join(dir, "missing")
+			_, err = monitor.fileCheck()
+			Expect(err.Error()).To(ContainSubstring("does not exist"))
+		})
+
+		It("verifies the file age", func() {
+			config.Config.FileMaxAge = util.CustomDuration(24 * time.Hour)
+			start()
+			_, err := monitor.fileCheck()
+			Expect(err).To(BeNil())
+
+			old := time.Now().Add(-25 * time.Hour)
+			Expect(os.Chtimes(marker, old, old)).To(BeNil())
+
+			_, err = monitor.fileCheck()
+			Expect(err).NotTo(BeNil())
+			Expect(err.Error()).To(ContainSubstring("was last modified 25h0m0s ago"))
+			Expect(err.Error()).To(ContainSubstring("(allowed age: 24h0m0s)"))
+		})
+
+		It("verifies the file size", func() {
+			config.Config.FileMinSize = 100
+			start()
+			_, err := monitor.fileCheck()
+			Expect(err.Error()).To(ContainSubstring("is 24 bytes (expected at least 100 bytes)"))
+
+			config.Config.FileMinSize = 0
+			config.Config.FileMaxSize = 10
+			_, err = monitor.fileCheck()
+			Expect(err.Error()).To(ContainSubstring("expected at most 10 bytes"))
+		})
+
+		It("matches the contents against 'expect'", func() {
+			config.Config.Expect = "status=success"
+			start()
+			_, err := monitor.fileCheck()
+			Expect(err).To(BeNil())
+
+			config.Config.Expect = `size=\d+T`
+			config.Config.ExpectRegex = true
+			start()
+			_, err = monitor.fileCheck()
+			Expect(err.Error()).To(ContainSubstring("do not match regex size="))
+
+			config.Config.FilePath = dir
+			_, err = monitor.fileCheck()
+			Expect(err.Error()).To(ContainSubstring("is a directory"))
+		})
+	})
+})
@@ -0,0 +1,313 @@
+package monitor
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+const (
+	DEFAULT_GRPC_TIMEOUT = time.Duration(5) * time.Second
+
+	grpcHealthCheckPath = "/grpc.health.v1.Health/Check"
+	grpcMaxMessageSize  = 4 * 1024 * 1024
+)
+
+var (
+	// grpc.health.v1.HealthCheckResponse.ServingStatus
+	grpcServingStatuses = map[uint64]string{
+		0: "UNKNOWN",
+		1: "SERVING",
+		2: "NOT_SERVING",
+		3: "SERVICE_UNKNOWN",
+	}
+)
+
+type GRPCMonitor struct {
+	Base
+
+	Timeout time.Duration
+	Client  *http.Client
+}
+
+func NewGRPCMonitor(rmc *RootMonitorConfig) *GRPCMonitor {
+	g := &GRPCMonitor{
+		Base: Base{
+			RMC:        rmc,
+			Identifier: "grpc",
+		},
+		Timeout: DEFAULT_GRPC_TIMEOUT,
+	}
+
+	if rmc.Config.Timeout != 0 {
+		g.Timeout = time.Duration(rmc.Config.Timeout)
+	}
+
+	g.MonitorFunc = g.grpcCheck
+
+	return g
+}
+
+func (g *GRPCMonitor) Validate() error {
+	g.RMC.Log.WithField("configName", g.RMC.ConfigName).Debug("Performing monitor config validation")
+
+	if g.RMC.Config.Host == "" {
+		return errors.New("'host' must be set")
+	}
+
+	if g.RMC.Config.Port == 0 {
+		return errors.New("'port' must be set")
+	}
+
+	if g.Timeout >= time.Duration(g.RMC.Config.Interval) {
+		return fmt.Errorf("'timeout' (%v) cannot equal or exceed 'interval' (%v)", g.Timeout.String(), g.RMC.Config.Interval.String())
+	}
+
+	client, err := newGRPCClient(g.RMC.Config, g.Timeout)
+	if err != nil {
+		return err
+	}
+
+	g.Client = client
+
+	return nil
+}
+
+// gRPC runs over HTTP/2; use TLS (with ALPN) if 'tls' is set, otherwise
+// HTTP/2 with prior knowledge (h2c). HTTP/1.x is never attempted.
+func newGRPCClient(cfg *MonitorConfig, timeout time.Duration) (*http.Client, error) {
+	protocols := &http.Protocols{}
+
+	transport := &http.Transport{
+		DialContext:         (&net.Dialer{Timeout: timeout}).DialContext,
+		TLSHandshakeTimeout: timeout,
+		Protocols:           protocols,
+	}
+
+	if cfg.TCPTLS {
+		tlsConfig, err := newTLSClientConfig(cfg)
+		if err != nil {
+			return nil, err
+		}
+
+		transport.TLSClientConfig = tlsConfig
+		transport.ForceAttemptHTTP2 = true
+		protocols.SetHTTP2(true)
+	} else {
+		protocols.SetUnencryptedHTTP2(true)
+	}
+
+	return &http.Client{Timeout: timeout, Transport: transport}, nil
+}
+
+// Call grpc.health.v1.Health/Check for 'grpc-service' (blank = overall server
+// health) and verify that the service is SERVING
+func (g *GRPCMonitor) grpcCheck() (*CheckResult, error) {
+	if g.Client == nil {
+		client, err := newGRPCClient(g.RMC.Config, g.Timeout)
+		if err != nil {
+			return nil, err
+		}
+
+		g.Client = client
+	}
+
+	scheme := "http"
+	if g.RMC.Config.TCPTLS {
+		scheme = "https"
+	}
+
+	fullURL := (&url.URL{
+		Scheme: scheme,
+		Host:   net.JoinHostPort(g.RMC.Config.Host, strconv.Itoa(g.RMC.Config.Port)),
+		Path:   grpcHealthCheckPath,
+	}).String()
+
+	g.RMC.Log.WithField("url", fullURL).Debugf("Performing grpc health check for service '%v'", g.RMC.Config.GRPCService)
+
+	req, err := http.NewRequest("POST", fullURL, bytes.NewReader(grpcFrame(encodeHealthCheckRequest(g.RMC.Config.GRPCService))))
+	if err != nil {
+		return nil, fmt.Errorf("Unable to create request: %v", err.Error())
+	}
+
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("TE", "trailers")
+	req.Header.Set("grpc-timeout", strconv.FormatInt(g.Timeout.Nanoseconds()/int64(time.Millisecond), 10)+"m")
+	req.Header.Set("User-Agent", "9volt-grpc-health")
+
+	for name, value := range g.RMC.Config.HTTPHeaders {
+		req.Header.Set(name, value)
+	}
+
+	resp, err := g.Client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("Health check against %v failed: %v", fullURL, err.Error())
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Health check against %v failed: unexpected HTTP status %v", fullURL, resp.Status)
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, grpcMaxMessageSize))
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read health check response: %v", err.Error())
+	}
+
+	// Trailers are only populated once the body has been fully read; errors
+	// may also come back as a headers-only response
+	if err := grpcStatusError(resp); err != nil {
+		return nil, err
+	}
+
+	message, err := grpcUnframe(body)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to parse health check response: %v", err.Error())
+	}
+
+	status, err := decodeHealthCheckResponse(message)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to parse health check response: %v", err.Error())
+	}
+
+	if status != 1 {
+		name, ok := grpcServingStatuses[status]
+		if !ok {
+			name = strconv.FormatUint(status, 10)
+		}
+
+		return nil, fmt.Errorf("Service '%v' is not serving (status: %v)", g.RMC.Config.GRPCService, name)
+	}
+
+	return nil, nil
+}
+
+// Check 'grpc-status' from the trailers (or headers, for trailers-only responses)
+func grpcStatusError(resp *http.Response) error {
+	status := resp.Trailer.Get("grpc-status")
+	message := resp.Trailer.Get("grpc-message")
+
+	if status == "" {
+		status = resp.Header.Get("grpc-status")
+		message = resp.Header.Get("grpc-message")
+	}
+
+	if status == "" || status == "0" {
+		return nil
+	}
+
+	if unescaped, err := url.PathUnescape(message); err == nil {
+		message = unescaped
+	}
+
+	// 12 = UNIMPLEMENTED; the server does not implement the health checking protocol
+	if status == "12" {
+		return fmt.Errorf("Server does not implement grpc.health.v1.Health (grpc-status 12): %v", message)
+	}
+
+	return fmt.Errorf("Health check RPC failed (grpc-status %v): %v", status, message)
+}
+
+// Length-prefixed message framing (uncompressed)
+func grpcFrame(message []byte) []byte {
+	frame := make([]byte, 5, 5+len(message))
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(message)))
+
+	return append(frame, message...)
+}
+
+func grpcUnframe(data []byte) ([]byte, error) {
+	if len(data) < 5 {
+		return nil, errors.New("response too short")
+	}
+
+	if data[0] != 0 {
+		return nil, errors.New("compressed responses are not supported")
+	}
+
+	size := binary.BigEndian.Uint32(data[1:5])
+	if uint32(len(data)-5) < size {
+		return nil, errors.New("truncated response")
+	}
+
+	return data[5 : 5+size], nil
+}
+
+// HealthCheckRequest { string service = 1; }
+func encodeHealthCheckRequest(service string) []byte {
+	if service == "" {
+		return []byte{}
+	}
+
+	msg := []byte{0x0a}
+	msg = appendVarint(msg, uint64(len(service)))
+
+	return append(msg, service...)
+}
+
+// HealthCheckResponse { ServingStatus status = 1; }; unknown fields are skipped
+func decodeHealthCheckResponse(msg []byte) (uint64, error) {
+	var status uint64
+
+	for len(msg) > 0 {
+		key, n := binary.Uvarint(msg)
+		if n <= 0 {
+			return 0, errors.New("malformed field key")
+		}
+
+		msg = msg[n:]
+
+		switch key & 0x7 {
+		case 0: // varint
+			value, n := binary.Uvarint(msg)
+			if n <= 0 {
+				return 0, errors.New("malformed varint")
+			}
+
+			if key>>3 == 1 {
+				status = value
+			}
+
+			msg = msg[n:]
+		case 1: // 64-bit
+			if len(msg) < 8 {
+				return 0, errors.New("truncated field")
+			}
+
+			msg = msg[8:]
+		case 2: // length-delimited
+			size, n := binary.Uvarint(msg)
+			if n <= 0 || uint64(len(msg)-n) < size {
+				return 0, errors.New("truncated field")
+			}
+
+			msg = msg[n+int(size):]
+		case 5: // 32-bit
+			if len(msg) < 4 {
+				return 0, errors.New("truncated field")
+			}
+
+			msg = msg[4:]
+		default:
+			return 0, fmt.Errorf("unsupported wire type %v", key&0x7)
+		}
+	}
+
+	return status, nil
+}
+
+func appendVarint(buf []byte, value uint64) []byte {
+	tmp := make([]byte, binary.MaxVarintLen64)
+	n := binary.PutUvarint(tmp, value)
+
+	return append(buf, tmp[:n]...)
+}
@@ -0,0 +1,209 @@
+package monitor
+
+import (
+	"crypto/tls"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/9corp/9volt/util"
+)
+
+// Implements grpc.health.v1.Health/Check over HTTP/2; 'statuses' maps service
+// names to serving statuses, unknown services get NOT_FOUND
+func newTestGRPCHandler(statuses map[string]uint64) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		Expect(r.ProtoMajor).To(Equal(2))
+		Expect(r.Header.Get("Content-Type")).To(Equal("application/grpc"))
+
+		if r.URL.Path != grpcHealthCheckPath {
+			w.Header().Set("Content-Type", "application/grpc")
+			w.Header().Set("Grpc-Status", "12")
+			w.Header().Set("Grpc-Message", "unknown service grpc.health.v1.Health")
+			return
+		}
+
+		body, _ := ioutil.ReadAll(r.Body)
+		msg, err := grpcUnframe(body)
+		Expect(err).To(BeNil())
+
+		// HealthCheckRequest is either empty or a single (short) string field
+		service := ""
+		if len(msg) > 2 {
+			service = string(msg[2:])
+		}
+
+		if r.Header.Get("Authorization") != "" && r.Header.Get("Authorization") != "Bearer letmein" {
+			w.Header().Set("Content-Type", "application/grpc")
+			w.Header().Set("Grpc-Status", "16")
+			w.Header().Set("Grpc-Message", "bad token")
+			return
+		}
+
+		status, ok := statuses[service]
+		if !ok {
+			w.Header().Set("Content-Type", "application/grpc")
+			w.Header().Set("Grpc-Status", "5")
+			w.Header().Set("Grpc-Message", url.PathEscape("unknown service "+service))
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Header().Set("Trailer", "Grpc-Status")
+		w.Write(grpcFrame(appendVarint([]byte{0x08}, status)))
+		w.Header().Set("Grpc-Status", "0")
+	})
+}
+
+var _ = Describe("grpc_monitor", func() {
+	var (
+		monitor *GRPCMonitor
+		config  *RootMonitorConfig
+		server  *httptest.Server
+		caFile  string
+	)
+
+	statuses := map[string]uint64{"": 1, "db": 2}
+
+	start := func(useTLS bool) {
+		server = httptest.NewUnstartedServer(newTestGRPCHandler(statuses))
+
+		if useTLS {
+			caCert, leaf := generateTestCerts([]string{"beowulf"}, time.Now().Add(24*time.Hour))
+			caFile = writeTestCAFile(caCert)
+
+			server.TLS = &tls.Config{Certificates: []tls.Certificate{leaf}}
+			server.EnableHTTP2 = true
+			server.StartTLS()
+		} else {
+			server.Config.Protocols = &http.Protocols{}
+			server.Config.Protocols.SetUnencryptedHTTP2(true)
+			server.Start()
+		}
+
+		host, port, _ := net.SplitHostPort(server.Listener.Addr().String())
+		config.Config.Host = host
+		config.Config.Port, _ = strconv.Atoi(port)
+
+		monitor = NewGRPCMonitor(config)
+		Expect(monitor.Validate()).To(BeNil())
+	}
+
+	BeforeEach(func() {
+		caFile = ""
+
+		config = &RootMonitorConfig{
+			Config: &MonitorConfig{
+				Host:     "127.0.0.1",
+				Port:     50051,
+				Interval: util.CustomDuration(10 * time.Second),
+			},
+			Log: log.New(),
+		}
+
+		monitor = NewGRPCMonitor(config)
+	})
+
+	AfterEach(func() {
+		if server != nil {
+			server.Close()
+			server = nil
+		}
+
+		if caFile != "" {
+			os.Remove(caFile)
+		}
+	})
+
+	Context("Validate", func() {
+		It("returns nil with correct settings", func() {
+			Expect(monitor.Validate()).To(BeNil())
+			Expect(monitor.Timeout).To(Equal(DEFAULT_GRPC_TIMEOUT))
+			Expect(monitor.Client).NotTo(BeNil())
+		})
+
+		It("requires a port", func() {
+			config.Config.Port = 0
+			Expect(monitor.Validate().Error()).To(ContainSubstring("'port' must be set"))
+		})
+
+		It("bad timeouts", func() {
+			config.Config.Interval = util.CustomDuration(time.Second)
+			Expect(monitor.Validate().Error()).To(ContainSubstring("cannot equal or exceed"))
+		})
+	})
+
+	Context("grpcCheck", func() {
+		It("succeeds when the server is SERVING over h2c", func() {
+			start(false)
+			_, err := monitor.grpcCheck()
+			Expect(err).To(BeNil())
+		})
+
+		It("fails when the service is NOT_SERVING", func() {
+			config.Config.GRPCService = "db"
+			start(false)
+
+			_, err := monitor.grpcCheck()
+			Expect(err).NotTo(BeNil())
+			Expect(err.Error()).To(ContainSubstring("Service 'db' is not serving (status: NOT_SERVING)"))
+		})
+
+		It("reports grpc errors", func() {
+			config.Config.GRPCService = "cache"
+			start(false)
+
+			_, err := monitor.grpcCheck()
+			Expect(err).NotTo(BeNil())
+			Expect(err.Error()).To(ContainSubstring("grpc-status 5): unknown service cache"))
+		})
+
+		It("sends 'headers' as metadata", func() {
+			config.Config.HTTPHeaders = map[string]string{"Authorization": "Bearer nope"}
+			start(false)
+
+			_, err := monitor.grpcCheck()
+			Expect(err).NotTo(BeNil())
+			Expect(err.Error()).To(ContainSubstring("grpc-status 16"))
+
+			config.Config.HTTPHeaders["Authorization"] = "Bearer letmein"
+			_, err = monitor.grpcCheck()
+			Expect(err).To(BeNil())
+		})
+
+		It("supports TLS", func() {
+			config.Config.TCPTLS = true
+			config.Config.TLSServerName = "beowulf"
+			start(true)
+
+			_, err := monitor.grpcCheck()
+			Expect(err).NotTo(BeNil())
+			Expect(err.Error()).To(ContainSubstring("certificate"))
+
+			config.Config.TLSCAFile = caFile
+			Expect(monitor.Validate()).To(BeNil())
+			_, err = monitor.grpcCheck()
+			Expect(err).To(BeNil())
+		})
+
+		It("fails against plain HTTP/1.1 servers", func() {
+			server = httptest.NewServer(http.NotFoundHandler())
+
+			_, port, _ := net.SplitHostPort(server.Listener.Addr().String())
+			config.Config.Port, _ = strconv.Atoi(port)
+
+			Expect(monitor.Validate()).To(BeNil())
+			_, err := monitor.grpcCheck()
+			Expect(err).NotTo(BeNil())
+		})
+	})
+})
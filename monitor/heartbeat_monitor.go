@@ -0,0 +1,175 @@
+package monitor
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/coreos/etcd/client"
+
+	"github.com/9corp/9volt/dal"
+	"github.com/9corp/9volt/util"
+)
+
+const (
+	// Heartbeats are stored under this key (by config name) so that the member
+	// receiving a ping does not have to be the member running the check
+	HEARTBEAT_PREFIX = "heartbeat"
+
+	HEARTBEAT_STATUS_OK       = "ok"
+	HEARTBEAT_STATUS_WARNING  = "warning"
+	HEARTBEAT_STATUS_CRITICAL = "critical"
+
+	// Placeholder stored by the first run of a check, before any ping was
+	// received; not accepted via the API
+	HEARTBEAT_STATUS_PENDING = "pending"
+)
+
+var (
+	HeartbeatStatuses = []string{HEARTBEAT_STATUS_OK, HEARTBEAT_STATUS_WARNING, HEARTBEAT_STATUS_CRITICAL}
+)
+
+// A single ping received via the API
+type Heartbeat struct {
+	Date     time.Time `json:"date"`
+	Status   string    `json:"status"`
+	Message  string    `json:"message,omitempty"`
+	MemberID string    `json:"member_id"` // member that received the ping
+}
+
+type HeartbeatMonitor struct {
+	Base
+
+	Grace time.Duration
+}
+
+func NewHeartbeatMonitor(rmc *RootMonitorConfig) *HeartbeatMonitor {
+	h := &HeartbeatMonitor{
+		Base: Base{
+			RMC:        rmc,
+			Identifier: "heartbeat",
+		},
+		Grace: time.Duration(rmc.Config.HeartbeatGrace),
+	}
+
+	h.MonitorFunc = h.heartbeatCheck
+
+	return h
+}
+
+func (h *HeartbeatMonitor) Validate() error {
+	h.RMC.Log.WithField("configName", h.RMC.ConfigName).Debug("Performing monitor config validation")
+
+	if h.Grace < 0 {
+		return fmt.Errorf("'heartbeat-grace' (%v) cannot be negative", h.Grace.String())
+	}
+
+	if h.RMC.DalClient == nil {
+		return errors.New("No dal client available for fetching heartbeats (bug?)")
+	}
+
+	return nil
+}
+
+// Verify that a ping has been received within 'interval' + 'heartbeat-grace';
+// late (or missing) pings are counted against the thresholds. So is a ping
+// carrying a 'warning' or 'critical' status, although 'warning' never leads
+// past WARNING.
+//
+// The first run stores a 'pending' placeholder, so new checks get a chance to
+// receive their first ping; as it lives in etcd, the grace period is not reset
+// when the check moves to another member.
+func (h *HeartbeatMonitor) heartbeatCheck() (*CheckResult, error) {
+	heartbeat, err := h.fetchHeartbeat()
+	if err != nil {
+		return nil, fmt.Errorf("Unable to fetch last heartbeat: %v", err.Error())
+	}
+
+	maxAge := time.Duration(h.RMC.Config.Interval) + h.Grace
+
+	if heartbeat == nil {
+		if err := h.storePending(); err != nil {
+			return nil, fmt.Errorf("Unable to store pending heartbeat: %v", err.Error())
+		}
+
+		return nil, nil
+	}
+
+	if heartbeat.Status == HEARTBEAT_STATUS_PENDING {
+		if time.Since(heartbeat.Date) <= maxAge {
+			return nil, nil
+		}
+
+		return nil, fmt.Errorf("No heartbeat received since %v (expected at least every %v)",
+			heartbeat.Date.UTC().Format(time.RFC3339), maxAge)
+	}
+
+	if age := time.Since(heartbeat.Date); age > maxAge {
+		return nil, fmt.Errorf("Last heartbeat received %v ago at %v (expected at least every %v)",
+			age.Truncate(time.Second), heartbeat.Date.UTC().Format(time.RFC3339), maxAge)
+	}
+
+	switch heartbeat.Status {
+	case HEARTBEAT_STATUS_WARNING:
+		return nil, NewCappedWarningError("Last heartbeat reported warning: %v", heartbeat.Message)
+	case HEARTBEAT_STATUS_CRITICAL:
+		return nil, fmt.Errorf("Last heartbeat reported critical: %v", heartbeat.Message)
+	}
+
+	return &CheckResult{Output: heartbeat.Message}, nil
+}
+
+// Fetch the last heartbeat for this check; returns nil if none was received yet
+func (h *HeartbeatMonitor) fetchHeartbeat() (*Heartbeat, error) {
+	key := HEARTBEAT_PREFIX + "/" + h.RMC.ConfigName
+
+	data, err := h.RMC.DalClient.Get(key, nil)
+	if err != nil {
+		if h.RMC.DalClient.IsKeyNotFound(err) {
+			return nil, nil
+		}
+
+		return nil, err
+	}
+
+	var heartbeat *Heartbeat
+
+	if err := json.Unmarshal([]byte(data[key]), &heartbeat); err != nil {
+		return nil, fmt.Errorf("Unable to unmarshal heartbeat: %v", err.Error())
+	}
+
+	return heartbeat, nil
+}
+
+// Store a 'pending' placeholder unless another member (or a ping) beat us to it
+func (h *HeartbeatMonitor) storePending() error {
+	data, err := json.Marshal(&Heartbeat{
+		Date:     time.Now(),
+		Status:   HEARTBEAT_STATUS_PENDING,
+		MemberID: h.RMC.MemberID,
+	})
+	if err != nil {
+		return err
+	}
+
+	err = h.RMC.DalClient.Set(HEARTBEAT_PREFIX+"/"+h.RMC.ConfigName, string(data), &dal.SetOptions{PrevExist: string(client.PrevNoExist)})
+	if etcdErr, ok := err.(client.Error); ok && etcdErr.Code == client.ErrorCodeNodeExist {
+		return nil
+	}
+
+	return err
+}
+
+// Validate a ping status; blank defaults to 'ok'
+func ValidateHeartbeatStatus(status string) (string, error) {
+	if status == "" {
+		return HEARTBEAT_STATUS_OK, nil
+	}
+
+	if !util.StringSliceContains(HeartbeatStatuses, status) {
+		return "", fmt.Errorf("Unknown heartbeat status '%v' (supported: ok, warning, critical)", status)
+	}
+
+	return status, nil
+}
@@ -0,0 +1,168 @@
+package monitor
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/coreos/etcd/client"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/9corp/9volt/fakes/dalfakes"
+	"github.com/9corp/9volt/util"
+)
+
+var _ = Describe("heartbeat_monitor", func() {
+	var (
+		monitor *HeartbeatMonitor
+		config  *RootMonitorConfig
+		fakeDAL *dalfakes.FakeIDal
+	)
+
+	notFound := errors.New("key not found")
+
+	ping := func(age time.Duration, status, message string) {
+		data, _ := json.Marshal(&Heartbeat{
+			Date:     time.Now().Add(-age),
+			Status:   status,
+			Message:  message,
+			MemberID: "member-2",
+		})
+
+		fakeDAL.GetReturns(map[string]string{"heartbeat/nightly-backup": string(data)}, nil)
+	}
+
+	BeforeEach(func() {
+		fakeDAL = &dalfakes.FakeIDal{}
+		fakeDAL.GetReturns(nil, notFound)
+		fakeDAL.IsKeyNotFoundStub = func(err error) bool { return err == notFound }
+
+		config = &RootMonitorConfig{
+			ConfigName: "nightly-backup",
+			Config: &MonitorConfig{
+				Type:           "heartbeat",
+				Interval:       util.CustomDuration(time.Hour),
+				HeartbeatGrace: util.CustomDuration(10 * time.Minute),
+			},
+			DalClient: fakeDAL,
+			Log:       log.New(),
+		}
+
+		monitor = NewHeartbeatMonitor(config)
+	})
+
+	Context("Validate", func() {
+		It("returns nil with correct settings", func() {
+			Expect(monitor.Validate()).To(BeNil())
+			Expect(monitor.Grace).To(Equal(10 * time.Minute))
+		})
+
+		It("rejects a negative grace period", func() {
+			config.Config.HeartbeatGrace = util.CustomDuration(-time.Minute)
+			monitor = NewHeartbeatMonitor(config)
+			Expect(monitor.Validate().Error()).To(ContainSubstring("'heartbeat-grace' (-1m0s) cannot be negative"))
+		})
+
+		It("requires a dal client", func() {
+			config.DalClient = nil
+			Expect(monitor.Validate()).NotTo(BeNil())
+		})
+	})
+
+	Context("heartbeatCheck", func() {
+		It("fetches the heartbeat by config name", func() {
+			ping(time.Minute, HEARTBEAT_STATUS_OK, "")
+			_, err := monitor.heartbeatCheck()
+			Expect(err).To(BeNil())
+
+			key, _ := fakeDAL.GetArgsForCall(0)
+			Expect(key).To(Equal("heartbeat/nightly-backup"))
+		})
+
+		It("succeeds if the last ping is within 'interval' + 'heartbeat-grace'", func() {
+			ping(65*time.Minute, HEARTBEAT_STATUS_OK, "backed up 42 GB")
+			result, err := monitor.heartbeatCheck()
+			Expect(err).To(BeNil())
+			Expect(result.Output).To(Equal("backed up 42 GB"))
+		})
+
+		It("fails if the last ping is too old", func() {
+			ping(75*time.Minute, HEARTBEAT_STATUS_OK, "")
+
+			_, err := monitor.heartbeatCheck()
+			Expect(err).NotTo(BeNil())
+			Expect(err).NotTo(BeAssignableToTypeOf(&StateError{}))
+			Expect(err.Error()).To(ContainSubstring("Last heartbeat received 1h15m0s ago"))
+			Expect(err.Error()).To(ContainSubstring("expected at least every 1h10m0s"))
+		})
+
+		It("passes on the status reported by the ping", func() {
+			ping(time.Minute, HEARTBEAT_STATUS_WARNING, "backup took 5h")
+
+			_, err := monitor.heartbeatCheck()
+			Expect(err.(*StateError).State).To(Equal(WARNING))
+			Expect(err.(*StateError).Capped).To(BeTrue())
+			Expect(err.Error()).To(Equal("Last heartbeat reported warning: backup took 5h"))
+
+			ping(time.Minute, HEARTBEAT_STATUS_CRITICAL, "disk full")
+
+			_, err = monitor.heartbeatCheck()
+			Expect(err).NotTo(BeAssignableToTypeOf(&StateError{}))
+			Expect(err.Error()).To(Equal("Last heartbeat reported critical: disk full"))
+		})
+
+		It("gives new checks a chance to receive their first ping", func() {
+			_, err := monitor.heartbeatCheck()
+			Expect(err).To(BeNil())
+			Expect(fakeDAL.SetCallCount()).To(Equal(1))
+
+			key, data, opts := fakeDAL.SetArgsForCall(0)
+			Expect(key).To(Equal("heartbeat/nightly-backup"))
+			Expect(data).To(ContainSubstring(`"status":"pending"`))
+			Expect(opts.PrevExist).To(Equal("false"))
+
+			// Lost the race against another member (or a ping)
+			fakeDAL.SetReturns(client.Error{Code: client.ErrorCodeNodeExist})
+			_, err = monitor.heartbeatCheck()
+			Expect(err).To(BeNil())
+
+			ping(30*time.Minute, HEARTBEAT_STATUS_PENDING, "")
+			_, err = monitor.heartbeatCheck()
+			Expect(err).To(BeNil())
+
+			ping(2*time.Hour, HEARTBEAT_STATUS_PENDING, "")
+			_, err = monitor.heartbeatCheck()
+			Expect(err).NotTo(BeNil())
+			Expect(err.Error()).To(ContainSubstring("No heartbeat received since"))
+			Expect(fakeDAL.SetCallCount()).To(Equal(2))
+		})
+
+		It("fails if the pending heartbeat cannot be stored", func() {
+			fakeDAL.SetReturns(errors.New("etcd is down"))
+
+			_, err := monitor.heartbeatCheck()
+			Expect(err).NotTo(BeNil())
+			Expect(err.Error()).To(Equal("Unable to store pending heartbeat: etcd is down"))
+		})
+
+		It("fails if the heartbeat cannot be fetched", func() {
+			fakeDAL.GetReturns(nil, errors.New("etcd is down"))
+
+			_, err := monitor.heartbeatCheck()
+			Expect(err).NotTo(BeAssignableToTypeOf(&StateError{}))
+			Expect(err.Error()).To(ContainSubstring("etcd is down"))
+		})
+	})
+
+	Context("ValidateHeartbeatStatus", func() {
+		It("defaults to 'ok' and rejects unknown statuses", func() {
+			Expect(ValidateHeartbeatStatus("")).To(Equal(HEARTBEAT_STATUS_OK))
+			Expect(ValidateHeartbeatStatus("critical")).To(Equal(HEARTBEAT_STATUS_CRITICAL))
+
+			_, err := ValidateHeartbeatStatus("broken")
+			Expect(err).NotTo(BeNil())
+		})
+	})
+})
@@ -0,0 +1,377 @@
+package monitor
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/9corp/9volt/util"
+)
+
+const (
+	ASSERT_STATUS = "status"
+	ASSERT_HEADER = "header"
+	ASSERT_JSON   = "json"
+	ASSERT_BODY   = "body"
+)
+
+var (
+	assertionOperators = []string{"==", "!=", "<", "<=", ">", ">=", "regex", "!regex", "exists", "absent"}
+
+	jsonPathSegmentRegex = regexp.MustCompile(`^([^\[\]]*)((?:\[[^\]]*\])*)$`)
+	jsonPathIndexRegex   = regexp.MustCompile(`\[([^\]]*)\]`)
+)
+
+// A single assertion on an HTTP response
+type HTTPAssertion struct {
+	Type     string `json:"type"`               // 'status', 'header', 'json', 'body'
+	Name     string `json:"name,omitempty"`     // header name ('header' only)
+	Path     string `json:"path,omitempty"`     // ie. '$.db' or 'checks[0].status' ('json' only)
+	Operator string `json:"operator,omitempty"` // '==', '!=', '<', '<=', '>', '>=', 'regex', '!regex', 'exists', 'absent'
+	Value    string `json:"value,omitempty"`    // for 'status' a list of codes and ranges, ie. '200-299,301'
+}
+
+// Fill in the default operator for an assertion
+func (a *HTTPAssertion) operator() string {
+	if a.Operator != "" {
+		return a.Operator
+	}
+
+	switch a.Type {
+	case ASSERT_HEADER:
+		if a.Value == "" {
+			return "exists"
+		}
+
+		return "regex"
+	case ASSERT_BODY:
+		return "regex"
+	}
+
+	return "=="
+}
+
+func (a *HTTPAssertion) String() string {
+	switch a.Type {
+	case ASSERT_STATUS:
+		return fmt.Sprintf("status in [%v]", a.Value)
+	case ASSERT_HEADER:
+		return fmt.Sprintf("header '%v' %v '%v'", a.Name, a.operator(), a.Value)
+	case ASSERT_JSON:
+		return fmt.Sprintf("json '%v' %v '%v'", a.Path, a.operator(), a.Value)
+	}
+
+	return fmt.Sprintf("body %v '%v'", a.operator(), a.Value)
+}
+
+// Verify that all assertions are well formed
+func validateHTTPAssertions(assertions []*HTTPAssertion) error {
+	for i, a := range assertions {
+		if a == nil {
+			return fmt.Errorf("Assertion #%v is empty", i+1)
+		}
+
+		switch a.Type {
+		case ASSERT_STATUS:
+			if _, err := parseStatusRanges(a.Value); err != nil {
+				return fmt.Errorf("Assertion #%v: %v", i+1, err.Error())
+			}
+
+			continue
+		case ASSERT_HEADER:
+			if a.Name == "" {
+				return fmt.Errorf("Assertion #%v: 'name' cannot be blank for header assertions", i+1)
+			}
+		case ASSERT_JSON:
+			if _, err := parseJSONPath(a.Path); err != nil {
+				return fmt.Errorf("Assertion #%v: %v", i+1, err.Error())
+			}
+		case ASSERT_BODY:
+		default:
+			return fmt.Errorf("Assertion #%v: unknown type '%v'", i+1, a.Type)
+		}
+
+		if !util.StringSliceContains(assertionOperators, a.operator()) {
+			return fmt.Errorf("Assertion #%v: unknown operator '%v'", i+1, a.Operator)
+		}
+
+		if a.operator() == "regex" || a.operator() == "!regex" {
+			if _, err := regexp.Compile(a.Value); err != nil {
+				return fmt.Errorf("Assertion #%v: unable to compile regex: %v", i+1, err.Error())
+			}
+		}
+	}
+
+	return nil
+}
+
+// Evaluate all assertions against a response; first failing assertion wins
+func evaluateHTTPAssertions(assertions []*HTTPAssertion, resp *http.Response, body []byte) error {
+	var parsedBody interface{}
+	var parseErr error
+
+	bodyParsed := false
+
+	for _, a := range assertions {
+		switch a.Type {
+		case ASSERT_STATUS:
+			ranges, err := parseStatusRanges(a.Value)
+			if err != nil {
+				return err
+			}
+
+			if !statusInRanges(resp.StatusCode, ranges) {
+				return fmt.Errorf("Received status code '%v' is not in accepted status codes '%v'", resp.StatusCode, a.Value)
+			}
+		case ASSERT_HEADER:
+			values, ok := resp.Header[http.CanonicalHeaderKey(a.Name)]
+
+			if err := compareValue(a.operator(), a.Value, strings.Join(values, ", "), ok); err != nil {
+				return fmt.Errorf("Assertion %v failed: %v", a, err.Error())
+			}
+		case ASSERT_JSON:
+			if !bodyParsed {
+				parseErr = json.Unmarshal(body, &parsedBody)
+				bodyParsed = true
+			}
+
+			if parseErr != nil {
+				return fmt.Errorf("Unable to parse response body as JSON for assertion %v: %v", a, parseErr.Error())
+			}
+
+			value, found, err := jsonPathLookup(parsedBody, a.Path)
+			if err != nil {
+				return fmt.Errorf("Assertion %v failed: %v", a, err.Error())
+			}
+
+			if err := compareValue(a.operator(), a.Value, jsonValueString(value), found); err != nil {
+				return fmt.Errorf("Assertion %v failed: %v", a, err.Error())
+			}
+		case ASSERT_BODY:
+			if err := compareValue(a.operator(), a.Value, string(body), true); err != nil {
+				return fmt.Errorf("Assertion %v failed: %v", a, err.Error())
+			}
+		default:
+			return fmt.Errorf("Unknown assertion type '%v'", a.Type)
+		}
+	}
+
+	return nil
+}
+
+// Compare 'actual' against the expected value using 'operator'; numeric comparison
+// is used if both sides are numbers, string comparison otherwise.
+func compareValue(operator, expected, actual string, found bool) error {
+	switch operator {
+	case "exists":
+		if !found {
+			return errors.New("value not found")
+		}
+
+		return nil
+	case "absent":
+		if found {
+			return fmt.Errorf("value '%v' is present", actual)
+		}
+
+		return nil
+	}
+
+	if !found {
+		return errors.New("value not found")
+	}
+
+	switch operator {
+	case "regex", "!regex":
+		re, err := regexp.Compile(expected)
+		if err != nil {
+			return fmt.Errorf("unable to compile regex: %v", err.Error())
+		}
+
+		if re.MatchString(actual) != (operator == "regex") {
+			return fmt.Errorf("got '%v'", actual)
+		}
+
+		return nil
+	}
+
+	actualNum, actualErr := strconv.ParseFloat(actual, 64)
+	expectedNum, expectedErr := strconv.ParseFloat(expected, 64)
+
+	var cmp int
+
+	if actualErr == nil && expectedErr == nil {
+		switch {
+		case actualNum < expectedNum:
+			cmp = -1
+		case actualNum > expectedNum:
+			cmp = 1
+		}
+	} else {
+		cmp = strings.Compare(actual, expected)
+	}
+
+	ok := map[string]bool{
+		"==": cmp == 0,
+		"!=": cmp != 0,
+		"<":  cmp < 0,
+		"<=": cmp <= 0,
+		">":  cmp > 0,
+		">=": cmp >= 0,
+	}[operator]
+
+	if !ok {
+		return fmt.Errorf("got '%v'", actual)
+	}
+
+	return nil
+}
+
+// Parse a status code list such as '200-299,301' into [from, to] pairs
+func parseStatusRanges(value string) ([][2]int, error) {
+	var ranges [][2]int
+
+	if strings.TrimSpace(value) == "" {
+		return nil, errors.New("'value' cannot be blank for status assertions")
+	}
+
+	for _, part := range strings.Split(value, ",") {
+		bounds := strings.SplitN(strings.TrimSpace(part), "-", 2)
+
+		from, err := strconv.Atoi(strings.TrimSpace(bounds[0]))
+		if err != nil {
+			return nil, fmt.Errorf("invalid status code '%v'", part)
+		}
+
+		to := from
+
+		if len(bounds) == 2 {
+			if to, err = strconv.Atoi(strings.TrimSpace(bounds[1])); err != nil || to < from {
+				return nil, fmt.Errorf("invalid status code range '%v'", part)
+			}
+		}
+
+		ranges = append(ranges, [2]int{from, to})
+	}
+
+	return ranges, nil
+}
+
+func statusInRanges(statusCode int, ranges [][2]int) bool {
+	for _, r := range ranges {
+		if statusCode >= r[0] && statusCode <= r[1] {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Parse a JSONPath-style selector (ie. '$.checks[0].status', 'db', '$["a.b"]')
+// into a list of object keys (strings) and array indexes (ints)
+func parseJSONPath(path string) ([]interface{}, error) {
+	var segments []interface{}
+
+	path = strings.TrimPrefix(strings.TrimSpace(path), "$")
+	if path == "" {
+		return nil, errors.New("'path' cannot be blank for json assertions")
+	}
+
+	for _, part := range splitJSONPath(strings.TrimPrefix(path, ".")) {
+		match := jsonPathSegmentRegex.FindStringSubmatch(part)
+		if match == nil {
+			return nil, fmt.Errorf("invalid json path segment '%v'", part)
+		}
+
+		if match[1] != "" {
+			segments = append(segments, match[1])
+		}
+
+		for _, idx := range jsonPathIndexRegex.FindAllStringSubmatch(match[2], -1) {
+			// Quoted keys; ie. ["some.key"]
+			if len(idx[1]) >= 2 && (idx[1][0] == '"' || idx[1][0] == '\'') && idx[1][len(idx[1])-1] == idx[1][0] {
+				segments = append(segments, idx[1][1:len(idx[1])-1])
+				continue
+			}
+
+			n, err := strconv.Atoi(idx[1])
+			if err != nil || n < 0 {
+				return nil, fmt.Errorf("invalid array index '%v' in json path", idx[1])
+			}
+
+			segments = append(segments, n)
+		}
+	}
+
+	return segments, nil
+}
+
+// Split a path on dots that are not inside brackets
+func splitJSONPath(path string) []string {
+	var parts []string
+
+	depth, start := 0, 0
+
+	for i, r := range path {
+		switch r {
+		case '[':
+			depth++
+		case ']':
+			depth--
+		case '.':
+			if depth == 0 {
+				parts = append(parts, path[start:i])
+				start = i + 1
+			}
+		}
+	}
+
+	return append(parts, path[start:])
+}
+
+// Walk decoded JSON data; second return value is false if the path does not exist
+func jsonPathLookup(data interface{}, path string) (interface{}, bool, error) {
+	segments, err := parseJSONPath(path)
+	if err != nil {
+		return nil, false, err
+	}
+
+	current := data
+
+	for _, segment := range segments {
+		switch s := segment.(type) {
+		case string:
+			obj, ok := current.(map[string]interface{})
+			if !ok {
+				return nil, false, nil
+			}
+
+			if current, ok = obj[s]; !ok {
+				return nil, false, nil
+			}
+		case int:
+			arr, ok := current.([]interface{})
+			if !ok || s >= len(arr) {
+				return nil, false, nil
+			}
+
+			current = arr[s]
+		}
+	}
+
+	return current, true, nil
+}
+
+// Strings are used as-is, everything else is compared in its JSON form
+func jsonValueString(value interface{}) string {
+	if s, ok := value.(string); ok {
+		return s
+	}
+
+	data, _ := json.Marshal(value)
+	return string(data)
+}
@@ -0,0 +1,121 @@
+package monitor
+
+import (
+	"net/http"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("http_assertions", func() {
+	var resp *http.Response
+
+	body := []byte(`{"db": "ok", "queue_depth": 12, "checks": [{"name": "redis", "status": "degraded"}], "a.b": true}`)
+
+	BeforeEach(func() {
+		resp = &http.Response{
+			StatusCode: 201,
+			Header: http.Header{
+				"Content-Type":  []string{"application/json; charset=utf-8"},
+				"Cache-Control": []string{"no-cache"},
+			},
+		}
+	})
+
+	Context("validateHTTPAssertions", func() {
+		It("returns nil with valid assertions", func() {
+			Expect(validateHTTPAssertions([]*HTTPAssertion{
+				{Type: "status", Value: "200-299, 304"},
+				{Type: "header", Name: "Content-Type", Value: "json"},
+				{Type: "json", Path: "$.checks[0].status", Operator: "!=", Value: "down"},
+				{Type: "body", Value: "^{"},
+			})).To(BeNil())
+		})
+
+		It("errors with unknown type", func() {
+			err := validateHTTPAssertions([]*HTTPAssertion{{Type: "xml"}})
+			Expect(err).NotTo(BeNil())
+			Expect(err.Error()).To(ContainSubstring("unknown type 'xml'"))
+		})
+
+		It("errors with unknown operator", func() {
+			err := validateHTTPAssertions([]*HTTPAssertion{{Type: "body", Operator: "~="}})
+			Expect(err).NotTo(BeNil())
+			Expect(err.Error()).To(ContainSubstring("unknown operator"))
+		})
+
+		It("errors with bad status ranges", func() {
+			err := validateHTTPAssertions([]*HTTPAssertion{{Type: "status", Value: "299-200"}})
+			Expect(err).NotTo(BeNil())
+			Expect(err.Error()).To(ContainSubstring("invalid status code range"))
+		})
+
+		It("errors with bad regex", func() {
+			err := validateHTTPAssertions([]*HTTPAssertion{{Type: "header", Name: "Server", Value: "["}})
+			Expect(err).NotTo(BeNil())
+			Expect(err.Error()).To(ContainSubstring("unable to compile regex"))
+		})
+
+		It("errors with bad json path", func() {
+			err := validateHTTPAssertions([]*HTTPAssertion{{Type: "json", Path: "checks[x]"}})
+			Expect(err).NotTo(BeNil())
+			Expect(err.Error()).To(ContainSubstring("invalid array index"))
+		})
+	})
+
+	Context("evaluateHTTPAssertions", func() {
+		It("passes when all assertions match", func() {
+			Expect(evaluateHTTPAssertions([]*HTTPAssertion{
+				{Type: "status", Value: "200-204"},
+				{Type: "header", Name: "content-type", Value: "^application/json"},
+				{Type: "header", Name: "X-Debug", Operator: "absent"},
+				{Type: "json", Path: "$.db", Value: "ok"},
+				{Type: "json", Path: "queue_depth", Operator: "<=", Value: "12"},
+				{Type: "json", Path: `$["a.b"]`, Value: "true"},
+				{Type: "json", Path: "$.checks[0].status", Operator: "regex", Value: "^(ok|degraded)$"},
+				{Type: "body", Operator: "!regex", Value: "panic"},
+			}, resp, body)).To(BeNil())
+		})
+
+		It("fails when status is out of range", func() {
+			err := evaluateHTTPAssertions([]*HTTPAssertion{{Type: "status", Value: "200,202-299"}}, resp, body)
+			Expect(err).NotTo(BeNil())
+			Expect(err.Error()).To(ContainSubstring("not in accepted status codes"))
+		})
+
+		It("fails when a forbidden header is present", func() {
+			err := evaluateHTTPAssertions([]*HTTPAssertion{{Type: "header", Name: "Cache-Control", Operator: "absent"}}, resp, body)
+			Expect(err).NotTo(BeNil())
+			Expect(err.Error()).To(ContainSubstring("value 'no-cache' is present"))
+		})
+
+		It("fails when a required header is missing", func() {
+			err := evaluateHTTPAssertions([]*HTTPAssertion{{Type: "header", Name: "ETag"}}, resp, body)
+			Expect(err).NotTo(BeNil())
+			Expect(err.Error()).To(ContainSubstring("value not found"))
+		})
+
+		It("compares numbers numerically", func() {
+			err := evaluateHTTPAssertions([]*HTTPAssertion{{Type: "json", Path: "$.queue_depth", Operator: ">", Value: "9"}}, resp, body)
+			Expect(err).To(BeNil())
+		})
+
+		It("fails when a json path does not exist", func() {
+			err := evaluateHTTPAssertions([]*HTTPAssertion{{Type: "json", Path: "$.checks[3].name", Value: "redis"}}, resp, body)
+			Expect(err).NotTo(BeNil())
+			Expect(err.Error()).To(ContainSubstring("value not found"))
+		})
+
+		It("fails when body is not json", func() {
+			err := evaluateHTTPAssertions([]*HTTPAssertion{{Type: "json", Path: "$.db", Value: "ok"}}, resp, []byte("<html>"))
+			Expect(err).NotTo(BeNil())
+			Expect(err.Error()).To(ContainSubstring("Unable to parse response body as JSON"))
+		})
+
+		It("fails when body does not match regex", func() {
+			err := evaluateHTTPAssertions([]*HTTPAssertion{{Type: "body", Value: `"db":\s*"down"`}}, resp, body)
+			Expect(err).NotTo(BeNil())
+			Expect(err.Error()).To(ContainSubstring("body regex"))
+		})
+	})
+})
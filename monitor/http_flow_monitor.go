@@ -0,0 +1,309 @@
+package monitor
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/cookiejar"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/9corp/9volt/util"
+)
+
+const (
+	DEFAULT_HTTP_FLOW_TIMEOUT = time.Duration(10) * time.Second
+
+	EXTRACT_COOKIE = "cookie"
+	EXTRACT_HEADER = "header"
+	EXTRACT_JSON   = "json"
+	EXTRACT_REGEX  = "regex"
+)
+
+var flowVariableRegex = regexp.MustCompile(`{{\s*([A-Za-z0-9_.-]+)\s*}}`)
+
+// A single request in an 'http-flow' monitor
+type HTTPFlowStep struct {
+	Name        string            `json:"name,omitempty"`
+	URL         string            `json:"url"` // path (combined with 'ssl', 'host', 'port') or full URL
+	Method      string            `json:"method,omitempty"`
+	Headers     map[string]string `json:"headers,omitempty"` // merged with (and override) monitor 'headers'
+	RequestBody string            `json:"request-body,omitempty"`
+	StatusCode  int               `json:"status-code,omitempty"`
+	Expect      string            `json:"expect,omitempty"`
+	Assertions  []*HTTPAssertion  `json:"assertions,omitempty"`
+	Extract     []*HTTPExtraction `json:"extract,omitempty"`
+}
+
+// Pull a value out of a response into a flow variable
+type HTTPExtraction struct {
+	Variable string `json:"variable"`
+	Type     string `json:"type"`            // 'cookie', 'header', 'json', 'regex'
+	Name     string `json:"name,omitempty"`  // cookie or header name
+	Path     string `json:"path,omitempty"`  // json path
+	Regex    string `json:"regex,omitempty"` // first capture group (or full match) is used
+}
+
+type HTTPFlowMonitor struct {
+	Base
+
+	Timeout time.Duration
+}
+
+func NewHTTPFlowMonitor(rmc *RootMonitorConfig) *HTTPFlowMonitor {
+	h := &HTTPFlowMonitor{
+		Base: Base{
+			RMC:        rmc,
+			Identifier: "http-flow",
+		},
+		Timeout: DEFAULT_HTTP_FLOW_TIMEOUT,
+	}
+
+	if rmc.Config.Timeout != util.CustomDuration(0) {
+		h.Timeout = time.Duration(rmc.Config.Timeout)
+	}
+
+	h.MonitorFunc = h.httpFlowCheck
+
+	return h
+}
+
+func (h *HTTPFlowMonitor) Validate() error {
+	h.RMC.Log.WithField("configName", h.RMC.ConfigName).Debug("Performing monitor config validation")
+
+	if len(h.RMC.Config.HTTPFlowSteps) == 0 {
+		return errors.New("'steps' must contain at least one step")
+	}
+
+	for i, step := range h.RMC.Config.HTTPFlowSteps {
+		if step == nil || step.URL == "" {
+			return fmt.Errorf("Step #%v: 'url' cannot be blank", i+1)
+		}
+
+		if err := validateHTTPAssertions(step.Assertions); err != nil {
+			return fmt.Errorf("Step #%v: %v", i+1, err.Error())
+		}
+
+		for j, e := range step.Extract {
+			if err := validateHTTPExtraction(e); err != nil {
+				return fmt.Errorf("Step #%v: extraction #%v: %v", i+1, j+1, err.Error())
+			}
+		}
+	}
+
+	if err := validateHTTPRequestOptions(h.RMC.Config); err != nil {
+		return err
+	}
+
+	if _, err := newHTTPClient(h.RMC.Config, h.Timeout); err != nil {
+		return err
+	}
+
+	if h.Timeout >= time.Duration(h.RMC.Config.Interval) {
+		return fmt.Errorf("'timeout' (%v) cannot equal or exceed 'interval' (%v)", h.Timeout.String(), h.RMC.Config.Interval.String())
+	}
+
+	return nil
+}
+
+// Run all steps in order, sharing cookies and extracted variables between them;
+// the whole flow must complete within 'timeout'.
+func (h *HTTPFlowMonitor) httpFlowCheck() (*CheckResult, error) {
+	h.RMC.Log.WithField("steps", len(h.RMC.Config.HTTPFlowSteps)).Debug("Performing http flow check")
+
+	client, err := newHTTPClient(h.RMC.Config, h.Timeout)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to create HTTP client for http-flow check: %v", err.Error())
+	}
+
+	// Fresh session on every run
+	client.Jar, _ = cookiejar.New(nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), h.Timeout)
+	defer cancel()
+
+	variables := make(map[string]string)
+	start := time.Now()
+
+	for i, step := range h.RMC.Config.HTTPFlowSteps {
+		if err := h.runStep(ctx, client, step, variables); err != nil {
+			return nil, fmt.Errorf("Step #%v (%v) failed: %v", i+1, stepName(step), err.Error())
+		}
+	}
+
+	return nil, checkResponseTime(time.Since(start), h.RMC.Config.HTTPWarningTime, h.RMC.Config.HTTPCriticalTime)
+}
+
+func (h *HTTPFlowMonitor) runStep(ctx context.Context, client *http.Client, step *HTTPFlowStep, variables map[string]string) error {
+	method := step.Method
+	if method == "" {
+		method = "GET"
+	}
+
+	fullURL := buildHTTPURL(h.RMC.Config, substituteVariables(step.URL, variables))
+
+	req, err := http.NewRequest(method, fullURL, strings.NewReader(substituteVariables(step.RequestBody, variables)))
+	if err != nil {
+		return fmt.Errorf("unable to create request: %v", err.Error())
+	}
+
+	req = req.WithContext(ctx)
+
+	applyHTTPRequestOptions(req, h.RMC.Config)
+
+	for k, v := range step.Headers {
+		req.Header.Set(k, substituteVariables(v, variables))
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("'%v %v' request failed: %v", method, fullURL, err.Error())
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("unable to read response body: %v", err.Error())
+	}
+
+	if step.StatusCode != 0 && resp.StatusCode != step.StatusCode {
+		return fmt.Errorf("received status code '%v' does not match expected status code '%v'", resp.StatusCode, step.StatusCode)
+	}
+
+	if step.Expect != "" && !strings.Contains(string(body), substituteVariables(step.Expect, variables)) {
+		return fmt.Errorf("response body does not contain expected content '%v'", step.Expect)
+	}
+
+	if err := evaluateHTTPAssertions(substituteAssertions(step.Assertions, variables), resp, body); err != nil {
+		return err
+	}
+
+	for _, e := range step.Extract {
+		value, err := extractValue(e, client, req, resp, body)
+		if err != nil {
+			return fmt.Errorf("unable to extract '%v': %v", e.Variable, err.Error())
+		}
+
+		variables[e.Variable] = value
+	}
+
+	return nil
+}
+
+func stepName(step *HTTPFlowStep) string {
+	if step.Name != "" {
+		return step.Name
+	}
+
+	return step.URL
+}
+
+func validateHTTPExtraction(e *HTTPExtraction) error {
+	if e == nil || e.Variable == "" {
+		return errors.New("'variable' cannot be blank")
+	}
+
+	switch e.Type {
+	case EXTRACT_COOKIE, EXTRACT_HEADER:
+		if e.Name == "" {
+			return fmt.Errorf("'name' cannot be blank for %v extractions", e.Type)
+		}
+	case EXTRACT_JSON:
+		if _, err := parseJSONPath(e.Path); err != nil {
+			return err
+		}
+	case EXTRACT_REGEX:
+		if _, err := regexp.Compile(e.Regex); err != nil {
+			return fmt.Errorf("unable to compile regex: %v", err.Error())
+		}
+	default:
+		return fmt.Errorf("unknown type '%v'", e.Type)
+	}
+
+	return nil
+}
+
+// Fetch a value from a response (or the cookie jar) according to an extraction
+func extractValue(e *HTTPExtraction, client *http.Client, req *http.Request, resp *http.Response, body []byte) (string, error) {
+	switch e.Type {
+	case EXTRACT_COOKIE:
+		for _, cookie := range client.Jar.Cookies(req.URL) {
+			if cookie.Name == e.Name {
+				return cookie.Value, nil
+			}
+		}
+
+		return "", fmt.Errorf("cookie '%v' not set", e.Name)
+	case EXTRACT_HEADER:
+		value := resp.Header.Get(e.Name)
+		if value == "" {
+			return "", fmt.Errorf("header '%v' not present", e.Name)
+		}
+
+		return value, nil
+	case EXTRACT_JSON:
+		var data interface{}
+
+		if err := json.Unmarshal(body, &data); err != nil {
+			return "", fmt.Errorf("unable to parse response body as JSON: %v", err.Error())
+		}
+
+		value, found, err := jsonPathLookup(data, e.Path)
+		if err != nil {
+			return "", err
+		}
+
+		if !found {
+			return "", fmt.Errorf("json path '%v' not found", e.Path)
+		}
+
+		return jsonValueString(value), nil
+	case EXTRACT_REGEX:
+		re, err := regexp.Compile(e.Regex)
+		if err != nil {
+			return "", err
+		}
+
+		match := re.FindSubmatch(body)
+		if match == nil {
+			return "", fmt.Errorf("regex '%v' did not match", e.Regex)
+		}
+
+		if len(match) > 1 {
+			return string(match[1]), nil
+		}
+
+		return string(match[0]), nil
+	}
+
+	return "", fmt.Errorf("unknown type '%v'", e.Type)
+}
+
+// Replace '{{ variable }}' references; unknown variables are left untouched
+func substituteVariables(s string, variables map[string]string) string {
+	return flowVariableRegex.ReplaceAllStringFunc(s, func(ref string) string {
+		name := flowVariableRegex.FindStringSubmatch(ref)[1]
+
+		if value, ok := variables[name]; ok {
+			return value
+		}
+
+		return ref
+	})
+}
+
+func substituteAssertions(assertions []*HTTPAssertion, variables map[string]string) []*HTTPAssertion {
+	substituted := make([]*HTTPAssertion, 0, len(assertions))
+
+	for _, a := range assertions {
+		copied := *a
+		copied.Value = substituteVariables(a.Value, variables)
+		substituted = append(substituted, &copied)
+	}
+
+	return substituted
+}
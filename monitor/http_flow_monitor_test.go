@@ -0,0 +1,174 @@
+package monitor
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/9corp/9volt/util"
+)
+
+var _ = Describe("http_flow_monitor", func() {
+	var (
+		monitor *HTTPFlowMonitor
+		config  *RootMonitorConfig
+		server  *httptest.Server
+	)
+
+	BeforeEach(func() {
+		// TLS server so that the custom (non-mocked) transport is used
+		server = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/login":
+				http.SetCookie(w, &http.Cookie{Name: "session", Value: "s3ss10n"})
+				w.Header().Set("X-Request-Id", "req-1")
+				fmt.Fprint(w, `{"token": "t0k3n", "user": {"id": 42}}`)
+			case "/api/users/42":
+				cookie, err := r.Cookie("session")
+				if err != nil || cookie.Value != "s3ss10n" || r.Header.Get("Authorization") != "Bearer t0k3n" {
+					w.WriteHeader(http.StatusUnauthorized)
+					return
+				}
+
+				fmt.Fprint(w, `{"name": "beowulf", "request": "`+r.Header.Get("X-Parent-Request")+`"}`)
+			default:
+				w.WriteHeader(http.StatusNotFound)
+			}
+		}))
+
+		config = &RootMonitorConfig{
+			Config: &MonitorConfig{
+				Interval:              util.CustomDuration(15 * time.Second),
+				TLSInsecureSkipVerify: true,
+				HTTPFlowSteps: []*HTTPFlowStep{
+					{
+						Name:       "login",
+						URL:        server.URL + "/login",
+						Method:     "POST",
+						StatusCode: 200,
+						Extract: []*HTTPExtraction{
+							{Variable: "token", Type: "json", Path: "$.token"},
+							{Variable: "user_id", Type: "regex", Regex: `"id":\s*(\d+)`},
+							{Variable: "session", Type: "cookie", Name: "session"},
+							{Variable: "request_id", Type: "header", Name: "X-Request-Id"},
+						},
+					},
+					{
+						Name: "fetch user",
+						URL:  server.URL + "/api/users/{{user_id}}",
+						Headers: map[string]string{
+							"Authorization":    "Bearer {{ token }}",
+							"X-Parent-Request": "{{request_id}}",
+						},
+						StatusCode: 200,
+						Assertions: []*HTTPAssertion{
+							{Type: "json", Path: "$.name", Value: "beowulf"},
+							{Type: "json", Path: "$.request", Value: "{{request_id}}"},
+						},
+					},
+				},
+			},
+			Log: log.New(),
+		}
+
+		monitor = NewHTTPFlowMonitor(config)
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	Context("NewHTTPFlowMonitor", func() {
+		It("returns a properly configured instance with defaults", func() {
+			Expect(monitor.Timeout).To(Equal(DEFAULT_HTTP_FLOW_TIMEOUT))
+			Expect(monitor.MonitorFunc).NotTo(BeNil())
+		})
+	})
+
+	Context("Validate", func() {
+		It("returns nil with correct settings", func() {
+			Expect(monitor.Validate()).To(BeNil())
+		})
+
+		It("errors without steps", func() {
+			config.Config.HTTPFlowSteps = nil
+			err := monitor.Validate()
+
+			Expect(err).NotTo(BeNil())
+			Expect(err.Error()).To(ContainSubstring("at least one step"))
+		})
+
+		It("errors with bad extraction", func() {
+			config.Config.HTTPFlowSteps[0].Extract[1].Regex = "("
+			err := monitor.Validate()
+
+			Expect(err).NotTo(BeNil())
+			Expect(err.Error()).To(ContainSubstring("Step #1: extraction #2"))
+		})
+
+		It("errors with bad assertion", func() {
+			config.Config.HTTPFlowSteps[1].Assertions[0].Type = "xpath"
+			err := monitor.Validate()
+
+			Expect(err).NotTo(BeNil())
+			Expect(err.Error()).To(ContainSubstring("Step #2: Assertion #1"))
+		})
+
+		It("errors with bad timeouts", func() {
+			config.Config.Interval = util.CustomDuration(10 * time.Second)
+			err := monitor.Validate()
+
+			Expect(err).NotTo(BeNil())
+			Expect(err.Error()).To(ContainSubstring("cannot equal or exceed"))
+		})
+	})
+
+	Context("httpFlowCheck", func() {
+		It("succeeds when all steps succeed", func() {
+			_, err := monitor.httpFlowCheck()
+			Expect(err).To(BeNil())
+		})
+
+		It("reports the failing step", func() {
+			config.Config.HTTPFlowSteps[1].Assertions[0].Value = "grendel"
+			_, err := monitor.httpFlowCheck()
+
+			Expect(err).NotTo(BeNil())
+			Expect(err.Error()).To(ContainSubstring("Step #2 (fetch user) failed"))
+			Expect(err.Error()).To(ContainSubstring("got 'beowulf'"))
+		})
+
+		It("reports failed extractions", func() {
+			config.Config.HTTPFlowSteps[0].Extract[0].Path = "$.access_token"
+			_, err := monitor.httpFlowCheck()
+
+			Expect(err).NotTo(BeNil())
+			Expect(err.Error()).To(ContainSubstring("Step #1 (login) failed: unable to extract 'token'"))
+		})
+
+		It("does not share sessions between runs", func() {
+			_, err := monitor.httpFlowCheck()
+			Expect(err).To(BeNil())
+
+			config.Config.HTTPFlowSteps = config.Config.HTTPFlowSteps[1:]
+			config.Config.HTTPFlowSteps[0].URL = server.URL + "/api/users/42"
+			config.Config.HTTPFlowSteps[0].Headers = map[string]string{"Authorization": "Bearer t0k3n"}
+
+			_, err = monitor.httpFlowCheck()
+
+			Expect(err).NotTo(BeNil())
+			Expect(err.Error()).To(ContainSubstring("'401' does not match expected status code '200'"))
+		})
+	})
+
+	Context("substituteVariables", func() {
+		It("leaves unknown variables untouched", func() {
+			Expect(substituteVariables("{{a}}-{{ b }}", map[string]string{"a": "1"})).To(Equal("1-{{ b }}"))
+		})
+	})
+})
@@ -1,13 +1,17 @@
 package monitor
 
 import (
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"net/http/httptrace"
 	"net/url"
+	"strconv"
 	"strings"
 	"time"
 
+	"github.com/9corp/9volt/state"
 	"github.com/9corp/9volt/util"
 )
 
@@ -15,10 +19,17 @@ const (
 	DEFAULT_HTTP_TIMEOUT = time.Duration(3) * time.Second
 )
 
+var (
+	// Template for transports with custom TLS or proxy settings; captured at
+	// startup, before anything (ie. tests) replaces 'http.DefaultTransport'
+	defaultHTTPTransport = http.DefaultTransport.(*http.Transport)
+)
+
 type HTTPMonitor struct {
 	Base
 
 	Timeout time.Duration
+	Client  *http.Client
 }
 
 func NewHTTPMonitor(rmc *RootMonitorConfig) *HTTPMonitor {
@@ -47,81 +58,331 @@ func (h *HTTPMonitor) Validate() error {
 		return fmt.Errorf("'timeout' (%v) cannot equal or exceed 'interval' (%v)", h.Timeout.String(), h.RMC.Config.Interval.String())
 	}
 
+	warningTime := time.Duration(h.RMC.Config.HTTPWarningTime)
+	criticalTime := time.Duration(h.RMC.Config.HTTPCriticalTime)
+
+	if warningTime != 0 && criticalTime != 0 && warningTime > criticalTime {
+		return fmt.Errorf("'response-time-warning' (%v) cannot exceed 'response-time-critical' (%v)", warningTime, criticalTime)
+	}
+
+	if err := validateHTTPAssertions(h.RMC.Config.HTTPAssertions); err != nil {
+		return err
+	}
+
+	if err := validateHTTPRequestOptions(h.RMC.Config); err != nil {
+		return err
+	}
+
+	if strings.Contains(h.RMC.Config.HTTPURL, "://") {
+		if _, err := parseFullURL(h.RMC.Config.HTTPURL); err != nil {
+			return err
+		}
+	}
+
+	// Loads certificates, so any problems surface here rather than on first run
+	client, err := newHTTPClient(h.RMC.Config, h.Timeout)
+	if err != nil {
+		return err
+	}
+
+	h.Client = client
+
 	return nil
 }
 
 // Perform a statusCode check; optionally, if 'Expect' is not blank, verify that
-// the received response body contains the 'Expect' string.
-func (h *HTTPMonitor) httpCheck() error {
+// the received response body contains the 'Expect' string. Any configured
+// 'assertions' are evaluated afterwards and finally, response time is compared
+// against the warning/critical response time limits.
+//
+// Once a response was received, its timings and size are reported even if the
+// check fails.
+func (h *HTTPMonitor) httpCheck() (*CheckResult, error) {
 	fullURL := h.constructURL()
 
 	h.RMC.Log.WithField("fullURL", fullURL).Debug("Performing http check")
 
-	resp, err := h.performRequest(h.RMC.Config.HTTPMethod, fullURL, h.RMC.Config.HTTPRequestBody)
+	start := time.Now()
+
+	resp, ttfb, err := h.performRequest(h.RMC.Config.HTTPMethod, fullURL, h.RMC.Config.HTTPRequestBody)
 	if err != nil {
-		return err
+		return nil, err
 	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read response body: %v", err.Error())
+	}
+
+	elapsed := time.Since(start)
+
+	result := &CheckResult{
+		Duration: elapsed,
+		Metrics: []*state.Metric{
+			durationMetric("response_time", elapsed, h.RMC.Config.HTTPWarningTime, h.RMC.Config.HTTPCriticalTime),
+			{Name: "ttfb", Value: ttfb.Seconds(), Unit: "s"},
+			{Name: "body_size", Value: float64(len(data)), Unit: "B"},
+		},
+		Labels: map[string]string{"status_code": strconv.Itoa(resp.StatusCode)},
+	}
+
+	// If set, verify we ended up in the right place after following redirects
+	if h.RMC.Config.HTTPFinalURL != "" {
+		finalURL := fullURL
+		if resp.Request != nil {
+			finalURL = resp.Request.URL.String()
+		}
 
-	// Check if StatusCode matches
-	if resp.StatusCode != h.RMC.Config.HTTPStatusCode {
-		return fmt.Errorf("Received status code '%v' does not match expected status code '%v'",
+		if finalURL != h.RMC.Config.HTTPFinalURL {
+			return result, fmt.Errorf("Final URL '%v' does not match expected final URL '%v'", finalURL, h.RMC.Config.HTTPFinalURL)
+		}
+	}
+
+	// Check if StatusCode matches; 'status' assertions can take over this job
+	if (h.RMC.Config.HTTPStatusCode != 0 || !h.hasStatusAssertion()) && resp.StatusCode != h.RMC.Config.HTTPStatusCode {
+		return result, fmt.Errorf("Received status code '%v' does not match expected status code '%v'",
 			resp.StatusCode, h.RMC.Config.HTTPStatusCode)
 	}
 
 	// If Expect is set, verify if returned response contains expected data
-	if h.RMC.Config.Expect != "" {
-		data, err := ioutil.ReadAll(resp.Body)
-		if err != nil {
-			return fmt.Errorf("Unable to read response body to perform content expectancy check: %v", err.Error())
-		}
-		defer resp.Body.Close()
+	if h.RMC.Config.Expect != "" && !strings.Contains(string(data), h.RMC.Config.Expect) {
+		return result, fmt.Errorf("Received response body '%v' does not contain expected content '%v'",
+			string(data), h.RMC.Config.Expect)
+	}
+
+	if err := evaluateHTTPAssertions(h.RMC.Config.HTTPAssertions, resp, data); err != nil {
+		return result, err
+	}
 
-		if !strings.Contains(string(data), h.RMC.Config.Expect) {
-			return fmt.Errorf("Received response body '%v' does not contain expected content '%v'",
-				string(data), h.RMC.Config.Expect)
+	return result, checkResponseTime(elapsed, h.RMC.Config.HTTPWarningTime, h.RMC.Config.HTTPCriticalTime)
+}
+
+func (h *HTTPMonitor) hasStatusAssertion() bool {
+	for _, a := range h.RMC.Config.HTTPAssertions {
+		if a != nil && a.Type == ASSERT_STATUS {
+			return true
 		}
 	}
 
+	return false
+}
+
+// Compare response time against (optional) warning and critical limits; the
+// attempt thresholds still apply, a slow response only caps the state at WARNING
+func checkResponseTime(elapsed time.Duration, warningTime, criticalTime util.CustomDuration) error {
+	if criticalTime != util.CustomDuration(0) && elapsed > time.Duration(criticalTime) {
+		return fmt.Errorf("Response time (%v) exceeds critical response time (%v)", elapsed, time.Duration(criticalTime))
+	}
+
+	if warningTime != util.CustomDuration(0) && elapsed > time.Duration(warningTime) {
+		return NewCappedWarningError("Response time (%v) exceeds warning response time (%v)", elapsed, time.Duration(warningTime))
+	}
+
 	return nil
 }
 
+// Construct a metric (in seconds) for 'elapsed' including its optional limits
+func durationMetric(name string, elapsed time.Duration, warningTime, criticalTime util.CustomDuration) *state.Metric {
+	metric := &state.Metric{Name: name, Value: elapsed.Seconds(), Unit: "s"}
+
+	if warningTime != util.CustomDuration(0) {
+		metric.Warning = strconv.FormatFloat(time.Duration(warningTime).Seconds(), 'g', -1, 64)
+	}
+
+	if criticalTime != util.CustomDuration(0) {
+		metric.Critical = strconv.FormatFloat(time.Duration(criticalTime).Seconds(), 'g', -1, 64)
+	}
+
+	return metric
+}
+
+// Build the check URL from 'ssl', 'host', 'port' and 'url'; if 'url' is a full
+// URL (ie. 'https://example.com/health?verbose=1'), it is used as-is.
 func (h *HTTPMonitor) constructURL() string {
+	return buildHTTPURL(h.RMC.Config, h.RMC.Config.HTTPURL)
+}
+
+// Combine 'ssl', 'host' and 'port' with a path (and optional query string);
+// full URLs are returned as-is
+func buildHTTPURL(cfg *MonitorConfig, urlStr string) string {
+	if strings.Contains(urlStr, "://") {
+		return urlStr
+	}
+
 	scheme := "http"
-	if h.RMC.Config.HTTPSSL {
+	if cfg.HTTPSSL {
 		scheme = "https"
 	}
 
 	checkUrl := url.URL{
 		Scheme: scheme,
-		Host:   h.RMC.Config.Host,
+		Host:   cfg.Host,
 	}
 
 	// If port is set, tack on a ':PORT'
-	if h.RMC.Config.Port != 0 {
-		checkUrl.Host = fmt.Sprintf("%s:%d", checkUrl.Host, h.RMC.Config.Port)
+	if cfg.Port != 0 {
+		checkUrl.Host = fmt.Sprintf("%s:%d", checkUrl.Host, cfg.Port)
+	}
+
+	// Anything after a '?' is the query string
+	urlPath := urlStr
+	if idx := strings.Index(urlPath, "?"); idx != -1 {
+		urlPath, checkUrl.RawQuery = urlPath[:idx], urlPath[idx+1:]
 	}
 
-	checkUrl.Path = "/" + strings.TrimLeft(h.RMC.Config.HTTPURL, "/")
+	checkUrl.Path = "/" + strings.TrimLeft(urlPath, "/")
 
 	return checkUrl.String()
 }
 
 // Create and perform a new HTTP request with a timeout; return http Response
-func (h *HTTPMonitor) performRequest(method, urlStr, requestBody string) (*http.Response, error) {
+// and the time it took until the first response byte arrived
+func (h *HTTPMonitor) performRequest(method, urlStr, requestBody string) (*http.Response, time.Duration, error) {
+	if h.Client == nil {
+		client, err := newHTTPClient(h.RMC.Config, h.Timeout)
+		if err != nil {
+			return nil, 0, fmt.Errorf("Unable to create HTTP client for HTTPMonitor check: %v", err.Error())
+		}
 
-	client := &http.Client{Timeout: h.Timeout}
+		h.Client = client
+	}
 
 	body := strings.NewReader(requestBody)
 
 	req, err := http.NewRequest(method, urlStr, body)
 	if err != nil {
-		return nil, fmt.Errorf("Unable to create new HTTP request for HTTPMonitor check: %v", err.Error())
+		return nil, 0, fmt.Errorf("Unable to create new HTTP request for HTTPMonitor check: %v", err.Error())
+	}
+
+	applyHTTPRequestOptions(req, h.RMC.Config)
+
+	// Measured from acquiring the connection; with redirects, for the final request
+	var start time.Time
+	var ttfb time.Duration
+
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), &httptrace.ClientTrace{
+		GetConn:              func(string) { start = time.Now() },
+		GotFirstResponseByte: func() { ttfb = time.Since(start) },
+	}))
+
+	resp, err := h.Client.Do(req)
+	if err != nil {
+		return nil, 0, fmt.Errorf("Ran into error while performing '%v' request: %v", method, err.Error())
+	}
+
+	return resp, ttfb, nil
+}
+
+// Verify a full URL; only http and https are supported
+func parseFullURL(rawURL string) (*url.URL, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to parse 'url' '%v': %v", rawURL, err.Error())
+	}
+
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("Unsupported scheme '%v' in 'url' (supported: http, https)", u.Scheme)
+	}
+
+	if u.Host == "" {
+		return nil, fmt.Errorf("'url' '%v' is missing a host", rawURL)
+	}
+
+	return u, nil
+}
+
+func validateHTTPRequestOptions(cfg *MonitorConfig) error {
+	if cfg.HTTPBearerToken != "" && (cfg.HTTPBasicAuthUser != "" || cfg.HTTPBasicAuthPassword != "") {
+		return errors.New("'bearer-token' and 'basic-auth-user'/'basic-auth-password' are mutually exclusive")
+	}
+
+	if cfg.HTTPMaxRedirects < 0 {
+		return errors.New("'max-redirects' must be larger or equal to 0")
+	}
+
+	if cfg.HTTPDisableRedirects && cfg.HTTPFinalURL != "" {
+		return errors.New("'final-url' cannot be used with 'disable-redirects'")
+	}
+
+	if cfg.HTTPProxy != "" {
+		if _, err := url.Parse(cfg.HTTPProxy); err != nil {
+			return fmt.Errorf("Unable to parse 'proxy' '%v': %v", cfg.HTTPProxy, err.Error())
+		}
 	}
 
-	resp, err := client.Do(req)
+	if (cfg.TLSClientCert == "") != (cfg.TLSClientKey == "") {
+		return errors.New("'tls-client-cert' and 'tls-client-key' must be set together")
+	}
+
+	return nil
+}
+
+// Create an HTTP client honoring redirect, TLS and proxy settings. The default
+// transport is used (and shared) unless TLS or proxy settings require otherwise.
+func newHTTPClient(cfg *MonitorConfig, timeout time.Duration) (*http.Client, error) {
+	client := &http.Client{Timeout: timeout}
+
+	switch {
+	case cfg.HTTPDisableRedirects:
+		client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		}
+	case cfg.HTTPMaxRedirects > 0:
+		client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+			if len(via) > cfg.HTTPMaxRedirects {
+				return fmt.Errorf("stopped after %v redirects", cfg.HTTPMaxRedirects)
+			}
+
+			return nil
+		}
+	}
+
+	if cfg.HTTPProxy == "" && cfg.TLSCAFile == "" && cfg.TLSClientCert == "" &&
+		cfg.TLSServerName == "" && !cfg.TLSInsecureSkipVerify {
+		return client, nil
+	}
+
+	tlsConfig, err := newTLSClientConfig(cfg)
 	if err != nil {
-		return nil, fmt.Errorf("Ran into error while performing '%v' request: %v", method, err.Error())
+		return nil, err
 	}
 
-	return resp, nil
+	// Keep the default dialer, keepalives and HTTP/2 support (the clone sets
+	// 'ForceAttemptHTTP2', so a custom TLS config does not disable it)
+	transport := defaultHTTPTransport.Clone()
+	transport.TLSClientConfig = tlsConfig
+	transport.TLSHandshakeTimeout = timeout
+
+	if cfg.HTTPProxy != "" {
+		proxyURL, err := url.Parse(cfg.HTTPProxy)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to parse 'proxy' '%v': %v", cfg.HTTPProxy, err.Error())
+		}
+
+		transport.Proxy = http.ProxyURL(proxyURL)
+	}
+
+	client.Transport = transport
+
+	return client, nil
+}
+
+// Set custom headers, auth and Host header override on a request
+func applyHTTPRequestOptions(req *http.Request, cfg *MonitorConfig) {
+	for k, v := range cfg.HTTPHeaders {
+		req.Header.Set(k, v)
+	}
+
+	if cfg.HTTPBasicAuthUser != "" || cfg.HTTPBasicAuthPassword != "" {
+		req.SetBasicAuth(cfg.HTTPBasicAuthUser, cfg.HTTPBasicAuthPassword)
+	}
+
+	if cfg.HTTPBearerToken != "" {
+		req.Header.Set("Authorization", "Bearer "+cfg.HTTPBearerToken)
+	}
+
+	if cfg.HTTPHostHeader != "" {
+		req.Host = cfg.HTTPHostHeader
+	}
 }
@@ -2,6 +2,8 @@ package monitor
 
 import (
 	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
@@ -78,6 +80,25 @@ var _ = Describe("http_monitor", func() {
 			Expect(err).NotTo(BeNil())
 			Expect(err.Error()).To(ContainSubstring("cannot equal or exceed"))
 		})
+
+		It("should return error if warning response time exceeds critical response time", func() {
+			config.Config.Interval = util.CustomDuration(5 * time.Second)
+			config.Config.HTTPWarningTime = util.CustomDuration(2 * time.Second)
+			config.Config.HTTPCriticalTime = util.CustomDuration(time.Second)
+
+			err := monitor.Validate()
+			Expect(err).NotTo(BeNil())
+			Expect(err.Error()).To(ContainSubstring("cannot exceed 'response-time-critical'"))
+		})
+
+		It("should return error with invalid assertions", func() {
+			config.Config.Interval = util.CustomDuration(5 * time.Second)
+			config.Config.HTTPAssertions = []*HTTPAssertion{{Type: "header"}}
+
+			err := monitor.Validate()
+			Expect(err).NotTo(BeNil())
+			Expect(err.Error()).To(ContainSubstring("'name' cannot be blank"))
+		})
 	})
 
 	Context("httpCheck", func() {
@@ -103,7 +124,7 @@ var _ = Describe("http_monitor", func() {
 				),
 			)
 
-			err := monitor.httpCheck()
+			_, err := monitor.httpCheck()
 			Expect(err).NotTo(BeNil())
 			Expect(err.Error()).To(ContainSubstring("does not match expected status"))
 		})
@@ -115,8 +136,15 @@ var _ = Describe("http_monitor", func() {
 				),
 			)
 
-			err := monitor.httpCheck()
+			result, err := monitor.httpCheck()
 			Expect(err).To(BeNil())
+			Expect(result.Duration).To(BeNumerically(">", 0))
+			Expect(result.Metrics).To(HaveLen(3))
+			Expect(result.Metrics[0].Name).To(Equal("response_time"))
+			Expect(result.Metrics[1].Name).To(Equal("ttfb"))
+			Expect(result.Metrics[2].Name).To(Equal("body_size"))
+			Expect(result.Metrics[2].Value).To(Equal(float64(len(`{"status": "error", "message": "Bad Thing™!"}`))))
+			Expect(result.Labels).To(Equal(map[string]string{"status_code": "200"}))
 		})
 
 		It("identifies failure by missing sttring", func() {
@@ -126,10 +154,73 @@ var _ = Describe("http_monitor", func() {
 
 			config.Config.Expect = "Amazing things!"
 
-			err := monitor.httpCheck()
+			_, err := monitor.httpCheck()
 			Expect(err).NotTo(BeNil())
 			Expect(err.Error()).To(ContainSubstring("does not contain expected"))
 		})
+
+		It("lets status assertions replace the status code check", func() {
+			httpmock.RegisterResponder("GET", "https://beowulf:31337/health",
+				httpmock.NewStringResponder(204, ""),
+			)
+
+			config.Config.HTTPStatusCode = 0
+			config.Config.HTTPAssertions = []*HTTPAssertion{{Type: "status", Value: "200-299"}}
+
+			_, err := monitor.httpCheck()
+			Expect(err).To(BeNil())
+		})
+
+		It("identifies failed assertions", func() {
+			httpmock.RegisterResponder("GET", "https://beowulf:31337/health",
+				httpmock.NewStringResponder(200, `{"db": "ok", "queue_depth": 12}`),
+			)
+
+			config.Config.HTTPAssertions = []*HTTPAssertion{
+				{Type: "json", Path: "$.db", Value: "ok"},
+				{Type: "json", Path: "$.queue_depth", Operator: "<", Value: "10"},
+			}
+
+			_, err := monitor.httpCheck()
+			Expect(err).NotTo(BeNil())
+			Expect(err.Error()).To(ContainSubstring("json '$.queue_depth' < '10' failed: got '12'"))
+		})
+
+		It("goes critical when response time exceeds critical response time", func() {
+			httpmock.RegisterResponder("GET", "https://beowulf:31337/health",
+				func(req *http.Request) (*http.Response, error) {
+					time.Sleep(20 * time.Millisecond)
+					return httpmock.NewStringResponse(200, ""), nil
+				},
+			)
+
+			config.Config.HTTPWarningTime = util.CustomDuration(time.Millisecond)
+			config.Config.HTTPCriticalTime = util.CustomDuration(10 * time.Millisecond)
+
+			result, err := monitor.httpCheck()
+			Expect(err).NotTo(BeNil())
+			Expect(result.Metrics[0].Value).To(BeNumerically(">=", 0.02))
+			Expect(result.Metrics[0].Warning).To(Equal("0.001"))
+			Expect(result.Metrics[0].Critical).To(Equal("0.01"))
+			Expect(err).NotTo(BeAssignableToTypeOf(&StateError{}))
+			Expect(err.Error()).To(ContainSubstring("exceeds critical response time"))
+		})
+
+		It("warns when response time exceeds warning response time", func() {
+			httpmock.RegisterResponder("GET", "https://beowulf:31337/health",
+				func(req *http.Request) (*http.Response, error) {
+					time.Sleep(20 * time.Millisecond)
+					return httpmock.NewStringResponse(200, ""), nil
+				},
+			)
+
+			config.Config.HTTPWarningTime = util.CustomDuration(10 * time.Millisecond)
+
+			_, err := monitor.httpCheck()
+			Expect(err).NotTo(BeNil())
+			Expect(err.(*StateError).State).To(Equal(WARNING))
+			Expect(err.(*StateError).Capped).To(BeTrue())
+		})
 	})
 
 	Context("constructURL", func() {
@@ -167,6 +258,17 @@ var _ = Describe("http_monitor", func() {
 			Expect(monitor.constructURL()).To(Equal("http:///a-place"))
 		})
 
+		It("keeps the query string", func() {
+			config.Config.HTTPURL = "/health?verbose=1&db=true"
+			Expect(monitor.constructURL()).To(Equal("http:///health?verbose=1&db=true"))
+		})
+
+		It("uses full URLs as-is", func() {
+			config.Config.HTTPURL = "https://grendel:8443/status?verbose=1"
+			config.Config.Host = "beowulf"
+			Expect(monitor.constructURL()).To(Equal("https://grendel:8443/status?verbose=1"))
+		})
+
 		It("formats a complete URL", func() {
 			config.Config.HTTPURL = "/health"
 			config.Config.Port = 31337
@@ -198,7 +300,7 @@ var _ = Describe("http_monitor", func() {
 				),
 			)
 
-			resp, err := monitor.performRequest("GET", url, "")
+			resp, _, err := monitor.performRequest("GET", url, "")
 			Expect(err).To(BeNil())
 			Expect(resp.StatusCode).To(Equal(200))
 			_, err = ioutil.ReadAll(resp.Body)
@@ -212,10 +314,149 @@ var _ = Describe("http_monitor", func() {
 				),
 			)
 
-			resp, err := monitor.performRequest("GET", url, "a request body")
+			resp, _, err := monitor.performRequest("GET", url, "a request body")
 			Expect(err).To(BeNil())
 			Expect(resp.StatusCode).To(Equal(200))
 		})
 
 	})
+
+	Context("request options", func() {
+		var server *httptest.Server
+
+		BeforeEach(func() {
+			server = httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				switch r.URL.Path {
+				case "/redirect":
+					http.Redirect(w, r, "/login", http.StatusFound)
+				default:
+					w.Header().Set("X-Seen-Auth", r.Header.Get("Authorization"))
+					w.Header().Set("X-Seen-Host", r.Host)
+					w.Header().Set("X-Seen-Custom", r.Header.Get("X-Custom"))
+				}
+			}))
+			server.EnableHTTP2 = true
+			server.StartTLS()
+
+			config = &RootMonitorConfig{
+				Config: &MonitorConfig{
+					HTTPURL:               server.URL + "/health",
+					HTTPMethod:            "GET",
+					HTTPStatusCode:        200,
+					TLSInsecureSkipVerify: true,
+					Interval:              util.CustomDuration(5 * time.Second),
+				},
+				Log: log.New(),
+			}
+			monitor = NewHTTPMonitor(config)
+		})
+
+		AfterEach(func() {
+			server.Close()
+		})
+
+		It("sends custom headers, bearer token and host header", func() {
+			config.Config.HTTPHeaders = map[string]string{"X-Custom": "hello"}
+			config.Config.HTTPBearerToken = "s3cr3t"
+			config.Config.HTTPHostHeader = "grendel"
+
+			resp, _, err := monitor.performRequest("GET", monitor.constructURL(), "")
+			Expect(err).To(BeNil())
+			Expect(resp.Header.Get("X-Seen-Custom")).To(Equal("hello"))
+			Expect(resp.Header.Get("X-Seen-Auth")).To(Equal("Bearer s3cr3t"))
+			Expect(resp.Header.Get("X-Seen-Host")).To(Equal("grendel"))
+		})
+
+		It("sends basic auth", func() {
+			config.Config.HTTPBasicAuthUser = "beowulf"
+			config.Config.HTTPBasicAuthPassword = "grendel"
+
+			resp, _, err := monitor.performRequest("GET", monitor.constructURL(), "")
+			Expect(err).To(BeNil())
+			Expect(resp.Header.Get("X-Seen-Auth")).To(Equal("Basic YmVvd3VsZjpncmVuZGVs"))
+		})
+
+		It("does not follow redirects when disabled", func() {
+			config.Config.HTTPURL = server.URL + "/redirect"
+			config.Config.HTTPDisableRedirects = true
+
+			_, err := monitor.httpCheck()
+			Expect(err).NotTo(BeNil())
+			Expect(err.Error()).To(ContainSubstring("'302' does not match expected status code '200'"))
+		})
+
+		It("verifies the final URL", func() {
+			config.Config.HTTPURL = server.URL + "/redirect"
+			config.Config.HTTPFinalURL = server.URL + "/login"
+			_, err := monitor.httpCheck()
+			Expect(err).To(BeNil())
+
+			config.Config.HTTPFinalURL = server.URL + "/dashboard"
+			_, err = monitor.httpCheck()
+			Expect(err).NotTo(BeNil())
+			Expect(err.Error()).To(ContainSubstring("does not match expected final URL"))
+		})
+
+		It("keeps the default transport settings and HTTP/2 with custom TLS settings", func() {
+			client, err := newHTTPClient(config.Config, time.Second)
+			Expect(err).To(BeNil())
+
+			transport := client.Transport.(*http.Transport)
+			Expect(transport.DialContext).NotTo(BeNil())
+			Expect(transport.IdleConnTimeout).To(Equal(defaultHTTPTransport.IdleConnTimeout))
+			Expect(transport.TLSHandshakeTimeout).To(Equal(time.Second))
+
+			resp, _, err := monitor.performRequest("GET", monitor.constructURL(), "")
+			Expect(err).To(BeNil())
+			Expect(resp.Proto).To(Equal("HTTP/2.0"))
+		})
+
+		It("fails certificate verification without skip-verify", func() {
+			config.Config.TLSInsecureSkipVerify = false
+			config.Config.TLSServerName = "example.com"
+
+			_, err := monitor.httpCheck()
+			Expect(err).NotTo(BeNil())
+			Expect(err.Error()).To(ContainSubstring("certificate"))
+		})
+
+		Context("Validate", func() {
+			It("returns nil with correct settings", func() {
+				Expect(monitor.Validate()).To(BeNil())
+			})
+
+			It("errors when bearer token and basic auth are both set", func() {
+				config.Config.HTTPBearerToken = "s3cr3t"
+				config.Config.HTTPBasicAuthUser = "beowulf"
+
+				err := monitor.Validate()
+				Expect(err).NotTo(BeNil())
+				Expect(err.Error()).To(ContainSubstring("mutually exclusive"))
+			})
+
+			It("errors with unsupported URL scheme", func() {
+				config.Config.HTTPURL = "ftp://beowulf/health"
+
+				err := monitor.Validate()
+				Expect(err).NotTo(BeNil())
+				Expect(err.Error()).To(ContainSubstring("Unsupported scheme 'ftp'"))
+			})
+
+			It("errors when client cert is missing its key", func() {
+				config.Config.TLSClientCert = "/etc/9volt/client.pem"
+
+				err := monitor.Validate()
+				Expect(err).NotTo(BeNil())
+				Expect(err.Error()).To(ContainSubstring("must be set together"))
+			})
+
+			It("errors when CA bundle cannot be loaded", func() {
+				config.Config.TLSCAFile = "/does/not/exist"
+
+				err := monitor.Validate()
+				Expect(err).NotTo(BeNil())
+				Expect(err.Error()).To(ContainSubstring("Unable to read CA bundle"))
+			})
+		})
+	})
 })
@@ -0,0 +1,277 @@
+package monitor
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/9corp/9volt/util"
+)
+
+const (
+	DEFAULT_ICMP_TIMEOUT = time.Duration(3) * time.Second
+	DEFAULT_ICMP_COUNT   = 3
+
+	ICMP_PROTO_V4       = 1
+	ICMP_PROTO_V6       = 58
+	ICMP_ECHO_REQUEST_4 = 8
+	ICMP_ECHO_REPLY_4   = 0
+	ICMP_ECHO_REQUEST_6 = 128
+	ICMP_ECHO_REPLY_6   = 129
+
+	icmpHeaderLength  = 8
+	icmpTokenLength   = 8
+	icmpMaxPacketSize = 1500
+)
+
+type ICMPMonitor struct {
+	Base
+
+	Timeout time.Duration
+	Count   int
+
+	token []byte
+}
+
+// Results of a single round of echo requests
+type icmpStats struct {
+	Sent     int
+	Received int
+	AvgRTT   time.Duration
+	MaxRTT   time.Duration
+}
+
+func NewICMPMonitor(rmc *RootMonitorConfig) *ICMPMonitor {
+	i := &ICMPMonitor{
+		Base: Base{
+			RMC:        rmc,
+			Identifier: "icmp",
+		},
+		Timeout: DEFAULT_ICMP_TIMEOUT,
+		Count:   DEFAULT_ICMP_COUNT,
+	}
+
+	if rmc.Config.Timeout != util.CustomDuration(0) {
+		i.Timeout = time.Duration(rmc.Config.Timeout)
+	}
+
+	if rmc.Config.ICMPCount != 0 {
+		i.Count = rmc.Config.ICMPCount
+	}
+
+	// Used for telling our replies apart from replies to other pingers
+	i.token = make([]byte, icmpTokenLength)
+	rand.Read(i.token)
+
+	i.MonitorFunc = i.icmpCheck
+
+	return i
+}
+
+func (i *ICMPMonitor) Validate() error {
+	i.RMC.Log.WithField("configName", i.RMC.ConfigName).Debug("Performing monitor config validation")
+
+	if i.RMC.Config.Host == "" {
+		return errors.New("'host' cannot be blank")
+	}
+
+	if i.Count < 1 {
+		return errors.New("'icmp-count' must be larger than 0")
+	}
+
+	if i.RMC.Config.ICMPMaxLoss < 0 || i.RMC.Config.ICMPMaxLoss > 100 {
+		return errors.New("'icmp-max-loss' must be between 0 and 100")
+	}
+
+	if i.Timeout >= time.Duration(i.RMC.Config.Interval) {
+		return fmt.Errorf("'timeout' (%v) cannot equal or exceed 'interval' (%v)", i.Timeout.String(), i.RMC.Config.Interval.String())
+	}
+
+	return nil
+}
+
+// Send 'Count' echo requests to the host and fail if all of them were lost,
+// or (optionally) if packet loss, average or max RTT exceed their thresholds.
+func (i *ICMPMonitor) icmpCheck() (*CheckResult, error) {
+	i.RMC.Log.WithField("host", i.RMC.Config.Host).Debug("Performing icmp check")
+
+	dst, err := net.ResolveIPAddr("ip", i.RMC.Config.Host)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to resolve host '%v': %v", i.RMC.Config.Host, err.Error())
+	}
+
+	stats, err := i.ping(dst)
+	if err != nil {
+		return nil, err
+	}
+
+	return nil, i.evaluate(stats)
+}
+
+// Compare gathered stats against configured thresholds
+func (i *ICMPMonitor) evaluate(stats *icmpStats) error {
+	loss := 100 - (float64(stats.Received) / float64(stats.Sent) * 100)
+
+	if stats.Received == 0 {
+		return fmt.Errorf("Host '%v' is unreachable (%v sent, 0 received, 100%% packet loss)", i.RMC.Config.Host, stats.Sent)
+	}
+
+	if i.RMC.Config.ICMPMaxLoss > 0 && loss > i.RMC.Config.ICMPMaxLoss {
+		return fmt.Errorf("Packet loss to '%v' (%.1f%%) exceeds allowed packet loss (%.1f%%)",
+			i.RMC.Config.Host, loss, i.RMC.Config.ICMPMaxLoss)
+	}
+
+	if i.RMC.Config.ICMPMaxAvgRTT != util.CustomDuration(0) && stats.AvgRTT > time.Duration(i.RMC.Config.ICMPMaxAvgRTT) {
+		return fmt.Errorf("Average RTT to '%v' (%v) exceeds allowed average RTT (%v)",
+			i.RMC.Config.Host, stats.AvgRTT, i.RMC.Config.ICMPMaxAvgRTT.String())
+	}
+
+	if i.RMC.Config.ICMPMaxRTT != util.CustomDuration(0) && stats.MaxRTT > time.Duration(i.RMC.Config.ICMPMaxRTT) {
+		return fmt.Errorf("Max RTT to '%v' (%v) exceeds allowed max RTT (%v)",
+			i.RMC.Config.Host, stats.MaxRTT, i.RMC.Config.ICMPMaxRTT.String())
+	}
+
+	return nil
+}
+
+// Send echo requests one at a time, waiting up to 'Timeout / Count' for each reply
+func (i *ICMPMonitor) ping(dst *net.IPAddr) (*icmpStats, error) {
+	ipv6 := dst.IP.To4() == nil
+
+	conn, datagram, err := listenICMP(ipv6)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to open ICMP socket: %v", err.Error())
+	}
+	defer conn.Close()
+
+	var addr net.Addr = dst
+	if datagram {
+		addr = &net.UDPAddr{IP: dst.IP, Zone: dst.Zone}
+	}
+
+	stats := &icmpStats{}
+	perEcho := i.Timeout / time.Duration(i.Count)
+	totalRTT := time.Duration(0)
+	id := int(time.Now().UnixNano() & 0xffff)
+
+	for seq := 0; seq < i.Count; seq++ {
+		sent := time.Now()
+
+		if _, err := conn.WriteTo(marshalEchoRequest(ipv6, id, seq, i.token), addr); err != nil {
+			return nil, fmt.Errorf("Unable to send echo request to %v: %v", dst.String(), err.Error())
+		}
+
+		stats.Sent++
+
+		if err := conn.SetReadDeadline(sent.Add(perEcho)); err != nil {
+			return nil, fmt.Errorf("Unable to set read timeout (%v): %v", perEcho, err.Error())
+		}
+
+		if !i.waitForReply(conn, ipv6, seq) {
+			continue
+		}
+
+		rtt := time.Since(sent)
+		totalRTT += rtt
+		stats.Received++
+
+		if rtt > stats.MaxRTT {
+			stats.MaxRTT = rtt
+		}
+	}
+
+	if stats.Received > 0 {
+		stats.AvgRTT = totalRTT / time.Duration(stats.Received)
+	}
+
+	return stats, nil
+}
+
+// Read from the connection until a matching reply shows up or the read deadline is hit
+func (i *ICMPMonitor) waitForReply(conn net.PacketConn, ipv6 bool, seq int) bool {
+	buf := make([]byte, icmpMaxPacketSize)
+
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			return false
+		}
+
+		// Kernel may rewrite the ID for datagram sockets, so match on seq + token instead
+		if replySeq, ok := parseEchoReply(ipv6, buf[:n], i.token); ok && replySeq == seq {
+			return true
+		}
+	}
+}
+
+// Build an ICMP echo request; payload consists of our per-monitor token
+func marshalEchoRequest(ipv6 bool, id, seq int, token []byte) []byte {
+	msgType := byte(ICMP_ECHO_REQUEST_4)
+	if ipv6 {
+		msgType = ICMP_ECHO_REQUEST_6
+	}
+
+	b := make([]byte, icmpHeaderLength+len(token))
+	b[0] = msgType
+	binary.BigEndian.PutUint16(b[4:6], uint16(id))
+	binary.BigEndian.PutUint16(b[6:8], uint16(seq))
+	copy(b[icmpHeaderLength:], token)
+
+	// Kernel takes care of the checksum for ICMPv6
+	if !ipv6 {
+		binary.BigEndian.PutUint16(b[2:4], icmpChecksum(b))
+	}
+
+	return b
+}
+
+// Parse an echo reply; returns the sequence number and whether the reply is ours
+func parseEchoReply(ipv6 bool, b []byte, token []byte) (int, bool) {
+	replyType := byte(ICMP_ECHO_REPLY_4)
+	if ipv6 {
+		replyType = ICMP_ECHO_REPLY_6
+	}
+
+	// Datagram sockets on darwin (and BSDs) include the IPv4 header; no ICMPv4
+	// type starts with a version 4 nibble, so it can safely be skipped
+	if !ipv6 && len(b) > 0 && b[0]>>4 == 4 {
+		headerLength := int(b[0]&0x0f) * 4
+		if len(b) < headerLength {
+			return 0, false
+		}
+
+		b = b[headerLength:]
+	}
+
+	if len(b) < icmpHeaderLength+len(token) || b[0] != replyType {
+		return 0, false
+	}
+
+	if !bytes.Equal(b[icmpHeaderLength:icmpHeaderLength+len(token)], token) {
+		return 0, false
+	}
+
+	return int(binary.BigEndian.Uint16(b[6:8])), true
+}
+
+// RFC 1071 internet checksum
+func icmpChecksum(b []byte) uint16 {
+	var sum uint32
+
+	for i := 0; i+1 < len(b); i += 2 {
+		sum += uint32(b[i])<<8 | uint32(b[i+1])
+	}
+
+	if len(b)%2 == 1 {
+		sum += uint32(b[len(b)-1]) << 8
+	}
+
+	sum = (sum >> 16) + (sum & 0xffff)
+	sum += sum >> 16
+
+	return ^uint16(sum)
+}
@@ -0,0 +1,154 @@
+package monitor
+
+import (
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/9corp/9volt/util"
+)
+
+var _ = Describe("icmp_monitor", func() {
+	var (
+		monitor *ICMPMonitor
+		config  *RootMonitorConfig
+	)
+
+	BeforeEach(func() {
+		config = &RootMonitorConfig{
+			Config: &MonitorConfig{
+				Host:     "beowulf",
+				Interval: util.CustomDuration(5 * time.Second),
+			},
+			Log: log.New(),
+		}
+
+		monitor = NewICMPMonitor(config)
+	})
+
+	Context("NewICMPMonitor", func() {
+		It("returns a properly configured instance with defaults", func() {
+			Expect(monitor.Timeout).To(Equal(DEFAULT_ICMP_TIMEOUT))
+			Expect(monitor.Count).To(Equal(DEFAULT_ICMP_COUNT))
+			Expect(monitor.MonitorFunc).NotTo(BeNil())
+		})
+
+		It("sources settings from the main config", func() {
+			config.Config.ICMPCount = 10
+			config.Config.Timeout = util.CustomDuration(time.Second)
+
+			monitor = NewICMPMonitor(config)
+
+			Expect(monitor.Count).To(Equal(10))
+			Expect(monitor.Timeout).To(Equal(time.Second))
+		})
+	})
+
+	Context("Validate", func() {
+		It("returns nil with correct settings", func() {
+			Expect(monitor.Validate()).To(BeNil())
+		})
+
+		It("errors with blank host", func() {
+			config.Config.Host = ""
+			err := monitor.Validate()
+
+			Expect(err).NotTo(BeNil())
+			Expect(err.Error()).To(ContainSubstring("'host' cannot be blank"))
+		})
+
+		It("errors with bad packet loss", func() {
+			config.Config.ICMPMaxLoss = 101
+			err := monitor.Validate()
+
+			Expect(err).NotTo(BeNil())
+			Expect(err.Error()).To(ContainSubstring("icmp-max-loss"))
+		})
+
+		It("errors with bad timeouts", func() {
+			config.Config.Interval = util.CustomDuration(time.Second)
+			err := monitor.Validate()
+
+			Expect(err).NotTo(BeNil())
+			Expect(err.Error()).To(ContainSubstring("cannot equal or exceed"))
+		})
+	})
+
+	Context("evaluate", func() {
+		It("fails when nothing was received", func() {
+			err := monitor.evaluate(&icmpStats{Sent: 3})
+
+			Expect(err).NotTo(BeNil())
+			Expect(err.Error()).To(ContainSubstring("100% packet loss"))
+		})
+
+		It("passes with partial loss when no loss threshold is set", func() {
+			Expect(monitor.evaluate(&icmpStats{Sent: 3, Received: 1})).To(BeNil())
+		})
+
+		It("fails when packet loss exceeds threshold", func() {
+			config.Config.ICMPMaxLoss = 50
+			err := monitor.evaluate(&icmpStats{Sent: 4, Received: 1})
+
+			Expect(err).NotTo(BeNil())
+			Expect(err.Error()).To(ContainSubstring("exceeds allowed packet loss"))
+		})
+
+		It("fails when average RTT exceeds threshold", func() {
+			config.Config.ICMPMaxAvgRTT = util.CustomDuration(10 * time.Millisecond)
+			err := monitor.evaluate(&icmpStats{Sent: 3, Received: 3, AvgRTT: 20 * time.Millisecond})
+
+			Expect(err).NotTo(BeNil())
+			Expect(err.Error()).To(ContainSubstring("Average RTT"))
+		})
+
+		It("fails when max RTT exceeds threshold", func() {
+			config.Config.ICMPMaxRTT = util.CustomDuration(10 * time.Millisecond)
+			err := monitor.evaluate(&icmpStats{Sent: 3, Received: 3, MaxRTT: 20 * time.Millisecond})
+
+			Expect(err).NotTo(BeNil())
+			Expect(err.Error()).To(ContainSubstring("Max RTT"))
+		})
+	})
+
+	Context("echo packets", func() {
+		It("produces a valid ICMPv4 checksum", func() {
+			packet := marshalEchoRequest(false, 1234, 1, monitor.token)
+			Expect(icmpChecksum(packet)).To(Equal(uint16(0)))
+		})
+
+		It("parses replies carrying our token", func() {
+			packet := marshalEchoRequest(false, 1234, 7, monitor.token)
+			packet[0] = ICMP_ECHO_REPLY_4
+
+			seq, ok := parseEchoReply(false, packet, monitor.token)
+			Expect(ok).To(BeTrue())
+			Expect(seq).To(Equal(7))
+		})
+
+		It("skips the IPv4 header included by darwin datagram sockets", func() {
+			packet := marshalEchoRequest(false, 1234, 7, monitor.token)
+			packet[0] = ICMP_ECHO_REPLY_4
+
+			header := make([]byte, 20)
+			header[0] = 0x45 // version 4, 5 * 4 byte header
+
+			seq, ok := parseEchoReply(false, append(header, packet...), monitor.token)
+			Expect(ok).To(BeTrue())
+			Expect(seq).To(Equal(7))
+
+			_, ok = parseEchoReply(false, header[:10], monitor.token)
+			Expect(ok).To(BeFalse())
+		})
+
+		It("ignores replies with a foreign token", func() {
+			packet := marshalEchoRequest(true, 1234, 7, []byte("someone!"))
+			packet[0] = ICMP_ECHO_REPLY_6
+
+			_, ok := parseEchoReply(true, packet, monitor.token)
+			Expect(ok).To(BeFalse())
+		})
+	})
+})
@@ -0,0 +1,23 @@
+//go:build !linux && !darwin
+// +build !linux,!darwin
+
+package monitor
+
+import (
+	"net"
+)
+
+// Datagram ICMP sockets are not available here; raw sockets only
+func listenICMP(ipv6 bool) (net.PacketConn, bool, error) {
+	network := "ip4:icmp"
+	if ipv6 {
+		network = "ip6:ipv6-icmp"
+	}
+
+	conn, err := net.ListenPacket(network, "")
+	if err != nil {
+		return nil, false, err
+	}
+
+	return conn, false, nil
+}
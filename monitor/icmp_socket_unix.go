@@ -0,0 +1,54 @@
+//go:build linux || darwin
+// +build linux darwin
+
+package monitor
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+)
+
+// Open an ICMP socket; prefer an unprivileged datagram socket (where the kernel
+// allows it) and fall back to a raw socket. Second return value is true when a
+// datagram socket is returned (addresses must then be *net.UDPAddr).
+func listenICMP(ipv6 bool) (net.PacketConn, bool, error) {
+	family, proto, rawNetwork := syscall.AF_INET, ICMP_PROTO_V4, "ip4:icmp"
+	if ipv6 {
+		family, proto, rawNetwork = syscall.AF_INET6, ICMP_PROTO_V6, "ip6:ipv6-icmp"
+	}
+
+	if conn, err := listenDatagramICMP(family, proto); err == nil {
+		return conn, true, nil
+	}
+
+	conn, err := net.ListenPacket(rawNetwork, "")
+	if err != nil {
+		return nil, false, err
+	}
+
+	return conn, false, nil
+}
+
+func listenDatagramICMP(family, proto int) (net.PacketConn, error) {
+	fd, err := syscall.Socket(family, syscall.SOCK_DGRAM, proto)
+	if err != nil {
+		return nil, err
+	}
+
+	var sa syscall.Sockaddr = &syscall.SockaddrInet4{}
+	if family == syscall.AF_INET6 {
+		sa = &syscall.SockaddrInet6{}
+	}
+
+	if err := syscall.Bind(fd, sa); err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+
+	f := os.NewFile(uintptr(fd), fmt.Sprintf("icmp-dgram-%d", fd))
+	defer f.Close()
+
+	return net.FilePacketConn(f)
+}
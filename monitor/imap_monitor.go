@@ -0,0 +1,274 @@
+package monitor
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/textproto"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	DEFAULT_IMAP_PORT     = 143
+	DEFAULT_IMAP_TLS_PORT = 993
+)
+
+var (
+	imapLiteralRegex = regexp.MustCompile(`\{(\d+)\}$`)
+)
+
+type IMAPMonitor struct {
+	MailMonitor
+}
+
+func NewIMAPMonitor(rmc *RootMonitorConfig) *IMAPMonitor {
+	i := &IMAPMonitor{
+		MailMonitor: newMailMonitor(rmc, "imap", DEFAULT_IMAP_PORT, DEFAULT_IMAP_TLS_PORT),
+	}
+
+	i.MonitorFunc = i.imapCheck
+
+	return i
+}
+
+// Check the advertised capabilities, optionally upgrade via STARTTLS, log in
+// and open 'mail-mailbox' (read-only)
+func (i *IMAPMonitor) imapCheck() (*CheckResult, error) {
+	fullAddress := net.JoinHostPort(i.RMC.Config.Host, strconv.Itoa(i.Port))
+
+	i.RMC.Log.WithField("address", fullAddress).Debug("Performing imap check")
+
+	conn, err := dialWithDeadline(fullAddress, i.implicitTLS(), time.Now().Add(i.Timeout))
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := newIMAPConn(conn)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("imap check against %v failed: %v", fullAddress, err.Error())
+	}
+
+	defer client.Close()
+
+	if err := i.session(client); err != nil {
+		return nil, fmt.Errorf("imap check against %v failed: %v", fullAddress, err.Error())
+	}
+
+	return nil, nil
+}
+
+func (i *IMAPMonitor) session(client *imapConn) error {
+	if err := client.capabilities(); err != nil {
+		return err
+	}
+
+	missing := missingExtensions(i.RMC.Config.MailExpectedExtensions, mapLookup(client.Capabilities))
+
+	if i.RMC.Config.MailStartTLS {
+		if err := client.startTLS(i.TLSConfig); err != nil {
+			return err
+		}
+
+		missing = missingExtensions(missing, mapLookup(client.Capabilities))
+	}
+
+	if len(missing) != 0 {
+		return fmt.Errorf("server does not advertise expected capabilities: %v", strings.Join(missing, ", "))
+	}
+
+	if i.RMC.Config.MailUser == "" {
+		return nil
+	}
+
+	if err := client.login(i.RMC.Config.MailUser, i.RMC.Config.MailPassword); err != nil {
+		return err
+	}
+
+	mailbox := DEFAULT_MAIL_MAILBOX
+	if i.RMC.Config.MailMailbox != "" {
+		mailbox = i.RMC.Config.MailMailbox
+	}
+
+	if _, err := client.command("EXAMINE " + imapQuote(mailbox)); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Minimal IMAP4rev1 client; just enough for checking capabilities, logging in
+// and looking up (and removing) probe messages
+type imapConn struct {
+	conn         net.Conn
+	text         *textproto.Conn
+	tag          int
+	Capabilities map[string]string
+}
+
+// Wrap an established connection and read the server greeting
+func newIMAPConn(conn net.Conn) (*imapConn, error) {
+	c := &imapConn{
+		conn: conn,
+		text: textproto.NewConn(conn),
+	}
+
+	line, err := c.text.ReadLine()
+	if err != nil {
+		return nil, fmt.Errorf("unable to read greeting: %v", err.Error())
+	}
+
+	if !strings.HasPrefix(line, "* OK") && !strings.HasPrefix(line, "* PREAUTH") {
+		return nil, fmt.Errorf("unexpected greeting '%v'", line)
+	}
+
+	return c, nil
+}
+
+// Send a tagged command and collect the untagged responses until the tagged
+// completion; anything but OK is returned as an error
+func (c *imapConn) command(command string) ([]string, error) {
+	c.tag++
+	tag := fmt.Sprintf("a%03d", c.tag)
+
+	// Never include arguments (ie. passwords) in errors
+	name := strings.Fields(command)[0]
+
+	if err := c.text.PrintfLine("%v %v", tag, command); err != nil {
+		return nil, fmt.Errorf("unable to send %v: %v", name, err.Error())
+	}
+
+	var untagged []string
+
+	for {
+		line, err := c.text.ReadLine()
+		if err != nil {
+			return nil, fmt.Errorf("unable to read %v response: %v", name, err.Error())
+		}
+
+		// Literal contents are not needed by any of our commands; skip them
+		if match := imapLiteralRegex.FindStringSubmatch(line); match != nil {
+			size, _ := strconv.ParseInt(match[1], 10, 64)
+
+			if _, err := io.CopyN(ioutil.Discard, c.text.R, size); err != nil {
+				return nil, fmt.Errorf("unable to read %v response: %v", name, err.Error())
+			}
+		}
+
+		switch {
+		case strings.HasPrefix(line, "* "):
+			untagged = append(untagged, line[2:])
+		case strings.HasPrefix(line, tag+" "):
+			status := strings.TrimPrefix(line, tag+" ")
+
+			if !strings.HasPrefix(strings.ToUpper(status), "OK") {
+				return untagged, fmt.Errorf("%v failed: %v", name, status)
+			}
+
+			return untagged, nil
+		case strings.HasPrefix(line, "+"):
+			return nil, fmt.Errorf("unexpected continuation request in response to %v", name)
+		}
+	}
+}
+
+func (c *imapConn) capabilities() error {
+	untagged, err := c.command("CAPABILITY")
+	if err != nil {
+		return err
+	}
+
+	var capabilities []string
+
+	for _, line := range untagged {
+		fields := strings.Fields(line)
+
+		if len(fields) > 0 && strings.EqualFold(fields[0], "CAPABILITY") {
+			capabilities = append(capabilities, fields[1:]...)
+		}
+	}
+
+	c.Capabilities = newExtensionMap(capabilities)
+
+	return nil
+}
+
+// Upgrade the connection via STARTTLS and refresh the capabilities
+func (c *imapConn) startTLS(tlsConfig *tls.Config) error {
+	if _, ok := c.Capabilities["STARTTLS"]; !ok {
+		return errors.New("server does not advertise STARTTLS")
+	}
+
+	if _, err := c.command("STARTTLS"); err != nil {
+		return err
+	}
+
+	tlsConn := tls.Client(c.conn, tlsConfig)
+
+	if err := tlsConn.Handshake(); err != nil {
+		return fmt.Errorf("TLS handshake failed: %v", err.Error())
+	}
+
+	c.conn = tlsConn
+	c.text = textproto.NewConn(tlsConn)
+
+	return c.capabilities()
+}
+
+func (c *imapConn) login(user, password string) error {
+	if _, ok := c.Capabilities["LOGINDISABLED"]; ok {
+		return errors.New("server does not allow LOGIN on this connection (LOGINDISABLED); use 'tls' or 'mail-starttls'")
+	}
+
+	_, err := c.command("LOGIN " + imapQuote(user) + " " + imapQuote(password))
+
+	return err
+}
+
+// Return the UIDs of all messages in the selected mailbox matching 'criteria'
+func (c *imapConn) search(criteria string) ([]string, error) {
+	untagged, err := c.command("UID SEARCH " + criteria)
+	if err != nil {
+		return nil, err
+	}
+
+	var uids []string
+
+	for _, line := range untagged {
+		fields := strings.Fields(line)
+
+		if len(fields) > 0 && strings.EqualFold(fields[0], "SEARCH") {
+			uids = append(uids, fields[1:]...)
+		}
+	}
+
+	return uids, nil
+}
+
+// Flag messages (by UID) as deleted and expunge them
+func (c *imapConn) delete(uids []string) error {
+	if _, err := c.command(fmt.Sprintf(`UID STORE %v +FLAGS.SILENT (\Deleted)`, strings.Join(uids, ","))); err != nil {
+		return err
+	}
+
+	_, err := c.command("EXPUNGE")
+
+	return err
+}
+
+// Log out (best effort) and close the connection
+func (c *imapConn) Close() error {
+	c.command("LOGOUT")
+
+	return c.conn.Close()
+}
+
+func imapQuote(value string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(value) + `"`
+}
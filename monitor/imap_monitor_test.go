@@ -0,0 +1,301 @@
+package monitor
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/textproto"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/9corp/9volt/util"
+)
+
+// Messages delivered by the SMTP stand-in and served by the IMAP stand-in
+type testMailbox struct {
+	sync.Mutex
+	messages []string
+	deleted  map[string]bool // by UID (1-based index into 'messages')
+}
+
+func (m *testMailbox) deliver(message string) {
+	m.Lock()
+	defer m.Unlock()
+
+	m.messages = append(m.messages, message)
+}
+
+func (m *testMailbox) count() int {
+	m.Lock()
+	defer m.Unlock()
+
+	return len(m.messages)
+}
+
+// Number of messages not flagged as deleted
+func (m *testMailbox) remaining() int {
+	m.Lock()
+	defer m.Unlock()
+
+	return len(m.messages) - len(m.deleted)
+}
+
+// Whether 'message' satisfies a series of 'HEADER <name> <value>' criteria,
+// each optionally preceded by 'NOT'
+func matchesSearch(message string, criteria []string) bool {
+	for i := 0; i < len(criteria); i += 3 {
+		negate := strings.ToUpper(criteria[i]) == "NOT"
+		if negate {
+			i++
+		}
+
+		if i+2 >= len(criteria) || strings.Contains(message, criteria[i+1]+": "+criteria[i+2]) == negate {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Minimal in-process IMAP stand-in; accepts 'user'/'secret', has a single 'INBOX'
+// and advertises STARTTLS (before the upgrade) if 'cert' is set
+func startTestIMAPServer(mailbox *testMailbox, capabilities []string, cert *tls.Certificate) (net.Listener, int) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	Expect(err).To(BeNil())
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+
+			go func(conn net.Conn) {
+				defer conn.Close()
+
+				text := textproto.NewConn(conn)
+				secure := false
+
+				text.PrintfLine("* OK test IMAP4rev1 server ready")
+
+				for {
+					line, err := text.ReadLine()
+					if err != nil {
+						return
+					}
+
+					args := strings.Fields(line)
+					tag, command := args[0], strings.ToUpper(args[1])
+
+					if command == "UID" {
+						command += " " + strings.ToUpper(args[2])
+					}
+
+					for i := range args {
+						args[i] = strings.Trim(args[i], `"`)
+					}
+
+					switch command {
+					case "CAPABILITY":
+						advertised := append([]string{"IMAP4rev1"}, capabilities...)
+						if cert != nil && !secure {
+							advertised = append(advertised, "STARTTLS")
+						}
+
+						text.PrintfLine("* CAPABILITY %v", strings.Join(advertised, " "))
+						text.PrintfLine("%v OK CAPABILITY completed", tag)
+					case "STARTTLS":
+						text.PrintfLine("%v OK begin TLS negotiation now", tag)
+
+						tlsConn := tls.Server(conn, &tls.Config{Certificates: []tls.Certificate{*cert}})
+						if err := tlsConn.Handshake(); err != nil {
+							return
+						}
+
+						conn, text, secure = tlsConn, textproto.NewConn(tlsConn), true
+					case "LOGIN":
+						if args[2] != "user" || args[3] != "secret" {
+							text.PrintfLine("%v NO [AUTHENTICATIONFAILED] invalid credentials", tag)
+							continue
+						}
+
+						text.PrintfLine("%v OK LOGIN completed", tag)
+					case "SELECT", "EXAMINE":
+						if args[2] != "INBOX" {
+							text.PrintfLine("%v NO mailbox does not exist", tag)
+							continue
+						}
+
+						text.PrintfLine("* %v EXISTS", mailbox.count())
+						text.PrintfLine("* OK [UIDVALIDITY 1] UIDs valid")
+						text.PrintfLine("%v OK [READ-WRITE] %v completed", tag, command)
+					case "UID SEARCH":
+						var uids []string
+
+						mailbox.Lock()
+						for i, message := range mailbox.messages {
+							if matchesSearch(message, args[3:]) && !mailbox.deleted[fmt.Sprint(i+1)] {
+								uids = append(uids, fmt.Sprint(i+1))
+							}
+						}
+						mailbox.Unlock()
+
+						text.PrintfLine("* SEARCH %v", strings.Join(uids, " "))
+						text.PrintfLine("%v OK SEARCH completed", tag)
+					case "UID STORE":
+						mailbox.Lock()
+						if mailbox.deleted == nil {
+							mailbox.deleted = map[string]bool{}
+						}
+
+						for _, uid := range strings.Split(args[3], ",") {
+							mailbox.deleted[uid] = true
+						}
+						mailbox.Unlock()
+
+						text.PrintfLine("%v OK STORE completed", tag)
+					case "EXPUNGE", "NOOP":
+						text.PrintfLine("%v OK %v completed", tag, command)
+					case "LOGOUT":
+						text.PrintfLine("* BYE logging out")
+						text.PrintfLine("%v OK LOGOUT completed", tag)
+						return
+					default:
+						text.PrintfLine("%v BAD unknown command", tag)
+					}
+				}
+			}(conn)
+		}
+	}()
+
+	return ln, ln.Addr().(*net.TCPAddr).Port
+}
+
+var _ = Describe("imap_monitor", func() {
+	var (
+		monitor *IMAPMonitor
+		config  *RootMonitorConfig
+		ln      net.Listener
+		cert    tls.Certificate
+	)
+
+	start := func(capabilities []string, cert *tls.Certificate) {
+		ln, config.Config.Port = startTestIMAPServer(&testMailbox{}, capabilities, cert)
+		monitor = NewIMAPMonitor(config)
+		Expect(monitor.Validate()).To(BeNil())
+	}
+
+	BeforeEach(func() {
+		_, cert = generateTestCerts([]string{"localhost"}, time.Now().Add(24*time.Hour))
+
+		config = &RootMonitorConfig{
+			Config: &MonitorConfig{
+				Host:     "127.0.0.1",
+				Interval: util.CustomDuration(30 * time.Second),
+			},
+			Log: log.New(),
+		}
+
+		monitor = NewIMAPMonitor(config)
+	})
+
+	AfterEach(func() {
+		if ln != nil {
+			ln.Close()
+			ln = nil
+		}
+	})
+
+	Context("NewIMAPMonitor", func() {
+		It("returns a properly configured instance with defaults", func() {
+			Expect(monitor.Port).To(Equal(DEFAULT_IMAP_PORT))
+			Expect(monitor.Timeout).To(Equal(DEFAULT_MAIL_TIMEOUT))
+			Expect(monitor.MonitorFunc).NotTo(BeNil())
+		})
+
+		It("defaults to the IMAPS port with 'tls'", func() {
+			config.Config.TCPTLS = true
+			Expect(NewIMAPMonitor(config).Port).To(Equal(DEFAULT_IMAP_TLS_PORT))
+		})
+	})
+
+	Context("Validate", func() {
+		It("rejects 'tls' combined with 'mail-starttls'", func() {
+			config.Config.TCPTLS = true
+			config.Config.MailStartTLS = true
+			Expect(monitor.Validate().Error()).To(ContainSubstring("cannot both be set"))
+		})
+
+		It("requires 'mail-user' with 'mail-password'", func() {
+			config.Config.MailPassword = "secret"
+			Expect(monitor.Validate().Error()).To(ContainSubstring("requires 'mail-user'"))
+		})
+	})
+
+	Context("imapCheck", func() {
+		It("checks advertised capabilities", func() {
+			config.Config.MailExpectedExtensions = []string{"IDLE", "AUTH=PLAIN"}
+			start([]string{"IDLE", "AUTH=PLAIN"}, nil)
+			_, err := monitor.imapCheck()
+			Expect(err).To(BeNil())
+
+			config.Config.MailExpectedExtensions = []string{"IDLE", "QUOTA"}
+			_, err = monitor.imapCheck()
+			Expect(err).NotTo(BeNil())
+			Expect(err.Error()).To(ContainSubstring("does not advertise expected capabilities: QUOTA"))
+		})
+
+		It("logs in and examines the mailbox", func() {
+			config.Config.MailUser = "user"
+			config.Config.MailPassword = "secret"
+			start(nil, nil)
+			_, err := monitor.imapCheck()
+			Expect(err).To(BeNil())
+
+			config.Config.MailMailbox = "Archive"
+			_, err = monitor.imapCheck()
+			Expect(err).NotTo(BeNil())
+			Expect(err.Error()).To(ContainSubstring("EXAMINE failed: NO mailbox does not exist"))
+
+			config.Config.MailPassword = "wrong"
+			_, err = monitor.imapCheck()
+			Expect(err).NotTo(BeNil())
+			Expect(err.Error()).To(ContainSubstring("LOGIN failed: NO [AUTHENTICATIONFAILED]"))
+			Expect(err.Error()).NotTo(ContainSubstring("wrong"))
+		})
+
+		It("refuses to log in if LOGINDISABLED is advertised", func() {
+			config.Config.MailUser = "user"
+			config.Config.MailPassword = "secret"
+			start([]string{"LOGINDISABLED"}, nil)
+
+			_, err := monitor.imapCheck()
+			Expect(err).NotTo(BeNil())
+			Expect(err.Error()).To(ContainSubstring("LOGINDISABLED"))
+		})
+
+		It("upgrades via STARTTLS", func() {
+			config.Config.MailStartTLS = true
+			config.Config.TLSInsecureSkipVerify = true
+			config.Config.MailExpectedExtensions = []string{"STARTTLS", "AUTH=PLAIN"}
+			start([]string{"AUTH=PLAIN"}, &cert)
+			_, err := monitor.imapCheck()
+			Expect(err).To(BeNil())
+		})
+
+		It("fails if STARTTLS is not advertised", func() {
+			config.Config.MailStartTLS = true
+			config.Config.TLSInsecureSkipVerify = true
+			start(nil, nil)
+
+			_, err := monitor.imapCheck()
+			Expect(err).NotTo(BeNil())
+			Expect(err.Error()).To(ContainSubstring("server does not advertise STARTTLS"))
+		})
+	})
+})
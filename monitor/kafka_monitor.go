@@ -0,0 +1,530 @@
+package monitor
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+const (
+	DEFAULT_KAFKA_PORT     = 9092
+	DEFAULT_KAFKA_TLS_PORT = 9093
+
+	kafkaClientID = "9volt"
+
+	// Upper bound for responses read; fetches are limited to 'kafkaMaxFetchSize'
+	kafkaMaxResponseSize = 4 * 1024 * 1024
+	kafkaMaxFetchSize    = 1024 * 1024
+	kafkaFetchMaxWait    = 500 // ms
+
+	// API keys; the versions used are supported by Kafka 1.0 and later
+	kafkaAPIProduce          = 0
+	kafkaAPIFetch            = 1
+	kafkaAPIMetadata         = 3
+	kafkaAPISaslHandshake    = 17
+	kafkaAPISaslAuthenticate = 36
+
+	kafkaRecordBatchMagic = 2
+	kafkaCompressionMask  = 0x07
+)
+
+var (
+	kafkaTopicRegex = regexp.MustCompile(`^[a-zA-Z0-9._-]{1,249}$`)
+
+	kafkaCRCTable = crc32.MakeTable(crc32.Castagnoli)
+
+	kafkaErrorCodes = map[int16]string{
+		-1: "UNKNOWN_SERVER_ERROR",
+		1:  "OFFSET_OUT_OF_RANGE",
+		2:  "CORRUPT_MESSAGE",
+		3:  "UNKNOWN_TOPIC_OR_PARTITION",
+		5:  "LEADER_NOT_AVAILABLE",
+		6:  "NOT_LEADER_OR_FOLLOWER",
+		7:  "REQUEST_TIMED_OUT",
+		10: "MESSAGE_TOO_LARGE",
+		17: "INVALID_TOPIC_EXCEPTION",
+		19: "NOT_ENOUGH_REPLICAS",
+		20: "NOT_ENOUGH_REPLICAS_AFTER_APPEND",
+		29: "TOPIC_AUTHORIZATION_FAILED",
+		31: "CLUSTER_AUTHORIZATION_FAILED",
+		33: "UNSUPPORTED_SASL_MECHANISM",
+		34: "ILLEGAL_SASL_STATE",
+		35: "UNSUPPORTED_VERSION",
+		58: "SASL_AUTHENTICATION_FAILED",
+	}
+)
+
+type KafkaMonitor struct {
+	BrokerMonitor
+}
+
+// A connection exchanging Kafka requests and responses
+type kafkaConn struct {
+	conn          net.Conn
+	reader        *bufio.Reader
+	correlationID int32
+}
+
+func NewKafkaMonitor(rmc *RootMonitorConfig) *KafkaMonitor {
+	k := &KafkaMonitor{
+		BrokerMonitor: newBrokerMonitor(rmc, "kafka", DEFAULT_KAFKA_PORT, DEFAULT_KAFKA_TLS_PORT),
+	}
+
+	k.MonitorFunc = k.kafkaCheck
+
+	return k
+}
+
+func (k *KafkaMonitor) Validate() error {
+	if err := k.BrokerMonitor.Validate(); err != nil {
+		return err
+	}
+
+	if !kafkaTopicRegex.MatchString(k.RMC.Config.BrokerTopic) {
+		return fmt.Errorf("'broker-topic' (%v) is not a valid topic name", k.RMC.Config.BrokerTopic)
+	}
+
+	if k.RMC.Config.BrokerPartition < 0 {
+		return fmt.Errorf("'broker-partition' (%v) must be larger or equal to 0", k.RMC.Config.BrokerPartition)
+	}
+
+	return nil
+}
+
+func (k *KafkaMonitor) kafkaCheck() (*CheckResult, error) {
+	return k.brokerCheck(k.roundTrip)
+}
+
+// Look up the leader of the partition, produce the probe (waiting for all
+// in-sync replicas) and fetch it back from the offset it was written at
+func (k *KafkaMonitor) roundTrip(conn net.Conn, deadline time.Time, probe []byte) (time.Duration, error) {
+	cfg := k.RMC.Config
+	c := newKafkaConn(conn)
+
+	if err := k.authenticate(c); err != nil {
+		return 0, err
+	}
+
+	leader, err := k.leader(c)
+	if err != nil {
+		return 0, err
+	}
+
+	if leader != net.JoinHostPort(cfg.Host, strconv.Itoa(k.Port)) {
+		leaderConn, err := k.dial(leader, deadline)
+		if err != nil {
+			return 0, fmt.Errorf("partition leader: %v", err.Error())
+		}
+
+		defer leaderConn.Close()
+
+		c = newKafkaConn(leaderConn)
+
+		if err := k.authenticate(c); err != nil {
+			return 0, fmt.Errorf("partition leader %v: %v", leader, err.Error())
+		}
+	}
+
+	start := time.Now()
+
+	offset, err := k.produce(c, deadline, probe, start)
+	if err != nil {
+		return 0, err
+	}
+
+	for {
+		records, err := k.fetch(c, offset)
+		if err != nil {
+			return 0, err
+		}
+
+		value, found, err := findKafkaRecord(records, offset)
+		if err != nil {
+			return 0, err
+		}
+
+		if !found {
+			continue
+		}
+
+		if !bytes.Equal(value, probe) {
+			return 0, fmt.Errorf("record at offset %v is not the probe", offset)
+		}
+
+		return time.Since(start), nil
+	}
+}
+
+// SASL PLAIN authentication if 'broker-user' is set
+func (k *KafkaMonitor) authenticate(c *kafkaConn) error {
+	if k.RMC.Config.BrokerUser == "" {
+		return nil
+	}
+
+	d, err := c.request(kafkaAPISaslHandshake, 1, kafkaString("PLAIN"))
+	if err != nil {
+		return err
+	}
+
+	if code := int16(d.uint16()); code != 0 {
+		return fmt.Errorf("SASL handshake failed: %v", kafkaError(code))
+	}
+
+	d, err = c.request(kafkaAPISaslAuthenticate, 0, kafkaBytes(brokerPlainAuth(k.RMC.Config.BrokerUser, k.RMC.Config.BrokerPassword)))
+	if err != nil {
+		return err
+	}
+
+	if code, message := int16(d.uint16()), kafkaReadString(d); code != 0 {
+		return fmt.Errorf("authentication as '%v' failed: %v: %v", k.RMC.Config.BrokerUser, kafkaError(code), message)
+	}
+
+	return nil
+}
+
+// Address of the leader of 'broker-partition' (Metadata v1)
+func (k *KafkaMonitor) leader(c *kafkaConn) (string, error) {
+	cfg := k.RMC.Config
+
+	d, err := c.request(kafkaAPIMetadata, 1, brokerUint32(1), kafkaString(cfg.BrokerTopic))
+	if err != nil {
+		return "", err
+	}
+
+	brokers := make(map[int32]string)
+
+	for i := d.uint32(); i > 0 && d.err == nil; i-- {
+		id, host, port := int32(d.uint32()), kafkaReadString(d), d.uint32()
+		kafkaReadString(d) // rack
+
+		brokers[id] = net.JoinHostPort(host, strconv.Itoa(int(port)))
+	}
+
+	d.uint32() // controller ID
+
+	for i := d.uint32(); i > 0 && d.err == nil; i-- {
+		code, topic := int16(d.uint16()), kafkaReadString(d)
+		d.uint8() // internal
+
+		var (
+			found         bool
+			partitionCode int16
+			leader        string
+		)
+
+		for j := d.uint32(); j > 0 && d.err == nil; j-- {
+			errorCode, partition, leaderID := int16(d.uint16()), int32(d.uint32()), int32(d.uint32())
+			d.bytes(4 * int(d.uint32())) // replicas
+			d.bytes(4 * int(d.uint32())) // in-sync replicas
+
+			if partition == int32(cfg.BrokerPartition) {
+				found, partitionCode, leader = true, errorCode, brokers[leaderID]
+			}
+		}
+
+		if topic != cfg.BrokerTopic || d.err != nil {
+			continue
+		}
+
+		if code != 0 {
+			return "", fmt.Errorf("topic '%v': %v", topic, kafkaError(code))
+		}
+
+		if !found {
+			return "", fmt.Errorf("topic '%v' has no partition %v", topic, cfg.BrokerPartition)
+		}
+
+		if partitionCode != 0 {
+			return "", fmt.Errorf("partition %v of topic '%v': %v", cfg.BrokerPartition, topic, kafkaError(partitionCode))
+		}
+
+		if leader == "" {
+			return "", fmt.Errorf("leader of partition %v of topic '%v' is unknown", cfg.BrokerPartition, topic)
+		}
+
+		return leader, nil
+	}
+
+	if d.err != nil {
+		return "", fmt.Errorf("invalid metadata response: %v", d.err.Error())
+	}
+
+	return "", fmt.Errorf("topic '%v' not found", cfg.BrokerTopic)
+}
+
+// Produce the probe (Produce v3) and return its offset
+func (k *KafkaMonitor) produce(c *kafkaConn, deadline time.Time, probe []byte, timestamp time.Time) (int64, error) {
+	cfg := k.RMC.Config
+	timeout := time.Until(deadline) / time.Millisecond
+
+	d, err := c.request(kafkaAPIProduce, 3,
+		brokerUint16(0xffff), // transactional ID (null)
+		brokerUint16(0xffff), // acks: all in-sync replicas
+		brokerUint32(uint32(timeout)),
+		brokerUint32(1), kafkaString(cfg.BrokerTopic),
+		brokerUint32(1), brokerUint32(uint32(cfg.BrokerPartition)),
+		kafkaBytes(kafkaRecordBatch(probe, timestamp)),
+	)
+	if err != nil {
+		return 0, err
+	}
+
+	d.uint32()         // topics
+	kafkaReadString(d) // topic
+	d.uint32()         // partitions
+	d.uint32()         // partition
+
+	code, offset := int16(d.uint16()), int64(d.uint64())
+
+	if d.err != nil {
+		return 0, fmt.Errorf("invalid produce response: %v", d.err.Error())
+	}
+
+	if code != 0 {
+		return 0, fmt.Errorf("unable to produce to partition %v of topic '%v': %v", cfg.BrokerPartition, cfg.BrokerTopic, kafkaError(code))
+	}
+
+	return offset, nil
+}
+
+// Fetch records starting at 'offset' (Fetch v4); returns the raw record batches
+func (k *KafkaMonitor) fetch(c *kafkaConn, offset int64) ([]byte, error) {
+	cfg := k.RMC.Config
+
+	d, err := c.request(kafkaAPIFetch, 4,
+		brokerUint32(0xffffffff), // replica ID (consumer)
+		brokerUint32(kafkaFetchMaxWait),
+		brokerUint32(1), // min bytes
+		brokerUint32(kafkaMaxFetchSize),
+		[]byte{0}, // isolation level: read uncommitted
+		brokerUint32(1), kafkaString(cfg.BrokerTopic),
+		brokerUint32(1), brokerUint32(uint32(cfg.BrokerPartition)), brokerUint64(uint64(offset)), brokerUint32(kafkaMaxFetchSize),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	d.uint32()         // throttle time
+	d.uint32()         // topics
+	kafkaReadString(d) // topic
+	d.uint32()         // partitions
+	d.uint32()         // partition
+
+	code := int16(d.uint16())
+	d.bytes(16) // high watermark, last stable offset
+
+	if aborted := int32(d.uint32()); aborted > 0 {
+		d.bytes(16 * int(aborted))
+	}
+
+	records := kafkaReadBytes(d)
+
+	if d.err != nil {
+		return nil, fmt.Errorf("invalid fetch response: %v", d.err.Error())
+	}
+
+	if code != 0 {
+		return nil, fmt.Errorf("unable to fetch offset %v of partition %v of topic '%v': %v", offset, cfg.BrokerPartition, cfg.BrokerTopic, kafkaError(code))
+	}
+
+	return records, nil
+}
+
+func newKafkaConn(conn net.Conn) *kafkaConn {
+	return &kafkaConn{
+		conn:   conn,
+		reader: bufio.NewReader(conn),
+	}
+}
+
+// Send a request (header v1) and read the response body
+func (c *kafkaConn) request(apiKey, apiVersion int16, body ...[]byte) (*brokerDecoder, error) {
+	c.correlationID++
+
+	header := bytes.Join([][]byte{
+		brokerUint16(uint16(apiKey)),
+		brokerUint16(uint16(apiVersion)),
+		brokerUint32(uint32(c.correlationID)),
+		kafkaString(kafkaClientID),
+	}, nil)
+
+	message := bytes.Join(append([][]byte{header}, body...), nil)
+
+	if _, err := c.conn.Write(append(brokerUint32(uint32(len(message))), message...)); err != nil {
+		return nil, err
+	}
+
+	sizeBytes := make([]byte, 4)
+
+	if _, err := io.ReadFull(c.reader, sizeBytes); err != nil {
+		return nil, err
+	}
+
+	size := binary.BigEndian.Uint32(sizeBytes)
+
+	if size < 4 || size > kafkaMaxResponseSize {
+		return nil, fmt.Errorf("invalid response size %v", size)
+	}
+
+	response := make([]byte, size)
+
+	if _, err := io.ReadFull(c.reader, response); err != nil {
+		return nil, err
+	}
+
+	d := &brokerDecoder{data: response}
+
+	if id := int32(d.uint32()); id != c.correlationID {
+		return nil, fmt.Errorf("unexpected correlation ID %v (expected %v)", id, c.correlationID)
+	}
+
+	return d, nil
+}
+
+func kafkaError(code int16) error {
+	if name, ok := kafkaErrorCodes[code]; ok {
+		return fmt.Errorf("%v (%v)", name, code)
+	}
+
+	return fmt.Errorf("error code %v", code)
+}
+
+func kafkaString(s string) []byte {
+	return append(brokerUint16(uint16(len(s))), s...)
+}
+
+func kafkaBytes(data []byte) []byte {
+	return append(brokerUint32(uint32(len(data))), data...)
+}
+
+// Nullable strings and bytes have a length of -1
+func kafkaReadString(d *brokerDecoder) string {
+	if length := int16(d.uint16()); length > 0 {
+		return string(d.bytes(int(length)))
+	}
+
+	return ""
+}
+
+func kafkaReadBytes(d *brokerDecoder) []byte {
+	if length := int32(d.uint32()); length > 0 {
+		return d.bytes(int(length))
+	}
+
+	return nil
+}
+
+func kafkaVarint(value int64) []byte {
+	b := make([]byte, binary.MaxVarintLen64)
+
+	return b[:binary.PutVarint(b, value)]
+}
+
+// Encode a record batch (message format v2) holding a single record without key
+func kafkaRecordBatch(value []byte, timestamp time.Time) []byte {
+	record := bytes.Join([][]byte{
+		{0},             // attributes
+		kafkaVarint(0),  // timestamp delta
+		kafkaVarint(0),  // offset delta
+		kafkaVarint(-1), // key (null)
+		kafkaVarint(int64(len(value))), value,
+		kafkaVarint(0), // headers
+	}, nil)
+
+	milliseconds := uint64(timestamp.UnixNano() / int64(time.Millisecond))
+
+	// Covered by the CRC
+	tail := bytes.Join([][]byte{
+		brokerUint16(0), // attributes: no compression
+		brokerUint32(0), // last offset delta
+		brokerUint64(milliseconds),
+		brokerUint64(milliseconds),
+		brokerUint64(0xffffffffffffffff), // producer ID (none)
+		brokerUint16(0xffff),             // producer epoch
+		brokerUint32(0xffffffff),         // base sequence
+		brokerUint32(1),                  // records
+		kafkaVarint(int64(len(record))), record,
+	}, nil)
+
+	batch := bytes.Join([][]byte{
+		brokerUint32(0xffffffff), // partition leader epoch
+		{kafkaRecordBatchMagic},
+		brokerUint32(crc32.Checksum(tail, kafkaCRCTable)),
+		tail,
+	}, nil)
+
+	return bytes.Join([][]byte{brokerUint64(0), brokerUint32(uint32(len(batch))), batch}, nil)
+}
+
+// Find the value of the record at 'offset' in fetched record batches; the last
+// batch may be truncated
+func findKafkaRecord(records []byte, offset int64) ([]byte, bool, error) {
+	d := &brokerDecoder{data: records}
+
+	for len(d.data) >= 12 {
+		baseOffset, length := int64(d.uint64()), int(d.uint32())
+
+		if length > len(d.data) {
+			break
+		}
+
+		batch := &brokerDecoder{data: d.bytes(length)}
+		batch.bytes(4) // partition leader epoch
+
+		if magic := batch.uint8(); magic != kafkaRecordBatchMagic {
+			return nil, false, fmt.Errorf("unsupported message format version %v", magic)
+		}
+
+		batch.bytes(4) // CRC
+		attributes, lastOffsetDelta := batch.uint16(), int64(int32(batch.uint32()))
+
+		if offset < baseOffset || offset > baseOffset+lastOffsetDelta {
+			continue
+		}
+
+		if attributes&kafkaCompressionMask != 0 {
+			return nil, false, errors.New("compressed record batches are not supported")
+		}
+
+		batch.bytes(30) // timestamps, producer ID and epoch, base sequence
+
+		for i := batch.uint32(); i > 0 && batch.err == nil; i-- {
+			record := &brokerDecoder{data: batch.bytes(int(batch.varint()))}
+			record.uint8()  // attributes
+			record.varint() // timestamp delta
+			offsetDelta := record.varint()
+
+			if keyLength := record.varint(); keyLength > 0 {
+				record.bytes(int(keyLength))
+			}
+
+			var value []byte
+
+			if valueLength := record.varint(); valueLength >= 0 {
+				value = record.bytes(int(valueLength))
+			}
+
+			if record.err != nil {
+				return nil, false, fmt.Errorf("invalid record: %v", record.err.Error())
+			}
+
+			if baseOffset+offsetDelta == offset {
+				return value, true, nil
+			}
+		}
+
+		if batch.err != nil {
+			return nil, false, fmt.Errorf("invalid record batch: %v", batch.err.Error())
+		}
+	}
+
+	return nil, false, nil
+}
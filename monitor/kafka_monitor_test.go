@@ -0,0 +1,287 @@
+package monitor
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"net"
+	"strconv"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/9corp/9volt/util"
+)
+
+// Minimal in-process Kafka broker hosting the single partition topic 'probes';
+// metadata names 'leader' (defaults to itself) as the partition leader.
+// Produced batches are verified and appended to 'log', which starts out with a
+// foreign record at offset 0.
+type testKafkaBroker struct {
+	listener net.Listener
+	leader   *testKafkaBroker
+	user     string
+	password string
+
+	log [][]byte
+}
+
+func startTestKafkaBroker(user, password string) (*testKafkaBroker, int) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	Expect(err).To(BeNil())
+
+	broker := &testKafkaBroker{
+		listener: listener,
+		user:     user,
+		password: password,
+		log:      [][]byte{kafkaRecordBatch([]byte("order #1234"), time.Now())},
+	}
+
+	broker.leader = broker
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			go broker.serve(conn)
+		}
+	}()
+
+	return broker, listener.Addr().(*net.TCPAddr).Port
+}
+
+func (b *testKafkaBroker) serve(conn net.Conn) {
+	defer conn.Close()
+
+	reader := bufio.NewReader(conn)
+	authenticated := b.user == ""
+
+	for {
+		sizeBytes := make([]byte, 4)
+		if _, err := io.ReadFull(reader, sizeBytes); err != nil {
+			return
+		}
+
+		request := make([]byte, binary.BigEndian.Uint32(sizeBytes))
+		if _, err := io.ReadFull(reader, request); err != nil {
+			return
+		}
+
+		d := &brokerDecoder{data: request}
+		apiKey := d.uint16()
+		d.uint16() // version
+		correlationID := d.uint32()
+		kafkaReadString(d) // client ID
+
+		var response [][]byte
+
+		switch {
+		case apiKey == kafkaAPISaslHandshake:
+			response = [][]byte{brokerUint16(0), brokerUint32(1), kafkaString("PLAIN")}
+		case apiKey == kafkaAPISaslAuthenticate:
+			if !bytes.Equal(kafkaReadBytes(d), brokerPlainAuth(b.user, b.password)) {
+				response = [][]byte{brokerUint16(58), kafkaString("Invalid username or password"), kafkaBytes(nil)}
+				break
+			}
+
+			authenticated = true
+			response = [][]byte{brokerUint16(0), brokerUint16(0xffff), kafkaBytes(nil)}
+		case !authenticated:
+			return
+		case apiKey == kafkaAPIMetadata:
+			d.uint32()
+			topic := kafkaReadString(d)
+
+			host, port, _ := net.SplitHostPort(b.leader.listener.Addr().String())
+			portNumber, _ := strconv.Atoi(port)
+
+			response = [][]byte{
+				brokerUint32(1), brokerUint32(1), kafkaString(host), brokerUint32(uint32(portNumber)), brokerUint16(0xffff),
+				brokerUint32(1), // controller
+				brokerUint32(1),
+			}
+
+			if topic != "probes" {
+				response = append(response, brokerUint16(3), kafkaString(topic), []byte{0}, brokerUint32(0))
+				break
+			}
+
+			response = append(response, brokerUint16(0), kafkaString(topic), []byte{0},
+				brokerUint32(1), brokerUint16(0), brokerUint32(0), brokerUint32(1), brokerUint32(1), brokerUint32(1), brokerUint32(1), brokerUint32(1))
+		case apiKey == kafkaAPIProduce:
+			d.bytes(2 + 2 + 4 + 4) // transactional ID, acks, timeout, topics
+			topic := kafkaReadString(d)
+			d.bytes(4 + 4) // partitions, partition
+			batch := append([]byte(nil), kafkaReadBytes(d)...)
+
+			code, offset := uint16(0), uint64(len(b.log))
+
+			switch {
+			case b.leader != b:
+				code = 6
+			case crc32.Checksum(batch[21:], kafkaCRCTable) != binary.BigEndian.Uint32(batch[17:]):
+				code = 2
+			default:
+				binary.BigEndian.PutUint64(batch, offset)
+				b.log = append(b.log, batch)
+			}
+
+			response = [][]byte{brokerUint32(1), kafkaString(topic), brokerUint32(1), brokerUint32(0), brokerUint16(code), brokerUint64(offset), brokerUint64(0xffffffffffffffff), brokerUint32(0)}
+		case apiKey == kafkaAPIFetch:
+			d.bytes(4 + 4 + 4 + 4 + 1 + 4) // replica ID, max wait, min/max bytes, isolation level, topics
+			topic := kafkaReadString(d)
+			d.bytes(4 + 4) // partitions, partition
+			offset := int(d.uint64())
+
+			var records []byte
+			for i := offset; i < len(b.log); i++ {
+				records = append(records, b.log[i]...)
+			}
+
+			// A truncated batch at the end, as sent by brokers hitting 'max_bytes'
+			records = append(records, b.log[0][:20]...)
+
+			response = [][]byte{brokerUint32(0), brokerUint32(1), kafkaString(topic), brokerUint32(1), brokerUint32(0), brokerUint16(0),
+				brokerUint64(uint64(len(b.log))), brokerUint64(uint64(len(b.log))), brokerUint32(0xffffffff), kafkaBytes(records)}
+		}
+
+		message := bytes.Join(append([][]byte{brokerUint32(correlationID)}, response...), nil)
+		conn.Write(append(brokerUint32(uint32(len(message))), message...))
+	}
+}
+
+var _ = Describe("kafka_monitor", func() {
+	var (
+		monitor *KafkaMonitor
+		config  *RootMonitorConfig
+		brokers []*testKafkaBroker
+	)
+
+	start := func(user, password string) *testKafkaBroker {
+		broker, port := startTestKafkaBroker(user, password)
+		brokers = append(brokers, broker)
+
+		config.Config.Port = port
+		monitor = NewKafkaMonitor(config)
+		Expect(monitor.Validate()).To(BeNil())
+
+		return broker
+	}
+
+	BeforeEach(func() {
+		config = &RootMonitorConfig{
+			ConfigName: "kafka-probe",
+			Config: &MonitorConfig{
+				Host:        "127.0.0.1",
+				Interval:    util.CustomDuration(10 * time.Second),
+				Timeout:     util.CustomDuration(time.Second),
+				BrokerTopic: "probes",
+			},
+			Log: log.New(),
+		}
+
+		monitor = NewKafkaMonitor(config)
+	})
+
+	AfterEach(func() {
+		for _, broker := range brokers {
+			broker.listener.Close()
+		}
+
+		brokers = nil
+	})
+
+	Context("NewKafkaMonitor", func() {
+		It("returns a properly configured instance with defaults", func() {
+			Expect(monitor.Port).To(Equal(DEFAULT_KAFKA_PORT))
+			Expect(monitor.MonitorFunc).NotTo(BeNil())
+		})
+	})
+
+	Context("Validate", func() {
+		It("errors with invalid settings", func() {
+			config.Config.BrokerTopic = "probes/1"
+			Expect(monitor.Validate().Error()).To(ContainSubstring("is not a valid topic name"))
+
+			config.Config.BrokerTopic = "probes"
+			config.Config.BrokerPartition = -1
+			Expect(monitor.Validate().Error()).To(ContainSubstring("'broker-partition' (-1) must be larger or equal to 0"))
+		})
+	})
+
+	Context("kafkaCheck", func() {
+		It("produces and fetches a probe", func() {
+			broker := start("", "")
+
+			result, err := monitor.kafkaCheck()
+			Expect(err).To(BeNil())
+			Expect(broker.log).To(HaveLen(2))
+			Expect(result.Output).To(HavePrefix("Probe consumed from 'probes' after "))
+			Expect(result.Metrics[0].Name).To(Equal("latency"))
+		})
+
+		It("connects to the partition leader and authenticates", func() {
+			config.Config.BrokerUser = "monitor"
+			config.Config.BrokerPassword = "secret"
+
+			leader := start("monitor", "secret")
+			bootstrap := start("monitor", "secret")
+			bootstrap.leader = leader
+
+			_, err := monitor.kafkaCheck()
+			Expect(err).To(BeNil())
+			Expect(leader.log).To(HaveLen(2))
+			Expect(bootstrap.log).To(HaveLen(1))
+
+			config.Config.BrokerPassword = "wrong"
+			_, err = monitor.kafkaCheck()
+			Expect(err).ToNot(BeNil())
+			Expect(err.Error()).To(ContainSubstring("authentication as 'monitor' failed: SASL_AUTHENTICATION_FAILED (58): Invalid username or password"))
+		})
+
+		It("fails for unknown topics and partitions", func() {
+			config.Config.BrokerTopic = "missing"
+			start("", "")
+
+			_, err := monitor.kafkaCheck()
+			Expect(err).ToNot(BeNil())
+			Expect(err.Error()).To(ContainSubstring("topic 'missing': UNKNOWN_TOPIC_OR_PARTITION (3)"))
+
+			config.Config.BrokerTopic = "probes"
+			config.Config.BrokerPartition = 3
+			_, err = monitor.kafkaCheck()
+			Expect(err).ToNot(BeNil())
+			Expect(err.Error()).To(ContainSubstring("topic 'probes' has no partition 3"))
+		})
+	})
+
+	Context("findKafkaRecord", func() {
+		It("finds records in record batches", func() {
+			batch := kafkaRecordBatch([]byte("probe"), time.Now())
+			binary.BigEndian.PutUint64(batch, 41)
+
+			records := append(append([]byte(nil), batch...), batch[:30]...)
+
+			value, found, err := findKafkaRecord(records, 41)
+			Expect(err).To(BeNil())
+			Expect(found).To(BeTrue())
+			Expect(string(value)).To(Equal("probe"))
+
+			_, found, err = findKafkaRecord(records, 42)
+			Expect(err).To(BeNil())
+			Expect(found).To(BeFalse())
+
+			batch[16] = 1 // message format v1
+			_, _, err = findKafkaRecord(batch, 41)
+			Expect(err).ToNot(BeNil())
+			Expect(err.Error()).To(ContainSubstring("unsupported message format version 1"))
+		})
+	})
+})
@@ -0,0 +1,240 @@
+package monitor
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// Filter choices (RFC 4511 4.5.1)
+const (
+	ldapFilterAnd            = 0xa0
+	ldapFilterOr             = 0xa1
+	ldapFilterNot            = 0xa2
+	ldapFilterEqualityMatch  = 0xa3
+	ldapFilterSubstrings     = 0xa4
+	ldapFilterGreaterOrEqual = 0xa5
+	ldapFilterLessOrEqual    = 0xa6
+	ldapFilterPresent        = 0x87
+	ldapFilterApproxMatch    = 0xa8
+
+	ldapSubstringInitial = 0x80
+	ldapSubstringAny     = 0x81
+	ldapSubstringFinal   = 0x82
+)
+
+type ldapFilterParser struct {
+	filter string
+	pos    int
+}
+
+// Encode a string filter (RFC 4515), ie. '(&(objectClass=person)(uid=jdoe))';
+// the outer parentheses are optional. Extensible matches are not supported.
+func encodeLDAPFilter(filter string) ([]byte, error) {
+	filter = strings.TrimSpace(filter)
+
+	if !strings.HasPrefix(filter, "(") {
+		filter = "(" + filter + ")"
+	}
+
+	p := &ldapFilterParser{filter: filter}
+
+	encoded, err := p.parse()
+	if err != nil {
+		return nil, err
+	}
+
+	if p.pos != len(p.filter) {
+		return nil, fmt.Errorf("unexpected '%v' at position %v", p.filter[p.pos:], p.pos)
+	}
+
+	return encoded, nil
+}
+
+func (p *ldapFilterParser) parse() ([]byte, error) {
+	if p.peek() != '(' {
+		return nil, fmt.Errorf("expected '(' at position %v", p.pos)
+	}
+
+	p.pos++
+
+	var (
+		encoded []byte
+		err     error
+	)
+
+	switch p.peek() {
+	case '&':
+		p.pos++
+		encoded, err = p.parseSet(ldapFilterAnd)
+	case '|':
+		p.pos++
+		encoded, err = p.parseSet(ldapFilterOr)
+	case '!':
+		p.pos++
+
+		var inner []byte
+		if inner, err = p.parse(); err == nil {
+			encoded = berEncode(ldapFilterNot, inner)
+		}
+	default:
+		encoded, err = p.parseItem()
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if p.peek() != ')' {
+		return nil, fmt.Errorf("expected ')' at position %v", p.pos)
+	}
+
+	p.pos++
+
+	return encoded, nil
+}
+
+// An empty set is allowed (absolute true/false filters, RFC 4526)
+func (p *ldapFilterParser) parseSet(tag byte) ([]byte, error) {
+	var filters [][]byte
+
+	for p.peek() == '(' {
+		filter, err := p.parse()
+		if err != nil {
+			return nil, err
+		}
+
+		filters = append(filters, filter)
+	}
+
+	return berEncodeSequence(tag, filters...), nil
+}
+
+// Parse 'attr=value', 'attr~=value', 'attr>=value', 'attr<=value', 'attr=*'
+// (presence) or 'attr=in*it*ial' (substrings)
+func (p *ldapFilterParser) parseItem() ([]byte, error) {
+	end := strings.IndexByte(p.filter[p.pos:], ')')
+	if end < 0 {
+		return nil, fmt.Errorf("missing ')' after position %v", p.pos)
+	}
+
+	item := p.filter[p.pos : p.pos+end]
+
+	separator := strings.IndexByte(item, '=')
+	if separator < 0 {
+		return nil, fmt.Errorf("invalid filter item '%v'", item)
+	}
+
+	attribute, value := item[:separator], item[separator+1:]
+	tag := byte(ldapFilterEqualityMatch)
+
+	switch {
+	case strings.HasSuffix(attribute, "~"):
+		tag = ldapFilterApproxMatch
+	case strings.HasSuffix(attribute, ">"):
+		tag = ldapFilterGreaterOrEqual
+	case strings.HasSuffix(attribute, "<"):
+		tag = ldapFilterLessOrEqual
+	case strings.HasSuffix(attribute, ":"):
+		return nil, fmt.Errorf("extensible match filter '%v' is not supported", item)
+	}
+
+	if tag != ldapFilterEqualityMatch {
+		attribute = attribute[:len(attribute)-1]
+	}
+
+	if attribute == "" || strings.ContainsAny(attribute, "()*\\ ") {
+		return nil, fmt.Errorf("invalid attribute '%v' in filter item '%v'", attribute, item)
+	}
+
+	p.pos += end
+
+	if tag == ldapFilterEqualityMatch && value == "*" {
+		return berEncode(ldapFilterPresent, []byte(attribute)), nil
+	}
+
+	if tag == ldapFilterEqualityMatch && strings.Contains(value, "*") {
+		return encodeLDAPSubstrings(attribute, value)
+	}
+
+	unescaped, err := unescapeLDAPFilterValue(value)
+	if err != nil {
+		return nil, err
+	}
+
+	return berEncodeSequence(tag,
+		berEncode(berTagOctetString, []byte(attribute)),
+		berEncode(berTagOctetString, unescaped),
+	), nil
+}
+
+func (p *ldapFilterParser) peek() byte {
+	if p.pos >= len(p.filter) {
+		return 0
+	}
+
+	return p.filter[p.pos]
+}
+
+func encodeLDAPSubstrings(attribute, value string) ([]byte, error) {
+	parts := strings.Split(value, "*")
+
+	var substrings [][]byte
+
+	for i, part := range parts {
+		if part == "" {
+			continue
+		}
+
+		unescaped, err := unescapeLDAPFilterValue(part)
+		if err != nil {
+			return nil, err
+		}
+
+		tag := byte(ldapSubstringAny)
+
+		switch i {
+		case 0:
+			tag = ldapSubstringInitial
+		case len(parts) - 1:
+			tag = ldapSubstringFinal
+		}
+
+		substrings = append(substrings, berEncode(tag, unescaped))
+	}
+
+	if len(substrings) == 0 {
+		return nil, fmt.Errorf("invalid substrings filter value '%v'", value)
+	}
+
+	return berEncodeSequence(ldapFilterSubstrings,
+		berEncode(berTagOctetString, []byte(attribute)),
+		berEncodeSequence(berTagSequence, substrings...),
+	), nil
+}
+
+// Values escape special characters as a backslash followed by two hex digits
+func unescapeLDAPFilterValue(value string) ([]byte, error) {
+	var unescaped []byte
+
+	for i := 0; i < len(value); i++ {
+		if value[i] != '\\' {
+			unescaped = append(unescaped, value[i])
+			continue
+		}
+
+		if i+2 >= len(value) {
+			return nil, fmt.Errorf("incomplete escape sequence in filter value '%v'", value)
+		}
+
+		decoded, err := hex.DecodeString(value[i+1 : i+3])
+		if err != nil {
+			return nil, fmt.Errorf("invalid escape sequence '%v' in filter value '%v'", value[i:i+3], value)
+		}
+
+		unescaped = append(unescaped, decoded...)
+		i += 2
+	}
+
+	return unescaped, nil
+}
@@ -0,0 +1,717 @@
+package monitor
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/9corp/9volt/state"
+	"github.com/9corp/9volt/util"
+)
+
+const (
+	DEFAULT_LDAP_PORT    = 389
+	DEFAULT_LDAPS_PORT   = 636
+	DEFAULT_LDAP_TIMEOUT = time.Duration(5) * time.Second
+	DEFAULT_LDAP_FILTER  = "(objectClass=*)"
+	DEFAULT_LDAP_SCOPE   = "sub"
+
+	ldapVersion     = 3
+	ldapStartTLSOID = "1.3.6.1.4.1.1466.20037"
+	ldapNoAttrs     = "1.1" // requests no attributes (RFC 4511 4.5.1.8)
+
+	// Protocol operations (RFC 4511)
+	ldapTagBindRequest      = 0x60
+	ldapTagBindResponse     = 0x61
+	ldapTagUnbindRequest    = 0x42
+	ldapTagSearchRequest    = 0x63
+	ldapTagSearchEntry      = 0x64
+	ldapTagSearchDone       = 0x65
+	ldapTagSearchReference  = 0x73
+	ldapTagExtendedRequest  = 0x77
+	ldapTagExtendedResponse = 0x78
+	ldapTagSimpleAuth       = 0x80
+	ldapTagExtendedName     = 0x80
+
+	ldapResultSuccess           = 0
+	ldapResultSizeLimitExceeded = 4
+)
+
+var (
+	ldapScopes = map[string]int64{"base": 0, "one": 1, "sub": 2}
+
+	ldapResultCodes = map[int64]string{
+		1:  "operationsError",
+		2:  "protocolError",
+		3:  "timeLimitExceeded",
+		4:  "sizeLimitExceeded",
+		7:  "authMethodNotSupported",
+		8:  "strongerAuthRequired",
+		10: "referral",
+		11: "adminLimitExceeded",
+		13: "confidentialityRequired",
+		32: "noSuchObject",
+		34: "invalidDNSyntax",
+		48: "inappropriateAuthentication",
+		49: "invalidCredentials",
+		50: "insufficientAccessRights",
+		51: "busy",
+		52: "unavailable",
+		53: "unwillingToPerform",
+		80: "other",
+	}
+)
+
+// A single assertion on an attribute of the first entry found; multi-valued
+// attributes pass if any value matches ('!=' and '!regex': if all values match)
+type LDAPAssertion struct {
+	Attribute string `json:"attribute"`          // 'dn' matches the entry's DN
+	Operator  string `json:"operator,omitempty"` // '==' (default), '!=', '<', '<=', '>', '>=', 'regex', '!regex', 'exists', 'absent'
+	Value     string `json:"value,omitempty"`
+}
+
+func (a *LDAPAssertion) operator() string {
+	if a.Operator != "" {
+		return a.Operator
+	}
+
+	return "=="
+}
+
+func (a *LDAPAssertion) String() string {
+	return fmt.Sprintf("'%v' %v '%v'", a.Attribute, a.operator(), a.Value)
+}
+
+func (a *LDAPAssertion) evaluate(entry *ldapEntry) error {
+	var values []string
+
+	if entry != nil {
+		values = entry.values(a.Attribute)
+	}
+
+	if len(values) == 0 {
+		return compareValue(a.operator(), a.Value, "", false)
+	}
+
+	negated := a.operator() == "!=" || a.operator() == "!regex"
+
+	var err error
+
+	for _, value := range values {
+		err = compareValue(a.operator(), a.Value, value, true)
+
+		if negated && err != nil {
+			return err
+		}
+
+		if !negated && err == nil {
+			return nil
+		}
+	}
+
+	return err
+}
+
+type LDAPMonitor struct {
+	Base
+
+	Timeout   time.Duration
+	Location  *url.URL
+	TLSConfig *tls.Config // used for ldaps:// and 'ldap-starttls'
+	Filter    []byte      // encoded 'ldap-filter'
+}
+
+// A search result entry; attribute names are lower-cased
+type ldapEntry struct {
+	DN         string
+	Attributes map[string][]string
+}
+
+func (e *ldapEntry) values(attribute string) []string {
+	if strings.EqualFold(attribute, "dn") {
+		return []string{e.DN}
+	}
+
+	return e.Attributes[strings.ToLower(attribute)]
+}
+
+// The outcome of a bind, search or extended operation
+type ldapResult struct {
+	Code    int64
+	Message string // diagnostic message
+}
+
+func (r *ldapResult) Error() string {
+	name, ok := ldapResultCodes[r.Code]
+	if !ok {
+		name = "result code"
+	}
+
+	if r.Message == "" {
+		return fmt.Sprintf("%v (%v)", name, r.Code)
+	}
+
+	return fmt.Sprintf("%v (%v): %v", name, r.Code, r.Message)
+}
+
+// A connection exchanging LDAP messages
+type ldapConn struct {
+	conn      net.Conn
+	reader    *bufio.Reader
+	messageID int64
+}
+
+func NewLDAPMonitor(rmc *RootMonitorConfig) *LDAPMonitor {
+	l := &LDAPMonitor{
+		Base: Base{
+			RMC:        rmc,
+			Identifier: "ldap",
+		},
+		Timeout: DEFAULT_LDAP_TIMEOUT,
+	}
+
+	if rmc.Config.Timeout != util.CustomDuration(0) {
+		l.Timeout = time.Duration(rmc.Config.Timeout)
+	}
+
+	l.MonitorFunc = l.ldapCheck
+
+	return l
+}
+
+func (l *LDAPMonitor) Validate() error {
+	l.RMC.Log.WithField("configName", l.RMC.ConfigName).Debug("Performing monitor config validation")
+
+	cfg := l.RMC.Config
+
+	if l.Timeout >= time.Duration(cfg.Interval) {
+		return fmt.Errorf("'timeout' (%v) cannot equal or exceed 'interval' (%v)", l.Timeout.String(), cfg.Interval.String())
+	}
+
+	location, err := l.constructURL()
+	if err != nil {
+		return err
+	}
+
+	if location.Scheme == "ldaps" && cfg.LDAPStartTLS {
+		return errors.New("'ldap-starttls' cannot be used with ldaps:// (or 'tls')")
+	}
+
+	if cfg.LDAPBindDN != "" && cfg.LDAPBindPassword == "" {
+		return errors.New("'ldap-bind-password' must be set along with 'ldap-bind-dn'")
+	}
+
+	if cfg.LDAPBindPassword != "" && cfg.LDAPBindDN == "" {
+		return errors.New("'ldap-bind-password' requires 'ldap-bind-dn' to be set")
+	}
+
+	if cfg.LDAPScope != "" {
+		if _, ok := ldapScopes[cfg.LDAPScope]; !ok {
+			return fmt.Errorf("Unknown 'ldap-scope' '%v' (supported: base, one, sub)", cfg.LDAPScope)
+		}
+	}
+
+	if cfg.LDAPMinEntries < 0 {
+		return fmt.Errorf("'ldap-min-entries' (%v) must be larger or equal to 0", cfg.LDAPMinEntries)
+	}
+
+	if cfg.LDAPEntries != nil && *cfg.LDAPEntries < 0 {
+		return fmt.Errorf("'ldap-entries' (%v) must be larger or equal to 0", *cfg.LDAPEntries)
+	}
+
+	if cfg.LDAPBaseDN == "" && (cfg.LDAPFilter != "" || cfg.LDAPEntries != nil || cfg.LDAPMinEntries != 0 || len(cfg.LDAPAssertions) != 0) {
+		return errors.New("'ldap-base-dn' must be set to search")
+	}
+
+	filter, err := encodeLDAPFilter(l.filter())
+	if err != nil {
+		return fmt.Errorf("Unable to parse 'ldap-filter' '%v': %v", l.filter(), err.Error())
+	}
+
+	for i, a := range cfg.LDAPAssertions {
+		if a == nil {
+			return fmt.Errorf("Assertion #%v is empty", i)
+		}
+
+		if a.Attribute == "" {
+			return fmt.Errorf("Assertion #%v: 'attribute' must be set", i)
+		}
+
+		if !util.StringSliceContains(assertionOperators, a.operator()) {
+			return fmt.Errorf("Assertion #%v: unknown operator '%v'", i, a.Operator)
+		}
+
+		if a.operator() == "regex" || a.operator() == "!regex" {
+			if _, err := regexp.Compile(a.Value); err != nil {
+				return fmt.Errorf("Assertion #%v: unable to compile regex: %v", i, err.Error())
+			}
+		}
+	}
+
+	if location.Scheme == "ldaps" || cfg.LDAPStartTLS {
+		tlsConfig, err := newTLSClientConfig(cfg)
+		if err != nil {
+			return err
+		}
+
+		if tlsConfig.ServerName == "" {
+			tlsConfig.ServerName = location.Hostname()
+		}
+
+		l.TLSConfig = tlsConfig
+	}
+
+	l.Location = location
+	l.Filter = filter
+
+	return nil
+}
+
+// Connect (via TLS for ldaps://, optionally upgrading via StartTLS), bind as
+// 'ldap-bind-dn' (or anonymously) and, if 'ldap-base-dn' is set, search it and
+// verify the number of entries and the assertions. The whole exchange has to
+// complete within 'timeout'.
+func (l *LDAPMonitor) ldapCheck() (*CheckResult, error) {
+	if l.Location == nil {
+		if err := l.Validate(); err != nil {
+			return nil, err
+		}
+	}
+
+	cfg := l.RMC.Config
+	address := ldapAddress(l.Location)
+
+	l.RMC.Log.WithField("address", address).Debug("Performing ldap check")
+
+	conn, err := net.DialTimeout("tcp", address, l.Timeout)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to open connection to %v: %v", address, err.Error())
+	}
+	defer conn.Close()
+
+	if err := conn.SetDeadline(time.Now().Add(l.Timeout)); err != nil {
+		return nil, fmt.Errorf("Unable to set timeout (%v): %v", l.Timeout, err.Error())
+	}
+
+	if cfg.LDAPStartTLS {
+		if err := startTLSLDAP(conn); err != nil {
+			return nil, fmt.Errorf("Unable to negotiate StartTLS with %v: %v", address, err.Error())
+		}
+	}
+
+	if l.Location.Scheme == "ldaps" || cfg.LDAPStartTLS {
+		tlsConn := tls.Client(conn, l.TLSConfig)
+
+		if err := tlsConn.Handshake(); err != nil {
+			return nil, fmt.Errorf("TLS handshake with %v failed: %v", address, err.Error())
+		}
+
+		conn = tlsConn
+	}
+
+	client := newLDAPConn(conn)
+	defer client.unbind()
+
+	bindDN := cfg.LDAPBindDN
+	if bindDN == "" {
+		bindDN = "<anonymous>"
+	}
+
+	if err := client.bind(cfg.LDAPBindDN, cfg.LDAPBindPassword); err != nil {
+		return nil, fmt.Errorf("Bind as '%v' to %v failed: %v", bindDN, address, err.Error())
+	}
+
+	if cfg.LDAPBaseDN == "" {
+		return &CheckResult{Output: fmt.Sprintf("Bound as '%v'", bindDN)}, nil
+	}
+
+	entries, limited, err := client.search(cfg.LDAPBaseDN, l.scope(), l.sizeLimit(), l.Timeout, l.Filter, l.attributes())
+	if err != nil {
+		return nil, fmt.Errorf("Search for '%v' in '%v' failed: %v", l.filter(), cfg.LDAPBaseDN, err.Error())
+	}
+
+	found := strconv.Itoa(len(entries))
+	if limited {
+		found = "more than " + strconv.Itoa(len(entries)-1)
+	}
+
+	if cfg.LDAPEntries != nil && (limited || len(entries) != *cfg.LDAPEntries) {
+		return nil, fmt.Errorf("Search for '%v' in '%v' returned %v entries (expected %v)",
+			l.filter(), cfg.LDAPBaseDN, found, *cfg.LDAPEntries)
+	}
+
+	if cfg.LDAPEntries == nil && len(entries) < l.minEntries() {
+		return nil, fmt.Errorf("Search for '%v' in '%v' returned %v entries (expected at least %v)",
+			l.filter(), cfg.LDAPBaseDN, len(entries), l.minEntries())
+	}
+
+	var first *ldapEntry
+	if len(entries) != 0 {
+		first = entries[0]
+	}
+
+	for _, a := range cfg.LDAPAssertions {
+		if err := a.evaluate(first); err != nil {
+			return nil, fmt.Errorf("Assertion %v failed: %v", a, err.Error())
+		}
+	}
+
+	result := &CheckResult{
+		Output: fmt.Sprintf("Bound as '%v'; search for '%v' in '%v' returned %v entries",
+			bindDN, l.filter(), cfg.LDAPBaseDN, found),
+	}
+
+	if !limited {
+		result.Metrics = []*state.Metric{{Name: "entries", Value: float64(len(entries))}}
+	}
+
+	return result, nil
+}
+
+// Either a full ldap:// or ldaps:// 'url' or 'host', 'port' and 'tls'
+func (l *LDAPMonitor) constructURL() (*url.URL, error) {
+	cfg := l.RMC.Config
+	rawURL := cfg.HTTPURL
+
+	if rawURL == "" {
+		if cfg.Host == "" {
+			return nil, errors.New("Either 'host' or a full ldap:// or ldaps:// 'url' must be set")
+		}
+
+		scheme, port := "ldap", DEFAULT_LDAP_PORT
+		if cfg.TCPTLS {
+			scheme, port = "ldaps", DEFAULT_LDAPS_PORT
+		}
+
+		if cfg.Port != 0 {
+			port = cfg.Port
+		}
+
+		rawURL = scheme + "://" + net.JoinHostPort(cfg.Host, strconv.Itoa(port))
+	}
+
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to parse 'url' '%v': %v", rawURL, err.Error())
+	}
+
+	if u.Scheme != "ldap" && u.Scheme != "ldaps" {
+		return nil, fmt.Errorf("Unsupported scheme '%v' in 'url' (supported: ldap, ldaps)", u.Scheme)
+	}
+
+	if u.Host == "" {
+		return nil, fmt.Errorf("'url' '%v' is missing a host", rawURL)
+	}
+
+	if strings.Trim(u.Path, "/") != "" || u.RawQuery != "" {
+		return nil, fmt.Errorf("'url' '%v' cannot contain a DN or search parameters; use 'ldap-base-dn' and 'ldap-filter'", rawURL)
+	}
+
+	return u, nil
+}
+
+func (l *LDAPMonitor) filter() string {
+	if l.RMC.Config.LDAPFilter == "" {
+		return DEFAULT_LDAP_FILTER
+	}
+
+	return l.RMC.Config.LDAPFilter
+}
+
+func (l *LDAPMonitor) scope() int64 {
+	if l.RMC.Config.LDAPScope == "" {
+		return ldapScopes[DEFAULT_LDAP_SCOPE]
+	}
+
+	return ldapScopes[l.RMC.Config.LDAPScope]
+}
+
+func (l *LDAPMonitor) minEntries() int {
+	if l.RMC.Config.LDAPMinEntries == 0 {
+		return 1
+	}
+
+	return l.RMC.Config.LDAPMinEntries
+}
+
+// Only fetch as many entries as needed to verify the count; the server
+// signals that there are more via 'sizeLimitExceeded'
+func (l *LDAPMonitor) sizeLimit() int {
+	if l.RMC.Config.LDAPEntries != nil {
+		return *l.RMC.Config.LDAPEntries + 1
+	}
+
+	if len(l.RMC.Config.LDAPAssertions) != 0 {
+		return l.minEntries()
+	}
+
+	return l.minEntries() + 1
+}
+
+// Only request the attributes used by assertions
+func (l *LDAPMonitor) attributes() []string {
+	var attributes []string
+
+	for _, a := range l.RMC.Config.LDAPAssertions {
+		if !strings.EqualFold(a.Attribute, "dn") {
+			attributes = append(attributes, a.Attribute)
+		}
+	}
+
+	if len(attributes) == 0 {
+		return []string{ldapNoAttrs}
+	}
+
+	return attributes
+}
+
+// host:port for an ldap:// or ldaps:// URL, using the default port if none is set
+func ldapAddress(location *url.URL) string {
+	if location.Port() != "" {
+		return location.Host
+	}
+
+	port := DEFAULT_LDAP_PORT
+	if location.Scheme == "ldaps" {
+		port = DEFAULT_LDAPS_PORT
+	}
+
+	return net.JoinHostPort(location.Hostname(), strconv.Itoa(port))
+}
+
+// Send a StartTLS extended request (RFC 4511 4.14); the TLS handshake follows
+// a successful response
+func startTLSLDAP(conn net.Conn) error {
+	client := newLDAPConn(conn)
+
+	id, err := client.send(berEncodeSequence(ldapTagExtendedRequest,
+		berEncode(ldapTagExtendedName, []byte(ldapStartTLSOID)),
+	))
+	if err != nil {
+		return err
+	}
+
+	op, err := client.receive(id)
+	if err != nil {
+		return err
+	}
+
+	result, err := parseLDAPResult(op, ldapTagExtendedResponse)
+	if err != nil {
+		return err
+	}
+
+	if result.Code != ldapResultSuccess {
+		return result
+	}
+
+	return nil
+}
+
+func newLDAPConn(conn net.Conn) *ldapConn {
+	return &ldapConn{
+		conn:   conn,
+		reader: bufio.NewReader(conn),
+	}
+}
+
+// Simple bind; a blank DN and password bind anonymously
+func (c *ldapConn) bind(dn, password string) error {
+	id, err := c.send(berEncodeSequence(ldapTagBindRequest,
+		berEncodeInteger(berTagInteger, ldapVersion),
+		berEncode(berTagOctetString, []byte(dn)),
+		berEncode(ldapTagSimpleAuth, []byte(password)),
+	))
+	if err != nil {
+		return err
+	}
+
+	op, err := c.receive(id)
+	if err != nil {
+		return err
+	}
+
+	result, err := parseLDAPResult(op, ldapTagBindResponse)
+	if err != nil {
+		return err
+	}
+
+	if result.Code != ldapResultSuccess {
+		return result
+	}
+
+	return nil
+}
+
+// Search and collect the entries; 'limited' is set if the server stopped at
+// 'sizeLimit' entries (0 == no limit). Continuation references are ignored.
+func (c *ldapConn) search(baseDN string, scope int64, sizeLimit int, timeout time.Duration, filter []byte, attributes []string) ([]*ldapEntry, bool, error) {
+	var encodedAttributes [][]byte
+
+	for _, attribute := range attributes {
+		encodedAttributes = append(encodedAttributes, berEncode(berTagOctetString, []byte(attribute)))
+	}
+
+	id, err := c.send(berEncodeSequence(ldapTagSearchRequest,
+		berEncode(berTagOctetString, []byte(baseDN)),
+		berEncodeInteger(berTagEnumerated, scope),
+		berEncodeInteger(berTagEnumerated, 0), // never dereference aliases
+		berEncodeInteger(berTagInteger, int64(sizeLimit)),
+		berEncodeInteger(berTagInteger, int64((timeout+time.Second-1)/time.Second)),
+		berEncode(berTagBoolean, []byte{0}), // types only
+		filter,
+		berEncodeSequence(berTagSequence, encodedAttributes...),
+	))
+	if err != nil {
+		return nil, false, err
+	}
+
+	var entries []*ldapEntry
+
+	for {
+		op, err := c.receive(id)
+		if err != nil {
+			return nil, false, err
+		}
+
+		switch op.Tag {
+		case ldapTagSearchEntry:
+			entry, err := parseLDAPEntry(op)
+			if err != nil {
+				return nil, false, err
+			}
+
+			entries = append(entries, entry)
+		case ldapTagSearchReference:
+			continue
+		default:
+			result, err := parseLDAPResult(op, ldapTagSearchDone)
+			if err != nil {
+				return nil, false, err
+			}
+
+			switch result.Code {
+			case ldapResultSuccess:
+				return entries, false, nil
+			case ldapResultSizeLimitExceeded:
+				return entries, true, nil
+			}
+
+			return nil, false, result
+		}
+	}
+}
+
+// Best effort; the connection is closed right after
+func (c *ldapConn) unbind() {
+	c.send(berEncode(ldapTagUnbindRequest, nil))
+}
+
+func (c *ldapConn) send(op []byte) (int64, error) {
+	c.messageID++
+
+	message := berEncodeSequence(berTagSequence, berEncodeInteger(berTagInteger, c.messageID), op)
+
+	if _, err := c.conn.Write(message); err != nil {
+		return 0, err
+	}
+
+	return c.messageID, nil
+}
+
+// Read messages until one for message 'id' arrives and return its protocol
+// operation; unsolicited notifications (ie. notice of disconnection) fail
+func (c *ldapConn) receive(id int64) (*berValue, error) {
+	for {
+		data, err := readBER(c.reader)
+		if err != nil {
+			return nil, err
+		}
+
+		message, _, err := berDecode(data)
+		if err != nil {
+			return nil, err
+		}
+
+		elements, err := berDecodeSequence(message, berTagSequence, 2)
+		if err != nil {
+			return nil, fmt.Errorf("invalid LDAP message: %v", err.Error())
+		}
+
+		messageID, err := elements[0].Int()
+		if err != nil {
+			return nil, fmt.Errorf("invalid LDAP message ID: %v", err.Error())
+		}
+
+		if messageID == 0 {
+			if result, err := parseLDAPResult(elements[1], ldapTagExtendedResponse); err == nil {
+				return nil, fmt.Errorf("server sent an unsolicited notification: %v", result)
+			}
+
+			return nil, errors.New("server sent an unsolicited notification")
+		}
+
+		if messageID == id {
+			return elements[1], nil
+		}
+	}
+}
+
+// LDAPResult: resultCode, matchedDN, diagnosticMessage and optional referrals
+func parseLDAPResult(op *berValue, tag byte) (*ldapResult, error) {
+	elements, err := berDecodeSequence(op, tag, 3)
+	if err != nil {
+		return nil, fmt.Errorf("unexpected response: %v", err.Error())
+	}
+
+	code, err := elements[0].Int()
+	if err != nil {
+		return nil, fmt.Errorf("invalid result code: %v", err.Error())
+	}
+
+	return &ldapResult{Code: code, Message: string(elements[2].Data)}, nil
+}
+
+func parseLDAPEntry(op *berValue) (*ldapEntry, error) {
+	elements, err := berDecodeSequence(op, ldapTagSearchEntry, 2)
+	if err != nil {
+		return nil, fmt.Errorf("invalid search result entry: %v", err.Error())
+	}
+
+	attributes, err := berDecodeSequence(elements[1], berTagSequence, 0)
+	if err != nil {
+		return nil, fmt.Errorf("invalid search result entry: %v", err.Error())
+	}
+
+	entry := &ldapEntry{
+		DN:         string(elements[0].Data),
+		Attributes: make(map[string][]string),
+	}
+
+	for _, attribute := range attributes {
+		pair, err := berDecodeSequence(attribute, berTagSequence, 2)
+		if err != nil {
+			return nil, fmt.Errorf("invalid attribute in entry '%v': %v", entry.DN, err.Error())
+		}
+
+		values, err := berDecodeSequence(pair[1], berTagSet, 0)
+		if err != nil {
+			return nil, fmt.Errorf("invalid attribute values in entry '%v': %v", entry.DN, err.Error())
+		}
+
+		name := strings.ToLower(string(pair[0].Data))
+
+		for _, value := range values {
+			entry.Attributes[name] = append(entry.Attributes[name], string(value.Data))
+		}
+	}
+
+	return entry, nil
+}
@@ -0,0 +1,420 @@
+package monitor
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/hex"
+	"net"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/9corp/9volt/util"
+)
+
+const (
+	testLDAPBaseDN   = "dc=example,dc=org"
+	testLDAPBindDN   = "cn=monitor,dc=example,dc=org"
+	testLDAPPassword = "secret"
+)
+
+// Minimal in-process LDAP server; accepts binds as 'testLDAPBindDN' (or
+// anonymous) and answers searches below 'testLDAPBaseDN' with 'entries',
+// ignoring the filter. If 'tlsConfig' is set, it either supports StartTLS or
+// (with 'implicitTLS') only accepts TLS connections.
+type testLDAPServer struct {
+	listener  net.Listener
+	tlsConfig *tls.Config
+	entries   []*ldapEntry
+
+	filters chan string // hex encoded filters of received searches
+}
+
+func startTestLDAPServer(tlsConfig *tls.Config, implicitTLS bool) (*testLDAPServer, int) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	Expect(err).To(BeNil())
+
+	if implicitTLS {
+		listener, tlsConfig = tls.NewListener(listener, tlsConfig), nil
+	}
+
+	server := &testLDAPServer{
+		listener:  listener,
+		tlsConfig: tlsConfig,
+		filters:   make(chan string, 10),
+		entries: []*ldapEntry{
+			{DN: "uid=jdoe,ou=people," + testLDAPBaseDN, Attributes: map[string][]string{
+				"objectClass": {"top", "inetOrgPerson"},
+				"mail":        {"jdoe@example.org"},
+			}},
+			{DN: "uid=asmith,ou=people," + testLDAPBaseDN, Attributes: map[string][]string{
+				"objectClass": {"top", "inetOrgPerson"},
+			}},
+		},
+	}
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			go server.serve(conn)
+		}
+	}()
+
+	return server, listener.Addr().(*net.TCPAddr).Port
+}
+
+func (s *testLDAPServer) serve(conn net.Conn) {
+	defer conn.Close()
+
+	reader := bufio.NewReader(conn)
+
+	for {
+		data, err := readBER(reader)
+		if err != nil {
+			return
+		}
+
+		message, _, _ := berDecode(data)
+		elements, err := berDecodeSequence(message, berTagSequence, 2)
+		if err != nil {
+			return
+		}
+
+		id, _ := elements[0].Int()
+		op := elements[1]
+
+		reply := func(ops ...[]byte) {
+			for _, op := range ops {
+				conn.Write(berEncodeSequence(berTagSequence, berEncodeInteger(berTagInteger, id), op))
+			}
+		}
+
+		switch op.Tag {
+		case ldapTagBindRequest:
+			request, _ := berDecodeSequence(op, ldapTagBindRequest, 3)
+			dn, password := string(request[1].Data), string(request[2].Data)
+
+			if (dn == "" && password == "") || (dn == testLDAPBindDN && password == testLDAPPassword) {
+				reply(testLDAPResult(ldapTagBindResponse, ldapResultSuccess, ""))
+			} else {
+				reply(testLDAPResult(ldapTagBindResponse, 49, "invalid credentials"))
+			}
+		case ldapTagExtendedRequest:
+			request, _ := berDecodeSequence(op, ldapTagExtendedRequest, 1)
+
+			if s.tlsConfig == nil || string(request[0].Data) != ldapStartTLSOID {
+				reply(testLDAPResult(ldapTagExtendedResponse, 2, "unsupported extended operation"))
+				continue
+			}
+
+			reply(testLDAPResult(ldapTagExtendedResponse, ldapResultSuccess, ""))
+
+			tlsConn := tls.Server(conn, s.tlsConfig)
+			conn, reader = tlsConn, bufio.NewReader(tlsConn)
+		case ldapTagSearchRequest:
+			request, _ := berDecodeSequence(op, ldapTagSearchRequest, 8)
+			sizeLimit, _ := request[3].Int()
+
+			s.filters <- hex.EncodeToString(berEncode(request[6].Tag, request[6].Data))
+
+			if !strings.HasSuffix(string(request[0].Data), testLDAPBaseDN) {
+				reply(testLDAPResult(ldapTagSearchDone, 32, ""))
+				continue
+			}
+
+			attributes, _ := berDecodeSequence(request[7], berTagSequence, 0)
+
+			for i, entry := range s.entries {
+				if sizeLimit != 0 && int64(i) == sizeLimit {
+					reply(testLDAPResult(ldapTagSearchDone, ldapResultSizeLimitExceeded, ""))
+					break
+				}
+
+				reply(testLDAPEntry(entry, attributes))
+
+				if i == len(s.entries)-1 {
+					reply(testLDAPResult(ldapTagSearchDone, ldapResultSuccess, ""))
+				}
+			}
+
+			if len(s.entries) == 0 {
+				reply(testLDAPResult(ldapTagSearchDone, ldapResultSuccess, ""))
+			}
+		case ldapTagUnbindRequest:
+			return
+		}
+	}
+}
+
+func testLDAPResult(tag byte, code int64, message string) []byte {
+	return berEncodeSequence(tag,
+		berEncodeInteger(berTagEnumerated, code),
+		berEncode(berTagOctetString, nil),
+		berEncode(berTagOctetString, []byte(message)),
+	)
+}
+
+// Encode an entry with the requested attributes (matched case-insensitively)
+func testLDAPEntry(entry *ldapEntry, requested []*berValue) []byte {
+	var attributes [][]byte
+
+	for name, values := range entry.Attributes {
+		for _, r := range requested {
+			if !strings.EqualFold(string(r.Data), name) {
+				continue
+			}
+
+			var encoded [][]byte
+			for _, value := range values {
+				encoded = append(encoded, berEncode(berTagOctetString, []byte(value)))
+			}
+
+			attributes = append(attributes, berEncodeSequence(berTagSequence,
+				berEncode(berTagOctetString, []byte(name)),
+				berEncodeSequence(berTagSet, encoded...),
+			))
+		}
+	}
+
+	return berEncodeSequence(ldapTagSearchEntry,
+		berEncode(berTagOctetString, []byte(entry.DN)),
+		berEncodeSequence(berTagSequence, attributes...),
+	)
+}
+
+var _ = Describe("ldap_monitor", func() {
+	var (
+		monitor *LDAPMonitor
+		config  *RootMonitorConfig
+		server  *testLDAPServer
+	)
+
+	intPtr := func(i int) *int {
+		return &i
+	}
+
+	start := func(tlsConfig *tls.Config, implicitTLS bool) {
+		server, config.Config.Port = startTestLDAPServer(tlsConfig, implicitTLS)
+		monitor = NewLDAPMonitor(config)
+		Expect(monitor.Validate()).To(BeNil())
+	}
+
+	BeforeEach(func() {
+		config = &RootMonitorConfig{
+			Config: &MonitorConfig{
+				Host:             "127.0.0.1",
+				Interval:         util.CustomDuration(10 * time.Second),
+				LDAPBindDN:       testLDAPBindDN,
+				LDAPBindPassword: testLDAPPassword,
+				LDAPBaseDN:       testLDAPBaseDN,
+				LDAPFilter:       "(objectClass=inetOrgPerson)",
+			},
+			Log: log.New(),
+		}
+
+		monitor = NewLDAPMonitor(config)
+	})
+
+	AfterEach(func() {
+		if server != nil {
+			server.listener.Close()
+			server = nil
+		}
+	})
+
+	Context("NewLDAPMonitor", func() {
+		It("returns a properly configured instance with defaults", func() {
+			Expect(monitor.Timeout).To(Equal(DEFAULT_LDAP_TIMEOUT))
+			Expect(monitor.MonitorFunc).NotTo(BeNil())
+		})
+	})
+
+	Context("Validate", func() {
+		It("returns nil with correct settings", func() {
+			Expect(monitor.Validate()).To(BeNil())
+			Expect(monitor.Location.String()).To(Equal("ldap://127.0.0.1:389"))
+			Expect(monitor.scope()).To(Equal(int64(2)))
+			Expect(monitor.TLSConfig).To(BeNil())
+		})
+
+		It("builds the URL from 'tls' and accepts ldap(s):// URLs", func() {
+			config.Config.TCPTLS = true
+			Expect(monitor.Validate()).To(BeNil())
+			Expect(monitor.Location.String()).To(Equal("ldaps://127.0.0.1:636"))
+			Expect(monitor.TLSConfig.ServerName).To(Equal("127.0.0.1"))
+
+			config.Config.HTTPURL = "ldaps://ldap.example.org"
+			Expect(monitor.Validate()).To(BeNil())
+			Expect(ldapAddress(monitor.Location)).To(Equal("ldap.example.org:636"))
+
+			config.Config.HTTPURL = "http://ldap.example.org"
+			Expect(monitor.Validate().Error()).To(ContainSubstring("Unsupported scheme 'http'"))
+
+			config.Config.HTTPURL = "ldap://ldap.example.org/dc=example,dc=org?uid"
+			Expect(monitor.Validate().Error()).To(ContainSubstring("cannot contain a DN"))
+		})
+
+		It("errors with invalid settings", func() {
+			config.Config.LDAPBindPassword = ""
+			Expect(monitor.Validate().Error()).To(ContainSubstring("'ldap-bind-password' must be set"))
+
+			config.Config.LDAPBindPassword = testLDAPPassword
+			config.Config.HTTPURL = "ldaps://ldap.example.org"
+			config.Config.LDAPStartTLS = true
+			Expect(monitor.Validate().Error()).To(ContainSubstring("'ldap-starttls' cannot be used with ldaps://"))
+
+			config.Config.HTTPURL = ""
+			config.Config.LDAPScope = "subtree"
+			Expect(monitor.Validate().Error()).To(ContainSubstring("Unknown 'ldap-scope' 'subtree'"))
+
+			config.Config.LDAPScope = "one"
+			config.Config.LDAPFilter = "(uid=jdoe"
+			Expect(monitor.Validate().Error()).To(ContainSubstring("Unable to parse 'ldap-filter'"))
+
+			config.Config.LDAPFilter = ""
+			config.Config.LDAPAssertions = []*LDAPAssertion{{Attribute: "mail", Operator: "~"}}
+			Expect(monitor.Validate().Error()).To(ContainSubstring("unknown operator '~'"))
+
+			config.Config.LDAPAssertions = nil
+			config.Config.LDAPBaseDN = ""
+			config.Config.LDAPEntries = intPtr(1)
+			Expect(monitor.Validate().Error()).To(ContainSubstring("'ldap-base-dn' must be set"))
+		})
+	})
+
+	Context("ldapCheck", func() {
+		It("binds, searches and counts the entries", func() {
+			start(nil, false)
+
+			result, err := monitor.ldapCheck()
+			Expect(err).To(BeNil())
+			Expect(<-server.filters).To(Equal("a31c040b" + hex.EncodeToString([]byte("objectClass")) + "040d" + hex.EncodeToString([]byte("inetOrgPerson"))))
+			Expect(result.Output).To(ContainSubstring("returned 2 entries"))
+
+			config.Config.LDAPEntries = intPtr(2)
+			result, err = monitor.ldapCheck()
+			Expect(err).To(BeNil())
+			Expect(result.Metrics).To(HaveLen(1))
+			Expect(result.Metrics[0].Name).To(Equal("entries"))
+			Expect(result.Metrics[0].Value).To(Equal(2.0))
+
+			config.Config.LDAPEntries = intPtr(1)
+			_, err = monitor.ldapCheck()
+			Expect(err).ToNot(BeNil())
+			Expect(err.Error()).To(ContainSubstring("returned 2 entries (expected 1)"))
+
+			config.Config.LDAPEntries = nil
+			config.Config.LDAPMinEntries = 3
+			_, err = monitor.ldapCheck()
+			Expect(err).ToNot(BeNil())
+			Expect(err.Error()).To(ContainSubstring("returned 2 entries (expected at least 3)"))
+		})
+
+		It("only binds if no base DN is set", func() {
+			config.Config.LDAPBaseDN = ""
+			config.Config.LDAPFilter = ""
+			start(nil, false)
+
+			result, err := monitor.ldapCheck()
+			Expect(err).To(BeNil())
+			Expect(result.Output).To(Equal("Bound as '" + testLDAPBindDN + "'"))
+			Expect(server.filters).To(BeEmpty())
+		})
+
+		It("fails on invalid credentials or search errors", func() {
+			config.Config.LDAPBindPassword = "wrong"
+			start(nil, false)
+
+			_, err := monitor.ldapCheck()
+			Expect(err).ToNot(BeNil())
+			Expect(err.Error()).To(ContainSubstring("failed: invalidCredentials (49): invalid credentials"))
+
+			config.Config.LDAPBindPassword = testLDAPPassword
+			config.Config.LDAPBaseDN = "dc=example,dc=com"
+			_, err = monitor.ldapCheck()
+			Expect(err).ToNot(BeNil())
+			Expect(err.Error()).To(ContainSubstring("failed: noSuchObject (32)"))
+		})
+
+		It("evaluates assertions against the first entry", func() {
+			config.Config.LDAPAssertions = []*LDAPAssertion{
+				{Attribute: "DN", Operator: "regex", Value: "^uid=jdoe,"},
+				{Attribute: "objectclass", Value: "inetOrgPerson"},
+				{Attribute: "mail", Operator: "!=", Value: "root@example.org"},
+			}
+			start(nil, false)
+
+			_, err := monitor.ldapCheck()
+			Expect(err).To(BeNil())
+
+			config.Config.LDAPAssertions = append(config.Config.LDAPAssertions, &LDAPAssertion{Attribute: "telephoneNumber", Operator: "exists"})
+			_, err = monitor.ldapCheck()
+			Expect(err).ToNot(BeNil())
+			Expect(err.Error()).To(ContainSubstring("Assertion 'telephoneNumber' exists '' failed"))
+		})
+
+		It("supports StartTLS and ldaps://", func() {
+			_, cert := generateTestCerts([]string{"127.0.0.1"}, time.Now().Add(time.Hour))
+			tlsConfig := &tls.Config{Certificates: []tls.Certificate{cert}}
+
+			config.Config.LDAPStartTLS = true
+			config.Config.TLSInsecureSkipVerify = true
+			start(tlsConfig, false)
+
+			_, err := monitor.ldapCheck()
+			Expect(err).To(BeNil())
+			server.listener.Close()
+
+			config.Config.LDAPStartTLS = false
+			config.Config.TCPTLS = true
+			start(tlsConfig, true)
+
+			_, err = monitor.ldapCheck()
+			Expect(err).To(BeNil())
+			Expect(monitor.Location.Scheme).To(Equal("ldaps"))
+		})
+
+		It("fails if StartTLS is not supported", func() {
+			config.Config.LDAPStartTLS = true
+			start(nil, false)
+
+			_, err := monitor.ldapCheck()
+			Expect(err).ToNot(BeNil())
+			Expect(err.Error()).To(ContainSubstring("Unable to negotiate StartTLS"))
+		})
+	})
+
+	Context("encodeLDAPFilter", func() {
+		It("encodes filters", func() {
+			filters := map[string]string{
+				"(uid=jdoe)":           "a30b04037569640404" + "6a646f65",
+				"(objectClass=*)":      "870b" + hex.EncodeToString([]byte("objectClass")),
+				"(cn=*smith)":          "a40d0402636e30078205736d697468",
+				"uid=jdoe":             "a30b04037569640404" + "6a646f65",
+				"(!(uid=jdoe))":        "a20d" + "a30b04037569640404" + "6a646f65",
+				"(cn=a\\2ab)":          "a3090402636e0403612a62",
+				"(&(uid=jdoe)(cn>=a))": "a016" + "a30b04037569640404" + "6a646f65" + "a5070402636e040161",
+			}
+
+			for filter, expected := range filters {
+				encoded, err := encodeLDAPFilter(filter)
+				Expect(err).To(BeNil(), filter)
+				Expect(hex.EncodeToString(encoded)).To(Equal(expected), filter)
+			}
+		})
+
+		It("errors on invalid filters", func() {
+			for _, filter := range []string{"", "(uid=jdoe", "(uid)", "(cn=**)", "(cn=a\\2)", "(cn:dn:=x)", "(uid=jdoe))"} {
+				_, err := encodeLDAPFilter(filter)
+				Expect(err).ToNot(BeNil(), filter)
+			}
+		})
+	})
+})
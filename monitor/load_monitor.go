@@ -0,0 +1,117 @@
+package monitor
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+
+	"github.com/9corp/9volt/state"
+)
+
+const (
+	DEFAULT_LOAD_PERIOD = "5m"
+)
+
+var (
+	// Field index in /proc/loadavg
+	loadPeriods = map[string]int{"1m": 0, "5m": 1, "15m": 2}
+)
+
+type LoadMonitor struct {
+	Base
+
+	ProcRoot string
+	Period   string
+	NumCPU   int
+}
+
+func NewLoadMonitor(rmc *RootMonitorConfig) *LoadMonitor {
+	l := &LoadMonitor{
+		Base: Base{
+			RMC:        rmc,
+			Identifier: "load",
+		},
+		ProcRoot: DEFAULT_PROC_ROOT,
+		Period:   DEFAULT_LOAD_PERIOD,
+		NumCPU:   runtime.NumCPU(),
+	}
+
+	if rmc.Config.LoadPeriod != "" {
+		l.Period = rmc.Config.LoadPeriod
+	}
+
+	l.MonitorFunc = l.loadCheck
+
+	return l
+}
+
+func (l *LoadMonitor) Validate() error {
+	l.RMC.Log.WithField("configName", l.RMC.ConfigName).Debug("Performing monitor config validation")
+
+	if err := checkProcSupport(l.Identifier); err != nil {
+		return err
+	}
+
+	if _, ok := loadPeriods[l.Period]; !ok {
+		return fmt.Errorf("Unknown 'load-period' '%v' (supported: 1m, 5m, 15m)", l.Period)
+	}
+
+	return validateLocalThresholds("load-", l.RMC.Config.LoadWarning, l.RMC.Config.LoadCritical, COMPARISON_ABOVE, 0)
+}
+
+// Compare the load average (optionally divided by the number of CPUs) against
+// the configured thresholds
+func (l *LoadMonitor) loadCheck() (*CheckResult, error) {
+	cfg := l.RMC.Config
+
+	loads, err := readLoadAvg(filepath.Join(l.ProcRoot, "loadavg"))
+	if err != nil {
+		return nil, err
+	}
+
+	load := loads[loadPeriods[l.Period]]
+	description := fmt.Sprintf("%v load average", l.Period)
+
+	if cfg.LoadPerCPU {
+		load = roundLocalValue(load / float64(l.NumCPU))
+		description = fmt.Sprintf("%v load average per CPU", l.Period)
+	}
+
+	result := &CheckResult{
+		Output: fmt.Sprintf("load average: %.2f, %.2f, %.2f (%v CPUs)", loads[0], loads[1], loads[2], l.NumCPU),
+		Metrics: []*state.Metric{
+			thresholdMetric("load"+strings.TrimSuffix(l.Period, "m"), load, "", cfg.LoadWarning, cfg.LoadCritical),
+		},
+	}
+
+	return result, checkThresholds(description, load, "", cfg.LoadWarning, cfg.LoadCritical, COMPARISON_ABOVE)
+}
+
+// Read the 1, 5 and 15 minute load averages
+func readLoadAvg(path string) ([3]float64, error) {
+	var loads [3]float64
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return loads, fmt.Errorf("Unable to read load average: %v", err.Error())
+	}
+
+	fields := strings.Fields(string(data))
+	if len(fields) < 3 {
+		return loads, fmt.Errorf("Unexpected contents in '%v': %q", path, string(data))
+	}
+
+	for i := range loads {
+		value, err := strconv.ParseFloat(fields[i], 64)
+		if err != nil {
+			return loads, fmt.Errorf("Unable to parse load average '%v' in '%v'", fields[i], path)
+		}
+
+		loads[i] = value
+	}
+
+	return loads, nil
+}
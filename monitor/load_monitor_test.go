@@ -0,0 +1,98 @@
+package monitor
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/9corp/9volt/util"
+)
+
+var _ = Describe("load_monitor", func() {
+	var (
+		monitor  *LoadMonitor
+		config   *RootMonitorConfig
+		procRoot string
+	)
+
+	float := func(f float64) *float64 {
+		return &f
+	}
+
+	BeforeEach(func() {
+		var err error
+
+		procRoot, err = ioutil.TempDir("", "9volt-proc")
+		Expect(err).To(BeNil())
+		Expect(ioutil.WriteFile(filepath.Join(procRoot, "loadavg"), []byte("3.20 6.40 1.60 2/1024 31337\n"), 0644)).To(BeNil())
+
+		config = &RootMonitorConfig{
+			Config: &MonitorConfig{
+				Interval:     util.CustomDuration(time.Minute),
+				LoadWarning:  float(4),
+				LoadCritical: float(8),
+			},
+			Log: log.New(),
+		}
+
+		monitor = NewLoadMonitor(config)
+		monitor.ProcRoot = procRoot
+		monitor.NumCPU = 4
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(procRoot)
+	})
+
+	Context("Validate", func() {
+		It("returns nil with correct settings", func() {
+			Expect(monitor.Validate()).To(BeNil())
+			Expect(monitor.Period).To(Equal(DEFAULT_LOAD_PERIOD))
+		})
+
+		It("verifies period and thresholds", func() {
+			monitor.Period = "10m"
+			Expect(monitor.Validate().Error()).To(ContainSubstring("Unknown 'load-period' '10m'"))
+
+			monitor.Period = "1m"
+			config.Config.LoadWarning = float(-1)
+			Expect(monitor.Validate().Error()).To(ContainSubstring("'load-warning' (-1) cannot be negative"))
+		})
+	})
+
+	Context("loadCheck", func() {
+		It("compares the selected load average against the thresholds", func() {
+			result, err := monitor.loadCheck()
+			Expect(err.(*StateError).State).To(Equal(WARNING))
+			Expect(err.(*StateError).Capped).To(BeTrue())
+			Expect(err.Error()).To(Equal("5m load average (6.4) is above warning threshold (4)"))
+			Expect(result.Output).To(Equal("load average: 3.20, 6.40, 1.60 (4 CPUs)"))
+			Expect(result.Metrics[0].Name).To(Equal("load5"))
+
+			monitor.Period = "15m"
+			_, err = monitor.loadCheck()
+			Expect(err).To(BeNil())
+		})
+
+		It("optionally divides by the number of CPUs", func() {
+			config.Config.LoadPerCPU = true
+			config.Config.LoadWarning = float(1)
+			config.Config.LoadCritical = float(1.5)
+
+			_, err := monitor.loadCheck()
+			Expect(err).NotTo(BeAssignableToTypeOf(&StateError{}))
+			Expect(err.Error()).To(ContainSubstring("5m load average per CPU (1.6) is above critical threshold (1.5)"))
+		})
+
+		It("fails if the load average cannot be read", func() {
+			monitor.ProcRoot = "/does/not/exist"
+			_, err := monitor.loadCheck()
+			Expect(err.Error()).To(ContainSubstring("Unable to read load average"))
+		})
+	})
+})
@@ -0,0 +1,42 @@
+package monitor
+
+import (
+	"fmt"
+	"math"
+)
+
+const (
+	// Local resource monitors ('disk', 'load', 'memory', 'process', 'file') check
+	// the member running the check; use 'member-tag' to pin them to a host
+	DEFAULT_PROC_ROOT = "/proc"
+)
+
+// Verify that (optional) thresholds for values that cannot be negative (ie.
+// percentages or load averages) are within range and ordered properly; a 'max'
+// of 0 means there is no upper bound
+func validateLocalThresholds(prefix string, warning, critical *float64, comparison string, max float64) error {
+	thresholds := []*float64{warning, critical}
+
+	for i, key := range []string{prefix + "warning", prefix + "critical"} {
+		threshold := thresholds[i]
+
+		if threshold == nil {
+			continue
+		}
+
+		if *threshold < 0 {
+			return fmt.Errorf("'%v' (%v) cannot be negative", key, *threshold)
+		}
+
+		if max != 0 && *threshold > max {
+			return fmt.Errorf("'%v' (%v) cannot exceed %v", key, *threshold, max)
+		}
+	}
+
+	return validateThresholds(prefix, warning, critical, comparison)
+}
+
+// Round to two decimals, so values read nicely in messages and metrics
+func roundLocalValue(value float64) float64 {
+	return math.Round(value*100) / 100
+}
@@ -0,0 +1,158 @@
+package monitor
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/9corp/9volt/util"
+)
+
+const (
+	DEFAULT_MAIL_TIMEOUT = time.Duration(10) * time.Second
+	DEFAULT_MAIL_MAILBOX = "INBOX"
+)
+
+// Shared settings and logic for the 'smtp', 'imap' and 'pop3' monitors
+type MailMonitor struct {
+	Base
+
+	Timeout   time.Duration
+	Port      int
+	TLSConfig *tls.Config // used for 'tls' (implicit TLS) and 'mail-starttls'
+}
+
+// Looks up an advertised extension (EHLO keyword, IMAP capability or POP3 CAPA
+// tag); returns whether it is present and its parameters
+type extensionLookup func(keyword string) (bool, string)
+
+func newMailMonitor(rmc *RootMonitorConfig, identifier string, defaultPort, defaultTLSPort int) MailMonitor {
+	m := MailMonitor{
+		Base: Base{
+			RMC:        rmc,
+			Identifier: identifier,
+		},
+		Timeout: DEFAULT_MAIL_TIMEOUT,
+		Port:    defaultPort,
+	}
+
+	if rmc.Config.TCPTLS {
+		m.Port = defaultTLSPort
+	}
+
+	if rmc.Config.Timeout != util.CustomDuration(0) {
+		m.Timeout = time.Duration(rmc.Config.Timeout)
+	}
+
+	if rmc.Config.Port != 0 {
+		m.Port = rmc.Config.Port
+	}
+
+	return m
+}
+
+func (m *MailMonitor) Validate() error {
+	m.RMC.Log.WithField("configName", m.RMC.ConfigName).Debug("Performing monitor config validation")
+
+	if m.RMC.Config.Host == "" {
+		return errors.New("'host' must be set")
+	}
+
+	if m.Timeout >= time.Duration(m.RMC.Config.Interval) {
+		return fmt.Errorf("'timeout' (%v) cannot equal or exceed 'interval' (%v)", m.Timeout.String(), m.RMC.Config.Interval.String())
+	}
+
+	if m.RMC.Config.TCPTLS && m.RMC.Config.MailStartTLS {
+		return errors.New("'tls' and 'mail-starttls' cannot both be set")
+	}
+
+	if m.RMC.Config.MailPassword != "" && m.RMC.Config.MailUser == "" {
+		return errors.New("'mail-password' requires 'mail-user' to be set")
+	}
+
+	if m.RMC.Config.TCPTLS || m.RMC.Config.MailStartTLS {
+		tlsConfig, err := newTLSClientConfig(m.RMC.Config)
+		if err != nil {
+			return err
+		}
+
+		if tlsConfig.ServerName == "" {
+			tlsConfig.ServerName = m.RMC.Config.Host
+		}
+
+		m.TLSConfig = tlsConfig
+	}
+
+	return nil
+}
+
+// TLS config to use right after connecting; nil unless 'tls' is set
+func (m *MailMonitor) implicitTLS() *tls.Config {
+	if !m.RMC.Config.TCPTLS {
+		return nil
+	}
+
+	return m.TLSConfig
+}
+
+// Return the 'expected' extensions that are not advertised. An entry may list
+// required parameters after the keyword (ie. 'AUTH PLAIN' or 'SASL PLAIN').
+func missingExtensions(expected []string, lookup extensionLookup) []string {
+	var missing []string
+
+	for _, entry := range expected {
+		fields := strings.Fields(entry)
+		if len(fields) == 0 {
+			continue
+		}
+
+		found, params := lookup(strings.ToUpper(fields[0]))
+
+		for _, param := range fields[1:] {
+			if !containsFold(strings.Fields(params), param) {
+				found = false
+			}
+		}
+
+		if !found {
+			missing = append(missing, entry)
+		}
+	}
+
+	return missing
+}
+
+func containsFold(list []string, value string) bool {
+	for _, entry := range list {
+		if strings.EqualFold(entry, value) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Build a lookup from 'KEYWORD params...' style lines (POP3 CAPA, IMAP capabilities)
+func newExtensionMap(lines []string) map[string]string {
+	extensions := make(map[string]string)
+
+	for _, line := range lines {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+
+		extensions[strings.ToUpper(fields[0])] = strings.Join(fields[1:], " ")
+	}
+
+	return extensions
+}
+
+func mapLookup(extensions map[string]string) extensionLookup {
+	return func(keyword string) (bool, string) {
+		params, ok := extensions[keyword]
+		return ok, params
+	}
+}
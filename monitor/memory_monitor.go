@@ -0,0 +1,114 @@
+package monitor
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/9corp/9volt/state"
+)
+
+type MemoryMonitor struct {
+	Base
+
+	ProcRoot string
+}
+
+func NewMemoryMonitor(rmc *RootMonitorConfig) *MemoryMonitor {
+	m := &MemoryMonitor{
+		Base: Base{
+			RMC:        rmc,
+			Identifier: "memory",
+		},
+		ProcRoot: DEFAULT_PROC_ROOT,
+	}
+
+	m.MonitorFunc = m.memoryCheck
+
+	return m
+}
+
+func (m *MemoryMonitor) Validate() error {
+	m.RMC.Log.WithField("configName", m.RMC.ConfigName).Debug("Performing monitor config validation")
+
+	if err := checkProcSupport(m.Identifier); err != nil {
+		return err
+	}
+
+	return validateLocalThresholds("memory-available-", m.RMC.Config.MemoryAvailableWarning,
+		m.RMC.Config.MemoryAvailableCritical, COMPARISON_BELOW, 100)
+}
+
+// Compare available memory (in percent of total memory) against the configured
+// thresholds; alerts when available memory drops *below* a threshold
+func (m *MemoryMonitor) memoryCheck() (*CheckResult, error) {
+	cfg := m.RMC.Config
+
+	meminfo, err := readMeminfo(filepath.Join(m.ProcRoot, "meminfo"))
+	if err != nil {
+		return nil, err
+	}
+
+	total := meminfo["MemTotal"]
+	if total == 0 {
+		return nil, fmt.Errorf("Unable to determine total memory from '%v'", filepath.Join(m.ProcRoot, "meminfo"))
+	}
+
+	// MemAvailable was added in Linux 3.14; approximate it on older kernels
+	available, ok := meminfo["MemAvailable"]
+	if !ok {
+		available = meminfo["MemFree"] + meminfo["Buffers"] + meminfo["Cached"]
+	}
+
+	availablePercent := roundLocalValue(float64(available) / float64(total) * 100)
+
+	result := &CheckResult{
+		Output: fmt.Sprintf("%v MB of %v MB available (%.2f%%)", available/1024, total/1024, availablePercent),
+		Metrics: []*state.Metric{
+			thresholdMetric("available", availablePercent, "%", cfg.MemoryAvailableWarning, cfg.MemoryAvailableCritical),
+		},
+	}
+
+	return result, checkThresholds("Available memory", availablePercent, "%", cfg.MemoryAvailableWarning, cfg.MemoryAvailableCritical, COMPARISON_BELOW)
+}
+
+// Parse /proc/meminfo; values are in kB
+func readMeminfo(path string) (map[string]uint64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read memory info: %v", err.Error())
+	}
+	defer f.Close()
+
+	meminfo := make(map[string]uint64, 0)
+	scanner := bufio.NewScanner(f)
+
+	for scanner.Scan() {
+		// ie. 'MemAvailable:    8046616 kB'
+		parts := strings.SplitN(scanner.Text(), ":", 2)
+		if len(parts) != 2 {
+			continue
+		}
+
+		fields := strings.Fields(parts[1])
+		if len(fields) == 0 {
+			continue
+		}
+
+		value, err := strconv.ParseUint(fields[0], 10, 64)
+		if err != nil {
+			continue
+		}
+
+		meminfo[strings.TrimSpace(parts[0])] = value
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("Unable to read memory info: %v", err.Error())
+	}
+
+	return meminfo, nil
+}
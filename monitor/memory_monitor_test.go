@@ -0,0 +1,87 @@
+package monitor
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/9corp/9volt/util"
+)
+
+var _ = Describe("memory_monitor", func() {
+	var (
+		monitor  *MemoryMonitor
+		config   *RootMonitorConfig
+		procRoot string
+	)
+
+	float := func(f float64) *float64 {
+		return &f
+	}
+
+	meminfo := func(contents string) {
+		Expect(ioutil.WriteFile(filepath.Join(procRoot, "meminfo"), []byte(contents), 0644)).To(BeNil())
+	}
+
+	BeforeEach(func() {
+		var err error
+
+		procRoot, err = ioutil.TempDir("", "9volt-proc")
+		Expect(err).To(BeNil())
+
+		meminfo("MemTotal:       16000000 kB\nMemFree:          800000 kB\nMemAvailable:    2400000 kB\nBuffers:          100000 kB\n")
+
+		config = &RootMonitorConfig{
+			Config: &MonitorConfig{
+				Interval:                util.CustomDuration(time.Minute),
+				MemoryAvailableWarning:  float(20),
+				MemoryAvailableCritical: float(10),
+			},
+			Log: log.New(),
+		}
+
+		monitor = NewMemoryMonitor(config)
+		monitor.ProcRoot = procRoot
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(procRoot)
+	})
+
+	Context("Validate", func() {
+		It("returns nil with correct settings", func() {
+			Expect(monitor.Validate()).To(BeNil())
+		})
+
+		It("requires the warning threshold to be larger than the critical threshold", func() {
+			config.Config.MemoryAvailableWarning = float(5)
+			Expect(monitor.Validate().Error()).To(ContainSubstring("'memory-available-warning' (5) cannot be lower than 'memory-available-critical' (10)"))
+		})
+	})
+
+	Context("memoryCheck", func() {
+		It("alerts when available memory drops below the thresholds", func() {
+			result, err := monitor.memoryCheck()
+			Expect(err.(*StateError).State).To(Equal(WARNING))
+			Expect(err.Error()).To(Equal("Available memory (15%) is below warning threshold (20%)"))
+			Expect(result.Output).To(Equal("2343 MB of 15625 MB available (15.00%)"))
+
+			config.Config.MemoryAvailableWarning = float(15)
+			_, err = monitor.memoryCheck()
+			Expect(err).To(BeNil())
+		})
+
+		It("approximates available memory on older kernels", func() {
+			meminfo("MemTotal:       16000000 kB\nMemFree:          800000 kB\nBuffers:          100000 kB\nCached:           600000 kB\n")
+
+			result, err := monitor.memoryCheck()
+			Expect(err).NotTo(BeAssignableToTypeOf(&StateError{}))
+			Expect(result.Metrics[0].Value).To(Equal(9.38))
+		})
+	})
+})
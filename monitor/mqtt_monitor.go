@@ -0,0 +1,319 @@
+package monitor
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+const (
+	DEFAULT_MQTT_PORT     = 1883
+	DEFAULT_MQTT_TLS_PORT = 8883
+
+	mqttProtocolLevel = 4 // MQTT 3.1.1
+
+	// Upper bound for packets read; probes and acknowledgements are tiny
+	mqttMaxPacketSize = 1024 * 1024
+
+	// Control packet types
+	mqttConnect    = 1
+	mqttConnack    = 2
+	mqttPublish    = 3
+	mqttPuback     = 4
+	mqttSubscribe  = 8
+	mqttSuback     = 9
+	mqttDisconnect = 14
+
+	// CONNECT flags
+	mqttFlagCleanSession = 0x02
+	mqttFlagPassword     = 0x40
+	mqttFlagUser         = 0x80
+
+	mqttSubscribeID = 1
+	mqttPublishID   = 2
+)
+
+var mqttConnectReturnCodes = map[byte]string{
+	1: "unacceptable protocol version",
+	2: "client identifier rejected",
+	3: "server unavailable",
+	4: "bad user name or password",
+	5: "not authorized",
+}
+
+type MQTTMonitor struct {
+	BrokerMonitor
+}
+
+func NewMQTTMonitor(rmc *RootMonitorConfig) *MQTTMonitor {
+	m := &MQTTMonitor{
+		BrokerMonitor: newBrokerMonitor(rmc, "mqtt", DEFAULT_MQTT_PORT, DEFAULT_MQTT_TLS_PORT),
+	}
+
+	m.MonitorFunc = m.mqttCheck
+
+	return m
+}
+
+func (m *MQTTMonitor) Validate() error {
+	if err := m.BrokerMonitor.Validate(); err != nil {
+		return err
+	}
+
+	if strings.ContainsAny(m.RMC.Config.BrokerTopic, "+#\x00") {
+		return fmt.Errorf("'broker-topic' (%v) cannot contain wildcards", m.RMC.Config.BrokerTopic)
+	}
+
+	if m.RMC.Config.BrokerQoS != 0 && m.RMC.Config.BrokerQoS != 1 {
+		return fmt.Errorf("'broker-qos' (%v) must be 0 or 1", m.RMC.Config.BrokerQoS)
+	}
+
+	return nil
+}
+
+func (m *MQTTMonitor) mqttCheck() (*CheckResult, error) {
+	return m.brokerCheck(m.roundTrip)
+}
+
+// Connect, subscribe to the topic, publish the probe and wait for the broker
+// to deliver it back
+func (m *MQTTMonitor) roundTrip(conn net.Conn, deadline time.Time, probe []byte) (time.Duration, error) {
+	cfg := m.RMC.Config
+	reader := bufio.NewReader(conn)
+
+	clientID, err := m.clientID()
+	if err != nil {
+		return 0, err
+	}
+
+	flags := byte(mqttFlagCleanSession)
+	payload := [][]byte{mqttString(clientID)}
+
+	if cfg.BrokerUser != "" {
+		flags |= mqttFlagUser | mqttFlagPassword
+		payload = append(payload, mqttString(cfg.BrokerUser), mqttString(cfg.BrokerPassword))
+	}
+
+	keepAlive := brokerUint16(uint16((m.Timeout + time.Second - 1) / time.Second))
+
+	connect := append([][]byte{mqttString("MQTT"), {mqttProtocolLevel, flags}, keepAlive}, payload...)
+
+	if _, err := conn.Write(mqttPacket(mqttConnect, 0, connect...)); err != nil {
+		return 0, err
+	}
+
+	packetType, _, body, err := readMQTTPacket(reader)
+	if err != nil {
+		return 0, err
+	}
+
+	if packetType != mqttConnack || len(body) != 2 {
+		return 0, fmt.Errorf("unexpected packet type %v in response to CONNECT", packetType)
+	}
+
+	if body[1] != 0 {
+		return 0, fmt.Errorf("connection refused: %v", mqttReturnCode(body[1]))
+	}
+
+	qos := byte(cfg.BrokerQoS)
+
+	if _, err := conn.Write(mqttPacket(mqttSubscribe, 0x02, brokerUint16(mqttSubscribeID), mqttString(cfg.BrokerTopic), []byte{qos})); err != nil {
+		return 0, err
+	}
+
+	if err := m.awaitSuback(reader); err != nil {
+		return 0, err
+	}
+
+	publish := [][]byte{mqttString(cfg.BrokerTopic)}
+	if qos > 0 {
+		publish = append(publish, brokerUint16(mqttPublishID))
+	}
+
+	start := time.Now()
+
+	if _, err := conn.Write(mqttPacket(mqttPublish, qos<<1, append(publish, probe)...)); err != nil {
+		return 0, err
+	}
+
+	for {
+		packetType, flags, body, err := readMQTTPacket(reader)
+		if err != nil {
+			return 0, fmt.Errorf("probe not received: %v", err.Error())
+		}
+
+		if packetType != mqttPublish {
+			continue
+		}
+
+		message, id, err := parseMQTTPublish(flags, body)
+		if err != nil {
+			return 0, err
+		}
+
+		// Deliveries with QoS 1 have to be acknowledged
+		if (flags>>1)&0x03 == 1 {
+			if _, err := conn.Write(mqttPacket(mqttPuback, 0, brokerUint16(id))); err != nil {
+				return 0, err
+			}
+		}
+
+		if bytes.Equal(message, probe) {
+			latency := time.Since(start)
+			conn.Write(mqttPacket(mqttDisconnect, 0))
+
+			return latency, nil
+		}
+	}
+}
+
+// Wait for the SUBACK; retained messages may arrive before it
+func (m *MQTTMonitor) awaitSuback(reader *bufio.Reader) error {
+	for {
+		packetType, _, body, err := readMQTTPacket(reader)
+		if err != nil {
+			return err
+		}
+
+		if packetType != mqttSuback {
+			continue
+		}
+
+		if len(body) != 3 || binary.BigEndian.Uint16(body) != mqttSubscribeID {
+			return errors.New("invalid SUBACK")
+		}
+
+		if body[2] == 0x80 {
+			return fmt.Errorf("subscription to '%v' rejected", m.RMC.Config.BrokerTopic)
+		}
+
+		return nil
+	}
+}
+
+// 'broker-client-id' or a random '9volt-' ID (at most 23 characters, which all
+// brokers have to accept)
+func (m *MQTTMonitor) clientID() (string, error) {
+	if m.RMC.Config.BrokerClientID != "" {
+		return m.RMC.Config.BrokerClientID, nil
+	}
+
+	id := make([]byte, 8)
+
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+
+	return "9volt-" + hex.EncodeToString(id), nil
+}
+
+func mqttReturnCode(code byte) string {
+	if name, ok := mqttConnectReturnCodes[code]; ok {
+		return name
+	}
+
+	return fmt.Sprintf("return code %v", code)
+}
+
+// Encode a control packet; the remaining length is a variable length integer
+func mqttPacket(packetType, flags byte, fields ...[]byte) []byte {
+	body := bytes.Join(fields, nil)
+	length := len(body)
+
+	packet := []byte{packetType<<4 | flags}
+
+	for {
+		b := byte(length % 128)
+		length /= 128
+
+		if length > 0 {
+			b |= 0x80
+		}
+
+		packet = append(packet, b)
+
+		if length == 0 {
+			break
+		}
+	}
+
+	return append(packet, body...)
+}
+
+func mqttString(s string) []byte {
+	return append(brokerUint16(uint16(len(s))), s...)
+}
+
+// Read a control packet; returns its type, flags and body
+func readMQTTPacket(r *bufio.Reader) (byte, byte, []byte, error) {
+	header, err := r.ReadByte()
+	if err != nil {
+		return 0, 0, nil, err
+	}
+
+	length, multiplier := 0, 1
+
+	for i := 0; ; i++ {
+		if i == 4 {
+			return 0, 0, nil, errors.New("invalid remaining length")
+		}
+
+		b, err := r.ReadByte()
+		if err != nil {
+			return 0, 0, nil, err
+		}
+
+		length += int(b&0x7f) * multiplier
+		multiplier *= 128
+
+		if b&0x80 == 0 {
+			break
+		}
+	}
+
+	if length > mqttMaxPacketSize {
+		return 0, 0, nil, fmt.Errorf("packet size %v exceeds limit of %v bytes", length, mqttMaxPacketSize)
+	}
+
+	body := make([]byte, length)
+
+	if _, err := io.ReadFull(r, body); err != nil {
+		return 0, 0, nil, err
+	}
+
+	return header >> 4, header & 0x0f, body, nil
+}
+
+// Returns the payload and packet identifier (0 for QoS 0) of a PUBLISH
+func parseMQTTPublish(flags byte, body []byte) ([]byte, uint16, error) {
+	if len(body) < 2 {
+		return nil, 0, errors.New("truncated PUBLISH")
+	}
+
+	offset := 2 + int(binary.BigEndian.Uint16(body))
+
+	var id uint16
+
+	if (flags>>1)&0x03 > 0 {
+		if len(body) < offset+2 {
+			return nil, 0, errors.New("truncated PUBLISH")
+		}
+
+		id = binary.BigEndian.Uint16(body[offset:])
+		offset += 2
+	}
+
+	if len(body) < offset {
+		return nil, 0, errors.New("truncated PUBLISH")
+	}
+
+	return body[offset:], id, nil
+}
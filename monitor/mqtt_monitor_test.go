@@ -0,0 +1,246 @@
+package monitor
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/9corp/9volt/util"
+)
+
+// Minimal in-process MQTT broker for a single client: accepts 'user' (if set),
+// grants subscriptions and delivers publishes to subscribed topics, sending a
+// retained message first. Nothing is delivered if 'drop' is set.
+type testMQTTBroker struct {
+	listener net.Listener
+	user     string
+	password string
+	drop     bool
+
+	clientIDs chan string
+}
+
+func startTestMQTTBroker(user, password string) (*testMQTTBroker, int) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	Expect(err).To(BeNil())
+
+	broker := &testMQTTBroker{
+		listener:  listener,
+		user:      user,
+		password:  password,
+		clientIDs: make(chan string, 10),
+	}
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			go broker.serve(conn)
+		}
+	}()
+
+	return broker, listener.Addr().(*net.TCPAddr).Port
+}
+
+func (b *testMQTTBroker) serve(conn net.Conn) {
+	defer conn.Close()
+
+	reader := bufio.NewReader(conn)
+	subscriptions := make(map[string]byte)
+
+	readString := func(d *brokerDecoder) string {
+		return string(d.bytes(int(d.uint16())))
+	}
+
+	for {
+		packetType, flags, body, err := readMQTTPacket(reader)
+		if err != nil {
+			return
+		}
+
+		d := &brokerDecoder{data: body}
+
+		switch packetType {
+		case mqttConnect:
+			readString(d) // protocol name
+			d.uint8()     // level
+			connectFlags := d.uint8()
+			d.uint16() // keep alive
+			b.clientIDs <- readString(d)
+
+			var user, password string
+			if connectFlags&mqttFlagUser != 0 {
+				user, password = readString(d), readString(d)
+			}
+
+			if user != b.user || password != b.password {
+				conn.Write(mqttPacket(mqttConnack, 0, []byte{0, 4}))
+				return
+			}
+
+			conn.Write(mqttPacket(mqttConnack, 0, []byte{0, 0}))
+		case mqttSubscribe:
+			id, topic, qos := d.uint16(), readString(d), d.uint8()
+
+			if strings.HasPrefix(topic, "forbidden") {
+				qos = 0x80
+			} else {
+				subscriptions[topic] = qos
+				conn.Write(mqttPacket(mqttPublish, 0x01, mqttString(topic), []byte("retained")))
+			}
+
+			conn.Write(mqttPacket(mqttSuback, 0, brokerUint16(id), []byte{qos}))
+		case mqttPublish:
+			qos := (flags >> 1) & 0x03
+			payload, id, _ := parseMQTTPublish(flags, body)
+			topic := readString(d)
+
+			if qos == 1 {
+				conn.Write(mqttPacket(mqttPuback, 0, brokerUint16(id)))
+			}
+
+			granted, ok := subscriptions[topic]
+			if !ok || b.drop {
+				continue
+			}
+
+			if granted == 1 {
+				conn.Write(mqttPacket(mqttPublish, 0x02, mqttString(topic), brokerUint16(7), payload))
+			} else {
+				conn.Write(mqttPacket(mqttPublish, 0, mqttString(topic), payload))
+			}
+		case mqttDisconnect:
+			return
+		}
+	}
+}
+
+var _ = Describe("mqtt_monitor", func() {
+	var (
+		monitor *MQTTMonitor
+		config  *RootMonitorConfig
+		broker  *testMQTTBroker
+	)
+
+	start := func(user, password string) {
+		broker, config.Config.Port = startTestMQTTBroker(user, password)
+		monitor = NewMQTTMonitor(config)
+		Expect(monitor.Validate()).To(BeNil())
+	}
+
+	BeforeEach(func() {
+		config = &RootMonitorConfig{
+			ConfigName: "mqtt-probe",
+			Config: &MonitorConfig{
+				Host:        "127.0.0.1",
+				Interval:    util.CustomDuration(10 * time.Second),
+				Timeout:     util.CustomDuration(time.Second),
+				BrokerTopic: "9volt/probe",
+			},
+			Log: log.New(),
+		}
+
+		monitor = NewMQTTMonitor(config)
+	})
+
+	AfterEach(func() {
+		if broker != nil {
+			broker.listener.Close()
+			broker = nil
+		}
+	})
+
+	Context("NewMQTTMonitor", func() {
+		It("returns a properly configured instance with defaults", func() {
+			config.Config.Timeout = util.CustomDuration(0)
+			monitor = NewMQTTMonitor(config)
+
+			Expect(monitor.Port).To(Equal(DEFAULT_MQTT_PORT))
+			Expect(monitor.Timeout).To(Equal(DEFAULT_BROKER_TIMEOUT))
+			Expect(monitor.MonitorFunc).NotTo(BeNil())
+
+			config.Config.TCPTLS = true
+			Expect(NewMQTTMonitor(config).Port).To(Equal(DEFAULT_MQTT_TLS_PORT))
+		})
+	})
+
+	Context("Validate", func() {
+		It("returns nil with correct settings", func() {
+			Expect(monitor.Validate()).To(BeNil())
+		})
+
+		It("errors with invalid settings", func() {
+			config.Config.BrokerTopic = ""
+			Expect(monitor.Validate().Error()).To(ContainSubstring("'broker-topic' must be set"))
+
+			config.Config.BrokerTopic = "sensors/+/temperature"
+			Expect(monitor.Validate().Error()).To(ContainSubstring("cannot contain wildcards"))
+
+			config.Config.BrokerTopic = "9volt/probe"
+			config.Config.BrokerQoS = 2
+			Expect(monitor.Validate().Error()).To(ContainSubstring("'broker-qos' (2) must be 0 or 1"))
+
+			config.Config.BrokerQoS = 0
+			config.Config.BrokerPassword = "secret"
+			Expect(monitor.Validate().Error()).To(ContainSubstring("'broker-password' requires 'broker-user'"))
+		})
+	})
+
+	Context("mqttCheck", func() {
+		It("publishes and consumes a probe", func() {
+			start("", "")
+
+			result, err := monitor.mqttCheck()
+			Expect(err).To(BeNil())
+			Expect(<-broker.clientIDs).To(HavePrefix("9volt-"))
+			Expect(result.Output).To(HavePrefix("Probe consumed from '9volt/probe' after "))
+			Expect(result.Metrics).To(HaveLen(1))
+			Expect(result.Metrics[0].Name).To(Equal("latency"))
+			Expect(result.Metrics[0].Unit).To(Equal("s"))
+		})
+
+		It("supports QoS 1, authentication and a fixed client ID", func() {
+			config.Config.BrokerQoS = 1
+			config.Config.BrokerUser = "monitor"
+			config.Config.BrokerPassword = "secret"
+			config.Config.BrokerClientID = "9volt-probe-1"
+			start("monitor", "secret")
+
+			_, err := monitor.mqttCheck()
+			Expect(err).To(BeNil())
+			Expect(<-broker.clientIDs).To(Equal("9volt-probe-1"))
+
+			config.Config.BrokerPassword = "wrong"
+			_, err = monitor.mqttCheck()
+			Expect(err).ToNot(BeNil())
+			Expect(err.Error()).To(ContainSubstring("connection refused: bad user name or password"))
+		})
+
+		It("fails if the subscription is rejected", func() {
+			config.Config.BrokerTopic = "forbidden/probe"
+			start("", "")
+
+			_, err := monitor.mqttCheck()
+			Expect(err).ToNot(BeNil())
+			Expect(err.Error()).To(ContainSubstring("subscription to 'forbidden/probe' rejected"))
+		})
+
+		It("fails if the probe is not delivered within the timeout", func() {
+			config.Config.Timeout = util.CustomDuration(200 * time.Millisecond)
+			start("", "")
+			broker.drop = true
+
+			_, err := monitor.mqttCheck()
+			Expect(err).ToNot(BeNil())
+			Expect(err.Error()).To(ContainSubstring("probe not received"))
+		})
+	})
+})
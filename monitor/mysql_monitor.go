@@ -0,0 +1,501 @@
+package monitor
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+)
+
+const (
+	DEFAULT_MYSQL_PORT  = 3306
+	DEFAULT_MYSQL_QUERY = "SELECT 1"
+
+	mysqlClientLongPassword     = 0x00000001
+	mysqlClientConnectWithDB    = 0x00000008
+	mysqlClientProtocol41       = 0x00000200
+	mysqlClientTransactions     = 0x00002000
+	mysqlClientSecureConnection = 0x00008000
+	mysqlClientPluginAuth       = 0x00080000
+
+	mysqlCharsetUTF8MB4 = 45
+	mysqlMaxPacketSize  = 16*1024*1024 - 1
+	mysqlComQuit        = 0x01
+	mysqlComQuery       = 0x03
+
+	mysqlNativePassword       = "mysql_native_password"
+	mysqlCachingSHA2Password  = "caching_sha2_password"
+	mysqlCachingSHA2FastOK    = 0x03
+	mysqlCachingSHA2FullAuth  = 0x04
+	mysqlCachingSHA2PublicKey = 0x02
+)
+
+type MySQLMonitor struct {
+	DBMonitor
+}
+
+func NewMySQLMonitor(rmc *RootMonitorConfig) *MySQLMonitor {
+	m := &MySQLMonitor{
+		DBMonitor: newDBMonitor(rmc, "mysql", DEFAULT_MYSQL_PORT, DEFAULT_MYSQL_QUERY),
+	}
+
+	m.MonitorFunc = m.mysqlCheck
+
+	return m
+}
+
+func (m *MySQLMonitor) Validate() error {
+	if err := m.DBMonitor.Validate(); err != nil {
+		return err
+	}
+
+	if m.RMC.Config.DBUser == "" {
+		return errors.New("'db-user' must be set")
+	}
+
+	return nil
+}
+
+func (m *MySQLMonitor) mysqlCheck() (*CheckResult, error) {
+	return nil, m.dbCheck(m.query)
+}
+
+// Packet framing for the MySQL client/server protocol
+type mysqlConn struct {
+	w   io.Writer
+	r   *bufio.Reader
+	seq byte
+}
+
+func (c *mysqlConn) readPacket() ([]byte, error) {
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(c.r, header); err != nil {
+		return nil, err
+	}
+
+	size := int(uint32(header[0]) | uint32(header[1])<<8 | uint32(header[2])<<16)
+	c.seq = header[3] + 1
+
+	data := make([]byte, size)
+	if _, err := io.ReadFull(c.r, data); err != nil {
+		return nil, err
+	}
+
+	return data, nil
+}
+
+func (c *mysqlConn) writePacket(data []byte) error {
+	if len(data) > mysqlMaxPacketSize {
+		return errors.New("packet too large")
+	}
+
+	size := len(data)
+	packet := append([]byte{byte(size), byte(size >> 8), byte(size >> 16), c.seq}, data...)
+	c.seq++
+
+	_, err := c.w.Write(packet)
+
+	return err
+}
+
+// Best effort; the connection is closed right after. Saves the server from
+// counting (and logging) an aborted connection on every check.
+func (c *mysqlConn) quit() {
+	c.seq = 0
+	c.writePacket([]byte{mysqlComQuit})
+}
+
+// Perform the handshake/authentication and run the query using the text protocol
+func (m *MySQLMonitor) query(conn net.Conn) (*DBResult, error) {
+	c := &mysqlConn{w: conn, r: bufio.NewReader(conn)}
+
+	if err := m.authenticate(c); err != nil {
+		return nil, err
+	}
+
+	defer c.quit()
+
+	c.seq = 0
+
+	if err := c.writePacket(append([]byte{mysqlComQuery}, m.Query...)); err != nil {
+		return nil, err
+	}
+
+	columns, rows, err := readMySQLResultSet(c)
+	if err != nil {
+		return nil, err
+	}
+
+	return newDBResult(columns, rows), nil
+}
+
+func (m *MySQLMonitor) authenticate(c *mysqlConn) error {
+	handshake, err := c.readPacket()
+	if err != nil {
+		return err
+	}
+
+	if len(handshake) > 0 && handshake[0] == 0xff {
+		return mysqlError(handshake)
+	}
+
+	salt, plugin, err := parseMySQLHandshake(handshake)
+	if err != nil {
+		return err
+	}
+
+	if plugin != mysqlNativePassword && plugin != mysqlCachingSHA2Password {
+		plugin = mysqlNativePassword
+	}
+
+	authResponse := mysqlScramble(plugin, m.RMC.Config.DBPassword, salt)
+
+	flags := uint32(mysqlClientLongPassword | mysqlClientProtocol41 | mysqlClientTransactions |
+		mysqlClientSecureConnection | mysqlClientPluginAuth)
+
+	if m.RMC.Config.DBName != "" {
+		flags |= mysqlClientConnectWithDB
+	}
+
+	response := make([]byte, 32)
+	binary.LittleEndian.PutUint32(response, flags)
+	binary.LittleEndian.PutUint32(response[4:], mysqlMaxPacketSize)
+	response[8] = mysqlCharsetUTF8MB4
+
+	response = append(append(response, m.RMC.Config.DBUser...), 0)
+	response = append(append(response, byte(len(authResponse))), authResponse...)
+
+	if m.RMC.Config.DBName != "" {
+		response = append(append(response, m.RMC.Config.DBName...), 0)
+	}
+
+	response = append(append(response, plugin...), 0)
+
+	if err := c.writePacket(response); err != nil {
+		return err
+	}
+
+	for {
+		packet, err := c.readPacket()
+		if err != nil {
+			return err
+		}
+
+		if len(packet) == 0 {
+			return errors.New("empty authentication response")
+		}
+
+		switch packet[0] {
+		case 0x00:
+			return nil
+		case 0xff:
+			return mysqlError(packet)
+		case 0xfe:
+			// Auth switch request: plugin name + new salt
+			end := bytes.IndexByte(packet[1:], 0)
+			if end < 0 {
+				return errors.New("malformed auth switch request")
+			}
+
+			plugin = string(packet[1 : end+1])
+			salt = bytes.TrimRight(packet[end+2:], "\x00")
+
+			if plugin != mysqlNativePassword && plugin != mysqlCachingSHA2Password {
+				return fmt.Errorf("unsupported authentication plugin '%v'", plugin)
+			}
+
+			if err := c.writePacket(mysqlScramble(plugin, m.RMC.Config.DBPassword, salt)); err != nil {
+				return err
+			}
+		case 0x01:
+			if plugin != mysqlCachingSHA2Password || len(packet) < 2 {
+				return errors.New("unexpected auth more data packet")
+			}
+
+			switch packet[1] {
+			case mysqlCachingSHA2FastOK:
+				continue
+			case mysqlCachingSHA2FullAuth:
+				if err := m.cachingSHA2FullAuth(c, salt); err != nil {
+					return err
+				}
+			default:
+				return fmt.Errorf("unexpected caching_sha2_password state %v", packet[1])
+			}
+		default:
+			return fmt.Errorf("unexpected authentication response 0x%02x", packet[0])
+		}
+	}
+}
+
+// Full caching_sha2_password authentication over an insecure connection:
+// fetch the server's RSA public key and send the encrypted password
+func (m *MySQLMonitor) cachingSHA2FullAuth(c *mysqlConn, salt []byte) error {
+	if err := c.writePacket([]byte{mysqlCachingSHA2PublicKey}); err != nil {
+		return err
+	}
+
+	packet, err := c.readPacket()
+	if err != nil {
+		return err
+	}
+
+	if len(packet) < 2 || packet[0] != 0x01 {
+		return errors.New("unable to retrieve server public key")
+	}
+
+	block, _ := pem.Decode(packet[1:])
+	if block == nil {
+		return errors.New("unable to decode server public key")
+	}
+
+	parsed, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return fmt.Errorf("unable to parse server public key: %v", err.Error())
+	}
+
+	pub, ok := parsed.(*rsa.PublicKey)
+	if !ok {
+		return errors.New("server public key is not an RSA key")
+	}
+
+	password := append([]byte(m.RMC.Config.DBPassword), 0)
+	for i := range password {
+		password[i] ^= salt[i%len(salt)]
+	}
+
+	encrypted, err := rsa.EncryptOAEP(sha1.New(), rand.Reader, pub, password, nil)
+	if err != nil {
+		return fmt.Errorf("unable to encrypt password: %v", err.Error())
+	}
+
+	return c.writePacket(encrypted)
+}
+
+// Extract the auth salt and plugin name from the initial handshake (v10)
+func parseMySQLHandshake(data []byte) ([]byte, string, error) {
+	if len(data) < 1 || data[0] != 10 {
+		return nil, "", errors.New("unsupported protocol version")
+	}
+
+	end := bytes.IndexByte(data[1:], 0)
+	if end < 0 {
+		return nil, "", errors.New("malformed handshake")
+	}
+
+	pos := 1 + end + 1
+
+	// connection id (4), salt part 1 (8), filler (1), capabilities (2), charset (1),
+	// status (2), capabilities (2), salt length (1), reserved (10)
+	if len(data) < pos+31 {
+		return nil, "", errors.New("malformed handshake")
+	}
+
+	salt := append([]byte{}, data[pos+4:pos+12]...)
+	pos += 31
+
+	// Remainder of the salt (at least 12 bytes + NUL), then the plugin name
+	end = bytes.IndexByte(data[pos:], 0)
+	if end < 0 {
+		salt = append(salt, data[pos:]...)
+		return salt, mysqlNativePassword, nil
+	}
+
+	salt = append(salt, data[pos:pos+end]...)
+	pos += end + 1
+
+	plugin := string(bytes.TrimRight(data[pos:], "\x00"))
+
+	return salt, plugin, nil
+}
+
+// Compute the auth response for the given plugin
+func mysqlScramble(plugin, password string, salt []byte) []byte {
+	if password == "" {
+		return []byte{}
+	}
+
+	if plugin == mysqlCachingSHA2Password {
+		// XOR(SHA256(password), SHA256(SHA256(SHA256(password)), salt))
+		stage1 := sha256.Sum256([]byte(password))
+		stage2 := sha256.Sum256(stage1[:])
+		stage3 := sha256.Sum256(append(stage2[:], salt...))
+
+		for i := range stage1 {
+			stage1[i] ^= stage3[i]
+		}
+
+		return stage1[:]
+	}
+
+	// XOR(SHA1(password), SHA1(salt, SHA1(SHA1(password))))
+	stage1 := sha1.Sum([]byte(password))
+	stage2 := sha1.Sum(stage1[:])
+	stage3 := sha1.Sum(append(append([]byte{}, salt...), stage2[:]...))
+
+	for i := range stage1 {
+		stage1[i] ^= stage3[i]
+	}
+
+	return stage1[:]
+}
+
+// Read a text protocol result set (or an OK packet for statements without one)
+func readMySQLResultSet(c *mysqlConn) ([]string, [][]*string, error) {
+	packet, err := c.readPacket()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if len(packet) == 0 {
+		return nil, nil, errors.New("empty query response")
+	}
+
+	switch packet[0] {
+	case 0x00:
+		return nil, nil, nil
+	case 0xff:
+		return nil, nil, mysqlError(packet)
+	}
+
+	count, _, ok := mysqlLengthEncodedInt(packet)
+	if !ok {
+		return nil, nil, errors.New("malformed column count")
+	}
+
+	columns := make([]string, 0, count)
+
+	for i := uint64(0); i < count; i++ {
+		packet, err := c.readPacket()
+		if err != nil {
+			return nil, nil, err
+		}
+
+		// catalog, schema, table, org_table, name, ...
+		var name *string
+		data := packet
+
+		for field := 0; field < 5; field++ {
+			var n int
+
+			name, n, ok = mysqlLengthEncodedString(data)
+			if !ok {
+				return nil, nil, errors.New("malformed column definition")
+			}
+
+			data = data[n:]
+		}
+
+		columns = append(columns, *name)
+	}
+
+	// EOF after the column definitions
+	if _, err := c.readPacket(); err != nil {
+		return nil, nil, err
+	}
+
+	var rows [][]*string
+
+	for {
+		packet, err := c.readPacket()
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if len(packet) > 0 && packet[0] == 0xff {
+			return nil, nil, mysqlError(packet)
+		}
+
+		if len(packet) > 0 && packet[0] == 0xfe && len(packet) < 9 {
+			return columns, rows, nil
+		}
+
+		row := make([]*string, 0, count)
+		data := packet
+
+		for i := uint64(0); i < count; i++ {
+			value, n, ok := mysqlLengthEncodedString(data)
+			if !ok {
+				return nil, nil, errors.New("malformed row")
+			}
+
+			row = append(row, value)
+			data = data[n:]
+		}
+
+		rows = append(rows, row)
+	}
+}
+
+// Returns the value and the number of bytes consumed
+func mysqlLengthEncodedInt(data []byte) (uint64, int, bool) {
+	if len(data) == 0 {
+		return 0, 0, false
+	}
+
+	var size int
+
+	switch data[0] {
+	case 0xfc:
+		size = 2
+	case 0xfd:
+		size = 3
+	case 0xfe:
+		size = 8
+	default:
+		return uint64(data[0]), 1, data[0] < 0xfb
+	}
+
+	if len(data) < 1+size {
+		return 0, 0, false
+	}
+
+	var value uint64
+	for i := 0; i < size; i++ {
+		value |= uint64(data[1+i]) << (8 * uint(i))
+	}
+
+	return value, 1 + size, true
+}
+
+// Returns the value (nil for NULL) and the number of bytes consumed
+func mysqlLengthEncodedString(data []byte) (*string, int, bool) {
+	if len(data) > 0 && data[0] == 0xfb {
+		return nil, 1, true
+	}
+
+	size, n, ok := mysqlLengthEncodedInt(data)
+	if !ok || uint64(len(data)-n) < size {
+		return nil, 0, false
+	}
+
+	value := string(data[n : n+int(size)])
+
+	return &value, n + int(size), true
+}
+
+// Build an error from an ERR packet
+func mysqlError(packet []byte) error {
+	if len(packet) < 3 {
+		return errors.New("server returned malformed error")
+	}
+
+	code := binary.LittleEndian.Uint16(packet[1:])
+	message := packet[3:]
+
+	// '#' + 5 character SQL state
+	if len(message) >= 6 && message[0] == '#' {
+		return fmt.Errorf("server returned error %v (%s): %s", code, message[1:6], message[6:])
+	}
+
+	return fmt.Errorf("server returned error %v: %s", code, message)
+}
@@ -0,0 +1,273 @@
+package monitor
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/pem"
+	"net"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/9corp/9volt/util"
+)
+
+// Minimal in-process mysql stand-in for user 'nine' / password 'volt'; with
+// 'fullAuth' caching_sha2_password goes through the RSA public key exchange.
+// A value is sent on the returned channel whenever a client sends COM_QUIT.
+func startTestMySQLServer(plugin string, fullAuth bool) (net.Listener, int, chan struct{}) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	Expect(err).To(BeNil())
+
+	quit := make(chan struct{}, 10)
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	Expect(err).To(BeNil())
+
+	lenenc := func(s string) []byte {
+		return append([]byte{byte(len(s))}, s...)
+	}
+
+	errPacket := func(code uint16, state, message string) []byte {
+		packet := []byte{0xff, 0, 0}
+		binary.LittleEndian.PutUint16(packet[1:], code)
+		return append(append(packet, "#"+state...), message...)
+	}
+
+	ok := []byte{0x00, 0, 0, 2, 0, 0, 0}
+	eof := []byte{0xfe, 0, 0, 2, 0}
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+
+			go func(conn net.Conn) {
+				defer conn.Close()
+
+				c := &mysqlConn{w: conn, r: bufio.NewReader(conn)}
+				salt := []byte("abcdefghijklmnopqrst")
+
+				handshake := append([]byte{10}, "8.0.35\x00"...)
+				handshake = append(handshake, 1, 0, 0, 0)
+				handshake = append(append(handshake, salt[:8]...), 0)
+				handshake = append(handshake, 0xff, 0xff, mysqlCharsetUTF8MB4, 2, 0, 0xff, 0xff, 21)
+				handshake = append(handshake, make([]byte, 10)...)
+				handshake = append(append(handshake, salt[8:]...), 0)
+				handshake = append(append(handshake, plugin...), 0)
+
+				c.writePacket(handshake)
+
+				response, _ := c.readPacket()
+				pos := 32
+				user := string(response[pos : pos+bytes.IndexByte(response[pos:], 0)])
+				pos += len(user) + 1
+				scramble := response[pos+1 : pos+1+int(response[pos])]
+
+				if user != "nine" || !bytes.Equal(scramble, mysqlScramble(plugin, "volt", salt)) {
+					c.writePacket(errPacket(1045, "28000", "Access denied for user '"+user+"'@'localhost'"))
+					return
+				}
+
+				if plugin == mysqlCachingSHA2Password {
+					if !fullAuth {
+						c.writePacket([]byte{0x01, mysqlCachingSHA2FastOK})
+					} else {
+						c.writePacket([]byte{0x01, mysqlCachingSHA2FullAuth})
+
+						request, _ := c.readPacket()
+						Expect(request).To(Equal([]byte{mysqlCachingSHA2PublicKey}))
+
+						der, _ := x509.MarshalPKIXPublicKey(&rsaKey.PublicKey)
+						c.writePacket(append([]byte{0x01}, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})...))
+
+						encrypted, _ := c.readPacket()
+						password, err := rsa.DecryptOAEP(sha1.New(), rand.Reader, rsaKey, encrypted, nil)
+						Expect(err).To(BeNil())
+
+						for i := range password {
+							password[i] ^= salt[i%len(salt)]
+						}
+
+						if string(password) != "volt\x00" {
+							c.writePacket(errPacket(1045, "28000", "Access denied"))
+							return
+						}
+					}
+				}
+
+				c.writePacket(ok)
+
+				query, err := c.readPacket()
+				if err != nil {
+					return
+				}
+
+				column := func(name string) []byte {
+					def := append(lenenc("def"), lenenc("")...)
+					def = append(append(append(def, lenenc("")...), lenenc("")...), lenenc(name)...)
+					return append(append(def, lenenc(name)...), make([]byte, 13)...)
+				}
+
+				switch string(query[1:]) {
+				case "SELECT 1":
+					c.writePacket([]byte{1})
+					c.writePacket(column("1"))
+					c.writePacket(eof)
+					c.writePacket(lenenc("1"))
+					c.writePacket(eof)
+				case "SHOW REPLICA STATUS":
+					c.writePacket([]byte{2})
+					c.writePacket(column("Replica_IO_Running"))
+					c.writePacket(column("Seconds_Behind_Source"))
+					c.writePacket(eof)
+					c.writePacket(append(lenenc("Yes"), 0xfb))
+					c.writePacket(eof)
+				case "DO 1":
+					c.writePacket(ok)
+				default:
+					c.writePacket(errPacket(1064, "42000", "You have an error in your SQL syntax"))
+				}
+
+				if packet, err := c.readPacket(); err == nil && bytes.Equal(packet, []byte{mysqlComQuit}) {
+					quit <- struct{}{}
+				}
+			}(conn)
+		}
+	}()
+
+	return ln, ln.Addr().(*net.TCPAddr).Port, quit
+}
+
+var _ = Describe("mysql_monitor", func() {
+	var (
+		monitor *MySQLMonitor
+		config  *RootMonitorConfig
+		ln      net.Listener
+		quit    chan struct{}
+	)
+
+	start := func(plugin string, fullAuth bool) {
+		ln, config.Config.Port, quit = startTestMySQLServer(plugin, fullAuth)
+		monitor = NewMySQLMonitor(config)
+		Expect(monitor.Validate()).To(BeNil())
+	}
+
+	BeforeEach(func() {
+		config = &RootMonitorConfig{
+			Config: &MonitorConfig{
+				Host:       "127.0.0.1",
+				DBUser:     "nine",
+				DBPassword: "volt",
+				DBName:     "monitoring",
+				Interval:   util.CustomDuration(10 * time.Second),
+			},
+			Log: log.New(),
+		}
+
+		monitor = NewMySQLMonitor(config)
+	})
+
+	AfterEach(func() {
+		if ln != nil {
+			ln.Close()
+			ln = nil
+		}
+	})
+
+	Context("NewMySQLMonitor", func() {
+		It("returns a properly configured instance with defaults", func() {
+			Expect(monitor.Port).To(Equal(DEFAULT_MYSQL_PORT))
+			Expect(monitor.Query).To(Equal(DEFAULT_MYSQL_QUERY))
+			Expect(monitor.MonitorFunc).NotTo(BeNil())
+		})
+	})
+
+	Context("Validate", func() {
+		It("requires a user", func() {
+			config.Config.DBUser = ""
+			Expect(monitor.Validate().Error()).To(ContainSubstring("'db-user' must be set"))
+		})
+	})
+
+	Context("mysqlCheck", func() {
+		It("authenticates with mysql_native_password", func() {
+			config.Config.DBAssertions = []*DBAssertion{{Value: "1"}}
+			start(mysqlNativePassword, false)
+			_, err := monitor.mysqlCheck()
+			Expect(err).To(BeNil())
+		})
+
+		It("sends COM_QUIT before closing the connection", func() {
+			start(mysqlNativePassword, false)
+			_, err := monitor.mysqlCheck()
+			Expect(err).To(BeNil())
+			Eventually(quit).Should(Receive())
+		})
+
+		It("authenticates with caching_sha2_password", func() {
+			start(mysqlCachingSHA2Password, false)
+			_, err := monitor.mysqlCheck()
+			Expect(err).To(BeNil())
+		})
+
+		It("performs full caching_sha2_password authentication", func() {
+			start(mysqlCachingSHA2Password, true)
+			_, err := monitor.mysqlCheck()
+			Expect(err).To(BeNil())
+		})
+
+		It("fails on bad credentials", func() {
+			config.Config.DBPassword = "wrong"
+			start(mysqlNativePassword, false)
+
+			_, err := monitor.mysqlCheck()
+			Expect(err).NotTo(BeNil())
+			Expect(err.Error()).To(ContainSubstring("error 1045 (28000): Access denied"))
+		})
+
+		It("asserts on columns and treats NULL as not found", func() {
+			config.Config.DBQuery = "SHOW REPLICA STATUS"
+			config.Config.DBAssertions = []*DBAssertion{{Field: "Replica_IO_Running", Value: "Yes"}}
+			start(mysqlNativePassword, false)
+
+			_, err := monitor.mysqlCheck()
+			Expect(err).To(BeNil())
+
+			config.Config.DBAssertions = []*DBAssertion{{Field: "Seconds_Behind_Source", Operator: "<", Value: "30"}}
+
+			_, err = monitor.mysqlCheck()
+			Expect(err).NotTo(BeNil())
+			Expect(err.Error()).To(ContainSubstring("value not found"))
+		})
+
+		It("handles statements without a result set", func() {
+			config.Config.DBQuery = "DO 1"
+			start(mysqlNativePassword, false)
+			_, err := monitor.mysqlCheck()
+			Expect(err).To(BeNil())
+
+			config.Config.DBAssertions = []*DBAssertion{{Operator: "exists"}}
+			_, err = monitor.mysqlCheck()
+			Expect(err).NotTo(BeNil())
+		})
+
+		It("reports query errors", func() {
+			config.Config.DBQuery = "SELEC 1"
+			start(mysqlNativePassword, false)
+
+			_, err := monitor.mysqlCheck()
+			Expect(err).NotTo(BeNil())
+			Expect(err.Error()).To(ContainSubstring("error 1064 (42000)"))
+		})
+	})
+})
@@ -0,0 +1,248 @@
+package monitor
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/9corp/9volt/state"
+	"github.com/9corp/9volt/util"
+)
+
+const (
+	DEFAULT_NTP_PORT    = 123
+	DEFAULT_NTP_TIMEOUT = time.Duration(3) * time.Second
+
+	// Seconds between the NTP (1900) and unix (1970) epochs
+	ntpEpochOffset = 2208988800
+
+	ntpPacketSize         = 48
+	ntpVersion            = 4
+	ntpModeClient         = 3
+	ntpModeServer         = 4
+	ntpLeapNotInSync      = 3
+	ntpMaxStratum         = 15 // 16 == unsynchronized
+	ntpKissOfDeathStratum = 0
+)
+
+type NTPMonitor struct {
+	Base
+
+	Timeout time.Duration
+	Port    int
+}
+
+// Relevant parts of an NTP server response
+type ntpResponse struct {
+	Leap      int
+	Stratum   int
+	RefID     [4]byte
+	Offset    time.Duration // server clock relative to the local clock
+	Delay     time.Duration // round trip delay
+	Originate uint64        // must echo our transmit timestamp
+}
+
+func NewNTPMonitor(rmc *RootMonitorConfig) *NTPMonitor {
+	n := &NTPMonitor{
+		Base: Base{
+			RMC:        rmc,
+			Identifier: "ntp",
+		},
+		Timeout: DEFAULT_NTP_TIMEOUT,
+		Port:    DEFAULT_NTP_PORT,
+	}
+
+	if rmc.Config.Timeout != util.CustomDuration(0) {
+		n.Timeout = time.Duration(rmc.Config.Timeout)
+	}
+
+	if rmc.Config.Port != 0 {
+		n.Port = rmc.Config.Port
+	}
+
+	n.MonitorFunc = n.ntpCheck
+
+	return n
+}
+
+func (n *NTPMonitor) Validate() error {
+	n.RMC.Log.WithField("configName", n.RMC.ConfigName).Debug("Performing monitor config validation")
+
+	cfg := n.RMC.Config
+
+	if cfg.Host == "" {
+		return errors.New("'host' must be set")
+	}
+
+	if n.Timeout >= time.Duration(cfg.Interval) {
+		return fmt.Errorf("'timeout' (%v) cannot equal or exceed 'interval' (%v)", n.Timeout.String(), cfg.Interval.String())
+	}
+
+	if cfg.NTPMaxStratum < 0 || cfg.NTPMaxStratum > ntpMaxStratum {
+		return fmt.Errorf("'ntp-max-stratum' (%v) must be between 1 and %v", cfg.NTPMaxStratum, ntpMaxStratum)
+	}
+
+	warning, critical := time.Duration(cfg.NTPOffsetWarning), time.Duration(cfg.NTPOffsetCritical)
+
+	if warning < 0 || critical < 0 {
+		return errors.New("'ntp-offset-warning' and 'ntp-offset-critical' cannot be negative")
+	}
+
+	if warning != 0 && critical != 0 && warning > critical {
+		return fmt.Errorf("'ntp-offset-warning' (%v) cannot exceed 'ntp-offset-critical' (%v)", warning, critical)
+	}
+
+	return nil
+}
+
+// Query the NTP server; fail if it is unreachable, unsynchronized or its stratum
+// exceeds 'ntp-max-stratum'. The clock offset relative to the local clock is
+// compared against the warning/critical offsets; both go through the attempt
+// thresholds like any other failure, with the warning offset capped at warning.
+func (n *NTPMonitor) ntpCheck() (*CheckResult, error) {
+	cfg := n.RMC.Config
+	address := net.JoinHostPort(cfg.Host, strconv.Itoa(n.Port))
+
+	n.RMC.Log.WithField("address", address).Debug("Performing ntp check")
+
+	resp, err := queryNTP(address, n.Timeout)
+	if err != nil {
+		return nil, fmt.Errorf("NTP query to %v failed: %v", address, err.Error())
+	}
+
+	if resp.Stratum == ntpKissOfDeathStratum {
+		return nil, fmt.Errorf("NTP server %v sent kiss-o'-death code '%v'", address, string(resp.RefID[:]))
+	}
+
+	if resp.Leap == ntpLeapNotInSync || resp.Stratum > ntpMaxStratum {
+		return nil, fmt.Errorf("NTP server %v is not synchronized (stratum %v)", address, resp.Stratum)
+	}
+
+	if cfg.NTPMaxStratum != 0 && resp.Stratum > cfg.NTPMaxStratum {
+		return nil, fmt.Errorf("NTP server %v stratum (%v) exceeds 'ntp-max-stratum' (%v)", address, resp.Stratum, cfg.NTPMaxStratum)
+	}
+
+	warning, critical := time.Duration(cfg.NTPOffsetWarning), time.Duration(cfg.NTPOffsetCritical)
+
+	offsetMetric := &state.Metric{Name: "offset", Value: resp.Offset.Seconds(), Unit: "s"}
+
+	if warning != 0 {
+		offsetMetric.Warning = strconv.FormatFloat(warning.Seconds(), 'g', -1, 64)
+	}
+
+	if critical != 0 {
+		offsetMetric.Critical = strconv.FormatFloat(critical.Seconds(), 'g', -1, 64)
+	}
+
+	result := &CheckResult{
+		Output: fmt.Sprintf("Offset %v, delay %v, stratum %v", resp.Offset, resp.Delay, resp.Stratum),
+		Metrics: []*state.Metric{
+			offsetMetric,
+			{Name: "delay", Value: resp.Delay.Seconds(), Unit: "s"},
+			{Name: "stratum", Value: float64(resp.Stratum)},
+		},
+	}
+
+	offset := resp.Offset
+	if offset < 0 {
+		offset = -offset
+	}
+
+	if critical != 0 && offset > critical {
+		return result, fmt.Errorf("Clock offset to NTP server %v (%v) exceeds critical offset (%v)", address, resp.Offset, critical)
+	}
+
+	if warning != 0 && offset > warning {
+		return result, NewCappedWarningError("Clock offset to NTP server %v (%v) exceeds warning offset (%v)", address, resp.Offset, warning)
+	}
+
+	return result, nil
+}
+
+// Send a single (S)NTP client request and calculate offset and delay from the
+// response timestamps
+func queryNTP(address string, timeout time.Duration) (*ntpResponse, error) {
+	conn, err := net.DialTimeout("udp", address, timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	request := make([]byte, ntpPacketSize)
+	request[0] = ntpVersion<<3 | ntpModeClient
+
+	sent := time.Now()
+	transmit := toNTPTime(sent)
+	binary.BigEndian.PutUint64(request[40:], transmit)
+
+	if _, err := conn.Write(request); err != nil {
+		return nil, err
+	}
+
+	response := make([]byte, ntpPacketSize)
+
+	for {
+		size, err := conn.Read(response)
+		if err != nil {
+			return nil, err
+		}
+
+		received := time.Now()
+
+		if size < ntpPacketSize {
+			return nil, fmt.Errorf("short response (%v bytes)", size)
+		}
+
+		resp := parseNTPResponse(response, sent, received)
+
+		// Ignore stray responses to other requests
+		if resp.Originate != transmit {
+			continue
+		}
+
+		if mode := response[0] & 0x7; mode != ntpModeServer {
+			return nil, fmt.Errorf("unexpected mode %v in response", mode)
+		}
+
+		return resp, nil
+	}
+}
+
+// Offset and delay as per RFC 5905: t1 = sent, t2 = server receive, t3 = server
+// transmit, t4 = received
+func parseNTPResponse(data []byte, sent, received time.Time) *ntpResponse {
+	serverReceive := fromNTPTime(binary.BigEndian.Uint64(data[32:]))
+	serverTransmit := fromNTPTime(binary.BigEndian.Uint64(data[40:]))
+
+	resp := &ntpResponse{
+		Leap:      int(data[0] >> 6),
+		Stratum:   int(data[1]),
+		Originate: binary.BigEndian.Uint64(data[24:]),
+		Offset:    (serverReceive.Sub(sent) + serverTransmit.Sub(received)) / 2,
+		Delay:     received.Sub(sent) - serverTransmit.Sub(serverReceive),
+	}
+
+	copy(resp.RefID[:], data[12:16])
+
+	return resp
+}
+
+// 32 bits of seconds since 1900 + 32 bits of fraction
+func toNTPTime(t time.Time) uint64 {
+	seconds := uint64(t.Unix() + ntpEpochOffset)
+	fraction := uint64(t.Nanosecond()) << 32 / uint64(time.Second)
+
+	return seconds<<32 | fraction
+}
+
+func fromNTPTime(ntp uint64) time.Time {
+	seconds := int64(ntp>>32) - ntpEpochOffset
+	nanos := int64((ntp & 0xffffffff) * uint64(time.Second) >> 32)
+
+	return time.Unix(seconds, nanos)
+}
@@ -0,0 +1,173 @@
+package monitor
+
+import (
+	"encoding/binary"
+	"net"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/9corp/9volt/util"
+)
+
+// Minimal in-process NTP server whose clock is 'skew' ahead of the local clock
+func startTestNTPServer(stratum, leap int, skew time.Duration) (net.PacketConn, int) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	Expect(err).To(BeNil())
+
+	go func() {
+		buf := make([]byte, ntpPacketSize)
+
+		for {
+			_, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+
+			received := time.Now().Add(skew)
+
+			resp := make([]byte, ntpPacketSize)
+			resp[0] = byte(leap<<6 | ntpVersion<<3 | ntpModeServer)
+			resp[1] = byte(stratum)
+
+			if stratum == 0 {
+				copy(resp[12:16], "RATE")
+			}
+
+			copy(resp[24:32], buf[40:48])
+			binary.BigEndian.PutUint64(resp[32:], toNTPTime(received))
+			binary.BigEndian.PutUint64(resp[40:], toNTPTime(time.Now().Add(skew)))
+
+			conn.WriteTo(resp, addr)
+		}
+	}()
+
+	return conn, conn.LocalAddr().(*net.UDPAddr).Port
+}
+
+var _ = Describe("ntp_monitor", func() {
+	var (
+		monitor *NTPMonitor
+		config  *RootMonitorConfig
+		server  net.PacketConn
+	)
+
+	start := func(stratum, leap int, skew time.Duration) {
+		server, config.Config.Port = startTestNTPServer(stratum, leap, skew)
+		monitor = NewNTPMonitor(config)
+		Expect(monitor.Validate()).To(BeNil())
+	}
+
+	BeforeEach(func() {
+		config = &RootMonitorConfig{
+			Config: &MonitorConfig{
+				Host:              "127.0.0.1",
+				Interval:          util.CustomDuration(10 * time.Second),
+				NTPOffsetWarning:  util.CustomDuration(100 * time.Millisecond),
+				NTPOffsetCritical: util.CustomDuration(time.Second),
+			},
+			Log: log.New(),
+		}
+
+		monitor = NewNTPMonitor(config)
+	})
+
+	AfterEach(func() {
+		if server != nil {
+			server.Close()
+			server = nil
+		}
+	})
+
+	Context("NewNTPMonitor", func() {
+		It("returns a properly configured instance with defaults", func() {
+			Expect(monitor.Port).To(Equal(DEFAULT_NTP_PORT))
+			Expect(monitor.Timeout).To(Equal(DEFAULT_NTP_TIMEOUT))
+			Expect(monitor.MonitorFunc).NotTo(BeNil())
+		})
+	})
+
+	Context("Validate", func() {
+		It("returns nil with correct settings", func() {
+			Expect(monitor.Validate()).To(BeNil())
+		})
+
+		It("verifies stratum and offsets", func() {
+			config.Config.NTPMaxStratum = 16
+			Expect(monitor.Validate().Error()).To(ContainSubstring("'ntp-max-stratum' (16) must be between 1 and 15"))
+
+			config.Config.NTPMaxStratum = 3
+			config.Config.NTPOffsetWarning = util.CustomDuration(2 * time.Second)
+			Expect(monitor.Validate().Error()).To(ContainSubstring("'ntp-offset-warning' (2s) cannot exceed 'ntp-offset-critical' (1s)"))
+		})
+	})
+
+	Context("ntpCheck", func() {
+		It("succeeds if the clock offset is within bounds", func() {
+			start(2, 0, 0)
+			result, err := monitor.ntpCheck()
+			Expect(err).To(BeNil())
+			Expect(result.Output).To(ContainSubstring("stratum 2"))
+			Expect(result.Metrics).To(HaveLen(3))
+			Expect(result.Metrics[0].Name).To(Equal("offset"))
+			Expect(result.Metrics[0].Critical).To(Equal("1"))
+		})
+
+		It("fails based on the offset", func() {
+			start(2, 0, -500*time.Millisecond)
+
+			result, err := monitor.ntpCheck()
+			Expect(err).To(BeAssignableToTypeOf(&StateError{}))
+			Expect(err.(*StateError).State).To(Equal(WARNING))
+			Expect(err.(*StateError).Capped).To(BeTrue())
+			Expect(err.Error()).To(ContainSubstring("exceeds warning offset (100ms)"))
+			Expect(result.Metrics[0].Value).To(BeNumerically("~", -0.5, 0.05))
+
+			server.Close()
+			start(2, 0, 5*time.Second)
+
+			_, err = monitor.ntpCheck()
+			Expect(err).NotTo(BeAssignableToTypeOf(&StateError{}))
+			Expect(err.Error()).To(ContainSubstring("exceeds critical offset (1s)"))
+		})
+
+		It("fails if the stratum is too high or the server is unsynchronized", func() {
+			config.Config.NTPMaxStratum = 3
+			start(4, 0, 0)
+			_, err := monitor.ntpCheck()
+			Expect(err.Error()).To(ContainSubstring("stratum (4) exceeds 'ntp-max-stratum' (3)"))
+
+			server.Close()
+			start(2, ntpLeapNotInSync, 0)
+			_, err = monitor.ntpCheck()
+			Expect(err.Error()).To(ContainSubstring("is not synchronized"))
+
+			server.Close()
+			start(0, 0, 0)
+			_, err = monitor.ntpCheck()
+			Expect(err.Error()).To(ContainSubstring("kiss-o'-death code 'RATE'"))
+		})
+
+		It("fails if the server does not respond", func() {
+			start(2, 0, 0)
+			server.Close()
+
+			config.Config.Timeout = util.CustomDuration(200 * time.Millisecond)
+			monitor = NewNTPMonitor(config)
+
+			_, err := monitor.ntpCheck()
+			Expect(err).NotTo(BeNil())
+			Expect(err).NotTo(BeAssignableToTypeOf(&StateError{}))
+			Expect(err.Error()).To(ContainSubstring("NTP query to 127.0.0.1"))
+		})
+	})
+
+	Context("NTP timestamps", func() {
+		It("round trips", func() {
+			now := time.Now()
+			Expect(fromNTPTime(toNTPTime(now))).To(BeTemporally("~", now, time.Microsecond))
+		})
+	})
+})
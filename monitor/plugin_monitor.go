@@ -0,0 +1,377 @@
+package monitor
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/9corp/9volt/state"
+	"github.com/9corp/9volt/util"
+)
+
+const (
+	DEFAULT_PLUGIN_TIMEOUT = time.Duration(10) * time.Second
+
+	// Longest response line accepted from a plugin
+	PLUGIN_MAX_RESPONSE_SIZE = 1024 * 1024
+
+	PLUGIN_METHOD_VALIDATE = "validate"
+	PLUGIN_METHOD_CHECK    = "check"
+)
+
+var (
+	// Plugin statuses -> monitor states
+	pluginStates = map[string]int{"ok": OK, "warning": WARNING, "critical": CRITICAL, "unknown": UNKNOWN}
+)
+
+// Request sent to a plugin as a single line of JSON on its stdin
+type PluginRequest struct {
+	ID         uint64         `json:"id"`
+	Method     string         `json:"method"` // 'validate' or 'check'
+	ConfigName string         `json:"config-name"`
+	Config     *MonitorConfig `json:"config"`
+}
+
+// Response written by a plugin as a single line of JSON on its stdout; 'id'
+// must match the request being answered.
+//
+// 'validate' requests are answered with 'error' (blank if the config is valid),
+// 'check' requests with 'status', 'message' and optional 'metrics'.
+type PluginResponse struct {
+	ID      uint64          `json:"id"`
+	Error   string          `json:"error,omitempty"`
+	Status  string          `json:"status,omitempty"` // 'ok', 'warning', 'critical' or 'unknown'
+	Message string          `json:"message,omitempty"`
+	Metrics []*state.Metric `json:"metrics,omitempty"`
+}
+
+// Long-running plugin process shared by all checks of a plugin provided monitor
+// type; the process is started on first use and restarted if it exits or stops
+// responding. Requests are matched to responses by their 'id', so plugins may
+// answer out of order.
+type pluginProcess struct {
+	Type    string
+	Command string
+	Args    []string
+	Log     log.FieldLogger
+
+	lock     *sync.Mutex
+	instance *pluginInstance // nil while the plugin is not running
+	lastID   uint64
+}
+
+// A started plugin process; requests are written to its stdin by a single
+// goroutine, so a plugin that stops reading cannot block other checks.
+type pluginInstance struct {
+	cmd     *exec.Cmd
+	queue   chan []byte
+	pending map[uint64]chan *PluginResponse
+}
+
+type PluginMonitor struct {
+	Base
+
+	Timeout time.Duration
+	plugin  *pluginProcess
+}
+
+// Register 'monitorType' as a monitor type whose checks are performed by an
+// external plugin; see 'PluginRequest' and 'PluginResponse' for the protocol.
+func RegisterPlugin(monitorType, command string, args ...string) error {
+	if command == "" {
+		return fmt.Errorf("Plugin command for monitor type '%v' cannot be blank", monitorType)
+	}
+
+	plugin := &pluginProcess{
+		Type:    monitorType,
+		Command: command,
+		Args:    args,
+		Log:     log.WithFields(log.Fields{"pkg": "monitor", "plugin": monitorType}),
+		lock:    &sync.Mutex{},
+	}
+
+	return Register(monitorType, func(rmc *RootMonitorConfig) IMonitor {
+		return newPluginMonitor(rmc, plugin)
+	})
+}
+
+func newPluginMonitor(rmc *RootMonitorConfig, plugin *pluginProcess) *PluginMonitor {
+	p := &PluginMonitor{
+		Base: Base{
+			RMC:        rmc,
+			Identifier: plugin.Type,
+		},
+		Timeout: DEFAULT_PLUGIN_TIMEOUT,
+		plugin:  plugin,
+	}
+
+	if rmc.Config.Timeout != util.CustomDuration(0) {
+		p.Timeout = time.Duration(rmc.Config.Timeout)
+	}
+
+	p.MonitorFunc = p.pluginCheck
+
+	return p
+}
+
+// Config validation is delegated to the plugin; its error is returned as-is
+func (p *PluginMonitor) Validate() error {
+	p.RMC.Log.WithField("configName", p.RMC.ConfigName).Debug("Performing monitor config validation")
+
+	if p.Timeout >= time.Duration(p.RMC.Config.Interval) {
+		return fmt.Errorf("'timeout' (%v) cannot equal or exceed 'interval' (%v)", p.Timeout.String(), p.RMC.Config.Interval.String())
+	}
+
+	response, err := p.plugin.request(PLUGIN_METHOD_VALIDATE, p.RMC, p.Timeout)
+	if err != nil {
+		return fmt.Errorf("Unable to validate config via plugin '%v': %v", p.plugin.Command, err.Error())
+	}
+
+	if response.Error != "" {
+		return errors.New(response.Error)
+	}
+
+	return nil
+}
+
+// Unless 'plugin-bypass-thresholds' is set, warning/critical thresholds still
+// apply to non-OK statuses but never lead past the state the plugin reported.
+func (p *PluginMonitor) pluginCheck() (*CheckResult, error) {
+	p.RMC.Log.WithField("configName", p.RMC.ConfigName).Debug("Performing plugin check")
+
+	response, err := p.plugin.request(PLUGIN_METHOD_CHECK, p.RMC, p.Timeout)
+	if err != nil {
+		return nil, p.pluginError(UNKNOWN, fmt.Sprintf("Plugin '%v' did not complete the check: %v", p.plugin.Command, err.Error()))
+	}
+
+	monitorState, ok := pluginStates[response.Status]
+	if !ok {
+		return nil, p.pluginError(UNKNOWN, fmt.Sprintf("Plugin '%v' returned unknown status '%v'", p.plugin.Command, response.Status))
+	}
+
+	result := &CheckResult{Metrics: response.Metrics}
+
+	message := response.Message
+	if message == "" {
+		message = fmt.Sprintf("Plugin '%v' returned '%v' and no message", p.plugin.Command, response.Status)
+	}
+
+	if monitorState == OK {
+		result.Output = message
+		return result, nil
+	}
+
+	return result, p.pluginError(monitorState, message)
+}
+
+func (p *PluginMonitor) pluginError(monitorState int, message string) error {
+	return &StateError{State: monitorState, Err: errors.New(message), Capped: !p.RMC.Config.PluginBypassThresholds}
+}
+
+// Send a request for 'rmc' and wait up to 'timeout' for the plugin's response;
+// a plugin that does not respond in time is killed (and restarted by the next
+// request).
+func (p *pluginProcess) request(method string, rmc *RootMonitorConfig, timeout time.Duration) (*PluginResponse, error) {
+	p.lock.Lock()
+
+	if p.instance == nil {
+		instance, err := p.start()
+		if err != nil {
+			p.lock.Unlock()
+			return nil, fmt.Errorf("unable to start plugin: %v", err.Error())
+		}
+
+		p.instance = instance
+	}
+
+	p.lastID++
+
+	data, err := json.Marshal(&PluginRequest{
+		ID:         p.lastID,
+		Method:     method,
+		ConfigName: rmc.ConfigName,
+		Config:     rmc.Config,
+	})
+	if err != nil {
+		p.lock.Unlock()
+		return nil, fmt.Errorf("unable to marshal request: %v", err.Error())
+	}
+
+	instance := p.instance
+	reply := make(chan *PluginResponse, 1)
+	instance.pending[p.lastID] = reply
+
+	p.lock.Unlock()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	data = append(data, '\n')
+	queue := instance.queue
+
+	for {
+		select {
+		case queue <- data:
+			// Queued; only wait for the response from now on
+			queue = nil
+		case response, ok := <-reply:
+			if !ok {
+				return nil, errors.New("plugin exited before responding")
+			}
+
+			return response, nil
+		case <-timer.C:
+			p.kill(instance, timeout)
+			return nil, fmt.Errorf("no response within %v", timeout)
+		}
+	}
+}
+
+// Start the plugin process; expects 'p.lock' to be held
+func (p *pluginProcess) start() (*pluginInstance, error) {
+	cmd := exec.Command(p.Command, p.Args...)
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+
+	// Anything the plugin writes to stderr ends up in our log
+	stderrReader, stderrWriter := io.Pipe()
+	cmd.Stderr = stderrWriter
+
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	p.Log.WithFields(log.Fields{"command": p.Command, "pid": cmd.Process.Pid}).Info("Started plugin")
+
+	instance := &pluginInstance{
+		cmd:     cmd,
+		queue:   make(chan []byte),
+		pending: make(map[uint64]chan *PluginResponse, 0),
+	}
+
+	done := make(chan struct{})
+
+	go p.logStderr(stderrReader)
+	go p.writeRequests(instance, stdin, done)
+	go p.readResponses(instance, stdin, stdout, stderrWriter, done)
+
+	return instance, nil
+}
+
+// Kill a plugin that stopped responding; the next request starts a new one
+func (p *pluginProcess) kill(instance *pluginInstance, timeout time.Duration) {
+	p.lock.Lock()
+
+	if p.instance == instance {
+		p.instance = nil
+	}
+
+	p.lock.Unlock()
+
+	p.Log.WithFields(log.Fields{"pid": instance.cmd.Process.Pid, "timeout": timeout}).Warning("Killing unresponsive plugin")
+
+	instance.cmd.Process.Kill()
+}
+
+// Write queued requests to the plugin's stdin until it exits
+func (p *pluginProcess) writeRequests(instance *pluginInstance, stdin io.Writer, done chan struct{}) {
+	for {
+		select {
+		case data := <-instance.queue:
+			if _, err := stdin.Write(data); err != nil {
+				p.Log.WithField("err", err).Error("Unable to send request to plugin")
+				return
+			}
+		case <-done:
+			return
+		}
+	}
+}
+
+// Dispatch responses to waiting requests until the plugin exits
+func (p *pluginProcess) readResponses(instance *pluginInstance, stdin io.Closer, stdout io.Reader, stderrWriter *io.PipeWriter, done chan struct{}) {
+	scanner := bufio.NewScanner(stdout)
+	scanner.Buffer(make([]byte, 0, 64*1024), PLUGIN_MAX_RESPONSE_SIZE)
+
+	for scanner.Scan() {
+		var response *PluginResponse
+
+		if err := json.Unmarshal(scanner.Bytes(), &response); err != nil || response == nil {
+			p.Log.WithField("line", scanner.Text()).Error("Unable to decode plugin response")
+			continue
+		}
+
+		p.lock.Lock()
+		reply, ok := instance.pending[response.ID]
+		delete(instance.pending, response.ID)
+		p.lock.Unlock()
+
+		if !ok {
+			p.Log.WithField("id", response.ID).Warning("Discarding response to unknown (or timed out) request")
+			continue
+		}
+
+		reply <- response
+	}
+
+	if err := scanner.Err(); err != nil {
+		p.Log.WithField("err", err).Error("Unable to read plugin output")
+	}
+
+	// Make sure the process is gone before it is restarted by the next request
+	close(done)
+	stdin.Close()
+	instance.cmd.Process.Kill()
+
+	err := instance.cmd.Wait()
+	stderrWriter.Close()
+
+	p.Log.WithField("err", err).Warning("Plugin exited")
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	for id, reply := range instance.pending {
+		close(reply)
+		delete(instance.pending, id)
+	}
+
+	if p.instance == instance {
+		p.instance = nil
+	}
+}
+
+func (p *pluginProcess) logStderr(stderr io.Reader) {
+	scanner := bufio.NewScanner(stderr)
+
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" {
+			p.Log.Info(line)
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		p.Log.WithField("err", err).Warning("Unable to read plugin stderr, discarding the rest")
+	}
+
+	// Keep draining so the plugin (and the 'Wait()' in readResponses) never
+	// blocks on a full stderr pipe
+	io.Copy(ioutil.Discard, stderr)
+}
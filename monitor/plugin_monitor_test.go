@@ -0,0 +1,259 @@
+package monitor
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	cfg "github.com/9corp/9volt/config"
+	"github.com/9corp/9volt/state"
+	"github.com/9corp/9volt/util"
+)
+
+// The test binary doubles as a fake plugin when started with NINEV_TEST_PLUGIN
+// set: configs need a 'threshold' plugin option, checks report the 'status'
+// option. Checks named 'slow' are never answered, 'stuck' stops the plugin from
+// reading any further requests, 'crash' exits the plugin and 'noisy' writes a
+// stderr line larger than both the log scanner's buffer and the pipe buffer.
+func init() {
+	if os.Getenv("NINEV_TEST_PLUGIN") == "" {
+		return
+	}
+
+	fmt.Fprintln(os.Stderr, "fake plugin ready")
+
+	stdoutLock := &sync.Mutex{}
+	scanner := bufio.NewScanner(os.Stdin)
+
+	for scanner.Scan() {
+		var request *PluginRequest
+
+		if err := json.Unmarshal(scanner.Bytes(), &request); err != nil {
+			os.Exit(2)
+		}
+
+		response := &PluginResponse{ID: request.ID}
+
+		switch {
+		case request.Method == PLUGIN_METHOD_VALIDATE:
+			if _, ok := request.Config.PluginConfig["threshold"]; !ok {
+				response.Error = "'plugin-config.threshold' must be set"
+			}
+		case request.ConfigName == "slow":
+			continue
+		case request.ConfigName == "stuck":
+			select {}
+		case request.ConfigName == "crash":
+			os.Exit(1)
+		case request.ConfigName == "noisy":
+			fmt.Fprintln(os.Stderr, strings.Repeat("x", 256*1024))
+			response.Status = "ok"
+		default:
+			response.Status, _ = request.Config.PluginConfig["status"].(string)
+			response.Message = "queue depth is 12"
+			response.Metrics = []*state.Metric{{Name: "queue_depth", Value: 12}}
+		}
+
+		data, _ := json.Marshal(response)
+
+		stdoutLock.Lock()
+		os.Stdout.Write(append(data, '\n'))
+		stdoutLock.Unlock()
+	}
+
+	os.Exit(0)
+}
+
+var _ = Describe("plugin_monitor", func() {
+	var (
+		monitor *PluginMonitor
+		config  *RootMonitorConfig
+	)
+
+	newMonitor := func() *PluginMonitor {
+		return registeredMonitors["test-plugin"](config).(*PluginMonitor)
+	}
+
+	BeforeEach(func() {
+		Expect(RegisterPlugin("test-plugin", "/usr/bin/env", "NINEV_TEST_PLUGIN=1", os.Args[0])).To(BeNil())
+
+		config = &RootMonitorConfig{
+			ConfigName: "queue-depth",
+			Config: &MonitorConfig{
+				Type:         "test-plugin",
+				Interval:     util.CustomDuration(10 * time.Second),
+				Timeout:      util.CustomDuration(time.Second),
+				PluginConfig: map[string]interface{}{"threshold": 100, "status": "ok"},
+			},
+			Log: log.New(),
+		}
+
+		monitor = newMonitor()
+	})
+
+	AfterEach(func() {
+		delete(registeredMonitors, "test-plugin")
+	})
+
+	Context("Register", func() {
+		It("adds monitor types to new monitor engines", func() {
+			Expect(New(&cfg.Config{}, nil, nil).SupportedMonitors).To(HaveKey("test-plugin"))
+			Expect(New(&cfg.Config{}, nil, nil).SupportedMonitors).To(HaveKey("http"))
+		})
+
+		It("rejects blank, built-in and duplicate types", func() {
+			newSample := func(rmc *RootMonitorConfig) IMonitor { return NewSampleMonitor(rmc) }
+
+			Expect(Register("", newSample).Error()).To(ContainSubstring("cannot be blank"))
+			Expect(Register("sample", nil).Error()).To(ContainSubstring("has no constructor"))
+			Expect(Register("http", newSample).Error()).To(ContainSubstring("'http' is a built-in type"))
+			Expect(Register("test-plugin", newSample).Error()).To(ContainSubstring("'test-plugin' is already registered"))
+			Expect(RegisterPlugin("sample", "").Error()).To(ContainSubstring("cannot be blank"))
+		})
+	})
+
+	Context("newPluginMonitor", func() {
+		It("returns a properly configured instance with defaults", func() {
+			config.Config.Timeout = util.CustomDuration(0)
+			monitor = newMonitor()
+
+			Expect(monitor.Identify()).To(Equal("test-plugin"))
+			Expect(monitor.Timeout).To(Equal(DEFAULT_PLUGIN_TIMEOUT))
+			Expect(monitor.MonitorFunc).NotTo(BeNil())
+		})
+	})
+
+	Context("Validate", func() {
+		It("delegates validation to the plugin", func() {
+			Expect(monitor.Validate()).To(BeNil())
+
+			delete(config.Config.PluginConfig, "threshold")
+			err := monitor.Validate()
+			Expect(err).ToNot(BeNil())
+			Expect(err.Error()).To(Equal("'plugin-config.threshold' must be set"))
+		})
+
+		It("errors if the timeout exceeds the interval or the plugin cannot start", func() {
+			config.Config.Timeout = util.CustomDuration(10 * time.Second)
+			monitor = newMonitor()
+			Expect(monitor.Validate().Error()).To(ContainSubstring("cannot equal or exceed 'interval'"))
+
+			delete(registeredMonitors, "test-plugin")
+			Expect(RegisterPlugin("test-plugin", "/nonexistent/plugin")).To(BeNil())
+			config.Config.Timeout = util.CustomDuration(time.Second)
+
+			err := newMonitor().Validate()
+			Expect(err).ToNot(BeNil())
+			Expect(err.Error()).To(ContainSubstring("Unable to validate config via plugin '/nonexistent/plugin': unable to start plugin"))
+		})
+	})
+
+	Context("pluginCheck", func() {
+		It("reports the plugin's message and metrics", func() {
+			result, err := monitor.pluginCheck()
+			Expect(err).To(BeNil())
+			Expect(result.Output).To(Equal("queue depth is 12"))
+			Expect(result.Metrics).To(HaveLen(1))
+			Expect(result.Metrics[0].Name).To(Equal("queue_depth"))
+			Expect(result.Metrics[0].Value).To(Equal(float64(12)))
+		})
+
+		It("maps statuses to check failures", func() {
+			config.Config.PluginConfig["status"] = "warning"
+			_, err := monitor.pluginCheck()
+			Expect(err).ToNot(BeNil())
+			Expect(err.Error()).To(Equal("queue depth is 12"))
+			Expect(err.(*StateError).State).To(Equal(WARNING))
+			Expect(err.(*StateError).Capped).To(BeTrue())
+
+			config.Config.PluginBypassThresholds = true
+			config.Config.PluginConfig["status"] = "critical"
+			_, err = monitor.pluginCheck()
+			Expect(err.(*StateError).State).To(Equal(CRITICAL))
+			Expect(err.(*StateError).Capped).To(BeFalse())
+
+			config.Config.PluginConfig["status"] = "broken"
+			_, err = monitor.pluginCheck()
+			Expect(err.Error()).To(ContainSubstring("returned unknown status 'broken'"))
+			Expect(err.(*StateError).State).To(Equal(UNKNOWN))
+		})
+
+		It("fails if the plugin does not respond and restarts it after it exits", func() {
+			config.Config.Timeout = util.CustomDuration(200 * time.Millisecond)
+			config.ConfigName = "slow"
+			monitor = newMonitor()
+
+			_, err := monitor.pluginCheck()
+			Expect(err).ToNot(BeNil())
+			Expect(err.Error()).To(ContainSubstring("did not complete the check: no response within 200ms"))
+			Expect(monitor.plugin.instance).To(BeNil())
+
+			// Leave the restarted plugin time to start up
+			config.Config.Timeout = util.CustomDuration(time.Second)
+			config.ConfigName = "crash"
+			monitor = newMonitor()
+
+			_, err = monitor.pluginCheck()
+			Expect(err).ToNot(BeNil())
+			Expect(err.Error()).To(ContainSubstring("plugin exited before responding"))
+
+			config.ConfigName = "queue-depth"
+			Eventually(func() error {
+				_, err := monitor.pluginCheck()
+				return err
+			}).Should(BeNil())
+		})
+
+		It("keeps working when the plugin writes an oversized stderr line", func() {
+			config.ConfigName = "noisy"
+			monitor = newMonitor()
+
+			for i := 0; i < 2; i++ {
+				_, err := monitor.pluginCheck()
+				Expect(err).To(BeNil())
+			}
+		})
+
+		It("does not block other checks on a plugin that stops reading requests", func() {
+			config.Config.Timeout = util.CustomDuration(200 * time.Millisecond)
+			config.ConfigName = "stuck"
+			stuck := newMonitor()
+
+			stuckErr := make(chan error, 1)
+			go func() {
+				_, err := stuck.pluginCheck()
+				stuckErr <- err
+			}()
+
+			Eventually(func() int {
+				monitor.plugin.lock.Lock()
+				defer monitor.plugin.lock.Unlock()
+				return int(monitor.plugin.lastID)
+			}).Should(BeNumerically(">=", 1))
+
+			// Larger than the pipe buffer, so writing it blocks
+			config.ConfigName = "queue-depth"
+			config.Config.PluginConfig["padding"] = strings.Repeat("x", 1024*1024)
+			config.Config.Timeout = util.CustomDuration(time.Second)
+			monitor = newMonitor()
+
+			_, err := monitor.pluginCheck()
+			Expect(err).ToNot(BeNil())
+			Eventually(stuckErr).Should(Receive(HaveOccurred()))
+
+			delete(config.Config.PluginConfig, "padding")
+			Eventually(func() error {
+				_, err := monitor.pluginCheck()
+				return err
+			}).Should(BeNil())
+		})
+	})
+})
@@ -0,0 +1,199 @@
+package monitor
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	DEFAULT_POP3_PORT     = 110
+	DEFAULT_POP3_TLS_PORT = 995
+)
+
+type POP3Monitor struct {
+	MailMonitor
+}
+
+func NewPOP3Monitor(rmc *RootMonitorConfig) *POP3Monitor {
+	p := &POP3Monitor{
+		MailMonitor: newMailMonitor(rmc, "pop3", DEFAULT_POP3_PORT, DEFAULT_POP3_TLS_PORT),
+	}
+
+	p.MonitorFunc = p.pop3Check
+
+	return p
+}
+
+// Check the advertised capabilities, optionally upgrade via STLS, log in and
+// verify that the maildrop can be accessed (STAT)
+func (p *POP3Monitor) pop3Check() (*CheckResult, error) {
+	fullAddress := net.JoinHostPort(p.RMC.Config.Host, strconv.Itoa(p.Port))
+
+	p.RMC.Log.WithField("address", fullAddress).Debug("Performing pop3 check")
+
+	conn, err := dialWithDeadline(fullAddress, p.implicitTLS(), time.Now().Add(p.Timeout))
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := newPOP3Conn(conn)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("pop3 check against %v failed: %v", fullAddress, err.Error())
+	}
+
+	defer client.Close()
+
+	if err := p.session(client); err != nil {
+		return nil, fmt.Errorf("pop3 check against %v failed: %v", fullAddress, err.Error())
+	}
+
+	return nil, nil
+}
+
+func (p *POP3Monitor) session(client *pop3Conn) error {
+	if err := client.capabilities(); err != nil {
+		return err
+	}
+
+	missing := missingExtensions(p.RMC.Config.MailExpectedExtensions, mapLookup(client.Capabilities))
+
+	if p.RMC.Config.MailStartTLS {
+		if err := client.startTLS(p.TLSConfig); err != nil {
+			return err
+		}
+
+		missing = missingExtensions(missing, mapLookup(client.Capabilities))
+	}
+
+	if len(missing) != 0 {
+		return fmt.Errorf("server does not advertise expected capabilities: %v", strings.Join(missing, ", "))
+	}
+
+	if p.RMC.Config.MailUser == "" {
+		return nil
+	}
+
+	if _, err := client.command("USER " + p.RMC.Config.MailUser); err != nil {
+		return err
+	}
+
+	if _, err := client.command("PASS " + p.RMC.Config.MailPassword); err != nil {
+		return err
+	}
+
+	if _, err := client.command("STAT"); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Minimal POP3 client
+type pop3Conn struct {
+	conn         net.Conn
+	text         *textproto.Conn
+	Capabilities map[string]string
+}
+
+// Wrap an established connection and read the server greeting
+func newPOP3Conn(conn net.Conn) (*pop3Conn, error) {
+	c := &pop3Conn{
+		conn: conn,
+		text: textproto.NewConn(conn),
+	}
+
+	line, err := c.text.ReadLine()
+	if err != nil {
+		return nil, fmt.Errorf("unable to read greeting: %v", err.Error())
+	}
+
+	if !strings.HasPrefix(line, "+OK") {
+		return nil, fmt.Errorf("unexpected greeting '%v'", line)
+	}
+
+	return c, nil
+}
+
+// Send a command and read its single line response; '-ERR' is returned as an error
+func (c *pop3Conn) command(command string) (string, error) {
+	// Never include arguments (ie. passwords) in errors
+	name := strings.Fields(command)[0]
+
+	if err := c.text.PrintfLine("%v", command); err != nil {
+		return "", fmt.Errorf("unable to send %v: %v", name, err.Error())
+	}
+
+	line, err := c.text.ReadLine()
+	if err != nil {
+		return "", fmt.Errorf("unable to read %v response: %v", name, err.Error())
+	}
+
+	if !strings.HasPrefix(line, "+OK") {
+		return "", fmt.Errorf("%v failed: %v", name, line)
+	}
+
+	return strings.TrimSpace(strings.TrimPrefix(line, "+OK")), nil
+}
+
+// CAPA is optional (RFC 2449); servers without it advertise nothing
+func (c *pop3Conn) capabilities() error {
+	c.Capabilities = make(map[string]string)
+
+	if err := c.text.PrintfLine("CAPA"); err != nil {
+		return fmt.Errorf("unable to send CAPA: %v", err.Error())
+	}
+
+	line, err := c.text.ReadLine()
+	if err != nil {
+		return fmt.Errorf("unable to read CAPA response: %v", err.Error())
+	}
+
+	if !strings.HasPrefix(line, "+OK") {
+		return nil
+	}
+
+	lines, err := c.text.ReadDotLines()
+	if err != nil {
+		return fmt.Errorf("unable to read CAPA response: %v", err.Error())
+	}
+
+	c.Capabilities = newExtensionMap(lines)
+
+	return nil
+}
+
+// Upgrade the connection via STLS and refresh the capabilities
+func (c *pop3Conn) startTLS(tlsConfig *tls.Config) error {
+	if _, ok := c.Capabilities["STLS"]; !ok {
+		return errors.New("server does not advertise STLS")
+	}
+
+	if _, err := c.command("STLS"); err != nil {
+		return err
+	}
+
+	tlsConn := tls.Client(c.conn, tlsConfig)
+
+	if err := tlsConn.Handshake(); err != nil {
+		return fmt.Errorf("TLS handshake failed: %v", err.Error())
+	}
+
+	c.conn = tlsConn
+	c.text = textproto.NewConn(tlsConn)
+
+	return c.capabilities()
+}
+
+// Quit (best effort) and close the connection
+func (c *pop3Conn) Close() error {
+	c.command("QUIT")
+
+	return c.conn.Close()
+}
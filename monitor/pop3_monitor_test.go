@@ -0,0 +1,193 @@
+package monitor
+
+import (
+	"crypto/tls"
+	"net"
+	"net/textproto"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/9corp/9volt/util"
+)
+
+// Minimal in-process POP3 stand-in; accepts 'user'/'secret', only supports CAPA
+// if 'capabilities' is non-nil and advertises STLS if 'cert' is set
+func startTestPOP3Server(capabilities []string, cert *tls.Certificate) (net.Listener, int) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	Expect(err).To(BeNil())
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+
+			go func(conn net.Conn) {
+				defer conn.Close()
+
+				text := textproto.NewConn(conn)
+				secure := false
+				user := ""
+
+				text.PrintfLine("+OK test POP3 server ready")
+
+				for {
+					line, err := text.ReadLine()
+					if err != nil {
+						return
+					}
+
+					args := strings.Fields(line)
+
+					switch strings.ToUpper(args[0]) {
+					case "CAPA":
+						if capabilities == nil {
+							text.PrintfLine("-ERR unknown command")
+							continue
+						}
+
+						text.PrintfLine("+OK capability list follows")
+
+						for _, capability := range capabilities {
+							text.PrintfLine("%v", capability)
+						}
+
+						if cert != nil && !secure {
+							text.PrintfLine("STLS")
+						}
+
+						text.PrintfLine(".")
+					case "STLS":
+						text.PrintfLine("+OK begin TLS negotiation")
+
+						tlsConn := tls.Server(conn, &tls.Config{Certificates: []tls.Certificate{*cert}})
+						if err := tlsConn.Handshake(); err != nil {
+							return
+						}
+
+						conn, text, secure = tlsConn, textproto.NewConn(tlsConn), true
+					case "USER":
+						user = args[1]
+						text.PrintfLine("+OK")
+					case "PASS":
+						if user != "user" || args[1] != "secret" {
+							text.PrintfLine("-ERR [AUTH] invalid credentials")
+							continue
+						}
+
+						text.PrintfLine("+OK logged in")
+					case "STAT":
+						text.PrintfLine("+OK 2 320")
+					case "QUIT":
+						text.PrintfLine("+OK bye")
+						return
+					default:
+						text.PrintfLine("-ERR unknown command")
+					}
+				}
+			}(conn)
+		}
+	}()
+
+	return ln, ln.Addr().(*net.TCPAddr).Port
+}
+
+var _ = Describe("pop3_monitor", func() {
+	var (
+		monitor *POP3Monitor
+		config  *RootMonitorConfig
+		ln      net.Listener
+		cert    tls.Certificate
+	)
+
+	start := func(capabilities []string, cert *tls.Certificate) {
+		ln, config.Config.Port = startTestPOP3Server(capabilities, cert)
+		monitor = NewPOP3Monitor(config)
+		Expect(monitor.Validate()).To(BeNil())
+	}
+
+	BeforeEach(func() {
+		_, cert = generateTestCerts([]string{"localhost"}, time.Now().Add(24*time.Hour))
+
+		config = &RootMonitorConfig{
+			Config: &MonitorConfig{
+				Host:     "127.0.0.1",
+				Interval: util.CustomDuration(30 * time.Second),
+			},
+			Log: log.New(),
+		}
+
+		monitor = NewPOP3Monitor(config)
+	})
+
+	AfterEach(func() {
+		if ln != nil {
+			ln.Close()
+			ln = nil
+		}
+	})
+
+	Context("NewPOP3Monitor", func() {
+		It("returns a properly configured instance with defaults", func() {
+			Expect(monitor.Port).To(Equal(DEFAULT_POP3_PORT))
+			Expect(monitor.MonitorFunc).NotTo(BeNil())
+
+			config.Config.TCPTLS = true
+			Expect(NewPOP3Monitor(config).Port).To(Equal(DEFAULT_POP3_TLS_PORT))
+		})
+	})
+
+	Context("pop3Check", func() {
+		It("logs in and checks the maildrop", func() {
+			config.Config.MailUser = "user"
+			config.Config.MailPassword = "secret"
+			start([]string{"USER", "UIDL"}, nil)
+			_, err := monitor.pop3Check()
+			Expect(err).To(BeNil())
+
+			config.Config.MailPassword = "wrong"
+			_, err = monitor.pop3Check()
+			Expect(err).NotTo(BeNil())
+			Expect(err.Error()).To(ContainSubstring("PASS failed: -ERR [AUTH] invalid credentials"))
+			Expect(err.Error()).NotTo(ContainSubstring("wrong"))
+		})
+
+		It("checks advertised capabilities (including parameters)", func() {
+			config.Config.MailExpectedExtensions = []string{"SASL PLAIN", "UIDL"}
+			start([]string{"SASL PLAIN LOGIN", "UIDL"}, nil)
+			_, err := monitor.pop3Check()
+			Expect(err).To(BeNil())
+
+			config.Config.MailExpectedExtensions = []string{"SASL CRAM-MD5"}
+			_, err = monitor.pop3Check()
+			Expect(err).NotTo(BeNil())
+			Expect(err.Error()).To(ContainSubstring("does not advertise expected capabilities: SASL CRAM-MD5"))
+		})
+
+		It("treats servers without CAPA as advertising nothing", func() {
+			start(nil, nil)
+			_, err := monitor.pop3Check()
+			Expect(err).To(BeNil())
+
+			config.Config.MailExpectedExtensions = []string{"UIDL"}
+			_, err = monitor.pop3Check()
+			Expect(err).NotTo(BeNil())
+		})
+
+		It("upgrades via STLS", func() {
+			config.Config.MailStartTLS = true
+			config.Config.TLSInsecureSkipVerify = true
+			config.Config.MailUser = "user"
+			config.Config.MailPassword = "secret"
+			config.Config.MailExpectedExtensions = []string{"STLS", "USER"}
+			start([]string{"USER"}, &cert)
+			_, err := monitor.pop3Check()
+			Expect(err).To(BeNil())
+		})
+	})
+})
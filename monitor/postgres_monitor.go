@@ -0,0 +1,489 @@
+package monitor
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/9corp/9volt/util"
+)
+
+const (
+	DEFAULT_POSTGRES_PORT  = 5432
+	DEFAULT_POSTGRES_QUERY = "SELECT 1"
+
+	postgresProtocolVersion = 196608 // 3.0
+	postgresMaxMessageSize  = 16 * 1024 * 1024
+
+	postgresAuthOK              = 0
+	postgresAuthCleartext       = 3
+	postgresAuthMD5             = 5
+	postgresAuthSASL            = 10
+	postgresAuthSASLContinue    = 11
+	postgresAuthSASLFinal       = 12
+	postgresSCRAMSHA256         = "SCRAM-SHA-256"
+	postgresApplicationName     = "9volt"
+	postgresSCRAMNonceByteCount = 18
+)
+
+type PostgresMonitor struct {
+	DBMonitor
+}
+
+func NewPostgresMonitor(rmc *RootMonitorConfig) *PostgresMonitor {
+	p := &PostgresMonitor{
+		DBMonitor: newDBMonitor(rmc, "postgres", DEFAULT_POSTGRES_PORT, DEFAULT_POSTGRES_QUERY),
+	}
+
+	p.MonitorFunc = p.postgresCheck
+
+	return p
+}
+
+func (p *PostgresMonitor) Validate() error {
+	if err := p.DBMonitor.Validate(); err != nil {
+		return err
+	}
+
+	if p.RMC.Config.DBUser == "" {
+		return errors.New("'db-user' must be set")
+	}
+
+	return nil
+}
+
+func (p *PostgresMonitor) postgresCheck() (*CheckResult, error) {
+	return nil, p.dbCheck(p.query)
+}
+
+// A single backend message
+type postgresMessage struct {
+	Type byte
+	Data []byte
+}
+
+// Perform the startup/authentication flow and run the query using the
+// simple query protocol
+func (p *PostgresMonitor) query(conn net.Conn) (*DBResult, error) {
+	reader := bufio.NewReader(conn)
+
+	params := []string{"user", p.RMC.Config.DBUser, "application_name", postgresApplicationName}
+	if p.RMC.Config.DBName != "" {
+		params = append(params, "database", p.RMC.Config.DBName)
+	}
+
+	startup := make([]byte, 4)
+	binary.BigEndian.PutUint32(startup, postgresProtocolVersion)
+
+	for _, param := range params {
+		startup = append(append(startup, param...), 0)
+	}
+
+	startup = append(startup, 0)
+
+	if err := writePostgresMessage(conn, 0, startup); err != nil {
+		return nil, err
+	}
+
+	// Best effort; saves the server from logging an unexpected EOF on every check
+	defer writePostgresMessage(conn, 'X', nil)
+
+	if err := p.authenticate(conn, reader); err != nil {
+		return nil, err
+	}
+
+	// Wait for the server to finish its startup
+	if _, _, err := readPostgresUntilReady(reader); err != nil {
+		return nil, err
+	}
+
+	if err := writePostgresMessage(conn, 'Q', append([]byte(p.Query), 0)); err != nil {
+		return nil, err
+	}
+
+	columns, rows, err := readPostgresUntilReady(reader)
+	if err != nil {
+		return nil, err
+	}
+
+	return newDBResult(columns, rows), nil
+}
+
+func (p *PostgresMonitor) authenticate(conn net.Conn, reader *bufio.Reader) error {
+	var scram *scramClient
+
+	for {
+		msg, err := readPostgresMessage(reader)
+		if err != nil {
+			return err
+		}
+
+		if msg.Type == 'E' {
+			return postgresError(msg.Data)
+		}
+
+		if msg.Type != 'R' || len(msg.Data) < 4 {
+			return fmt.Errorf("unexpected message '%c' during authentication", msg.Type)
+		}
+
+		code := binary.BigEndian.Uint32(msg.Data)
+		payload := msg.Data[4:]
+
+		switch code {
+		case postgresAuthOK:
+			return nil
+		case postgresAuthCleartext:
+			err = writePostgresMessage(conn, 'p', append([]byte(p.RMC.Config.DBPassword), 0))
+		case postgresAuthMD5:
+			if len(payload) < 4 {
+				return errors.New("malformed MD5 authentication request")
+			}
+
+			err = writePostgresMessage(conn, 'p', append([]byte(postgresMD5Password(p.RMC.Config.DBUser, p.RMC.Config.DBPassword, payload[:4])), 0))
+		case postgresAuthSASL:
+			mechanisms := strings.Split(strings.TrimRight(string(payload), "\x00"), "\x00")
+			if !util.StringSliceContains(mechanisms, postgresSCRAMSHA256) {
+				return fmt.Errorf("server does not support %v (offered: %v)", postgresSCRAMSHA256, strings.Join(mechanisms, ", "))
+			}
+
+			scram, err = newSCRAMClient(p.RMC.Config.DBPassword)
+			if err != nil {
+				return err
+			}
+
+			first := scram.clientFirstMessage()
+
+			data := append([]byte(postgresSCRAMSHA256), 0)
+			data = append(data, make([]byte, 4)...)
+			binary.BigEndian.PutUint32(data[len(data)-4:], uint32(len(first)))
+			data = append(data, first...)
+
+			err = writePostgresMessage(conn, 'p', data)
+		case postgresAuthSASLContinue:
+			if scram == nil {
+				return errors.New("unexpected SASL continue message")
+			}
+
+			final, scramErr := scram.clientFinalMessage(string(payload))
+			if scramErr != nil {
+				return scramErr
+			}
+
+			err = writePostgresMessage(conn, 'p', []byte(final))
+		case postgresAuthSASLFinal:
+			if scram == nil {
+				return errors.New("unexpected SASL final message")
+			}
+
+			if err := scram.verifyServerFinal(string(payload)); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("unsupported authentication method (%v)", code)
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// Read messages until 'ReadyForQuery', collecting the first result set
+func readPostgresUntilReady(reader *bufio.Reader) ([]string, [][]*string, error) {
+	var columns []string
+	var rows [][]*string
+	var queryErr error
+
+	resultSets := 0
+
+	for {
+		msg, err := readPostgresMessage(reader)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		switch msg.Type {
+		case 'Z':
+			return columns, rows, queryErr
+		case 'E':
+			if queryErr == nil {
+				queryErr = postgresError(msg.Data)
+			}
+		case 'T':
+			resultSets++
+
+			if resultSets == 1 {
+				columns, err = parsePostgresRowDescription(msg.Data)
+				if err != nil {
+					return nil, nil, err
+				}
+			}
+		case 'D':
+			if resultSets > 1 {
+				continue
+			}
+
+			row, err := parsePostgresDataRow(msg.Data)
+			if err != nil {
+				return nil, nil, err
+			}
+
+			rows = append(rows, row)
+		}
+
+		// Anything else (ParameterStatus, BackendKeyData, NoticeResponse,
+		// CommandComplete, ...) is of no interest to us
+	}
+}
+
+func parsePostgresRowDescription(data []byte) ([]string, error) {
+	if len(data) < 2 {
+		return nil, errors.New("malformed row description")
+	}
+
+	count := int(binary.BigEndian.Uint16(data))
+	data = data[2:]
+
+	columns := make([]string, 0, count)
+
+	for i := 0; i < count; i++ {
+		end := strings.IndexByte(string(data), 0)
+
+		// name + table oid (4), attnum (2), type oid (4), typlen (2), typmod (4), format (2)
+		if end < 0 || len(data) < end+1+18 {
+			return nil, errors.New("malformed row description")
+		}
+
+		columns = append(columns, string(data[:end]))
+		data = data[end+1+18:]
+	}
+
+	return columns, nil
+}
+
+func parsePostgresDataRow(data []byte) ([]*string, error) {
+	if len(data) < 2 {
+		return nil, errors.New("malformed data row")
+	}
+
+	count := int(binary.BigEndian.Uint16(data))
+	data = data[2:]
+
+	row := make([]*string, 0, count)
+
+	for i := 0; i < count; i++ {
+		if len(data) < 4 {
+			return nil, errors.New("malformed data row")
+		}
+
+		size := int32(binary.BigEndian.Uint32(data))
+		data = data[4:]
+
+		if size < 0 {
+			row = append(row, nil)
+			continue
+		}
+
+		if len(data) < int(size) {
+			return nil, errors.New("malformed data row")
+		}
+
+		value := string(data[:size])
+		row = append(row, &value)
+		data = data[size:]
+	}
+
+	return row, nil
+}
+
+// Build an error from an 'ErrorResponse' message
+func postgresError(data []byte) error {
+	fields := make(map[byte]string)
+
+	for _, field := range strings.Split(string(data), "\x00") {
+		if len(field) > 1 {
+			fields[field[0]] = field[1:]
+		}
+	}
+
+	return fmt.Errorf("server returned error: %v: %v (SQLSTATE %v)", fields['S'], fields['M'], fields['C'])
+}
+
+func readPostgresMessage(r *bufio.Reader) (*postgresMessage, error) {
+	header := make([]byte, 5)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+
+	size := int(binary.BigEndian.Uint32(header[1:])) - 4
+	if size < 0 || size > postgresMaxMessageSize {
+		return nil, fmt.Errorf("invalid message length %v", size)
+	}
+
+	data := make([]byte, size)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, err
+	}
+
+	return &postgresMessage{Type: header[0], Data: data}, nil
+}
+
+// Write a frontend message; the startup message has no type (0)
+func writePostgresMessage(w io.Writer, msgType byte, data []byte) error {
+	msg := make([]byte, 0, len(data)+5)
+
+	if msgType != 0 {
+		msg = append(msg, msgType)
+	}
+
+	length := make([]byte, 4)
+	binary.BigEndian.PutUint32(length, uint32(len(data)+4))
+
+	msg = append(append(msg, length...), data...)
+
+	_, err := w.Write(msg)
+
+	return err
+}
+
+// 'md5' + md5(md5(password + user) + salt)
+func postgresMD5Password(user, password string, salt []byte) string {
+	inner := md5.Sum([]byte(password + user))
+	outer := md5.Sum(append([]byte(hex.EncodeToString(inner[:])), salt...))
+
+	return "md5" + hex.EncodeToString(outer[:])
+}
+
+// Client side of SCRAM-SHA-256 (RFC 5802 / RFC 7677) without channel binding
+type scramClient struct {
+	password        string
+	clientNonce     string
+	clientFirstBare string
+	authMessage     string
+	saltedPassword  []byte
+}
+
+func newSCRAMClient(password string) (*scramClient, error) {
+	nonce := make([]byte, postgresSCRAMNonceByteCount)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("unable to generate SCRAM nonce: %v", err.Error())
+	}
+
+	return &scramClient{
+		password:    password,
+		clientNonce: base64.RawStdEncoding.EncodeToString(nonce),
+	}, nil
+}
+
+func (s *scramClient) clientFirstMessage() string {
+	// Postgres ignores the SCRAM user name in favor of the startup message
+	s.clientFirstBare = "n=,r=" + s.clientNonce
+
+	return "n,," + s.clientFirstBare
+}
+
+func (s *scramClient) clientFinalMessage(serverFirst string) (string, error) {
+	attrs := parseSCRAMAttributes(serverFirst)
+
+	nonce, salt64, iterStr := attrs["r"], attrs["s"], attrs["i"]
+
+	if !strings.HasPrefix(nonce, s.clientNonce) || len(nonce) == len(s.clientNonce) {
+		return "", errors.New("invalid SCRAM server nonce")
+	}
+
+	salt, err := base64.StdEncoding.DecodeString(salt64)
+	if err != nil {
+		return "", errors.New("invalid SCRAM salt")
+	}
+
+	iterations, err := strconv.Atoi(iterStr)
+	if err != nil || iterations < 1 {
+		return "", errors.New("invalid SCRAM iteration count")
+	}
+
+	s.saltedPassword = scramHi([]byte(s.password), salt, iterations)
+
+	clientFinalWithoutProof := "c=biws,r=" + nonce
+	s.authMessage = s.clientFirstBare + "," + serverFirst + "," + clientFinalWithoutProof
+
+	clientKey := scramHMAC(s.saltedPassword, []byte("Client Key"))
+	storedKey := sha256.Sum256(clientKey)
+	clientSignature := scramHMAC(storedKey[:], []byte(s.authMessage))
+
+	proof := make([]byte, len(clientKey))
+	for i := range clientKey {
+		proof[i] = clientKey[i] ^ clientSignature[i]
+	}
+
+	return clientFinalWithoutProof + ",p=" + base64.StdEncoding.EncodeToString(proof), nil
+}
+
+func (s *scramClient) verifyServerFinal(serverFinal string) error {
+	attrs := parseSCRAMAttributes(serverFinal)
+
+	if e, ok := attrs["e"]; ok {
+		return fmt.Errorf("SCRAM authentication failed: %v", e)
+	}
+
+	serverKey := scramHMAC(s.saltedPassword, []byte("Server Key"))
+	expected := base64.StdEncoding.EncodeToString(scramHMAC(serverKey, []byte(s.authMessage)))
+
+	if !hmac.Equal([]byte(attrs["v"]), []byte(expected)) {
+		return errors.New("invalid SCRAM server signature")
+	}
+
+	return nil
+}
+
+func parseSCRAMAttributes(msg string) map[string]string {
+	attrs := make(map[string]string)
+
+	for _, part := range strings.Split(msg, ",") {
+		if len(part) > 2 && part[1] == '=' {
+			attrs[part[:1]] = part[2:]
+		}
+	}
+
+	return attrs
+}
+
+func scramHMAC(key, data []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(data)
+
+	return mac.Sum(nil)
+}
+
+// PBKDF2-HMAC-SHA256 with a single block of output
+func scramHi(password, salt []byte, iterations int) []byte {
+	mac := hmac.New(sha256.New, password)
+	mac.Write(salt)
+	mac.Write([]byte{0, 0, 0, 1})
+
+	u := mac.Sum(nil)
+	result := make([]byte, len(u))
+	copy(result, u)
+
+	for i := 1; i < iterations; i++ {
+		mac.Reset()
+		mac.Write(u)
+		u = mac.Sum(nil)
+
+		for j := range result {
+			result[j] ^= u[j]
+		}
+	}
+
+	return result
+}
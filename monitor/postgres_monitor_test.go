@@ -0,0 +1,280 @@
+package monitor
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/9corp/9volt/util"
+)
+
+// Minimal in-process postgres stand-in for user 'nine' / password 'volt'; a
+// value is sent on the returned channel whenever a client sends Terminate
+func startTestPostgresServer(authMethod uint32) (net.Listener, int, chan struct{}) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	Expect(err).To(BeNil())
+
+	terminated := make(chan struct{}, 10)
+
+	auth := func(code uint32, data ...byte) []byte {
+		payload := make([]byte, 4)
+		binary.BigEndian.PutUint32(payload, code)
+		return append(payload, data...)
+	}
+
+	send := func(w io.Writer, msgType byte, data []byte) {
+		writePostgresMessage(w, msgType, data)
+	}
+
+	fail := func(w io.Writer, message string) {
+		send(w, 'E', []byte("SFATAL\x00C28P01\x00M"+message+"\x00\x00"))
+	}
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+
+			go func(conn net.Conn) {
+				defer conn.Close()
+
+				r := bufio.NewReader(conn)
+
+				// Startup message has no type byte
+				header := make([]byte, 4)
+				io.ReadFull(r, header)
+				startup := make([]byte, binary.BigEndian.Uint32(header)-4)
+				io.ReadFull(r, startup)
+
+				params := strings.Split(string(startup[4:]), "\x00")
+				if params[1] != "nine" {
+					fail(conn, `role "`+params[1]+`" does not exist`)
+					return
+				}
+
+				switch authMethod {
+				case postgresAuthCleartext:
+					send(conn, 'R', auth(postgresAuthCleartext))
+
+					msg, _ := readPostgresMessage(r)
+					if string(msg.Data) != "volt\x00" {
+						fail(conn, `password authentication failed for user "nine"`)
+						return
+					}
+				case postgresAuthMD5:
+					salt := []byte{1, 2, 3, 4}
+					send(conn, 'R', auth(postgresAuthMD5, salt...))
+
+					msg, _ := readPostgresMessage(r)
+					if string(msg.Data) != postgresMD5Password("nine", "volt", salt)+"\x00" {
+						fail(conn, `password authentication failed for user "nine"`)
+						return
+					}
+				case postgresAuthSASL:
+					send(conn, 'R', auth(postgresAuthSASL, []byte("SCRAM-SHA-256-PLUS\x00SCRAM-SHA-256\x00\x00")...))
+
+					msg, _ := readPostgresMessage(r)
+					mechanism := msg.Data[:bytes.IndexByte(msg.Data, 0)]
+					Expect(string(mechanism)).To(Equal(postgresSCRAMSHA256))
+
+					clientFirst := string(msg.Data[len(mechanism)+5:])
+					clientFirstBare := strings.TrimPrefix(clientFirst, "n,,")
+					nonce := parseSCRAMAttributes(clientFirstBare)["r"] + "server"
+					salt := []byte("saltysalt")
+
+					serverFirst := "r=" + nonce + ",s=" + base64.StdEncoding.EncodeToString(salt) + ",i=4096"
+					send(conn, 'R', auth(postgresAuthSASLContinue, []byte(serverFirst)...))
+
+					msg, _ = readPostgresMessage(r)
+					clientFinal := string(msg.Data)
+					withoutProof := clientFinal[:strings.Index(clientFinal, ",p=")]
+					proof, _ := base64.StdEncoding.DecodeString(parseSCRAMAttributes(clientFinal)["p"])
+
+					salted := scramHi([]byte("volt"), salt, 4096)
+					authMessage := clientFirstBare + "," + serverFirst + "," + withoutProof
+					storedKey := sha256.Sum256(scramHMAC(salted, []byte("Client Key")))
+					signature := scramHMAC(storedKey[:], []byte(authMessage))
+
+					for i := range proof {
+						proof[i] ^= signature[i]
+					}
+
+					if sha256.Sum256(proof) != storedKey {
+						fail(conn, `password authentication failed for user "nine"`)
+						return
+					}
+
+					serverKey := scramHMAC(salted, []byte("Server Key"))
+					serverFinal := "v=" + base64.StdEncoding.EncodeToString(scramHMAC(serverKey, []byte(authMessage)))
+					send(conn, 'R', auth(postgresAuthSASLFinal, []byte(serverFinal)...))
+				}
+
+				send(conn, 'R', auth(postgresAuthOK))
+				send(conn, 'S', []byte("server_version\x0015.0\x00"))
+				send(conn, 'K', make([]byte, 8))
+				send(conn, 'Z', []byte("I"))
+
+				msg, err := readPostgresMessage(r)
+				if err != nil || msg.Type != 'Q' {
+					return
+				}
+
+				column := func(name string) []byte {
+					return append(append([]byte(name), 0), make([]byte, 18)...)
+				}
+
+				switch strings.TrimRight(string(msg.Data), "\x00") {
+				case "SELECT 1":
+					send(conn, 'T', append([]byte{0, 1}, column("?column?")...))
+					send(conn, 'D', []byte{0, 1, 0, 0, 0, 1, '1'})
+					send(conn, 'C', []byte("SELECT 1\x00"))
+				case "SELECT pg_is_in_recovery() AS replica, lag":
+					send(conn, 'T', append(append([]byte{0, 2}, column("replica")...), column("lag")...))
+					send(conn, 'D', []byte{0, 2, 0, 0, 0, 1, 't', 0xff, 0xff, 0xff, 0xff})
+					send(conn, 'C', []byte("SELECT 1\x00"))
+				default:
+					send(conn, 'E', []byte("SERROR\x00C42601\x00Msyntax error\x00\x00"))
+				}
+
+				send(conn, 'Z', []byte("I"))
+
+				if msg, err := readPostgresMessage(r); err == nil && msg.Type == 'X' {
+					terminated <- struct{}{}
+				}
+			}(conn)
+		}
+	}()
+
+	return ln, ln.Addr().(*net.TCPAddr).Port, terminated
+}
+
+var _ = Describe("postgres_monitor", func() {
+	var (
+		monitor    *PostgresMonitor
+		config     *RootMonitorConfig
+		ln         net.Listener
+		terminated chan struct{}
+	)
+
+	start := func(authMethod uint32) {
+		ln, config.Config.Port, terminated = startTestPostgresServer(authMethod)
+		monitor = NewPostgresMonitor(config)
+		Expect(monitor.Validate()).To(BeNil())
+	}
+
+	BeforeEach(func() {
+		config = &RootMonitorConfig{
+			Config: &MonitorConfig{
+				Host:       "127.0.0.1",
+				DBUser:     "nine",
+				DBPassword: "volt",
+				DBName:     "monitoring",
+				Interval:   util.CustomDuration(10 * time.Second),
+			},
+			Log: log.New(),
+		}
+
+		monitor = NewPostgresMonitor(config)
+	})
+
+	AfterEach(func() {
+		if ln != nil {
+			ln.Close()
+			ln = nil
+		}
+	})
+
+	Context("NewPostgresMonitor", func() {
+		It("returns a properly configured instance with defaults", func() {
+			Expect(monitor.Port).To(Equal(DEFAULT_POSTGRES_PORT))
+			Expect(monitor.Query).To(Equal(DEFAULT_POSTGRES_QUERY))
+			Expect(monitor.MonitorFunc).NotTo(BeNil())
+		})
+	})
+
+	Context("Validate", func() {
+		It("requires a user", func() {
+			config.Config.DBUser = ""
+			Expect(monitor.Validate().Error()).To(ContainSubstring("'db-user' must be set"))
+		})
+
+		It("requires a host", func() {
+			config.Config.Host = ""
+			Expect(monitor.Validate().Error()).To(ContainSubstring("'host' must be set"))
+		})
+	})
+
+	Context("postgresCheck", func() {
+		It("authenticates with a cleartext password", func() {
+			start(postgresAuthCleartext)
+			_, err := monitor.postgresCheck()
+			Expect(err).To(BeNil())
+		})
+
+		It("sends Terminate before closing the connection", func() {
+			start(postgresAuthCleartext)
+			_, err := monitor.postgresCheck()
+			Expect(err).To(BeNil())
+			Eventually(terminated).Should(Receive())
+		})
+
+		It("authenticates with md5", func() {
+			config.Config.DBAssertions = []*DBAssertion{{Value: "1"}, {Field: "?column?", Value: "1"}}
+			start(postgresAuthMD5)
+			_, err := monitor.postgresCheck()
+			Expect(err).To(BeNil())
+		})
+
+		It("authenticates with SCRAM-SHA-256", func() {
+			start(postgresAuthSASL)
+			_, err := monitor.postgresCheck()
+			Expect(err).To(BeNil())
+		})
+
+		It("fails on bad credentials", func() {
+			config.Config.DBPassword = "wrong"
+			start(postgresAuthSASL)
+
+			_, err := monitor.postgresCheck()
+			Expect(err).NotTo(BeNil())
+			Expect(err.Error()).To(ContainSubstring("password authentication failed"))
+			Expect(err.Error()).To(ContainSubstring("28P01"))
+		})
+
+		It("asserts on columns and treats NULL as not found", func() {
+			config.Config.DBQuery = "SELECT pg_is_in_recovery() AS replica, lag"
+			config.Config.DBAssertions = []*DBAssertion{{Field: "replica", Value: "t"}, {Field: "lag", Operator: "absent"}}
+			start(postgresAuthMD5)
+
+			_, err := monitor.postgresCheck()
+			Expect(err).To(BeNil())
+
+			config.Config.DBAssertions = []*DBAssertion{{Field: "lag", Operator: "<", Value: "30"}}
+
+			_, err = monitor.postgresCheck()
+			Expect(err).NotTo(BeNil())
+			Expect(err.Error()).To(ContainSubstring("value not found"))
+		})
+
+		It("reports query errors", func() {
+			config.Config.DBQuery = "SELEC 1"
+			start(postgresAuthMD5)
+
+			_, err := monitor.postgresCheck()
+			Expect(err).NotTo(BeNil())
+			Expect(err.Error()).To(ContainSubstring("syntax error (SQLSTATE 42601)"))
+		})
+	})
+})
@@ -0,0 +1,9 @@
+//go:build linux
+// +build linux
+
+package monitor
+
+// Monitors reading /proc ('load', 'memory', 'process') are supported
+func checkProcSupport(monitorType string) error {
+	return nil
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package monitor
+
+import (
+	"fmt"
+	"runtime"
+)
+
+// Monitors reading /proc ('load', 'memory', 'process') are Linux only
+func checkProcSupport(monitorType string) error {
+	return fmt.Errorf("'%v' checks are not supported on %v (they read /proc)", monitorType, runtime.GOOS)
+}
@@ -0,0 +1,193 @@
+package monitor
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+type ProcessMonitor struct {
+	Base
+
+	ProcRoot string
+	Cmdline  *regexp.Regexp
+}
+
+// A running process as seen in /proc
+type localProcess struct {
+	PID     int
+	Comm    string // truncated to 15 characters by the kernel
+	Cmdline []string
+}
+
+func NewProcessMonitor(rmc *RootMonitorConfig) *ProcessMonitor {
+	p := &ProcessMonitor{
+		Base: Base{
+			RMC:        rmc,
+			Identifier: "process",
+		},
+		ProcRoot: DEFAULT_PROC_ROOT,
+	}
+
+	p.MonitorFunc = p.processCheck
+
+	return p
+}
+
+func (p *ProcessMonitor) Validate() error {
+	p.RMC.Log.WithField("configName", p.RMC.ConfigName).Debug("Performing monitor config validation")
+
+	if err := checkProcSupport(p.Identifier); err != nil {
+		return err
+	}
+
+	cfg := p.RMC.Config
+
+	if cfg.ProcessName == "" && cfg.ProcessCmdline == "" {
+		return errors.New("Either 'process-name' or 'process-cmdline' must be set")
+	}
+
+	if cfg.ProcessMin < 0 || cfg.ProcessMax < 0 {
+		return errors.New("'process-min' and 'process-max' must be larger or equal to 0")
+	}
+
+	if cfg.ProcessMax != 0 && p.min() > cfg.ProcessMax {
+		return fmt.Errorf("'process-min' (%v) cannot exceed 'process-max' (%v)", p.min(), cfg.ProcessMax)
+	}
+
+	if cfg.ProcessCmdline != "" {
+		re, err := regexp.Compile(cfg.ProcessCmdline)
+		if err != nil {
+			return fmt.Errorf("Unable to compile 'process-cmdline' regex: %v", err.Error())
+		}
+
+		p.Cmdline = re
+	}
+
+	return nil
+}
+
+// Count the processes matching 'process-name' and/or 'process-cmdline' and
+// verify the count is within 'process-min' and 'process-max'
+func (p *ProcessMonitor) processCheck() (*CheckResult, error) {
+	cfg := p.RMC.Config
+
+	if cfg.ProcessCmdline != "" && p.Cmdline == nil {
+		if err := p.Validate(); err != nil {
+			return nil, err
+		}
+	}
+
+	processes, err := listProcesses(p.ProcRoot)
+	if err != nil {
+		return nil, err
+	}
+
+	var pids []string
+
+	for _, proc := range processes {
+		if p.matches(proc) {
+			pids = append(pids, strconv.Itoa(proc.PID))
+		}
+	}
+
+	if len(pids) < p.min() {
+		return nil, fmt.Errorf("Found %v process(es) matching %v (expected at least %v)", len(pids), p.description(), p.min())
+	}
+
+	if cfg.ProcessMax != 0 && len(pids) > cfg.ProcessMax {
+		return nil, fmt.Errorf("Found %v process(es) matching %v (expected at most %v): %v",
+			len(pids), p.description(), cfg.ProcessMax, strings.Join(pids, ", "))
+	}
+
+	return &CheckResult{Output: fmt.Sprintf("Found %v process(es) matching %v", len(pids), p.description())}, nil
+}
+
+// A process matches 'process-name' if either its (possibly truncated) command
+// name or the base name of its executable equals it
+func (p *ProcessMonitor) matches(proc *localProcess) bool {
+	if name := p.RMC.Config.ProcessName; name != "" {
+		exe := ""
+		if len(proc.Cmdline) != 0 {
+			exe = filepath.Base(proc.Cmdline[0])
+		}
+
+		if proc.Comm != name && exe != name {
+			return false
+		}
+	}
+
+	if p.Cmdline != nil && !p.Cmdline.MatchString(strings.Join(proc.Cmdline, " ")) {
+		return false
+	}
+
+	return true
+}
+
+func (p *ProcessMonitor) min() int {
+	if p.RMC.Config.ProcessMin == 0 {
+		return 1
+	}
+
+	return p.RMC.Config.ProcessMin
+}
+
+func (p *ProcessMonitor) description() string {
+	var parts []string
+
+	if p.RMC.Config.ProcessName != "" {
+		parts = append(parts, fmt.Sprintf("name '%v'", p.RMC.Config.ProcessName))
+	}
+
+	if p.RMC.Config.ProcessCmdline != "" {
+		parts = append(parts, fmt.Sprintf("cmdline '%v'", p.RMC.Config.ProcessCmdline))
+	}
+
+	return strings.Join(parts, " and ")
+}
+
+// List all processes in /proc; processes exiting while being read are skipped
+func listProcesses(procRoot string) ([]*localProcess, error) {
+	entries, err := ioutil.ReadDir(procRoot)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to list processes: %v", err.Error())
+	}
+
+	var processes []*localProcess
+
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil || !entry.IsDir() {
+			continue
+		}
+
+		comm, err := ioutil.ReadFile(filepath.Join(procRoot, entry.Name(), "comm"))
+		if err != nil {
+			continue
+		}
+
+		// Kernel threads have an empty cmdline
+		cmdline, _ := ioutil.ReadFile(filepath.Join(procRoot, entry.Name(), "cmdline"))
+
+		var args []string
+
+		for _, arg := range bytes.Split(bytes.TrimRight(cmdline, "\x00"), []byte{0}) {
+			if len(arg) != 0 {
+				args = append(args, string(arg))
+			}
+		}
+
+		processes = append(processes, &localProcess{
+			PID:     pid,
+			Comm:    strings.TrimSpace(string(comm)),
+			Cmdline: args,
+		})
+	}
+
+	return processes, nil
+}
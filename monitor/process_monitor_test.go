@@ -0,0 +1,132 @@
+package monitor
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/9corp/9volt/util"
+)
+
+var _ = Describe("process_monitor", func() {
+	var (
+		monitor  *ProcessMonitor
+		config   *RootMonitorConfig
+		procRoot string
+	)
+
+	process := func(pid int, comm string, args ...string) {
+		dir := filepath.Join(procRoot, strconv.Itoa(pid))
+		Expect(os.MkdirAll(dir, 0755)).To(BeNil())
+		Expect(ioutil.WriteFile(filepath.Join(dir, "comm"), []byte(comm+"\n"), 0644)).To(BeNil())
+
+		cmdline := ""
+		if len(args) != 0 {
+			cmdline = strings.Join(args, "\x00") + "\x00"
+		}
+
+		Expect(ioutil.WriteFile(filepath.Join(dir, "cmdline"), []byte(cmdline), 0644)).To(BeNil())
+	}
+
+	start := func() {
+		monitor = NewProcessMonitor(config)
+		monitor.ProcRoot = procRoot
+		Expect(monitor.Validate()).To(BeNil())
+	}
+
+	BeforeEach(func() {
+		var err error
+
+		procRoot, err = ioutil.TempDir("", "9volt-proc")
+		Expect(err).To(BeNil())
+
+		process(1, "systemd", "/sbin/init", "splash")
+		process(2, "kthreadd")
+		process(812, "nginx", "nginx: master process /usr/sbin/nginx", "-g", "daemon on;")
+		process(813, "nginx", "nginx: worker process")
+		process(901, "postgres-expor", "/usr/local/bin/postgres-exporter", "--web.listen-address=:9187")
+
+		config = &RootMonitorConfig{
+			Config: &MonitorConfig{
+				Interval:    util.CustomDuration(time.Minute),
+				ProcessName: "nginx",
+			},
+			Log: log.New(),
+		}
+
+		monitor = NewProcessMonitor(config)
+		monitor.ProcRoot = procRoot
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(procRoot)
+	})
+
+	Context("Validate", func() {
+		It("returns nil with correct settings", func() {
+			Expect(monitor.Validate()).To(BeNil())
+		})
+
+		It("requires a name or cmdline and sane limits", func() {
+			config.Config.ProcessName = ""
+			Expect(monitor.Validate().Error()).To(ContainSubstring("Either 'process-name' or 'process-cmdline' must be set"))
+
+			config.Config.ProcessCmdline = "("
+			Expect(monitor.Validate().Error()).To(ContainSubstring("Unable to compile 'process-cmdline' regex"))
+
+			config.Config.ProcessCmdline = "nginx"
+			config.Config.ProcessMin = 3
+			config.Config.ProcessMax = 2
+			Expect(monitor.Validate().Error()).To(ContainSubstring("'process-min' (3) cannot exceed 'process-max' (2)"))
+		})
+	})
+
+	Context("processCheck", func() {
+		It("counts processes by name", func() {
+			start()
+			result, err := monitor.processCheck()
+			Expect(err).To(BeNil())
+			Expect(result.Output).To(Equal("Found 2 process(es) matching name 'nginx'"))
+
+			// comm is truncated; the executable name matches as well
+			config.Config.ProcessName = "postgres-exporter"
+			start()
+			_, err = monitor.processCheck()
+			Expect(err).To(BeNil())
+
+			config.Config.ProcessName = "haproxy"
+			start()
+			_, err = monitor.processCheck()
+			Expect(err.Error()).To(Equal("Found 0 process(es) matching name 'haproxy' (expected at least 1)"))
+		})
+
+		It("matches the command line against a regex", func() {
+			config.Config.ProcessName = ""
+			config.Config.ProcessCmdline = `nginx: master process .* -g daemon`
+			start()
+			result, err := monitor.processCheck()
+			Expect(err).To(BeNil())
+			Expect(result.Output).To(ContainSubstring("Found 1 process(es)"))
+		})
+
+		It("enforces 'process-min' and 'process-max'", func() {
+			config.Config.ProcessMin = 3
+			start()
+			_, err := monitor.processCheck()
+			Expect(err.Error()).To(ContainSubstring("expected at least 3"))
+
+			config.Config.ProcessMin = 0
+			config.Config.ProcessMax = 1
+			start()
+			_, err = monitor.processCheck()
+			Expect(err.Error()).To(ContainSubstring("(expected at most 1): 812, 813"))
+		})
+	})
+})
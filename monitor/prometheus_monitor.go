@@ -0,0 +1,527 @@
+package monitor
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/9corp/9volt/state"
+	"github.com/9corp/9volt/util"
+)
+
+const (
+	DEFAULT_PROMETHEUS_TIMEOUT = time.Duration(3) * time.Second
+	DEFAULT_PROMETHEUS_URL     = "/metrics"
+
+	// Ask for the text exposition format; protobuf is not supported
+	prometheusAcceptHeader = "text/plain;version=0.0.4;q=1,*/*;q=0.1"
+	prometheusMaxLineSize  = 1024 * 1024
+)
+
+var (
+	prometheusAggregations = []string{"sum", "max", "min", "avg", "count"}
+	prometheusOperators    = []string{"=~", "!~", "!=", "="} // longest first
+
+	prometheusMetricNameRegex = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*`)
+	prometheusLabelNameRegex  = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*`)
+)
+
+type PrometheusMonitor struct {
+	Base
+
+	Timeout  time.Duration
+	Client   *http.Client
+	Selector *PrometheusSelector
+}
+
+// A PromQL style instant vector selector, ie. 'http_requests_total{code=~"5.."}'
+type PrometheusSelector struct {
+	Metric   string
+	Matchers []*PrometheusMatcher
+}
+
+type PrometheusMatcher struct {
+	Label    string
+	Operator string // '=', '!=', '=~' or '!~'
+	Value    string
+
+	regex *regexp.Regexp
+}
+
+// A single sample parsed from the text exposition format
+type PrometheusSample struct {
+	Metric string
+	Labels map[string]string
+	Value  float64
+}
+
+func NewPrometheusMonitor(rmc *RootMonitorConfig) *PrometheusMonitor {
+	p := &PrometheusMonitor{
+		Base: Base{
+			RMC:        rmc,
+			Identifier: "prometheus",
+		},
+		Timeout: DEFAULT_PROMETHEUS_TIMEOUT,
+	}
+
+	if rmc.Config.Timeout != util.CustomDuration(0) {
+		p.Timeout = time.Duration(rmc.Config.Timeout)
+	}
+
+	p.MonitorFunc = p.prometheusCheck
+
+	return p
+}
+
+func (p *PrometheusMonitor) Validate() error {
+	p.RMC.Log.WithField("configName", p.RMC.ConfigName).Debug("Performing monitor config validation")
+
+	cfg := p.RMC.Config
+
+	if p.Timeout >= time.Duration(cfg.Interval) {
+		return fmt.Errorf("'timeout' (%v) cannot equal or exceed 'interval' (%v)", p.Timeout.String(), cfg.Interval.String())
+	}
+
+	if cfg.PrometheusMetric == "" {
+		return errors.New("'prometheus-metric' must be set")
+	}
+
+	selector, err := ParsePrometheusSelector(cfg.PrometheusMetric)
+	if err != nil {
+		return fmt.Errorf("Unable to parse 'prometheus-metric' '%v': %v", cfg.PrometheusMetric, err.Error())
+	}
+
+	if cfg.PrometheusAggregate != "" && !util.StringSliceContains(prometheusAggregations, cfg.PrometheusAggregate) {
+		return fmt.Errorf("Unknown 'prometheus-aggregate' '%v' (supported: %v)",
+			cfg.PrometheusAggregate, strings.Join(prometheusAggregations, ", "))
+	}
+
+	if err := validateThresholds("prometheus-", cfg.PrometheusWarning, cfg.PrometheusCritical, cfg.PrometheusComparison); err != nil {
+		return err
+	}
+
+	if err := validateHTTPRequestOptions(cfg); err != nil {
+		return err
+	}
+
+	if strings.Contains(cfg.HTTPURL, "://") {
+		if _, err := parseFullURL(cfg.HTTPURL); err != nil {
+			return err
+		}
+	}
+
+	client, err := newHTTPClient(cfg, p.Timeout)
+	if err != nil {
+		return err
+	}
+
+	p.Client = client
+	p.Selector = selector
+
+	return nil
+}
+
+// Scrape the metrics endpoint, select (and optionally aggregate) the configured
+// series and compare the resulting value against the warning/critical thresholds.
+// Scrape failures and missing series count against the regular thresholds.
+func (p *PrometheusMonitor) prometheusCheck() (*CheckResult, error) {
+	cfg := p.RMC.Config
+
+	if p.Selector == nil {
+		selector, err := ParsePrometheusSelector(cfg.PrometheusMetric)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to parse 'prometheus-metric' '%v': %v", cfg.PrometheusMetric, err.Error())
+		}
+
+		p.Selector = selector
+	}
+
+	fullURL := buildHTTPURL(cfg, p.url())
+
+	p.RMC.Log.WithField("fullURL", fullURL).Debug("Performing prometheus check")
+
+	values, err := p.scrape(fullURL)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(values) == 0 && cfg.PrometheusAggregate != "count" {
+		return nil, fmt.Errorf("No series matching '%v' found at '%v'", cfg.PrometheusMetric, fullURL)
+	}
+
+	value, err := aggregatePrometheusValues(cfg.PrometheusAggregate, values)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to evaluate '%v': %v", cfg.PrometheusMetric, err.Error())
+	}
+
+	if math.IsNaN(value) {
+		return nil, fmt.Errorf("'%v' is NaN", cfg.PrometheusMetric)
+	}
+
+	metric := thresholdMetric(cfg.PrometheusMetric, value, "", cfg.PrometheusWarning, cfg.PrometheusCritical)
+
+	result := &CheckResult{
+		Output:  fmt.Sprintf("%v = %v", cfg.PrometheusMetric, value),
+		Metrics: []*state.Metric{metric},
+	}
+
+	if crossesThreshold(value, cfg.PrometheusCritical, p.comparison()) {
+		return result, fmt.Errorf("'%v' (%v) is %v critical threshold (%v)",
+			cfg.PrometheusMetric, value, p.comparison(), *cfg.PrometheusCritical)
+	}
+
+	if crossesThreshold(value, cfg.PrometheusWarning, p.comparison()) {
+		return result, NewCappedWarningError("'%v' (%v) is %v warning threshold (%v)",
+			cfg.PrometheusMetric, value, p.comparison(), *cfg.PrometheusWarning)
+	}
+
+	return result, nil
+}
+
+// Fetch the metrics endpoint and return the values of all matching series
+func (p *PrometheusMonitor) scrape(fullURL string) ([]float64, error) {
+	if p.Client == nil {
+		client, err := newHTTPClient(p.RMC.Config, p.Timeout)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to create HTTP client for PrometheusMonitor check: %v", err.Error())
+		}
+
+		p.Client = client
+	}
+
+	req, err := http.NewRequest("GET", fullURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to create new HTTP request for PrometheusMonitor check: %v", err.Error())
+	}
+
+	req.Header.Set("Accept", prometheusAcceptHeader)
+
+	applyHTTPRequestOptions(req, p.RMC.Config)
+
+	resp, err := p.Client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to scrape '%v': %v", fullURL, err.Error())
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Received status code '%v' while scraping '%v'", resp.StatusCode, fullURL)
+	}
+
+	var values []float64
+
+	err = ParsePrometheusText(resp.Body, func(sample *PrometheusSample) {
+		if p.Selector.Matches(sample) {
+			values = append(values, sample.Value)
+		}
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Unable to parse metrics from '%v': %v", fullURL, err.Error())
+	}
+
+	return values, nil
+}
+
+func (p *PrometheusMonitor) url() string {
+	if p.RMC.Config.HTTPURL == "" {
+		return DEFAULT_PROMETHEUS_URL
+	}
+
+	return p.RMC.Config.HTTPURL
+}
+
+func (p *PrometheusMonitor) comparison() string {
+	if p.RMC.Config.PrometheusComparison == "" {
+		return COMPARISON_ABOVE
+	}
+
+	return p.RMC.Config.PrometheusComparison
+}
+
+// Reduce the values of all matching series to a single value; without an
+// aggregation, exactly one series must match
+func aggregatePrometheusValues(aggregate string, values []float64) (float64, error) {
+	if aggregate == "count" {
+		return float64(len(values)), nil
+	}
+
+	if len(values) == 0 {
+		return 0, errors.New("no matching series")
+	}
+
+	if aggregate == "" {
+		if len(values) > 1 {
+			return 0, fmt.Errorf("%v series match; narrow down the selector or set 'prometheus-aggregate'", len(values))
+		}
+
+		return values[0], nil
+	}
+
+	result := values[0]
+
+	for _, v := range values[1:] {
+		switch aggregate {
+		case "sum", "avg":
+			result += v
+		case "max":
+			result = math.Max(result, v)
+		case "min":
+			result = math.Min(result, v)
+		default:
+			return 0, fmt.Errorf("unknown aggregation '%v'", aggregate)
+		}
+	}
+
+	if aggregate == "avg" {
+		result /= float64(len(values))
+	}
+
+	return result, nil
+}
+
+// Parse a selector such as 'queue_depth{queue="emails",env!~"dev|test"}'. As in
+// PromQL, regex matchers are fully anchored and the metric name may be omitted
+// if the selector includes at least one label matcher.
+func ParsePrometheusSelector(selector string) (*PrometheusSelector, error) {
+	selector = strings.TrimSpace(selector)
+
+	s := &PrometheusSelector{
+		Metric: prometheusMetricNameRegex.FindString(selector),
+	}
+
+	rest := selector[len(s.Metric):]
+
+	if strings.HasPrefix(rest, "{") {
+		matchers, remainder, err := parsePrometheusLabels(rest[1:])
+		if err != nil {
+			return nil, err
+		}
+
+		for _, m := range matchers {
+			if m.Operator == "=~" || m.Operator == "!~" {
+				re, err := regexp.Compile("^(?:" + m.Value + ")$")
+				if err != nil {
+					return nil, fmt.Errorf("unable to compile regex for label '%v': %v", m.Label, err.Error())
+				}
+
+				m.regex = re
+			}
+		}
+
+		s.Matchers, rest = matchers, remainder
+	}
+
+	if strings.TrimSpace(rest) != "" {
+		return nil, fmt.Errorf("unexpected '%v'", rest)
+	}
+
+	if s.Metric == "" && len(s.Matchers) == 0 {
+		return nil, errors.New("a metric name or at least one label matcher is required")
+	}
+
+	return s, nil
+}
+
+// Determine whether a sample is selected by the metric name and all matchers;
+// missing labels are treated as empty, ie. 'code=""' matches samples without 'code'
+func (s *PrometheusSelector) Matches(sample *PrometheusSample) bool {
+	if s.Metric != "" && s.Metric != sample.Metric {
+		return false
+	}
+
+	for _, m := range s.Matchers {
+		value := sample.Labels[m.Label]
+
+		if m.Label == "__name__" {
+			value = sample.Metric
+		}
+
+		var matched bool
+
+		switch m.Operator {
+		case "=":
+			matched = value == m.Value
+		case "!=":
+			matched = value != m.Value
+		case "=~":
+			matched = m.regex.MatchString(value)
+		case "!~":
+			matched = !m.regex.MatchString(value)
+		}
+
+		if !matched {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Parse the Prometheus text exposition format, calling 'fn' for every sample;
+// comments ('# HELP', '# TYPE', ...), blank lines and timestamps are skipped.
+func ParsePrometheusText(r io.Reader, fn func(*PrometheusSample)) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), prometheusMaxLineSize)
+
+	lineNum := 0
+
+	for scanner.Scan() {
+		lineNum++
+
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		sample, err := parsePrometheusSample(line)
+		if err != nil {
+			return fmt.Errorf("line %v: %v", lineNum, err.Error())
+		}
+
+		fn(sample)
+	}
+
+	return scanner.Err()
+}
+
+// Parse a single 'metric_name{label="value",...} value [timestamp]' line
+func parsePrometheusSample(line string) (*PrometheusSample, error) {
+	sample := &PrometheusSample{
+		Metric: prometheusMetricNameRegex.FindString(line),
+		Labels: make(map[string]string, 0),
+	}
+
+	if sample.Metric == "" {
+		return nil, fmt.Errorf("invalid metric name in '%v'", line)
+	}
+
+	rest := line[len(sample.Metric):]
+
+	if strings.HasPrefix(rest, "{") {
+		labels, remainder, err := parsePrometheusLabels(rest[1:])
+		if err != nil {
+			return nil, err
+		}
+
+		for _, l := range labels {
+			if l.Operator != "=" {
+				return nil, fmt.Errorf("unexpected '%v' for label '%v'", l.Operator, l.Label)
+			}
+
+			sample.Labels[l.Label] = l.Value
+		}
+
+		rest = remainder
+	}
+
+	// OpenMetrics exemplars (' # {...}') and timestamps are ignored
+	fields := strings.Fields(rest)
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("missing value for '%v'", sample.Metric)
+	}
+
+	value, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid value '%v' for '%v'", fields[0], sample.Metric)
+	}
+
+	sample.Value = value
+
+	return sample, nil
+}
+
+// Parse a 'name="value",...}' label list (following the opening '{'); returns
+// the labels (as matchers) and anything following the closing '}'
+func parsePrometheusLabels(s string) ([]*PrometheusMatcher, string, error) {
+	var matchers []*PrometheusMatcher
+
+	for {
+		s = strings.TrimLeft(s, " \t")
+
+		if strings.HasPrefix(s, "}") {
+			return matchers, s[1:], nil
+		}
+
+		label := prometheusLabelNameRegex.FindString(s)
+		if label == "" {
+			return nil, "", fmt.Errorf("expected label name at '%v'", s)
+		}
+
+		s = strings.TrimLeft(s[len(label):], " \t")
+
+		operator := ""
+
+		for _, candidate := range prometheusOperators {
+			if strings.HasPrefix(s, candidate) {
+				operator = candidate
+				break
+			}
+		}
+
+		if operator == "" {
+			return nil, "", fmt.Errorf("expected operator after label '%v'", label)
+		}
+
+		value, rest, err := readPrometheusString(strings.TrimLeft(s[len(operator):], " \t"))
+		if err != nil {
+			return nil, "", fmt.Errorf("invalid value for label '%v': %v", label, err.Error())
+		}
+
+		matchers = append(matchers, &PrometheusMatcher{
+			Label:    label,
+			Operator: operator,
+			Value:    value,
+		})
+
+		s = strings.TrimLeft(rest, " \t")
+
+		if strings.HasPrefix(s, ",") {
+			s = s[1:]
+			continue
+		}
+
+		if !strings.HasPrefix(s, "}") {
+			return nil, "", fmt.Errorf("expected ',' or '}' after label '%v'", label)
+		}
+	}
+}
+
+// Read a double quoted string, unescaping '\\', '\"' and '\n'
+func readPrometheusString(s string) (string, string, error) {
+	if !strings.HasPrefix(s, `"`) {
+		return "", "", errors.New("expected '\"'")
+	}
+
+	var buf bytes.Buffer
+
+	for i := 1; i < len(s); i++ {
+		switch s[i] {
+		case '"':
+			return buf.String(), s[i+1:], nil
+		case '\\':
+			i++
+
+			if i == len(s) {
+				return "", "", errors.New("unterminated string")
+			}
+
+			if s[i] == 'n' {
+				buf.WriteByte('\n')
+			} else {
+				buf.WriteByte(s[i])
+			}
+		default:
+			buf.WriteByte(s[i])
+		}
+	}
+
+	return "", "", errors.New("unterminated string")
+}
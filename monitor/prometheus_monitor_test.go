@@ -0,0 +1,248 @@
+package monitor
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"gopkg.in/jarcoal/httpmock.v1"
+
+	"github.com/9corp/9volt/util"
+)
+
+const testPrometheusMetrics = `# HELP queue_depth Number of queued jobs.
+# TYPE queue_depth gauge
+queue_depth{queue="emails",env="prod"} 120
+queue_depth{queue="reports",env="prod"} 30 1507827600000
+queue_depth{queue="emails",env="dev"} 5
+# HELP http_requests_total Total HTTP requests.
+# TYPE http_requests_total counter
+http_requests_total{code="200",path="/a \"quoted\" path"} 1027
+http_requests_total{code="503"} 4
+up 1
+
+process_start_time_seconds +Inf
+`
+
+var _ = Describe("prometheus_monitor", func() {
+	var (
+		monitor *PrometheusMonitor
+		config  *RootMonitorConfig
+	)
+
+	float := func(f float64) *float64 {
+		return &f
+	}
+
+	start := func() {
+		monitor = NewPrometheusMonitor(config)
+		Expect(monitor.Validate()).To(BeNil())
+	}
+
+	BeforeEach(func() {
+		config = &RootMonitorConfig{
+			Config: &MonitorConfig{
+				Host:             "exporter",
+				Port:             9100,
+				Interval:         util.CustomDuration(10 * time.Second),
+				PrometheusMetric: `queue_depth{queue="emails",env="prod"}`,
+			},
+			Log: log.New(),
+		}
+
+		httpmock.RegisterResponder("GET", "http://exporter:9100/metrics",
+			httpmock.NewStringResponder(200, testPrometheusMetrics))
+
+		monitor = NewPrometheusMonitor(config)
+	})
+
+	Context("Validate", func() {
+		It("returns nil with correct settings", func() {
+			Expect(monitor.Validate()).To(BeNil())
+			Expect(monitor.Timeout).To(Equal(DEFAULT_PROMETHEUS_TIMEOUT))
+			Expect(monitor.Selector.Metric).To(Equal("queue_depth"))
+			Expect(monitor.Selector.Matchers).To(HaveLen(2))
+		})
+
+		It("requires a valid selector", func() {
+			config.Config.PrometheusMetric = ""
+			Expect(monitor.Validate().Error()).To(ContainSubstring("'prometheus-metric' must be set"))
+
+			config.Config.PrometheusMetric = `queue_depth{queue="emails"`
+			Expect(monitor.Validate().Error()).To(ContainSubstring("Unable to parse 'prometheus-metric'"))
+
+			config.Config.PrometheusMetric = `queue_depth{queue=~"(emails"}`
+			Expect(monitor.Validate().Error()).To(ContainSubstring("unable to compile regex for label 'queue'"))
+		})
+
+		It("rejects unknown aggregations and comparisons", func() {
+			config.Config.PrometheusAggregate = "median"
+			Expect(monitor.Validate().Error()).To(ContainSubstring("Unknown 'prometheus-aggregate' 'median'"))
+
+			config.Config.PrometheusAggregate = ""
+			config.Config.PrometheusComparison = "sideways"
+			Expect(monitor.Validate().Error()).To(ContainSubstring("Unknown 'prometheus-comparison' 'sideways'"))
+		})
+
+		It("verifies threshold ordering", func() {
+			config.Config.PrometheusWarning = float(100)
+			config.Config.PrometheusCritical = float(50)
+			Expect(monitor.Validate().Error()).To(ContainSubstring("'prometheus-warning' (100) cannot exceed 'prometheus-critical' (50)"))
+
+			config.Config.PrometheusComparison = COMPARISON_BELOW
+			Expect(monitor.Validate()).To(BeNil())
+		})
+	})
+
+	Context("prometheusCheck", func() {
+		It("selects a single series and reports it as a metric", func() {
+			config.Config.PrometheusWarning = float(200)
+			start()
+
+			result, err := monitor.prometheusCheck()
+			Expect(err).To(BeNil())
+			Expect(result.Output).To(Equal(`queue_depth{queue="emails",env="prod"} = 120`))
+			Expect(result.Metrics).To(HaveLen(1))
+			Expect(result.Metrics[0].Value).To(Equal(float64(120)))
+			Expect(result.Metrics[0].Warning).To(Equal("200"))
+		})
+
+		It("fails when crossing thresholds", func() {
+			config.Config.PrometheusWarning = float(100)
+			config.Config.PrometheusCritical = float(150)
+			start()
+
+			_, err := monitor.prometheusCheck()
+			Expect(err).To(BeAssignableToTypeOf(&StateError{}))
+			Expect(err.(*StateError).State).To(Equal(WARNING))
+			Expect(err.(*StateError).Capped).To(BeTrue())
+			Expect(err.Error()).To(ContainSubstring("(120) is above warning threshold (100)"))
+
+			config.Config.PrometheusCritical = float(110)
+			_, err = monitor.prometheusCheck()
+			Expect(err).NotTo(BeAssignableToTypeOf(&StateError{}))
+			Expect(err.Error()).To(ContainSubstring("(120) is above critical threshold (110)"))
+		})
+
+		It("supports alerting on values below the thresholds", func() {
+			config.Config.PrometheusMetric = "up"
+			config.Config.PrometheusComparison = COMPARISON_BELOW
+			config.Config.PrometheusCritical = float(1)
+			start()
+			_, err := monitor.prometheusCheck()
+			Expect(err).To(BeNil())
+
+			config.Config.PrometheusCritical = float(2)
+			_, err = monitor.prometheusCheck()
+			Expect(err).NotTo(BeNil())
+			Expect(err.Error()).To(ContainSubstring("is below critical threshold (2)"))
+		})
+
+		It("requires an aggregation if multiple series match", func() {
+			config.Config.PrometheusMetric = `queue_depth{env="prod"}`
+			start()
+
+			_, err := monitor.prometheusCheck()
+			Expect(err).NotTo(BeNil())
+			Expect(err.Error()).To(ContainSubstring("2 series match"))
+
+			for aggregate, expected := range map[string]float64{"sum": 150, "max": 120, "min": 30, "avg": 75, "count": 2} {
+				config.Config.PrometheusAggregate = aggregate
+				result, err := monitor.prometheusCheck()
+				Expect(err).To(BeNil())
+				Expect(result.Metrics[0].Value).To(Equal(expected), aggregate)
+			}
+		})
+
+		It("supports regex and negative matchers", func() {
+			config.Config.PrometheusMetric = `http_requests_total{code=~"5.."}`
+			start()
+			result, err := monitor.prometheusCheck()
+			Expect(err).To(BeNil())
+			Expect(result.Metrics[0].Value).To(Equal(float64(4)))
+
+			config.Config.PrometheusMetric = `{__name__="queue_depth", env!="prod"}`
+			start()
+			result, err = monitor.prometheusCheck()
+			Expect(err).To(BeNil())
+			Expect(result.Metrics[0].Value).To(Equal(float64(5)))
+
+			config.Config.PrometheusMetric = `http_requests_total{path="/a \"quoted\" path"}`
+			start()
+			result, err = monitor.prometheusCheck()
+			Expect(err).To(BeNil())
+			Expect(result.Metrics[0].Value).To(Equal(float64(1027)))
+		})
+
+		It("fails if no series match, unless counting", func() {
+			config.Config.PrometheusMetric = `queue_depth{queue="invoices"}`
+			start()
+
+			_, err := monitor.prometheusCheck()
+			Expect(err).NotTo(BeNil())
+			Expect(err).NotTo(BeAssignableToTypeOf(&StateError{}))
+			Expect(err.Error()).To(ContainSubstring("No series matching"))
+
+			config.Config.PrometheusAggregate = "count"
+			config.Config.PrometheusCritical = float(0)
+			config.Config.PrometheusComparison = COMPARISON_BELOW
+			_, err = monitor.prometheusCheck()
+			Expect(err).To(BeNil())
+		})
+
+		It("passes request options and honors 'url'", func() {
+			config.Config.HTTPURL = "/custom/metrics"
+			config.Config.HTTPBearerToken = "hunter2"
+
+			var header http.Header
+
+			httpmock.RegisterResponder("GET", "http://exporter:9100/custom/metrics", func(req *http.Request) (*http.Response, error) {
+				header = req.Header
+				return httpmock.NewStringResponse(200, testPrometheusMetrics), nil
+			})
+
+			start()
+			_, err := monitor.prometheusCheck()
+			Expect(err).To(BeNil())
+			Expect(header.Get("Authorization")).To(Equal("Bearer hunter2"))
+			Expect(header.Get("Accept")).To(ContainSubstring("text/plain"))
+		})
+
+		It("fails on bad status codes and unparseable responses", func() {
+			httpmock.RegisterResponder("GET", "http://exporter:9100/metrics",
+				httpmock.NewStringResponder(503, ""))
+			start()
+
+			_, err := monitor.prometheusCheck()
+			Expect(err).NotTo(BeNil())
+			Expect(err.Error()).To(ContainSubstring("Received status code '503'"))
+
+			httpmock.RegisterResponder("GET", "http://exporter:9100/metrics",
+				httpmock.NewStringResponder(200, "up 1\nbroken{ 2\n"))
+
+			_, err = monitor.prometheusCheck()
+			Expect(err).NotTo(BeNil())
+			Expect(err.Error()).To(ContainSubstring("line 2"))
+		})
+	})
+
+	Context("ParsePrometheusText", func() {
+		It("parses samples, skipping comments and timestamps", func() {
+			var samples []*PrometheusSample
+
+			err := ParsePrometheusText(strings.NewReader(testPrometheusMetrics), func(s *PrometheusSample) {
+				samples = append(samples, s)
+			})
+
+			Expect(err).To(BeNil())
+			Expect(samples).To(HaveLen(7))
+			Expect(samples[1].Labels).To(Equal(map[string]string{"queue": "reports", "env": "prod"}))
+			Expect(samples[1].Value).To(Equal(float64(30)))
+			Expect(samples[3].Labels["path"]).To(Equal(`/a "quoted" path`))
+			Expect(samples[6].Metric).To(Equal("process_start_time_seconds"))
+		})
+	})
+})
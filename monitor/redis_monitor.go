@@ -0,0 +1,225 @@
+package monitor
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+const (
+	DEFAULT_REDIS_PORT  = 6379
+	DEFAULT_REDIS_QUERY = "PING"
+
+	// Upper bound for bulk replies; 'INFO' is typically a few KB
+	MAX_REDIS_BULK_SIZE = 1024 * 1024
+)
+
+type RedisMonitor struct {
+	DBMonitor
+}
+
+func NewRedisMonitor(rmc *RootMonitorConfig) *RedisMonitor {
+	r := &RedisMonitor{
+		DBMonitor: newDBMonitor(rmc, "redis", DEFAULT_REDIS_PORT, DEFAULT_REDIS_QUERY),
+	}
+
+	r.MonitorFunc = r.redisCheck
+
+	return r
+}
+
+func (r *RedisMonitor) Validate() error {
+	if err := r.DBMonitor.Validate(); err != nil {
+		return err
+	}
+
+	if r.RMC.Config.DBName != "" {
+		if _, err := strconv.Atoi(r.RMC.Config.DBName); err != nil {
+			return fmt.Errorf("'db-name' (%v) must be a numeric database index for redis", r.RMC.Config.DBName)
+		}
+	}
+
+	if len(strings.Fields(r.Query)) == 0 {
+		return errors.New("'db-query' cannot be blank")
+	}
+
+	return nil
+}
+
+func (r *RedisMonitor) redisCheck() (*CheckResult, error) {
+	return nil, r.dbCheck(r.query)
+}
+
+// Authenticate, select the database and run the command
+func (r *RedisMonitor) query(conn net.Conn) (*DBResult, error) {
+	reader := bufio.NewReader(conn)
+
+	if r.RMC.Config.DBPassword != "" {
+		args := []string{"AUTH", r.RMC.Config.DBPassword}
+
+		// Redis 6+ ACL users
+		if r.RMC.Config.DBUser != "" {
+			args = []string{"AUTH", r.RMC.Config.DBUser, r.RMC.Config.DBPassword}
+		}
+
+		if _, err := redisCommand(conn, reader, args); err != nil {
+			return nil, fmt.Errorf("authentication failed: %v", err.Error())
+		}
+	}
+
+	if r.RMC.Config.DBName != "" {
+		if _, err := redisCommand(conn, reader, []string{"SELECT", r.RMC.Config.DBName}); err != nil {
+			return nil, fmt.Errorf("unable to select database %v: %v", r.RMC.Config.DBName, err.Error())
+		}
+	}
+
+	reply, err := redisCommand(conn, reader, strings.Fields(r.Query))
+	if err != nil {
+		return nil, fmt.Errorf("'%v' failed: %v", r.Query, err.Error())
+	}
+
+	return redisResult(reply), nil
+}
+
+// Convert a reply into a result; 'INFO' style 'key:value' lines become fields
+func redisResult(reply interface{}) *DBResult {
+	result := &DBResult{Fields: make(map[string]string)}
+
+	switch v := reply.(type) {
+	case nil:
+		return result
+	case []interface{}:
+		result.Rows = len(v)
+
+		if len(v) > 0 {
+			result.Value = redisReplyString(v[0])
+		}
+
+		return result
+	}
+
+	result.Rows = 1
+	result.Value = redisReplyString(reply)
+
+	for _, line := range strings.Split(result.Value, "\n") {
+		line = strings.TrimSpace(line)
+
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) == 2 {
+			result.Fields[parts[0]] = parts[1]
+		}
+	}
+
+	return result
+}
+
+func redisReplyString(reply interface{}) string {
+	switch v := reply.(type) {
+	case nil:
+		return ""
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case []interface{}:
+		parts := make([]string, len(v))
+		for i := range v {
+			parts[i] = redisReplyString(v[i])
+		}
+
+		return strings.Join(parts, " ")
+	}
+
+	return fmt.Sprintf("%v", reply)
+}
+
+// Send a command (as a RESP array of bulk strings) and read the reply
+func redisCommand(w io.Writer, r *bufio.Reader, args []string) (interface{}, error) {
+	var buf bytes.Buffer
+
+	fmt.Fprintf(&buf, "*%d\r\n", len(args))
+
+	for _, arg := range args {
+		fmt.Fprintf(&buf, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+
+	if _, err := w.Write(buf.Bytes()); err != nil {
+		return nil, err
+	}
+
+	return readRedisReply(r)
+}
+
+// Read a single RESP reply; errors ('-') are returned as errors
+func readRedisReply(r *bufio.Reader) (interface{}, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+
+	line = strings.TrimRight(line, "\r\n")
+	if line == "" {
+		return nil, errors.New("malformed reply: empty line")
+	}
+
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, fmt.Errorf("server returned error: %v", line[1:])
+	case ':':
+		n, err := strconv.ParseInt(line[1:], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("malformed integer reply '%v'", line)
+		}
+
+		return n, nil
+	case '$':
+		size, err := strconv.Atoi(line[1:])
+		if err != nil || size > MAX_REDIS_BULK_SIZE {
+			return nil, fmt.Errorf("malformed bulk reply '%v'", line)
+		}
+
+		if size < 0 {
+			return nil, nil
+		}
+
+		data := make([]byte, size+2)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return nil, err
+		}
+
+		return string(data[:size]), nil
+	case '*':
+		count, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, fmt.Errorf("malformed array reply '%v'", line)
+		}
+
+		if count < 0 {
+			return nil, nil
+		}
+
+		items := make([]interface{}, 0, count)
+
+		for i := 0; i < count; i++ {
+			item, err := readRedisReply(r)
+			if err != nil {
+				return nil, err
+			}
+
+			items = append(items, item)
+		}
+
+		return items, nil
+	}
+
+	return nil, fmt.Errorf("unknown reply type '%v'", line)
+}
@@ -0,0 +1,204 @@
+package monitor
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/9corp/9volt/util"
+)
+
+// Minimal in-process redis stand-in; requires AUTH with 'secret' when 'password' is set
+func startTestRedisServer(password string) (net.Listener, int) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	Expect(err).To(BeNil())
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+
+			go func(conn net.Conn) {
+				defer conn.Close()
+
+				r := bufio.NewReader(conn)
+				authed := password == ""
+
+				for {
+					reply, err := readRedisReply(r)
+					if err != nil {
+						return
+					}
+
+					args := []string{}
+					for _, arg := range reply.([]interface{}) {
+						args = append(args, arg.(string))
+					}
+
+					switch {
+					case args[0] == "AUTH":
+						if args[len(args)-1] != password {
+							conn.Write([]byte("-WRONGPASS invalid username-password pair\r\n"))
+							continue
+						}
+
+						authed = true
+						conn.Write([]byte("+OK\r\n"))
+					case !authed:
+						conn.Write([]byte("-NOAUTH Authentication required.\r\n"))
+					case args[0] == "SELECT":
+						conn.Write([]byte("+OK\r\n"))
+					case args[0] == "PING":
+						conn.Write([]byte("+PONG\r\n"))
+					case args[0] == "DBSIZE":
+						conn.Write([]byte(":42\r\n"))
+					case args[0] == "INFO":
+						info := "# Replication\r\nrole:slave\r\nmaster_link_status:up\r\nmaster_last_io_seconds_ago:3\r\n"
+						conn.Write([]byte(fmt.Sprintf("$%d\r\n%s\r\n", len(info), info)))
+					case args[0] == "LRANGE":
+						conn.Write([]byte("*2\r\n$3\r\nfoo\r\n$-1\r\n"))
+					default:
+						conn.Write([]byte("-ERR unknown command '" + strings.ToLower(args[0]) + "'\r\n"))
+					}
+				}
+			}(conn)
+		}
+	}()
+
+	return ln, ln.Addr().(*net.TCPAddr).Port
+}
+
+var _ = Describe("redis_monitor", func() {
+	var (
+		monitor *RedisMonitor
+		config  *RootMonitorConfig
+		ln      net.Listener
+		port    int
+	)
+
+	BeforeEach(func() {
+		ln, port = startTestRedisServer("secret")
+
+		config = &RootMonitorConfig{
+			Config: &MonitorConfig{
+				Host:       "127.0.0.1",
+				Port:       port,
+				DBPassword: "secret",
+				Interval:   util.CustomDuration(10 * time.Second),
+			},
+			Log: log.New(),
+		}
+
+		monitor = NewRedisMonitor(config)
+	})
+
+	AfterEach(func() {
+		ln.Close()
+	})
+
+	Context("NewRedisMonitor", func() {
+		It("returns a properly configured instance with defaults", func() {
+			config.Config.Port = 0
+			monitor = NewRedisMonitor(config)
+
+			Expect(monitor.Port).To(Equal(DEFAULT_REDIS_PORT))
+			Expect(monitor.Query).To(Equal(DEFAULT_REDIS_QUERY))
+			Expect(monitor.Timeout).To(Equal(DEFAULT_DB_TIMEOUT))
+			Expect(monitor.MonitorFunc).NotTo(BeNil())
+		})
+	})
+
+	Context("Validate", func() {
+		It("returns nil with correct settings", func() {
+			Expect(monitor.Validate()).To(BeNil())
+		})
+
+		It("requires a numeric db index", func() {
+			config.Config.DBName = "cache"
+			Expect(monitor.Validate().Error()).To(ContainSubstring("numeric database index"))
+		})
+
+		It("rejects bad assertions and timeouts", func() {
+			config.Config.DBAssertions = []*DBAssertion{{Operator: "~="}}
+			Expect(monitor.Validate().Error()).To(ContainSubstring("unknown operator"))
+
+			config.Config.DBAssertions = nil
+			config.Config.Interval = util.CustomDuration(time.Second)
+			Expect(monitor.Validate().Error()).To(ContainSubstring("cannot equal or exceed"))
+		})
+	})
+
+	Context("redisCheck", func() {
+		It("authenticates and pings by default", func() {
+			config.Config.DBName = "2"
+			config.Config.DBAssertions = []*DBAssertion{{Value: "PONG"}}
+
+			Expect(monitor.Validate()).To(BeNil())
+			_, err := monitor.redisCheck()
+			Expect(err).To(BeNil())
+		})
+
+		It("fails on bad credentials", func() {
+			config.Config.DBPassword = "wrong"
+
+			_, err := monitor.redisCheck()
+			Expect(err).NotTo(BeNil())
+			Expect(err.Error()).To(ContainSubstring("authentication failed"))
+			Expect(err.Error()).To(ContainSubstring("WRONGPASS"))
+		})
+
+		It("asserts on INFO fields", func() {
+			config.Config.DBQuery = "INFO replication"
+			config.Config.DBAssertions = []*DBAssertion{
+				{Field: "master_link_status", Value: "up"},
+				{Field: "master_last_io_seconds_ago", Operator: "<", Value: "10"},
+			}
+			monitor = NewRedisMonitor(config)
+
+			Expect(monitor.Validate()).To(BeNil())
+			_, err := monitor.redisCheck()
+			Expect(err).To(BeNil())
+
+			config.Config.DBAssertions = append(config.Config.DBAssertions, &DBAssertion{Field: "role", Value: "master"})
+
+			_, err = monitor.redisCheck()
+			Expect(err).NotTo(BeNil())
+			Expect(err.Error()).To(ContainSubstring("Assertion 'role' == 'master' failed: got 'slave'"))
+		})
+
+		It("handles integer and array replies", func() {
+			config.Config.DBQuery = "DBSIZE"
+			config.Config.DBAssertions = []*DBAssertion{{Operator: ">=", Value: "40"}}
+			monitor = NewRedisMonitor(config)
+			_, err := monitor.redisCheck()
+			Expect(err).To(BeNil())
+
+			config.Config.DBAssertions = []*DBAssertion{{Operator: ">", Value: "42"}}
+			_, err = monitor.redisCheck()
+			Expect(err).NotTo(BeNil())
+
+			config.Config.DBQuery = "LRANGE queue 0 -1"
+			config.Config.DBAssertions = []*DBAssertion{{Value: "foo"}}
+			monitor = NewRedisMonitor(config)
+			_, err = monitor.redisCheck()
+			Expect(err).To(BeNil())
+		})
+
+		It("reports command errors", func() {
+			config.Config.DBQuery = "BOGUS"
+			monitor = NewRedisMonitor(config)
+
+			_, err := monitor.redisCheck()
+			Expect(err).NotTo(BeNil())
+			Expect(err.Error()).To(ContainSubstring("unknown command 'bogus'"))
+		})
+	})
+})
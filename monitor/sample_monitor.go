@@ -5,7 +5,9 @@
 //
 // - In the New* constructor, create an instance of your monitor struct, assign
 //   MonitorFunc to the actual, private "check" method; return struct instance.
-// - Your check method should return an error or nil, depending on check status.
+// - Your check method should return an error or nil, depending on check status,
+//   along with an optional *CheckResult carrying output, metrics (ie. response
+//   times) or labels for the state message.
 // - Implement a 'Validate' method that validates check-specific MonitorConfig bits
 // - That's it - everything else is automatically handled by `Base` for you.
 //
@@ -33,8 +35,8 @@ func (s *SampleMonitor) Validate() error {
 	return nil
 }
 
-func (s *SampleMonitor) sampleCheck() error {
+func (s *SampleMonitor) sampleCheck() (*CheckResult, error) {
 	s.RMC.Log.WithField("configName", s.RMC.ConfigName).Debug("Performing sample check")
 
-	return nil
+	return nil, nil
 }
@@ -0,0 +1,406 @@
+package monitor
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/smtp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/9corp/9volt/util"
+)
+
+const (
+	DEFAULT_SMTP_PORT               = 25
+	DEFAULT_SMTP_TLS_PORT           = 465
+	DEFAULT_SMTP_HELO               = "9volt"
+	DEFAULT_MAIL_FLOW_DEADLINE      = time.Duration(1) * time.Minute
+	DEFAULT_MAIL_FLOW_POLL_INTERVAL = time.Duration(2) * time.Second
+
+	MAIL_PROBE_HEADER       = "X-9volt-Probe"
+	MAIL_PROBE_CHECK_HEADER = "X-9volt-Check" // '<config name>', for cleaning up late probes
+)
+
+type SMTPMonitor struct {
+	MailMonitor
+
+	Helo string
+
+	// Round-trip ('mail-to') settings
+	FlowDeadline  time.Duration
+	PollInterval  time.Duration
+	IMAPAddress   string
+	IMAPTLSConfig *tls.Config
+}
+
+func NewSMTPMonitor(rmc *RootMonitorConfig) *SMTPMonitor {
+	s := &SMTPMonitor{
+		MailMonitor:  newMailMonitor(rmc, "smtp", DEFAULT_SMTP_PORT, DEFAULT_SMTP_TLS_PORT),
+		Helo:         DEFAULT_SMTP_HELO,
+		FlowDeadline: DEFAULT_MAIL_FLOW_DEADLINE,
+		PollInterval: DEFAULT_MAIL_FLOW_POLL_INTERVAL,
+	}
+
+	if rmc.Config.MailHelo != "" {
+		s.Helo = rmc.Config.MailHelo
+	}
+
+	if rmc.Config.MailFlowDeadline != util.CustomDuration(0) {
+		s.FlowDeadline = time.Duration(rmc.Config.MailFlowDeadline)
+	}
+
+	s.MonitorFunc = s.smtpCheck
+
+	return s
+}
+
+func (s *SMTPMonitor) Validate() error {
+	if err := s.MailMonitor.Validate(); err != nil {
+		return err
+	}
+
+	if s.RMC.Config.MailTo == "" {
+		return nil
+	}
+
+	if s.Timeout+s.FlowDeadline >= time.Duration(s.RMC.Config.Interval) {
+		return fmt.Errorf("'timeout' + 'mail-flow-deadline' (%v) cannot equal or exceed 'interval' (%v)",
+			(s.Timeout + s.FlowDeadline).String(), s.RMC.Config.Interval.String())
+	}
+
+	if s.imapUser() == "" {
+		return errors.New("'mail-flow-imap-user' (or 'mail-user') must be set when 'mail-to' is set")
+	}
+
+	host := s.RMC.Config.Host
+	if s.RMC.Config.MailFlowIMAPHost != "" {
+		host = s.RMC.Config.MailFlowIMAPHost
+	}
+
+	port := DEFAULT_IMAP_PORT
+	if s.RMC.Config.MailFlowIMAPTLS {
+		port = DEFAULT_IMAP_TLS_PORT
+	}
+
+	if s.RMC.Config.MailFlowIMAPPort != 0 {
+		port = s.RMC.Config.MailFlowIMAPPort
+	}
+
+	s.IMAPAddress = net.JoinHostPort(host, strconv.Itoa(port))
+
+	if s.RMC.Config.MailFlowIMAPTLS {
+		tlsConfig, err := newTLSClientConfig(s.RMC.Config)
+		if err != nil {
+			return err
+		}
+
+		// 'tls-server-name' refers to 'host'
+		tlsConfig.ServerName = host
+
+		s.IMAPTLSConfig = tlsConfig
+	}
+
+	return nil
+}
+
+// Mailbox credentials used for confirming delivery; default to 'mail-user' and 'mail-password'
+func (s *SMTPMonitor) imapUser() string {
+	if s.RMC.Config.MailFlowIMAPUser != "" {
+		return s.RMC.Config.MailFlowIMAPUser
+	}
+
+	return s.RMC.Config.MailUser
+}
+
+func (s *SMTPMonitor) imapPassword() string {
+	if s.RMC.Config.MailFlowIMAPUser != "" {
+		return s.RMC.Config.MailFlowIMAPPassword
+	}
+
+	return s.RMC.Config.MailPassword
+}
+
+// Perform an SMTP session (EHLO, extension checks, optional STARTTLS and AUTH).
+// If 'mail-to' is set, also send a probe message and wait for it to show up
+// in the recipient's mailbox (via IMAP) within 'mail-flow-deadline'.
+func (s *SMTPMonitor) smtpCheck() (*CheckResult, error) {
+	var (
+		token   string
+		message []byte
+	)
+
+	if s.RMC.Config.MailTo != "" {
+		token = util.RandomString(16, false)
+		message = s.probeMessage(token, time.Now())
+	}
+
+	if err := s.session(message); err != nil {
+		return nil, err
+	}
+
+	if message == nil {
+		return nil, nil
+	}
+
+	return nil, s.awaitDelivery(token, time.Now())
+}
+
+func (s *SMTPMonitor) session(message []byte) error {
+	fullAddress := net.JoinHostPort(s.RMC.Config.Host, strconv.Itoa(s.Port))
+
+	s.RMC.Log.WithField("address", fullAddress).Debug("Performing smtp check")
+
+	conn, err := dialWithDeadline(fullAddress, s.implicitTLS(), time.Now().Add(s.Timeout))
+	if err != nil {
+		return err
+	}
+
+	client, err := smtp.NewClient(conn, s.RMC.Config.Host)
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("smtp check against %v failed: unexpected greeting: %v", fullAddress, err.Error())
+	}
+
+	defer client.Close()
+
+	if err := s.converse(client, message); err != nil {
+		return fmt.Errorf("smtp check against %v failed: %v", fullAddress, err.Error())
+	}
+
+	return nil
+}
+
+func (s *SMTPMonitor) converse(client *smtp.Client, message []byte) error {
+	if err := client.Hello(s.Helo); err != nil {
+		return fmt.Errorf("EHLO rejected: %v", err.Error())
+	}
+
+	missing := missingExtensions(s.RMC.Config.MailExpectedExtensions, client.Extension)
+
+	if s.RMC.Config.MailStartTLS {
+		if ok, _ := client.Extension("STARTTLS"); !ok {
+			return errors.New("server does not advertise STARTTLS")
+		}
+
+		if err := client.StartTLS(s.TLSConfig); err != nil {
+			return fmt.Errorf("STARTTLS failed: %v", err.Error())
+		}
+
+		missing = missingExtensions(missing, client.Extension)
+	}
+
+	if len(missing) != 0 {
+		return fmt.Errorf("server does not advertise expected extensions: %v", strings.Join(missing, ", "))
+	}
+
+	if s.RMC.Config.MailUser != "" {
+		if err := s.authenticate(client); err != nil {
+			return fmt.Errorf("authentication failed: %v", err.Error())
+		}
+	}
+
+	if message != nil {
+		if err := s.send(client, message); err != nil {
+			return err
+		}
+	}
+
+	// Some servers drop the connection right away; nothing left to verify
+	client.Quit()
+
+	return nil
+}
+
+// Pick the first mechanism (PLAIN, LOGIN, CRAM-MD5) offered by the server. Like
+// net/smtp, credentials are only sent in the clear over TLS or to localhost.
+func (s *SMTPMonitor) authenticate(client *smtp.Client) error {
+	ok, mechanisms := client.Extension("AUTH")
+	if !ok {
+		return errors.New("server does not advertise AUTH")
+	}
+
+	offered := strings.Fields(mechanisms)
+
+	var auth smtp.Auth
+
+	switch {
+	case containsFold(offered, "PLAIN"):
+		auth = smtp.PlainAuth("", s.RMC.Config.MailUser, s.RMC.Config.MailPassword, s.RMC.Config.Host)
+	case containsFold(offered, "LOGIN"):
+		auth = &smtpLoginAuth{username: s.RMC.Config.MailUser, password: s.RMC.Config.MailPassword, host: s.RMC.Config.Host}
+	case containsFold(offered, "CRAM-MD5"):
+		auth = smtp.CRAMMD5Auth(s.RMC.Config.MailUser, s.RMC.Config.MailPassword)
+	default:
+		return fmt.Errorf("no supported mechanism offered (server offers: %v)", mechanisms)
+	}
+
+	return client.Auth(auth)
+}
+
+func (s *SMTPMonitor) send(client *smtp.Client, message []byte) error {
+	if err := client.Mail(s.mailFrom()); err != nil {
+		return fmt.Errorf("MAIL FROM rejected: %v", err.Error())
+	}
+
+	if err := client.Rcpt(s.RMC.Config.MailTo); err != nil {
+		return fmt.Errorf("RCPT TO rejected: %v", err.Error())
+	}
+
+	w, err := client.Data()
+	if err != nil {
+		return fmt.Errorf("DATA rejected: %v", err.Error())
+	}
+
+	if _, err := w.Write(message); err != nil {
+		return fmt.Errorf("unable to send probe message: %v", err.Error())
+	}
+
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("probe message rejected: %v", err.Error())
+	}
+
+	return nil
+}
+
+func (s *SMTPMonitor) mailFrom() string {
+	if s.RMC.Config.MailFrom != "" {
+		return s.RMC.Config.MailFrom
+	}
+
+	return s.RMC.Config.MailTo
+}
+
+func (s *SMTPMonitor) probeMessage(token string, now time.Time) []byte {
+	var buf bytes.Buffer
+
+	fmt.Fprintf(&buf, "From: <%v>\r\n", s.mailFrom())
+	fmt.Fprintf(&buf, "To: <%v>\r\n", s.RMC.Config.MailTo)
+	fmt.Fprintf(&buf, "Subject: 9volt mail flow probe (%v)\r\n", s.RMC.ConfigName)
+	fmt.Fprintf(&buf, "Date: %v\r\n", now.Format(time.RFC1123Z))
+	fmt.Fprintf(&buf, "Message-ID: <%v@9volt>\r\n", token)
+	fmt.Fprintf(&buf, "%v: %v\r\n", MAIL_PROBE_HEADER, token)
+	fmt.Fprintf(&buf, "%v: <%v>\r\n", MAIL_PROBE_CHECK_HEADER, s.RMC.ConfigName)
+	fmt.Fprintf(&buf, "\r\n")
+	fmt.Fprintf(&buf, "This message was sent by 9volt to verify mail delivery; it is removed automatically.\r\n")
+
+	return buf.Bytes()
+}
+
+// Poll the recipient's mailbox for the probe message until 'mail-flow-deadline'
+// has passed since it was 'sent'; the message is deleted once found, as are
+// probe messages of earlier runs that arrived too late
+func (s *SMTPMonitor) awaitDelivery(token string, sent time.Time) error {
+	deadline := sent.Add(s.FlowDeadline)
+
+	s.RMC.Log.WithField("address", s.IMAPAddress).Debugf("Waiting for delivery of probe message '%v'", token)
+
+	conn, err := dialWithDeadline(s.IMAPAddress, s.IMAPTLSConfig, deadline)
+	if err != nil {
+		return fmt.Errorf("Unable to confirm delivery of probe message: %v", err.Error())
+	}
+
+	client, err := newIMAPConn(conn)
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("Unable to confirm delivery of probe message: %v", err.Error())
+	}
+
+	defer client.Close()
+
+	mailbox := DEFAULT_MAIL_MAILBOX
+	if s.RMC.Config.MailMailbox != "" {
+		mailbox = s.RMC.Config.MailMailbox
+	}
+
+	if err := client.capabilities(); err != nil {
+		return fmt.Errorf("Unable to confirm delivery of probe message: %v", err.Error())
+	}
+
+	if err := client.login(s.imapUser(), s.imapPassword()); err != nil {
+		return fmt.Errorf("Unable to confirm delivery of probe message: %v", err.Error())
+	}
+
+	if _, err := client.command("SELECT " + imapQuote(mailbox)); err != nil {
+		return fmt.Errorf("Unable to confirm delivery of probe message: %v", err.Error())
+	}
+
+	// Runs of a check never overlap, so any other probe of this check is stale
+	stale, err := client.search(fmt.Sprintf("HEADER %v %v NOT HEADER %v %v", MAIL_PROBE_CHECK_HEADER,
+		imapQuote("<"+s.RMC.ConfigName+">"), MAIL_PROBE_HEADER, imapQuote(token)))
+	if err != nil {
+		s.RMC.Log.Warningf("Unable to search for stale probe messages: %v", err.Error())
+	} else if len(stale) != 0 {
+		if err := client.delete(stale); err != nil {
+			s.RMC.Log.Warningf("Unable to remove %v stale probe message(s): %v", len(stale), err.Error())
+		}
+	}
+
+	for {
+		uids, err := client.search(fmt.Sprintf("HEADER %v %v", MAIL_PROBE_HEADER, imapQuote(token)))
+		if err != nil {
+			return fmt.Errorf("Unable to confirm delivery of probe message: %v", err.Error())
+		}
+
+		if len(uids) != 0 {
+			s.RMC.Log.Debugf("Probe message '%v' delivered after %v", token, time.Since(sent))
+
+			if err := client.delete(uids); err != nil {
+				s.RMC.Log.Warningf("Unable to remove probe message '%v': %v", token, err.Error())
+			}
+
+			return nil
+		}
+
+		if time.Now().Add(s.PollInterval).After(deadline) {
+			return fmt.Errorf("Probe message was not delivered to '%v' (mailbox '%v') within %v",
+				s.RMC.Config.MailTo, mailbox, s.FlowDeadline)
+		}
+
+		time.Sleep(s.PollInterval)
+
+		// Lets the server report newly arrived messages
+		if _, err := client.command("NOOP"); err != nil {
+			return fmt.Errorf("Unable to confirm delivery of probe message: %v", err.Error())
+		}
+	}
+}
+
+// AUTH LOGIN (not provided by net/smtp)
+type smtpLoginAuth struct {
+	username string
+	password string
+	host     string
+}
+
+func (a *smtpLoginAuth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	local := server.Name == "localhost" || server.Name == "127.0.0.1" || server.Name == "::1"
+
+	if !server.TLS && !local {
+		return "", nil, errors.New("unencrypted connection")
+	}
+
+	if server.Name != a.host {
+		return "", nil, errors.New("wrong host name")
+	}
+
+	return "LOGIN", nil, nil
+}
+
+func (a *smtpLoginAuth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if !more {
+		return nil, nil
+	}
+
+	switch strings.ToLower(strings.TrimSpace(string(fromServer))) {
+	case "username:":
+		return []byte(a.username), nil
+	case "password:":
+		return []byte(a.password), nil
+	}
+
+	return nil, fmt.Errorf("unexpected server challenge '%v'", string(fromServer))
+}
@@ -0,0 +1,335 @@
+package monitor
+
+import (
+	"crypto/tls"
+	"encoding/base64"
+	"net"
+	"net/textproto"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/9corp/9volt/util"
+)
+
+// Minimal in-process SMTP stand-in; advertises 'extensions' (plus STARTTLS if
+// 'cert' is set), accepts 'user'/'secret' via AUTH PLAIN or LOGIN and delivers
+// accepted messages to 'mailbox' after 'delay'
+func startTestSMTPServer(extensions []string, cert *tls.Certificate, mailbox *testMailbox, delay time.Duration) (net.Listener, int) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	Expect(err).To(BeNil())
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+
+			go func(conn net.Conn) {
+				defer conn.Close()
+
+				text := textproto.NewConn(conn)
+				secure := false
+
+				checkCredentials := func(user, password string) {
+					if user == "user" && password == "secret" {
+						text.PrintfLine("235 2.7.0 Authentication successful")
+					} else {
+						text.PrintfLine("535 5.7.8 Authentication credentials invalid")
+					}
+				}
+
+				readBase64 := func() string {
+					line, _ := text.ReadLine()
+					decoded, _ := base64.StdEncoding.DecodeString(line)
+					return string(decoded)
+				}
+
+				text.PrintfLine("220 test.local ESMTP ready")
+
+				for {
+					line, err := text.ReadLine()
+					if err != nil {
+						return
+					}
+
+					args := strings.Fields(line)
+
+					switch strings.ToUpper(args[0]) {
+					case "EHLO":
+						advertised := append([]string{"test.local"}, extensions...)
+						if cert != nil && !secure {
+							advertised = append(advertised, "STARTTLS")
+						}
+
+						for i, ext := range advertised {
+							separator := "-"
+							if i == len(advertised)-1 {
+								separator = " "
+							}
+
+							text.PrintfLine("250%v%v", separator, ext)
+						}
+					case "STARTTLS":
+						text.PrintfLine("220 2.0.0 Ready to start TLS")
+
+						tlsConn := tls.Server(conn, &tls.Config{Certificates: []tls.Certificate{*cert}})
+						if err := tlsConn.Handshake(); err != nil {
+							return
+						}
+
+						conn, text, secure = tlsConn, textproto.NewConn(tlsConn), true
+					case "AUTH":
+						switch strings.ToUpper(args[1]) {
+						case "PLAIN":
+							decoded, _ := base64.StdEncoding.DecodeString(args[2])
+							parts := strings.Split(string(decoded), "\x00")
+							checkCredentials(parts[1], parts[2])
+						case "LOGIN":
+							text.PrintfLine("334 %v", base64.StdEncoding.EncodeToString([]byte("Username:")))
+							user := readBase64()
+							text.PrintfLine("334 %v", base64.StdEncoding.EncodeToString([]byte("Password:")))
+							checkCredentials(user, readBase64())
+						default:
+							text.PrintfLine("504 5.5.4 Unrecognized authentication type")
+						}
+					case "MAIL", "RCPT":
+						if strings.Contains(line, "nobody@") {
+							text.PrintfLine("550 5.1.1 No such user")
+							continue
+						}
+
+						text.PrintfLine("250 2.1.0 Ok")
+					case "DATA":
+						text.PrintfLine("354 End data with <CR><LF>.<CR><LF>")
+
+						lines, err := text.ReadDotLines()
+						if err != nil {
+							return
+						}
+
+						text.PrintfLine("250 2.0.0 Ok: queued")
+
+						message := strings.Join(lines, "\r\n")
+						time.AfterFunc(delay, func() { mailbox.deliver(message) })
+					case "QUIT":
+						text.PrintfLine("221 2.0.0 Bye")
+						return
+					default:
+						text.PrintfLine("502 5.5.2 Error: command not recognized")
+					}
+				}
+			}(conn)
+		}
+	}()
+
+	return ln, ln.Addr().(*net.TCPAddr).Port
+}
+
+var _ = Describe("smtp_monitor", func() {
+	var (
+		monitor  *SMTPMonitor
+		config   *RootMonitorConfig
+		ln       net.Listener
+		imapLn   net.Listener
+		mailbox  *testMailbox
+		imapPort int
+		cert     tls.Certificate
+	)
+
+	start := func(extensions []string, cert *tls.Certificate, delay time.Duration) {
+		ln, config.Config.Port = startTestSMTPServer(extensions, cert, mailbox, delay)
+		monitor = NewSMTPMonitor(config)
+		Expect(monitor.Validate()).To(BeNil())
+
+		monitor.PollInterval = 20 * time.Millisecond
+	}
+
+	BeforeEach(func() {
+		_, cert = generateTestCerts([]string{"localhost"}, time.Now().Add(24*time.Hour))
+
+		config = &RootMonitorConfig{
+			ConfigName: "mail-flow",
+			Config: &MonitorConfig{
+				Host:     "127.0.0.1",
+				Interval: util.CustomDuration(30 * time.Second),
+			},
+			Log: log.New(),
+		}
+
+		mailbox = &testMailbox{}
+		imapLn, imapPort = startTestIMAPServer(mailbox, nil, nil)
+
+		monitor = NewSMTPMonitor(config)
+	})
+
+	AfterEach(func() {
+		if ln != nil {
+			ln.Close()
+			ln = nil
+		}
+
+		imapLn.Close()
+	})
+
+	Context("NewSMTPMonitor", func() {
+		It("returns a properly configured instance with defaults", func() {
+			Expect(monitor.Port).To(Equal(DEFAULT_SMTP_PORT))
+			Expect(monitor.Helo).To(Equal(DEFAULT_SMTP_HELO))
+			Expect(monitor.FlowDeadline).To(Equal(DEFAULT_MAIL_FLOW_DEADLINE))
+			Expect(monitor.MonitorFunc).NotTo(BeNil())
+		})
+	})
+
+	Context("Validate", func() {
+		It("requires the round-trip to fit into 'interval'", func() {
+			config.Config.MailTo = "probe@example.com"
+			config.Config.MailUser = "user"
+			Expect(monitor.Validate().Error()).To(ContainSubstring("'timeout' + 'mail-flow-deadline' (1m10s) cannot equal or exceed 'interval'"))
+		})
+
+		It("requires IMAP credentials for round-trips", func() {
+			config.Config.MailTo = "probe@example.com"
+			config.Config.MailFlowDeadline = util.CustomDuration(5 * time.Second)
+
+			monitor = NewSMTPMonitor(config)
+			Expect(monitor.Validate().Error()).To(ContainSubstring("'mail-flow-imap-user' (or 'mail-user') must be set"))
+		})
+
+		It("sets the IMAP address", func() {
+			config.Config.MailTo = "probe@example.com"
+			config.Config.MailFlowDeadline = util.CustomDuration(5 * time.Second)
+			config.Config.MailFlowIMAPUser = "user"
+			config.Config.MailFlowIMAPHost = "imap.example.com"
+			config.Config.MailFlowIMAPTLS = true
+
+			monitor = NewSMTPMonitor(config)
+			Expect(monitor.Validate()).To(BeNil())
+			Expect(monitor.IMAPAddress).To(Equal("imap.example.com:993"))
+			Expect(monitor.IMAPTLSConfig.ServerName).To(Equal("imap.example.com"))
+		})
+	})
+
+	Context("smtpCheck", func() {
+		It("checks advertised extensions", func() {
+			config.Config.MailExpectedExtensions = []string{"PIPELINING", "SIZE", "AUTH PLAIN"}
+			start([]string{"PIPELINING", "SIZE 10240000", "AUTH PLAIN LOGIN"}, nil, 0)
+			_, err := monitor.smtpCheck()
+			Expect(err).To(BeNil())
+
+			config.Config.MailExpectedExtensions = []string{"8BITMIME", "AUTH CRAM-MD5"}
+			_, err = monitor.smtpCheck()
+			Expect(err).NotTo(BeNil())
+			Expect(err.Error()).To(ContainSubstring("does not advertise expected extensions: 8BITMIME, AUTH CRAM-MD5"))
+		})
+
+		It("authenticates via AUTH PLAIN", func() {
+			config.Config.MailUser = "user"
+			config.Config.MailPassword = "secret"
+			start([]string{"AUTH PLAIN LOGIN"}, nil, 0)
+			_, err := monitor.smtpCheck()
+			Expect(err).To(BeNil())
+
+			config.Config.MailPassword = "wrong"
+			_, err = monitor.smtpCheck()
+			Expect(err).NotTo(BeNil())
+			Expect(err.Error()).To(ContainSubstring("authentication failed: 535"))
+		})
+
+		It("falls back to AUTH LOGIN", func() {
+			config.Config.MailUser = "user"
+			config.Config.MailPassword = "secret"
+			start([]string{"AUTH LOGIN"}, nil, 0)
+			_, err := monitor.smtpCheck()
+			Expect(err).To(BeNil())
+		})
+
+		It("fails if AUTH is not advertised", func() {
+			config.Config.MailUser = "user"
+			start(nil, nil, 0)
+
+			_, err := monitor.smtpCheck()
+			Expect(err).NotTo(BeNil())
+			Expect(err.Error()).To(ContainSubstring("server does not advertise AUTH"))
+		})
+
+		It("upgrades via STARTTLS", func() {
+			config.Config.MailStartTLS = true
+			config.Config.TLSInsecureSkipVerify = true
+			config.Config.MailUser = "user"
+			config.Config.MailPassword = "secret"
+			config.Config.MailExpectedExtensions = []string{"STARTTLS", "AUTH"}
+			start([]string{"AUTH PLAIN"}, &cert, 0)
+			_, err := monitor.smtpCheck()
+			Expect(err).To(BeNil())
+		})
+
+		It("sends a probe message and confirms its delivery via IMAP", func() {
+			config.Config.MailTo = "probe@example.com"
+			config.Config.MailUser = "user"
+			config.Config.MailPassword = "secret"
+			config.Config.MailFlowIMAPPort = imapPort
+			config.Config.MailFlowDeadline = util.CustomDuration(5 * time.Second)
+			start([]string{"AUTH PLAIN"}, nil, 100*time.Millisecond)
+
+			_, err := monitor.smtpCheck()
+			Expect(err).To(BeNil())
+			Expect(mailbox.count()).To(Equal(1))
+			Expect(mailbox.remaining()).To(Equal(0))
+			Expect(mailbox.messages[0]).To(ContainSubstring("Subject: 9volt mail flow probe (mail-flow)"))
+			Expect(mailbox.messages[0]).To(ContainSubstring(MAIL_PROBE_HEADER + ": "))
+			Expect(mailbox.messages[0]).To(ContainSubstring(MAIL_PROBE_CHECK_HEADER + ": <mail-flow>"))
+		})
+
+		It("removes probe messages that arrived after an earlier run failed", func() {
+			config.Config.MailTo = "probe@example.com"
+			config.Config.MailUser = "user"
+			config.Config.MailPassword = "secret"
+			config.Config.MailFlowIMAPPort = imapPort
+			config.Config.MailFlowDeadline = util.CustomDuration(5 * time.Second)
+			start([]string{"AUTH PLAIN"}, nil, 0)
+
+			mailbox.deliver(string(monitor.probeMessage("late", time.Now().Add(-time.Hour))))
+
+			// Probes of other checks are left alone
+			config.ConfigName = "mail-flow-2"
+			mailbox.deliver(string(monitor.probeMessage("other", time.Now())))
+			config.ConfigName = "mail-flow"
+
+			_, err := monitor.smtpCheck()
+			Expect(err).To(BeNil())
+			Expect(mailbox.count()).To(Equal(3))
+			Expect(mailbox.remaining()).To(Equal(1))
+			Expect(mailbox.deleted).NotTo(HaveKey("2"))
+		})
+
+		It("fails if the probe message is not delivered in time", func() {
+			config.Config.MailTo = "probe@example.com"
+			config.Config.MailFlowIMAPUser = "user"
+			config.Config.MailFlowIMAPPassword = "secret"
+			config.Config.MailFlowIMAPPort = imapPort
+			config.Config.MailFlowDeadline = util.CustomDuration(200 * time.Millisecond)
+			start(nil, nil, time.Second)
+
+			_, err := monitor.smtpCheck()
+			Expect(err).NotTo(BeNil())
+			Expect(err.Error()).To(ContainSubstring("Probe message was not delivered to 'probe@example.com' (mailbox 'INBOX') within 200ms"))
+		})
+
+		It("fails if the recipient is rejected", func() {
+			config.Config.MailTo = "nobody@example.com"
+			config.Config.MailFlowIMAPUser = "user"
+			config.Config.MailFlowIMAPPort = imapPort
+			config.Config.MailFlowDeadline = util.CustomDuration(time.Second)
+			start(nil, nil, 0)
+
+			_, err := monitor.smtpCheck()
+			Expect(err).NotTo(BeNil())
+			Expect(err.Error()).To(ContainSubstring("MAIL FROM rejected: 550"))
+		})
+	})
+})
@@ -0,0 +1,85 @@
+package monitor
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	// SNMP application types (RFC 2578)
+	snmpTagIPAddress = 0x40
+	snmpTagCounter32 = 0x41
+	snmpTagGauge32   = 0x42
+	snmpTagTimeTicks = 0x43
+	snmpTagOpaque    = 0x44
+	snmpTagCounter64 = 0x46
+
+	// SNMPv2 exceptions in place of a value (RFC 3416)
+	snmpTagNoSuchObject   = 0x80
+	snmpTagNoSuchInstance = 0x81
+	snmpTagEndOfMibView   = 0x82
+
+	// PDU types
+	snmpTagGetRequest  = 0xa0
+	snmpTagGetResponse = 0xa2
+	snmpTagReport      = 0xa8
+)
+
+// Format a varbind value the way it is compared against; 'found' is false for
+// NULL and the SNMPv2 exceptions (noSuchObject, noSuchInstance, endOfMibView)
+func (v *berValue) SNMPString() (string, bool, error) {
+	switch v.Tag {
+	case berTagNull, snmpTagNoSuchObject, snmpTagNoSuchInstance, snmpTagEndOfMibView:
+		return "", false, nil
+	case berTagInteger:
+		value, err := v.Int()
+		return strconv.FormatInt(value, 10), true, err
+	case snmpTagCounter32, snmpTagGauge32, snmpTagTimeTicks, snmpTagCounter64:
+		value, err := v.Uint()
+		return strconv.FormatUint(value, 10), true, err
+	case berTagOID:
+		value, err := v.OID()
+		return value, true, err
+	case snmpTagIPAddress:
+		if len(v.Data) != net.IPv4len {
+			return "", true, fmt.Errorf("invalid IpAddress length (%v)", len(v.Data))
+		}
+
+		return net.IP(v.Data).String(), true, nil
+	case berTagOctetString, snmpTagOpaque:
+		return snmpOctetString(v.Data), true, nil
+	}
+
+	return "", true, fmt.Errorf("unsupported value type 0x%02x", v.Tag)
+}
+
+// Printable strings are returned as is (without trailing NULs); binary data,
+// such as MAC addresses, as colon separated hex ('00:1a:2b:3c:4d:5e')
+func snmpOctetString(data []byte) string {
+	text := strings.TrimRight(string(data), "\x00")
+
+	printable := utf8.ValidString(text)
+
+	for _, r := range text {
+		if !unicode.IsPrint(r) && !unicode.IsSpace(r) {
+			printable = false
+			break
+		}
+	}
+
+	if printable {
+		return text
+	}
+
+	hex := make([]string, len(data))
+
+	for i, b := range data {
+		hex[i] = fmt.Sprintf("%02x", b)
+	}
+
+	return strings.Join(hex, ":")
+}
@@ -0,0 +1,765 @@
+package monitor
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/9corp/9volt/state"
+	"github.com/9corp/9volt/util"
+)
+
+const (
+	DEFAULT_SNMP_PORT      = 161
+	DEFAULT_SNMP_TIMEOUT   = time.Duration(3) * time.Second
+	DEFAULT_SNMP_COMMUNITY = "public"
+
+	SNMP_VERSION_2C = "2c"
+	SNMP_VERSION_3  = "3"
+
+	// On the wire version number of SNMPv2c messages
+	snmpVersion2c = 1
+
+	// RFC 3414 requires passwords of at least 8 characters
+	snmpMinPasswordLength = 8
+)
+
+var (
+	snmpVersions = []string{SNMP_VERSION_2C, SNMP_VERSION_3}
+
+	// PDU error-status values (RFC 3416)
+	snmpErrorStatuses = []string{
+		"noError", "tooBig", "noSuchName", "badValue", "readOnly", "genErr", "noAccess", "wrongType",
+		"wrongLength", "wrongEncoding", "wrongValue", "noCreation", "inconsistentValue",
+		"resourceUnavailable", "commitFailed", "undoFailed", "authorizationError", "notWritable",
+		"inconsistentName",
+	}
+
+	snmpExceptions = map[byte]string{
+		berTagNull:            "NULL",
+		snmpTagNoSuchObject:   "noSuchObject",
+		snmpTagNoSuchInstance: "noSuchInstance",
+		snmpTagEndOfMibView:   "endOfMibView",
+	}
+
+	// Value types which are numbers even without thresholds or 'rate'
+	snmpNumericTypes = []byte{berTagInteger, snmpTagCounter32, snmpTagGauge32, snmpTagTimeTicks, snmpTagCounter64}
+)
+
+// A single OID to GET along with how to evaluate its value; 'operator'/'value'
+// assert on the (string) value, 'warning'/'critical' compare it as a number
+type SNMPOID struct {
+	OID        string   `json:"oid"`                  // numeric, ie. '1.3.6.1.2.1.1.3.0'
+	Name       string   `json:"name,omitempty"`       // used in output and metrics; defaults to 'oid'
+	Operator   string   `json:"operator,omitempty"`   // '==' (default if 'value' is set), '!=', '<', '<=', '>', '>=', 'regex', '!regex', 'exists', 'absent'
+	Value      string   `json:"value,omitempty"`      // expected value
+	Comparison string   `json:"comparison,omitempty"` // 'above' (default) or 'below'
+	Warning    *float64 `json:"warning,omitempty"`
+	Critical   *float64 `json:"critical,omitempty"`
+	Rate       bool     `json:"rate,omitempty"` // compare the per second rate of change between checks (counters)
+}
+
+func (o *SNMPOID) name() string {
+	if o.Name != "" {
+		return o.Name
+	}
+
+	return o.OID
+}
+
+func (o *SNMPOID) oid() string {
+	return strings.TrimPrefix(o.OID, ".")
+}
+
+func (o *SNMPOID) hasAssertion() bool {
+	return o.Operator != "" || o.Value != ""
+}
+
+func (o *SNMPOID) operator() string {
+	if o.Operator != "" {
+		return o.Operator
+	}
+
+	return "=="
+}
+
+// Thresholds and rates require a numeric value
+func (o *SNMPOID) numeric() bool {
+	return o.Warning != nil || o.Critical != nil || o.Rate
+}
+
+func (o *SNMPOID) comparison() string {
+	if o.Comparison == "" {
+		return COMPARISON_ABOVE
+	}
+
+	return o.Comparison
+}
+
+func (o *SNMPOID) String() string {
+	return fmt.Sprintf("'%v' %v '%v'", o.name(), o.operator(), o.Value)
+}
+
+type SNMPMonitor struct {
+	Base
+
+	Timeout time.Duration
+	Port    int
+
+	// Previous values of 'rate' OIDs
+	samples map[string]*snmpSample
+}
+
+type snmpSample struct {
+	Value float64
+	Date  time.Time
+}
+
+type snmpPDU struct {
+	Type        byte
+	RequestID   int64
+	ErrorStatus int64
+	ErrorIndex  int64
+	VarBinds    []*snmpVarBind
+}
+
+type snmpVarBind struct {
+	OID   string
+	Value *berValue // nil == NULL
+}
+
+func NewSNMPMonitor(rmc *RootMonitorConfig) *SNMPMonitor {
+	s := &SNMPMonitor{
+		Base: Base{
+			RMC:        rmc,
+			Identifier: "snmp",
+		},
+		Timeout: DEFAULT_SNMP_TIMEOUT,
+		Port:    DEFAULT_SNMP_PORT,
+		samples: make(map[string]*snmpSample),
+	}
+
+	if rmc.Config.Timeout != util.CustomDuration(0) {
+		s.Timeout = time.Duration(rmc.Config.Timeout)
+	}
+
+	if rmc.Config.Port != 0 {
+		s.Port = rmc.Config.Port
+	}
+
+	s.MonitorFunc = s.snmpCheck
+
+	return s
+}
+
+func (s *SNMPMonitor) Validate() error {
+	s.RMC.Log.WithField("configName", s.RMC.ConfigName).Debug("Performing monitor config validation")
+
+	cfg := s.RMC.Config
+
+	if cfg.Host == "" {
+		return errors.New("'host' must be set")
+	}
+
+	if s.Timeout >= time.Duration(cfg.Interval) {
+		return fmt.Errorf("'timeout' (%v) cannot equal or exceed 'interval' (%v)", s.Timeout.String(), cfg.Interval.String())
+	}
+
+	if !util.StringSliceContains(snmpVersions, s.version()) {
+		return fmt.Errorf("Unknown 'snmp-version' '%v' (supported: %v)", cfg.SNMPVersion, strings.Join(snmpVersions, ", "))
+	}
+
+	if s.version() == SNMP_VERSION_3 {
+		if err := s.validateUSM(); err != nil {
+			return err
+		}
+	}
+
+	if len(cfg.SNMPOIDs) == 0 {
+		return errors.New("'snmp-oids' must contain at least one OID")
+	}
+
+	for i, o := range cfg.SNMPOIDs {
+		if o == nil {
+			return fmt.Errorf("OID #%v is empty", i)
+		}
+
+		if o.OID == "" {
+			return fmt.Errorf("OID #%v: 'oid' must be set", i)
+		}
+
+		if _, err := berEncodeOID(o.OID); err != nil {
+			return fmt.Errorf("OID #%v: %v", i, err.Error())
+		}
+
+		if !util.StringSliceContains(assertionOperators, o.operator()) {
+			return fmt.Errorf("OID #%v: unknown operator '%v'", i, o.Operator)
+		}
+
+		if o.operator() == "regex" || o.operator() == "!regex" {
+			if _, err := regexp.Compile(o.Value); err != nil {
+				return fmt.Errorf("OID #%v: unable to compile regex: %v", i, err.Error())
+			}
+		}
+
+		if err := validateThresholds("", o.Warning, o.Critical, o.Comparison); err != nil {
+			return fmt.Errorf("OID #%v: %v", i, err.Error())
+		}
+	}
+
+	return nil
+}
+
+func (s *SNMPMonitor) validateUSM() error {
+	cfg := s.RMC.Config
+	usm := s.usm()
+
+	if cfg.SNMPUser == "" {
+		return errors.New("'snmp-user' must be set for SNMPv3")
+	}
+
+	if usm.AuthProtocol != "" {
+		if !util.StringSliceContains(snmpAuthProtocols, usm.AuthProtocol) {
+			return fmt.Errorf("Unknown 'snmp-auth-protocol' '%v' (supported: %v)",
+				cfg.SNMPAuthProtocol, strings.Join(snmpAuthProtocols, ", "))
+		}
+
+		if len(cfg.SNMPAuthPassword) < snmpMinPasswordLength {
+			return fmt.Errorf("'snmp-auth-password' must be at least %v characters", snmpMinPasswordLength)
+		}
+	}
+
+	if usm.PrivProtocol != "" {
+		if usm.AuthProtocol == "" {
+			return errors.New("'snmp-priv-password' requires 'snmp-auth-password' to be set")
+		}
+
+		if !util.StringSliceContains(snmpPrivProtocols, usm.PrivProtocol) {
+			return fmt.Errorf("Unknown 'snmp-priv-protocol' '%v' (supported: %v)",
+				cfg.SNMPPrivProtocol, strings.Join(snmpPrivProtocols, ", "))
+		}
+
+		if len(cfg.SNMPPrivPassword) < snmpMinPasswordLength {
+			return fmt.Errorf("'snmp-priv-password' must be at least %v characters", snmpMinPasswordLength)
+		}
+	}
+
+	return nil
+}
+
+// GET all OIDs in a single request and evaluate each value: assertions and
+// missing values fail the check, crossed thresholds go through the attempt
+// thresholds (warning capped at warning; the most severe crossed threshold wins)
+func (s *SNMPMonitor) snmpCheck() (*CheckResult, error) {
+	cfg := s.RMC.Config
+	address := net.JoinHostPort(cfg.Host, strconv.Itoa(s.Port))
+
+	s.RMC.Log.WithField("address", address).Debug("Performing snmp check")
+
+	request := &snmpPDU{
+		Type:      snmpTagGetRequest,
+		RequestID: snmpRandomID(),
+	}
+
+	for _, o := range cfg.SNMPOIDs {
+		request.VarBinds = append(request.VarBinds, &snmpVarBind{OID: o.oid()})
+	}
+
+	response, err := s.get(address, request)
+	if err != nil {
+		return nil, fmt.Errorf("SNMP GET from %v failed: %v", address, err.Error())
+	}
+
+	if response.ErrorStatus != 0 {
+		return nil, fmt.Errorf("SNMP GET from %v failed: agent returned '%v' (error index %v)",
+			address, snmpErrorStatus(response.ErrorStatus), response.ErrorIndex)
+	}
+
+	if len(response.VarBinds) != len(request.VarBinds) {
+		return nil, fmt.Errorf("SNMP GET from %v returned %v values (expected %v)", address, len(response.VarBinds), len(request.VarBinds))
+	}
+
+	var (
+		metrics       []*state.Metric
+		output        []string
+		thresholdErrs []error
+		now           = time.Now()
+	)
+
+	for i, o := range cfg.SNMPOIDs {
+		varBind := response.VarBinds[i]
+
+		if varBind.OID != o.oid() {
+			return nil, fmt.Errorf("Unexpected OID '%v' in response (expected '%v')", varBind.OID, o.oid())
+		}
+
+		value, found, err := varBind.Value.SNMPString()
+		if err != nil {
+			return nil, fmt.Errorf("Unable to decode value of '%v': %v", o.name(), err.Error())
+		}
+
+		if o.hasAssertion() {
+			if err := compareValue(o.operator(), o.Value, value, found); err != nil {
+				return nil, fmt.Errorf("Assertion %v failed: %v", o, err.Error())
+			}
+		}
+
+		if !found {
+			if o.numeric() {
+				return nil, fmt.Errorf("'%v' is not available (%v)", o.name(), snmpExceptions[varBind.Value.Tag])
+			}
+
+			output = append(output, fmt.Sprintf("%v = %v", o.name(), snmpExceptions[varBind.Value.Tag]))
+			continue
+		}
+
+		number, err := strconv.ParseFloat(value, 64)
+
+		if !o.numeric() {
+			if err == nil && snmpNumericType(varBind.Value.Tag) {
+				metrics = append(metrics, &state.Metric{Name: o.name(), Value: number})
+			}
+
+			output = append(output, fmt.Sprintf("%v = %v", o.name(), value))
+			continue
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("Value '%v' of '%v' is not numeric", value, o.name())
+		}
+
+		unit := ""
+
+		if o.Rate {
+			rate, ok := s.rate(o.oid(), varBind.Value.Tag, number, now)
+			if !ok {
+				output = append(output, fmt.Sprintf("%v = %v (rate available after the next check)", o.name(), value))
+				continue
+			}
+
+			number, unit = rate, "/s"
+		}
+
+		metrics = append(metrics, thresholdMetric(o.name(), number, unit, o.Warning, o.Critical))
+		output = append(output, fmt.Sprintf("%v = %v%v", o.name(), strconv.FormatFloat(number, 'g', -1, 64), unit))
+
+		thresholdErrs = append(thresholdErrs,
+			checkThresholds(fmt.Sprintf("'%v'", o.name()), number, unit, o.Warning, o.Critical, o.comparison()))
+	}
+
+	return &CheckResult{Output: strings.Join(output, ", "), Metrics: metrics}, mostSevere(thresholdErrs...)
+}
+
+// Per second rate of change since the previous check; not available for the
+// first sample or after a 64 bit counter (or the agent) was reset. 32 bit
+// counters are assumed to have wrapped.
+func (s *SNMPMonitor) rate(oid string, tag byte, value float64, now time.Time) (float64, bool) {
+	previous, ok := s.samples[oid]
+	s.samples[oid] = &snmpSample{Value: value, Date: now}
+
+	if !ok || !now.After(previous.Date) {
+		return 0, false
+	}
+
+	delta := value - previous.Value
+
+	if delta < 0 {
+		switch tag {
+		case snmpTagCounter32:
+			delta += 1 << 32
+		case snmpTagCounter64:
+			return 0, false
+		}
+	}
+
+	return delta / now.Sub(previous.Date).Seconds(), true
+}
+
+// Send the request using the configured version; the whole exchange (including
+// SNMPv3 engine discovery) has to complete within 'timeout'
+func (s *SNMPMonitor) get(address string, request *snmpPDU) (*snmpPDU, error) {
+	conn, err := net.DialTimeout("udp", address, s.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if err := conn.SetDeadline(time.Now().Add(s.Timeout)); err != nil {
+		return nil, fmt.Errorf("unable to set timeout (%v): %v", s.Timeout, err.Error())
+	}
+
+	if s.version() == SNMP_VERSION_3 {
+		return s.getV3(conn, request)
+	}
+
+	return s.getV2c(conn, request)
+}
+
+func (s *SNMPMonitor) getV2c(conn net.Conn, request *snmpPDU) (*snmpPDU, error) {
+	pdu, err := request.encode()
+	if err != nil {
+		return nil, err
+	}
+
+	message := berEncodeSequence(berTagSequence,
+		berEncodeInteger(berTagInteger, snmpVersion2c),
+		berEncode(berTagOctetString, []byte(s.community())),
+		pdu,
+	)
+
+	var response *snmpPDU
+
+	err = snmpExchange(conn, message, func(data []byte) (bool, error) {
+		_, pdu, err := decodeSNMPv2cMessage(data)
+		if err != nil {
+			return false, err
+		}
+
+		if pdu.RequestID != request.RequestID {
+			return false, nil
+		}
+
+		if pdu.Type != snmpTagGetResponse {
+			return false, fmt.Errorf("unexpected PDU type 0x%02x", pdu.Type)
+		}
+
+		response = pdu
+
+		return true, nil
+	})
+
+	return response, err
+}
+
+// Discover the agent's engine ID, boots and time (RFC 3414 4), localize the
+// keys and send the actual request
+func (s *SNMPMonitor) getV3(conn net.Conn, request *snmpPDU) (*snmpPDU, error) {
+	discovery := &snmpPDU{
+		Type:      snmpTagGetRequest,
+		RequestID: snmpRandomID(),
+	}
+
+	_, msg, err := s.exchangeV3(conn, &snmpUSM{}, snmpMsgFlagReportable, discovery)
+	if err != nil {
+		return nil, fmt.Errorf("engine discovery failed: %v", err.Error())
+	}
+
+	if len(msg.EngineID) == 0 {
+		return nil, errors.New("engine discovery failed: agent did not report its engine ID")
+	}
+
+	usm := s.usm()
+	usm.localize(msg.EngineID)
+	usm.EngineBoots, usm.EngineTime = msg.EngineBoots, msg.EngineTime
+
+	for attempt := 0; ; attempt++ {
+		response, msg, err := s.exchangeV3(conn, usm, usm.flags()|snmpMsgFlagReportable, request)
+		if err != nil {
+			return nil, err
+		}
+
+		if response.Type == snmpTagGetResponse {
+			if msg.Flags&usm.flags() != usm.flags() {
+				return nil, errors.New("response does not use the requested security level")
+			}
+
+			return response, nil
+		}
+
+		// Some agents only reveal their time in reply to an authenticated request
+		if attempt == 0 && snmpReportContains(response, snmpNotInTimeWindowsOID) && msg.Flags&snmpMsgFlagAuth != 0 {
+			usm.EngineBoots, usm.EngineTime = msg.EngineBoots, msg.EngineTime
+			continue
+		}
+
+		return nil, fmt.Errorf("agent reported %v", snmpReportReason(response))
+	}
+}
+
+// Exchange a scoped PDU; reports are returned as is
+func (s *SNMPMonitor) exchangeV3(conn net.Conn, usm *snmpUSM, flags byte, request *snmpPDU) (*snmpPDU, *snmpV3Message, error) {
+	pdu, err := request.encode()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	scopedPDU := berEncodeSequence(berTagSequence,
+		berEncode(berTagOctetString, usm.EngineID),
+		berEncode(berTagOctetString, []byte(s.RMC.Config.SNMPContext)),
+		pdu,
+	)
+
+	msgID := snmpRandomID()
+
+	message, err := usm.encode(msgID, flags, scopedPDU)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var (
+		response    *snmpPDU
+		responseMsg *snmpV3Message
+	)
+
+	err = snmpExchange(conn, message, func(data []byte) (bool, error) {
+		msg, err := usm.decode(data)
+		if err != nil {
+			return false, err
+		}
+
+		if msg.MsgID != msgID {
+			return false, nil
+		}
+
+		pdu, err := decodeSNMPScopedPDU(msg.ScopedPDU)
+		if err != nil {
+			return false, err
+		}
+
+		if pdu.Type != snmpTagGetResponse && pdu.Type != snmpTagReport {
+			return false, fmt.Errorf("unexpected PDU type 0x%02x", pdu.Type)
+		}
+
+		response, responseMsg = pdu, msg
+
+		return true, nil
+	})
+
+	return response, responseMsg, err
+}
+
+// Send a message and read responses until 'handle' accepts one (stray
+// responses to earlier requests are skipped) or the deadline passes
+func snmpExchange(conn net.Conn, message []byte, handle func(data []byte) (bool, error)) error {
+	if _, err := conn.Write(message); err != nil {
+		return err
+	}
+
+	buf := make([]byte, snmpMaxMessageSize)
+
+	for {
+		size, err := conn.Read(buf)
+		if err != nil {
+			return err
+		}
+
+		done, err := handle(buf[:size])
+		if err != nil {
+			return err
+		}
+
+		if done {
+			return nil
+		}
+	}
+}
+
+func (s *SNMPMonitor) version() string {
+	if s.RMC.Config.SNMPVersion == "" {
+		return SNMP_VERSION_2C
+	}
+
+	return s.RMC.Config.SNMPVersion
+}
+
+func (s *SNMPMonitor) community() string {
+	if s.RMC.Config.SNMPCommunity == "" {
+		return DEFAULT_SNMP_COMMUNITY
+	}
+
+	return s.RMC.Config.SNMPCommunity
+}
+
+// The configured v3 user; setting a password enables auth/priv, the protocols
+// default to SHA and AES
+func (s *SNMPMonitor) usm() *snmpUSM {
+	cfg := s.RMC.Config
+
+	usm := &snmpUSM{
+		User:         cfg.SNMPUser,
+		AuthPassword: cfg.SNMPAuthPassword,
+		PrivPassword: cfg.SNMPPrivPassword,
+	}
+
+	if cfg.SNMPAuthPassword != "" {
+		usm.AuthProtocol = SNMP_AUTH_SHA
+
+		if cfg.SNMPAuthProtocol != "" {
+			usm.AuthProtocol = strings.ToUpper(cfg.SNMPAuthProtocol)
+		}
+	}
+
+	if cfg.SNMPPrivPassword != "" {
+		usm.PrivProtocol = SNMP_PRIV_AES
+
+		if cfg.SNMPPrivProtocol != "" {
+			usm.PrivProtocol = strings.ToUpper(cfg.SNMPPrivProtocol)
+		}
+	}
+
+	return usm
+}
+
+func (p *snmpPDU) encode() ([]byte, error) {
+	var varBinds []byte
+
+	for _, varBind := range p.VarBinds {
+		oid, err := berEncodeOID(varBind.OID)
+		if err != nil {
+			return nil, err
+		}
+
+		value := berEncode(berTagNull, nil)
+		if varBind.Value != nil {
+			value = berEncode(varBind.Value.Tag, varBind.Value.Data)
+		}
+
+		varBinds = append(varBinds, berEncodeSequence(berTagSequence, oid, value)...)
+	}
+
+	return berEncodeSequence(p.Type,
+		berEncodeInteger(berTagInteger, p.RequestID),
+		berEncodeInteger(berTagInteger, p.ErrorStatus),
+		berEncodeInteger(berTagInteger, p.ErrorIndex),
+		berEncode(berTagSequence, varBinds),
+	), nil
+}
+
+func decodeSNMPPDU(value *berValue) (*snmpPDU, error) {
+	if value.Tag&0xe0 != 0xa0 {
+		return nil, fmt.Errorf("unexpected PDU type 0x%02x", value.Tag)
+	}
+
+	elements, err := berDecodeAll(value.Data)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(elements) != 4 {
+		return nil, fmt.Errorf("expected 4 elements in PDU (got %v)", len(elements))
+	}
+
+	pdu := &snmpPDU{Type: value.Tag}
+
+	for i, field := range []*int64{&pdu.RequestID, &pdu.ErrorStatus, &pdu.ErrorIndex} {
+		if *field, err = elements[i].Int(); err != nil {
+			return nil, fmt.Errorf("invalid PDU header: %v", err.Error())
+		}
+	}
+
+	varBinds, err := berDecodeSequence(elements[3], berTagSequence, 0)
+	if err != nil {
+		return nil, fmt.Errorf("invalid variable bindings: %v", err.Error())
+	}
+
+	for _, varBind := range varBinds {
+		pair, err := berDecodeSequence(varBind, berTagSequence, 2)
+		if err != nil {
+			return nil, fmt.Errorf("invalid variable binding: %v", err.Error())
+		}
+
+		if pair[0].Tag != berTagOID {
+			return nil, errors.New("invalid variable binding: expected an OID")
+		}
+
+		oid, err := pair[0].OID()
+		if err != nil {
+			return nil, fmt.Errorf("invalid variable binding: %v", err.Error())
+		}
+
+		pdu.VarBinds = append(pdu.VarBinds, &snmpVarBind{OID: oid, Value: pair[1]})
+	}
+
+	return pdu, nil
+}
+
+// Returns the community and PDU of an SNMPv2c message
+func decodeSNMPv2cMessage(data []byte) (string, *snmpPDU, error) {
+	top, _, err := berDecode(data)
+	if err != nil {
+		return "", nil, err
+	}
+
+	elements, err := berDecodeSequence(top, berTagSequence, 3)
+	if err != nil {
+		return "", nil, err
+	}
+
+	if version, err := elements[0].Int(); err != nil || version != snmpVersion2c {
+		return "", nil, fmt.Errorf("unexpected SNMP version (%v)", version)
+	}
+
+	pdu, err := decodeSNMPPDU(elements[2])
+	if err != nil {
+		return "", nil, err
+	}
+
+	return string(elements[1].Data), pdu, nil
+}
+
+// A scoped PDU consists of the context engine ID, context name and the PDU
+func decodeSNMPScopedPDU(value *berValue) (*snmpPDU, error) {
+	elements, err := berDecodeSequence(value, berTagSequence, 3)
+	if err != nil {
+		return nil, fmt.Errorf("invalid scoped PDU: %v", err.Error())
+	}
+
+	return decodeSNMPPDU(elements[2])
+}
+
+// Describe why an agent sent a report, ie. 'unknown user name'
+func snmpReportReason(report *snmpPDU) string {
+	var oids []string
+
+	for _, varBind := range report.VarBinds {
+		if reason, ok := snmpUSMStats[varBind.OID]; ok {
+			return reason
+		}
+
+		oids = append(oids, varBind.OID)
+	}
+
+	return fmt.Sprintf("an error (%v)", strings.Join(oids, ", "))
+}
+
+func snmpReportContains(report *snmpPDU, oid string) bool {
+	for _, varBind := range report.VarBinds {
+		if varBind.OID == oid {
+			return true
+		}
+	}
+
+	return false
+}
+
+func snmpErrorStatus(status int64) string {
+	if status < 0 || status >= int64(len(snmpErrorStatuses)) {
+		return strconv.FormatInt(status, 10)
+	}
+
+	return snmpErrorStatuses[status]
+}
+
+func snmpNumericType(tag byte) bool {
+	for _, numeric := range snmpNumericTypes {
+		if tag == numeric {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Positive 31 bit request/message ID
+func snmpRandomID() int64 {
+	buf := make([]byte, 4)
+	rand.Read(buf)
+
+	return int64(binary.BigEndian.Uint32(buf) & 0x7fffffff)
+}
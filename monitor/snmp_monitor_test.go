@@ -0,0 +1,439 @@
+package monitor
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"encoding/hex"
+	"net"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/9corp/9volt/util"
+)
+
+const (
+	testSysDescrOID  = "1.3.6.1.2.1.1.1.0"
+	testSysUpTimeOID = "1.3.6.1.2.1.1.3.0"
+	testIfInOctets   = "1.3.6.1.2.1.2.2.1.10.1"
+	testBatteryOID   = "1.3.6.1.2.1.33.1.2.4.0"
+)
+
+// Minimal in-process SNMP agent answering GET requests from 'values'; SNMPv3
+// requests are handled if 'usm' is set
+type testSNMPAgent struct {
+	conn      net.PacketConn
+	community string
+	usm       *snmpUSM
+
+	lock   sync.Mutex
+	values map[string]*berValue
+}
+
+func startTestSNMPAgent(community string, usm *snmpUSM) (*testSNMPAgent, int) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	Expect(err).To(BeNil())
+
+	agent := &testSNMPAgent{
+		conn:      conn,
+		community: community,
+		usm:       usm,
+		values: map[string]*berValue{
+			testSysDescrOID:  {Tag: berTagOctetString, Data: []byte("APC Web/SNMP Management Card")},
+			testSysUpTimeOID: {Tag: snmpTagTimeTicks, Data: []byte{0x01, 0x00}},
+			testBatteryOID:   {Tag: berTagInteger, Data: []byte{90}},
+		},
+	}
+
+	if usm != nil {
+		usm.EngineBoots, usm.EngineTime = 3, 1234
+		usm.localize([]byte{0x80, 0x00, 0x1f, 0x88, 0x04, 0x39, 0x76, 0x6f, 0x6c, 0x74})
+	}
+
+	go func() {
+		buf := make([]byte, snmpMaxMessageSize)
+
+		for {
+			size, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+
+			if response := agent.handle(buf[:size]); response != nil {
+				conn.WriteTo(response, addr)
+			}
+		}
+	}()
+
+	return agent, conn.LocalAddr().(*net.UDPAddr).Port
+}
+
+func (a *testSNMPAgent) set(oid string, value *berValue) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	a.values[oid] = value
+}
+
+func (a *testSNMPAgent) respond(request *snmpPDU) *snmpPDU {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	response := &snmpPDU{Type: snmpTagGetResponse, RequestID: request.RequestID}
+
+	for _, varBind := range request.VarBinds {
+		value, ok := a.values[varBind.OID]
+		if !ok {
+			value = &berValue{Tag: snmpTagNoSuchObject}
+		}
+
+		response.VarBinds = append(response.VarBinds, &snmpVarBind{OID: varBind.OID, Value: value})
+	}
+
+	return response
+}
+
+func (a *testSNMPAgent) handle(data []byte) []byte {
+	if community, request, err := decodeSNMPv2cMessage(data); err == nil {
+		if community != a.community {
+			return nil
+		}
+
+		pdu, _ := a.respond(request).encode()
+
+		return berEncodeSequence(berTagSequence,
+			berEncodeInteger(berTagInteger, snmpVersion2c),
+			berEncode(berTagOctetString, []byte(community)),
+			pdu,
+		)
+	}
+
+	if a.usm == nil {
+		return nil
+	}
+
+	report := func(msgID int64, oid string) []byte {
+		pdu, _ := (&snmpPDU{
+			Type:     snmpTagReport,
+			VarBinds: []*snmpVarBind{{OID: oid, Value: &berValue{Tag: snmpTagCounter32, Data: []byte{1}}}},
+		}).encode()
+
+		message, _ := a.usm.encode(msgID, 0, a.scopedPDU(pdu))
+
+		return message
+	}
+
+	msg, err := a.usm.decode(data)
+	if err != nil {
+		top, _, _ := berDecode(data)
+		elements, _ := berDecodeAll(top.Data)
+		globalData, _ := berDecodeAll(elements[1].Data)
+		msgID, _ := globalData[0].Int()
+
+		return report(msgID, "1.3.6.1.6.3.15.1.1.5.0")
+	}
+
+	if len(msg.EngineID) == 0 {
+		return report(msg.MsgID, "1.3.6.1.6.3.15.1.1.4.0")
+	}
+
+	if msg.User != a.usm.User {
+		return report(msg.MsgID, "1.3.6.1.6.3.15.1.1.3.0")
+	}
+
+	request, err := decodeSNMPScopedPDU(msg.ScopedPDU)
+	Expect(err).To(BeNil())
+
+	pdu, _ := a.respond(request).encode()
+
+	message, err := a.usm.encode(msg.MsgID, msg.Flags&^snmpMsgFlagReportable, a.scopedPDU(pdu))
+	Expect(err).To(BeNil())
+
+	return message
+}
+
+func (a *testSNMPAgent) scopedPDU(pdu []byte) []byte {
+	return berEncodeSequence(berTagSequence,
+		berEncode(berTagOctetString, a.usm.EngineID),
+		berEncode(berTagOctetString, nil),
+		pdu,
+	)
+}
+
+var _ = Describe("snmp_monitor", func() {
+	var (
+		monitor *SNMPMonitor
+		config  *RootMonitorConfig
+		agent   *testSNMPAgent
+	)
+
+	float := func(f float64) *float64 {
+		return &f
+	}
+
+	start := func(usm *snmpUSM) {
+		agent, config.Config.Port = startTestSNMPAgent("public", usm)
+		monitor = NewSNMPMonitor(config)
+		Expect(monitor.Validate()).To(BeNil())
+	}
+
+	BeforeEach(func() {
+		config = &RootMonitorConfig{
+			Config: &MonitorConfig{
+				Host:     "127.0.0.1",
+				Interval: util.CustomDuration(10 * time.Second),
+				SNMPOIDs: []*SNMPOID{
+					{OID: testSysDescrOID, Name: "sysDescr", Operator: "regex", Value: "^APC"},
+					{OID: "." + testSysUpTimeOID, Name: "sysUpTime"},
+				},
+			},
+			Log: log.New(),
+		}
+
+		monitor = NewSNMPMonitor(config)
+	})
+
+	AfterEach(func() {
+		if agent != nil {
+			agent.conn.Close()
+			agent = nil
+		}
+	})
+
+	Context("NewSNMPMonitor", func() {
+		It("returns a properly configured instance with defaults", func() {
+			Expect(monitor.Port).To(Equal(DEFAULT_SNMP_PORT))
+			Expect(monitor.Timeout).To(Equal(DEFAULT_SNMP_TIMEOUT))
+			Expect(monitor.version()).To(Equal(SNMP_VERSION_2C))
+			Expect(monitor.community()).To(Equal(DEFAULT_SNMP_COMMUNITY))
+			Expect(monitor.MonitorFunc).NotTo(BeNil())
+		})
+	})
+
+	Context("Validate", func() {
+		It("returns nil with correct settings", func() {
+			Expect(monitor.Validate()).To(BeNil())
+		})
+
+		It("verifies the OIDs", func() {
+			config.Config.SNMPOIDs = nil
+			Expect(monitor.Validate().Error()).To(ContainSubstring("'snmp-oids' must contain at least one OID"))
+
+			config.Config.SNMPOIDs = []*SNMPOID{{OID: "1.3.6.x"}}
+			Expect(monitor.Validate().Error()).To(ContainSubstring("OID #0: OID '1.3.6.x' contains invalid component 'x'"))
+
+			config.Config.SNMPOIDs = []*SNMPOID{{OID: testBatteryOID, Warning: float(50), Critical: float(20)}}
+			Expect(monitor.Validate().Error()).To(ContainSubstring("OID #0: 'warning' (50) cannot exceed 'critical' (20)"))
+
+			config.Config.SNMPOIDs[0].Comparison = COMPARISON_BELOW
+			Expect(monitor.Validate()).To(BeNil())
+		})
+
+		It("verifies SNMPv3 settings", func() {
+			config.Config.SNMPVersion = "1"
+			Expect(monitor.Validate().Error()).To(ContainSubstring("Unknown 'snmp-version' '1'"))
+
+			config.Config.SNMPVersion = SNMP_VERSION_3
+			Expect(monitor.Validate().Error()).To(ContainSubstring("'snmp-user' must be set"))
+
+			config.Config.SNMPUser = "monitor"
+			config.Config.SNMPPrivPassword = "privpassword"
+			Expect(monitor.Validate().Error()).To(ContainSubstring("'snmp-priv-password' requires 'snmp-auth-password'"))
+
+			config.Config.SNMPAuthPassword = "short"
+			Expect(monitor.Validate().Error()).To(ContainSubstring("'snmp-auth-password' must be at least 8 characters"))
+
+			config.Config.SNMPAuthPassword = "authpassword"
+			config.Config.SNMPAuthProtocol = "sha512"
+			Expect(monitor.Validate().Error()).To(ContainSubstring("Unknown 'snmp-auth-protocol' 'sha512'"))
+
+			config.Config.SNMPAuthProtocol = "md5"
+			Expect(monitor.Validate()).To(BeNil())
+		})
+	})
+
+	Context("snmpCheck", func() {
+		It("succeeds if all assertions pass", func() {
+			start(nil)
+
+			result, err := monitor.snmpCheck()
+			Expect(err).To(BeNil())
+			Expect(result.Output).To(Equal("sysDescr = APC Web/SNMP Management Card, sysUpTime = 256"))
+			Expect(result.Metrics).To(HaveLen(1))
+			Expect(result.Metrics[0].Name).To(Equal("sysUpTime"))
+			Expect(result.Metrics[0].Value).To(Equal(256.0))
+		})
+
+		It("fails if an assertion fails or a value is missing", func() {
+			config.Config.SNMPOIDs[0].Value = "^Cisco"
+			start(nil)
+
+			_, err := monitor.snmpCheck()
+			Expect(err.Error()).To(ContainSubstring("Assertion 'sysDescr' regex '^Cisco' failed: got 'APC Web/SNMP Management Card'"))
+
+			config.Config.SNMPOIDs = []*SNMPOID{{OID: "1.3.6.1.4.1.318.1.1.1.2.2.1.0", Warning: float(30)}}
+			_, err = monitor.snmpCheck()
+			Expect(err.Error()).To(ContainSubstring("'1.3.6.1.4.1.318.1.1.1.2.2.1.0' is not available (noSuchObject)"))
+		})
+
+		It("sets the state based on thresholds", func() {
+			config.Config.SNMPOIDs = append(config.Config.SNMPOIDs, &SNMPOID{
+				OID:        testBatteryOID,
+				Name:       "battery",
+				Comparison: COMPARISON_BELOW,
+				Warning:    float(50),
+				Critical:   float(20),
+			})
+			start(nil)
+
+			result, err := monitor.snmpCheck()
+			Expect(err).To(BeNil())
+			Expect(result.Metrics[1].Warning).To(Equal("50"))
+
+			agent.set(testBatteryOID, &berValue{Tag: berTagInteger, Data: []byte{40}})
+
+			_, err = monitor.snmpCheck()
+			Expect(err).To(BeAssignableToTypeOf(&StateError{}))
+			Expect(err.(*StateError).State).To(Equal(WARNING))
+			Expect(err.(*StateError).Capped).To(BeTrue())
+			Expect(err.Error()).To(ContainSubstring("'battery' (40) is below warning threshold (50)"))
+
+			agent.set(testBatteryOID, &berValue{Tag: berTagInteger, Data: []byte{10}})
+
+			_, err = monitor.snmpCheck()
+			Expect(err).NotTo(BeAssignableToTypeOf(&StateError{}))
+			Expect(err.Error()).To(ContainSubstring("'battery' (10) is below critical threshold (20)"))
+		})
+
+		It("compares the rate of change of counters", func() {
+			config.Config.SNMPOIDs = []*SNMPOID{{OID: testIfInOctets, Name: "ifInOctets", Rate: true, Critical: float(1000)}}
+			start(nil)
+
+			agent.set(testIfInOctets, &berValue{Tag: snmpTagCounter32, Data: []byte{0x00, 0xff, 0xff, 0xff, 0x00}})
+
+			result, err := monitor.snmpCheck()
+			Expect(err).To(BeNil())
+			Expect(result.Metrics).To(BeEmpty())
+			Expect(result.Output).To(ContainSubstring("rate available after the next check"))
+
+			// 32 bit counter wrapped; 0xffffff00 -> 0x00000400 == +1280 bytes in 10s
+			monitor.samples[testIfInOctets].Date = time.Now().Add(-10 * time.Second)
+			agent.set(testIfInOctets, &berValue{Tag: snmpTagCounter32, Data: []byte{0x04, 0x00}})
+
+			result, err = monitor.snmpCheck()
+			Expect(err).To(BeNil())
+			Expect(result.Metrics[0].Value).To(BeNumerically("~", 128, 1))
+			Expect(result.Metrics[0].Unit).To(Equal("/s"))
+
+			monitor.samples[testIfInOctets].Date = time.Now().Add(-1 * time.Second)
+			agent.set(testIfInOctets, &berValue{Tag: snmpTagCounter32, Data: []byte{0x10, 0x00}})
+
+			_, err = monitor.snmpCheck()
+			Expect(err).NotTo(BeNil())
+			Expect(err.Error()).To(ContainSubstring("is above critical threshold (1000/s)"))
+		})
+
+		It("fails if the agent does not respond", func() {
+			config.Config.SNMPCommunity = "private"
+			config.Config.Timeout = util.CustomDuration(200 * time.Millisecond)
+			start(nil)
+
+			_, err := monitor.snmpCheck()
+			Expect(err).NotTo(BeAssignableToTypeOf(&StateError{}))
+			Expect(err.Error()).To(ContainSubstring("SNMP GET from 127.0.0.1"))
+		})
+
+		It("supports SNMPv3 with authentication and privacy", func() {
+			config.Config.SNMPVersion = SNMP_VERSION_3
+			config.Config.SNMPUser = "monitor"
+
+			for _, protocols := range [][2]string{
+				{"", ""},
+				{SNMP_AUTH_MD5, ""},
+				{SNMP_AUTH_SHA, SNMP_PRIV_DES},
+				{SNMP_AUTH_SHA, SNMP_PRIV_AES},
+				{SNMP_AUTH_SHA256, SNMP_PRIV_AES},
+			} {
+				usm := &snmpUSM{User: "monitor", AuthProtocol: protocols[0], PrivProtocol: protocols[1]}
+				config.Config.SNMPAuthPassword, config.Config.SNMPAuthProtocol = "", protocols[0]
+				config.Config.SNMPPrivPassword, config.Config.SNMPPrivProtocol = "", protocols[1]
+
+				if protocols[0] != "" {
+					usm.AuthPassword = "authpassword"
+					config.Config.SNMPAuthPassword = usm.AuthPassword
+				}
+
+				if protocols[1] != "" {
+					usm.PrivPassword = "privpassword"
+					config.Config.SNMPPrivPassword = usm.PrivPassword
+				}
+
+				start(usm)
+
+				result, err := monitor.snmpCheck()
+				Expect(err).To(BeNil(), "auth '%v', priv '%v'", protocols[0], protocols[1])
+				Expect(result.Output).To(ContainSubstring("sysUpTime = 256"))
+
+				agent.conn.Close()
+			}
+		})
+
+		It("reports SNMPv3 authentication failures", func() {
+			config.Config.SNMPVersion = SNMP_VERSION_3
+			config.Config.SNMPUser = "monitor"
+			config.Config.SNMPAuthPassword = "wrongpassword"
+
+			start(&snmpUSM{User: "monitor", AuthProtocol: SNMP_AUTH_SHA, AuthPassword: "authpassword"})
+
+			_, err := monitor.snmpCheck()
+			Expect(err.Error()).To(ContainSubstring("agent reported wrong digest"))
+
+			config.Config.SNMPAuthPassword = "authpassword"
+			config.Config.SNMPUser = "nobody"
+			_, err = monitor.snmpCheck()
+			Expect(err.Error()).To(ContainSubstring("agent reported unknown user name"))
+		})
+	})
+
+	Context("snmpUSM", func() {
+		// RFC 3414 A.3
+		It("localizes keys", func() {
+			engineID := []byte{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 2}
+
+			key := snmpLocalizeKey(md5.New, snmpPasswordToKey(md5.New, "maplesyrup"), engineID)
+			Expect(hex.EncodeToString(key)).To(Equal("526f5eed9fcce26f8964c2930787d82b"))
+
+			key = snmpLocalizeKey(sha1.New, snmpPasswordToKey(sha1.New, "maplesyrup"), engineID)
+			Expect(hex.EncodeToString(key)).To(Equal("6695febc9288e36282235fc7151f128497b38f3f"))
+		})
+	})
+
+	Context("BER", func() {
+		It("round trips integers and OIDs", func() {
+			for _, i := range []int64{0, 127, 128, 256, -1, -128, -129, 2147483647} {
+				value, _, err := berDecode(berEncodeInteger(berTagInteger, i))
+				Expect(err).To(BeNil())
+				Expect(value.Int()).To(Equal(i))
+			}
+
+			value, _, err := berDecode(berEncodeUnsigned(snmpTagCounter64, 18446744073709551615))
+			Expect(err).To(BeNil())
+			Expect(value.Uint()).To(Equal(uint64(18446744073709551615)))
+
+			encoded, err := berEncodeOID("1.3.6.1.4.1.2636.3.1.13.1.8.9.1.0.0")
+			Expect(err).To(BeNil())
+
+			value, _, err = berDecode(encoded)
+			Expect(err).To(BeNil())
+			Expect(value.OID()).To(Equal("1.3.6.1.4.1.2636.3.1.13.1.8.9.1.0.0"))
+		})
+
+		It("formats binary octet strings as hex", func() {
+			Expect(snmpOctetString([]byte{0x00, 0x1a, 0x2b, 0x3c, 0x4d, 0x5e})).To(Equal("00:1a:2b:3c:4d:5e"))
+			Expect(snmpOctetString([]byte("eth0\x00"))).To(Equal("eth0"))
+		})
+	})
+})
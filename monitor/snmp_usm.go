@@ -0,0 +1,463 @@
+package monitor
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/des"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"sync/atomic"
+)
+
+// SNMPv3 user-based security model (RFC 3414, RFC 3826 and RFC 7860)
+const (
+	SNMP_AUTH_MD5    = "MD5"
+	SNMP_AUTH_SHA    = "SHA"
+	SNMP_AUTH_SHA256 = "SHA256"
+
+	SNMP_PRIV_DES = "DES"
+	SNMP_PRIV_AES = "AES" // AES-128-CFB
+
+	snmpVersion3          = 3
+	snmpSecurityModelUSM  = 3
+	snmpMaxMessageSize    = 65507
+	snmpMsgFlagAuth       = 0x01
+	snmpMsgFlagPriv       = 0x02
+	snmpMsgFlagReportable = 0x04
+
+	snmpNotInTimeWindowsOID = "1.3.6.1.6.3.15.1.1.2.0"
+
+	// Passwords are stretched to 1MB before hashing (RFC 3414 A.2)
+	snmpPasswordExpansion = 1024 * 1024
+)
+
+var (
+	snmpAuthProtocols = []string{SNMP_AUTH_MD5, SNMP_AUTH_SHA, SNMP_AUTH_SHA256}
+	snmpPrivProtocols = []string{SNMP_PRIV_DES, SNMP_PRIV_AES}
+
+	// Reasons an agent sends a report instead of a response
+	snmpUSMStats = map[string]string{
+		"1.3.6.1.6.3.15.1.1.1.0": "unsupported security level",
+		snmpNotInTimeWindowsOID:  "not in time window",
+		"1.3.6.1.6.3.15.1.1.3.0": "unknown user name",
+		"1.3.6.1.6.3.15.1.1.4.0": "unknown engine ID",
+		"1.3.6.1.6.3.15.1.1.5.0": "wrong digest (check the auth protocol and password)",
+		"1.3.6.1.6.3.15.1.1.6.0": "decryption error (check the priv protocol and password)",
+	}
+
+	// Source of salts for encryption; must not repeat for the same key
+	snmpSaltCounter = newSNMPSalt()
+)
+
+// A USM user along with the (discovered) authoritative engine it talks to
+type snmpUSM struct {
+	User         string
+	AuthProtocol string // blank == noAuth
+	AuthPassword string
+	PrivProtocol string // blank == noPriv
+	PrivPassword string
+
+	EngineID    []byte
+	EngineBoots int64
+	EngineTime  int64
+
+	authKey []byte
+	privKey []byte
+}
+
+// The relevant parts of a decoded SNMPv3 message
+type snmpV3Message struct {
+	MsgID       int64
+	Flags       byte
+	EngineID    []byte
+	EngineBoots int64
+	EngineTime  int64
+	User        string
+	ScopedPDU   *berValue // decrypted, if necessary
+}
+
+// Message flags matching the configured security level
+func (u *snmpUSM) flags() byte {
+	var flags byte
+
+	if u.AuthProtocol != "" {
+		flags |= snmpMsgFlagAuth
+	}
+
+	if u.PrivProtocol != "" {
+		flags |= snmpMsgFlagPriv
+	}
+
+	return flags
+}
+
+func (u *snmpUSM) hash() func() hash.Hash {
+	switch u.AuthProtocol {
+	case SNMP_AUTH_MD5:
+		return md5.New
+	case SNMP_AUTH_SHA256:
+		return sha256.New
+	}
+
+	return sha1.New
+}
+
+// HMAC-MD5-96 and HMAC-SHA-96 are truncated to 12 bytes; HMAC-SHA-256 to 24
+func (u *snmpUSM) authParamsLength() int {
+	if u.AuthProtocol == SNMP_AUTH_SHA256 {
+		return 24
+	}
+
+	return 12
+}
+
+// Localize the keys for the (discovered) engine ID
+func (u *snmpUSM) localize(engineID []byte) {
+	u.EngineID = engineID
+	u.authKey, u.privKey = nil, nil
+
+	if u.AuthProtocol != "" {
+		u.authKey = snmpLocalizeKey(u.hash(), snmpPasswordToKey(u.hash(), u.AuthPassword), engineID)
+	}
+
+	if u.PrivProtocol != "" {
+		u.privKey = snmpLocalizeKey(u.hash(), snmpPasswordToKey(u.hash(), u.PrivPassword), engineID)
+	}
+}
+
+// Start the salt counter at a random value so salts are not reused across restarts
+func newSNMPSalt() uint64 {
+	buf := make([]byte, 8)
+	rand.Read(buf)
+
+	return binary.BigEndian.Uint64(buf)
+}
+
+// Password to key algorithm (RFC 3414 A.2)
+func snmpPasswordToKey(newHash func() hash.Hash, password string) []byte {
+	h := newHash()
+
+	if password == "" {
+		return h.Sum(nil)
+	}
+
+	buf := make([]byte, 64)
+	index := 0
+
+	for count := 0; count < snmpPasswordExpansion; count += len(buf) {
+		for i := range buf {
+			buf[i] = password[index%len(password)]
+			index++
+		}
+
+		h.Write(buf)
+	}
+
+	return h.Sum(nil)
+}
+
+func snmpLocalizeKey(newHash func() hash.Hash, key, engineID []byte) []byte {
+	h := newHash()
+
+	h.Write(key)
+	h.Write(engineID)
+	h.Write(key)
+
+	return h.Sum(nil)
+}
+
+// Encode a message carrying 'scopedPDU' with the given flags; the PDU is
+// encrypted and the message authenticated as the flags require
+func (u *snmpUSM) encode(msgID int64, flags byte, scopedPDU []byte) ([]byte, error) {
+	var (
+		authParams []byte
+		privParams []byte
+		msgData    = scopedPDU
+	)
+
+	if flags&snmpMsgFlagAuth != 0 {
+		if u.authKey == nil {
+			return nil, errors.New("authentication requested without an auth key")
+		}
+
+		authParams = make([]byte, u.authParamsLength())
+	}
+
+	if flags&snmpMsgFlagPriv != 0 {
+		encrypted, salt, err := u.encrypt(scopedPDU)
+		if err != nil {
+			return nil, err
+		}
+
+		msgData = berEncode(berTagOctetString, encrypted)
+		privParams = salt
+	}
+
+	globalData := berEncodeSequence(berTagSequence,
+		berEncodeInteger(berTagInteger, msgID),
+		berEncodeInteger(berTagInteger, snmpMaxMessageSize),
+		berEncode(berTagOctetString, []byte{flags}),
+		berEncodeInteger(berTagInteger, snmpSecurityModelUSM),
+	)
+
+	// The digest is calculated over the whole message with zeroed auth params,
+	// so keep track of where they end up
+	securityPrefix := berConcat(
+		berEncode(berTagOctetString, u.EngineID),
+		berEncodeInteger(berTagInteger, u.EngineBoots),
+		berEncodeInteger(berTagInteger, u.EngineTime),
+		berEncode(berTagOctetString, []byte(u.User)),
+	)
+
+	authTLV := berEncode(berTagOctetString, authParams)
+	securityData := berConcat(securityPrefix, authTLV, berEncode(berTagOctetString, privParams))
+	securitySequence := berEncode(berTagSequence, securityData)
+	securityParams := berEncode(berTagOctetString, securitySequence)
+
+	version := berEncodeInteger(berTagInteger, snmpVersion3)
+	body := berConcat(version, globalData, securityParams, msgData)
+	message := berEncode(berTagSequence, body)
+
+	if flags&snmpMsgFlagAuth != 0 {
+		authOffset := len(message) - len(body) + len(version) + len(globalData) +
+			len(securityParams) - len(securitySequence) +
+			len(securitySequence) - len(securityData) +
+			len(securityPrefix) + len(authTLV) - len(authParams)
+
+		copy(message[authOffset:], u.digest(message))
+	}
+
+	return message, nil
+}
+
+// Decode a message, verifying its digest and decrypting its scoped PDU as its
+// flags require. Messages without authentication (ie. discovery reports) are
+// accepted as is.
+func (u *snmpUSM) decode(data []byte) (*snmpV3Message, error) {
+	top, _, err := berDecode(data)
+	if err != nil {
+		return nil, err
+	}
+
+	elements, err := berDecodeSequence(top, berTagSequence, 4)
+	if err != nil {
+		return nil, err
+	}
+
+	if version, err := elements[0].Int(); err != nil || version != snmpVersion3 {
+		return nil, fmt.Errorf("unexpected SNMP version in response (%v)", version)
+	}
+
+	globalData, err := berDecodeSequence(elements[1], berTagSequence, 4)
+	if err != nil {
+		return nil, fmt.Errorf("invalid message header: %v", err.Error())
+	}
+
+	msg := &snmpV3Message{}
+
+	if msg.MsgID, err = globalData[0].Int(); err != nil {
+		return nil, fmt.Errorf("invalid message ID: %v", err.Error())
+	}
+
+	if len(globalData[2].Data) != 1 {
+		return nil, errors.New("invalid message flags")
+	}
+
+	msg.Flags = globalData[2].Data[0]
+
+	if model, err := globalData[3].Int(); err != nil || model != snmpSecurityModelUSM {
+		return nil, fmt.Errorf("unsupported security model (%v)", model)
+	}
+
+	securitySequence, _, err := berDecode(elements[2].Data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid security parameters: %v", err.Error())
+	}
+
+	security, err := berDecodeSequence(securitySequence, berTagSequence, 6)
+	if err != nil {
+		return nil, fmt.Errorf("invalid security parameters: %v", err.Error())
+	}
+
+	msg.EngineID = security[0].Data
+	msg.User = string(security[3].Data)
+
+	if msg.EngineBoots, err = security[1].Int(); err != nil {
+		return nil, fmt.Errorf("invalid engine boots: %v", err.Error())
+	}
+
+	if msg.EngineTime, err = security[2].Int(); err != nil {
+		return nil, fmt.Errorf("invalid engine time: %v", err.Error())
+	}
+
+	if msg.Flags&snmpMsgFlagAuth != 0 {
+		if u.authKey == nil {
+			return nil, errors.New("received authenticated message without an auth key")
+		}
+
+		authParams := security[4]
+		if len(authParams.Data) != u.authParamsLength() {
+			return nil, fmt.Errorf("unexpected auth parameters length (%v)", len(authParams.Data))
+		}
+
+		authOffset := top.offset + elements[2].offset + securitySequence.offset + authParams.offset
+
+		zeroed := append([]byte{}, data...)
+		copy(zeroed[authOffset:authOffset+len(authParams.Data)], make([]byte, len(authParams.Data)))
+
+		if !hmac.Equal(u.digest(zeroed), authParams.Data) {
+			return nil, errors.New("message digest mismatch (check the auth protocol and password)")
+		}
+	}
+
+	scopedPDU := elements[3]
+
+	if msg.Flags&snmpMsgFlagPriv != 0 {
+		if u.privKey == nil {
+			return nil, errors.New("received encrypted message without a priv key")
+		}
+
+		if scopedPDU.Tag != berTagOctetString {
+			return nil, errors.New("expected an encrypted scoped PDU")
+		}
+
+		plaintext, err := u.decrypt(scopedPDU.Data, security[5].Data, msg.EngineBoots, msg.EngineTime)
+		if err != nil {
+			return nil, err
+		}
+
+		if scopedPDU, _, err = berDecode(plaintext); err != nil {
+			return nil, errors.New("unable to decrypt scoped PDU (check the priv protocol and password)")
+		}
+	}
+
+	msg.ScopedPDU = scopedPDU
+
+	return msg, nil
+}
+
+func (u *snmpUSM) digest(message []byte) []byte {
+	mac := hmac.New(u.hash(), u.authKey)
+	mac.Write(message)
+
+	return mac.Sum(nil)[:u.authParamsLength()]
+}
+
+// Encrypt a scoped PDU, returning the ciphertext and the salt (priv params)
+func (u *snmpUSM) encrypt(plaintext []byte) ([]byte, []byte, error) {
+	salt := make([]byte, 8)
+	counter := atomic.AddUint64(&snmpSaltCounter, 1)
+
+	switch u.PrivProtocol {
+	case SNMP_PRIV_DES:
+		// Salt = engine boots + local counter; IV = pre-IV XOR salt (RFC 3414 8.1.1.1)
+		binary.BigEndian.PutUint32(salt, uint32(u.EngineBoots))
+		binary.BigEndian.PutUint32(salt[4:], uint32(counter))
+
+		block, iv, err := u.desCipher(salt)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		padded := make([]byte, (len(plaintext)+des.BlockSize-1)/des.BlockSize*des.BlockSize)
+		copy(padded, plaintext)
+
+		cipher.NewCBCEncrypter(block, iv).CryptBlocks(padded, padded)
+
+		return padded, salt, nil
+	case SNMP_PRIV_AES:
+		binary.BigEndian.PutUint64(salt, counter)
+
+		block, iv, err := u.aesCipher(salt, u.EngineBoots, u.EngineTime)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		ciphertext := make([]byte, len(plaintext))
+		cipher.NewCFBEncrypter(block, iv).XORKeyStream(ciphertext, plaintext)
+
+		return ciphertext, salt, nil
+	}
+
+	return nil, nil, fmt.Errorf("unsupported priv protocol '%v'", u.PrivProtocol)
+}
+
+func (u *snmpUSM) decrypt(ciphertext, salt []byte, boots, time int64) ([]byte, error) {
+	if len(salt) != 8 {
+		return nil, fmt.Errorf("unexpected priv parameters length (%v)", len(salt))
+	}
+
+	plaintext := make([]byte, len(ciphertext))
+
+	switch u.PrivProtocol {
+	case SNMP_PRIV_DES:
+		if len(ciphertext)%des.BlockSize != 0 {
+			return nil, errors.New("encrypted scoped PDU is not a multiple of the DES block size")
+		}
+
+		block, iv, err := u.desCipher(salt)
+		if err != nil {
+			return nil, err
+		}
+
+		cipher.NewCBCDecrypter(block, iv).CryptBlocks(plaintext, ciphertext)
+	case SNMP_PRIV_AES:
+		block, iv, err := u.aesCipher(salt, boots, time)
+		if err != nil {
+			return nil, err
+		}
+
+		cipher.NewCFBDecrypter(block, iv).XORKeyStream(plaintext, ciphertext)
+	default:
+		return nil, fmt.Errorf("unsupported priv protocol '%v'", u.PrivProtocol)
+	}
+
+	return plaintext, nil
+}
+
+// DES key = first 8 bytes of the localized key, pre-IV = the next 8 bytes
+func (u *snmpUSM) desCipher(salt []byte) (cipher.Block, []byte, error) {
+	if len(u.privKey) < 16 {
+		return nil, nil, errors.New("priv key too short for DES")
+	}
+
+	block, err := des.NewCipher(u.privKey[:8])
+	if err != nil {
+		return nil, nil, err
+	}
+
+	iv := make([]byte, des.BlockSize)
+
+	for i := range iv {
+		iv[i] = u.privKey[8+i] ^ salt[i]
+	}
+
+	return block, iv, nil
+}
+
+// AES key = first 16 bytes of the localized key; IV = engine boots + engine
+// time + salt (RFC 3826 3.1.2.1)
+func (u *snmpUSM) aesCipher(salt []byte, boots, time int64) (cipher.Block, []byte, error) {
+	if len(u.privKey) < 16 {
+		return nil, nil, errors.New("priv key too short for AES")
+	}
+
+	block, err := aes.NewCipher(u.privKey[:16])
+	if err != nil {
+		return nil, nil, err
+	}
+
+	iv := make([]byte, aes.BlockSize)
+	binary.BigEndian.PutUint32(iv, uint32(boots))
+	binary.BigEndian.PutUint32(iv[4:], uint32(time))
+	copy(iv[8:], salt)
+
+	return block, iv, nil
+}
@@ -0,0 +1,157 @@
+package monitor
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/9corp/9volt/util"
+)
+
+const (
+	PAYLOAD_ENCODING_TEXT   = "text"
+	PAYLOAD_ENCODING_HEX    = "hex"
+	PAYLOAD_ENCODING_BASE64 = "base64"
+)
+
+// Timeout and read size settings shared by the socket based monitors ('tcp', 'udp')
+type SocketSettings struct {
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+	ConnTimeout  time.Duration
+	ReadSize     int
+}
+
+// Update timeout and read size related settings
+func (s *SocketSettings) updateSettings(cfg *MonitorConfig) {
+	s.ConnTimeout = DEFAULT_CONN_TIMEOUT
+	s.ReadTimeout = DEFAULT_READ_TIMEOUT
+	s.WriteTimeout = DEFAULT_WRITE_TIMEOUT
+	s.ReadSize = DEFAULT_READ_SIZE
+
+	if cfg.Timeout != util.CustomDuration(0) {
+		s.ConnTimeout = time.Duration(cfg.Timeout)
+	}
+
+	if cfg.TCPReadTimeout != util.CustomDuration(0) {
+		s.ReadTimeout = time.Duration(cfg.TCPReadTimeout)
+	}
+
+	if cfg.TCPWriteTimeout != util.CustomDuration(0) {
+		s.WriteTimeout = time.Duration(cfg.TCPWriteTimeout)
+	}
+
+	if cfg.TCPReadSize != 0 {
+		s.ReadSize = cfg.TCPReadSize
+	}
+}
+
+// Verify that none of the timeouts (nor their sum) exceed the check interval
+func (s *SocketSettings) validateTimeouts(interval util.CustomDuration) error {
+	if s.ConnTimeout >= time.Duration(interval) {
+		return fmt.Errorf("'timeout' (%v) cannot equal or exceed 'interval' (%v)", s.ConnTimeout.String(), interval.String())
+	}
+
+	if s.ReadTimeout.String() != "0s" {
+		if s.ReadTimeout >= time.Duration(interval) {
+			return fmt.Errorf("'read-timeout' (%v) cannot equal or exceed 'interval' (%v)", s.ReadTimeout.String(), interval.String())
+		}
+	}
+
+	if s.WriteTimeout.String() != "0s" {
+		if s.WriteTimeout >= time.Duration(interval) {
+			return fmt.Errorf("'write-timeout' (%v) cannot equal or exceed 'interval' (%v)", s.WriteTimeout.String(), interval.String())
+		}
+	}
+
+	// Check that the combination of timeouts does not exceed interval
+	totalTimeoutTime := s.ConnTimeout + s.ReadTimeout + s.WriteTimeout
+
+	if totalTimeoutTime >= time.Duration(interval) {
+		return fmt.Errorf("Total timeout duration (%v) cannot equal or exceed 'interval' (%v)", totalTimeoutTime.String(), interval.String())
+	}
+
+	return nil
+}
+
+// Decode a 'send' or 'expect' payload using the given encoding
+func decodePayload(data, encoding string) ([]byte, error) {
+	switch strings.ToLower(encoding) {
+	case "", PAYLOAD_ENCODING_TEXT:
+		return []byte(data), nil
+	case PAYLOAD_ENCODING_HEX:
+		// Allow "de ad be ef" and "DE:AD:BE:EF" for readability
+		cleaned := strings.NewReplacer(" ", "", ":", "", "\n", "", "\t", "").Replace(data)
+
+		decoded, err := hex.DecodeString(cleaned)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to decode hex payload: %v", err.Error())
+		}
+
+		return decoded, nil
+	case PAYLOAD_ENCODING_BASE64:
+		decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(data))
+		if err != nil {
+			return nil, fmt.Errorf("Unable to decode base64 payload: %v", err.Error())
+		}
+
+		return decoded, nil
+	default:
+		return nil, fmt.Errorf("Unknown payload encoding '%v' (supported: %v, %v, %v)",
+			encoding, PAYLOAD_ENCODING_TEXT, PAYLOAD_ENCODING_HEX, PAYLOAD_ENCODING_BASE64)
+	}
+}
+
+// Matches received data against 'expect' as either a (decoded) substring or a regex
+type PayloadMatcher struct {
+	Expected []byte
+	Regex    *regexp.Regexp
+}
+
+// Returns nil if no 'expect' is configured
+func newPayloadMatcher(cfg *MonitorConfig) (*PayloadMatcher, error) {
+	if cfg.Expect == "" {
+		return nil, nil
+	}
+
+	if cfg.ExpectRegex {
+		if cfg.ExpectEncoding != "" && strings.ToLower(cfg.ExpectEncoding) != PAYLOAD_ENCODING_TEXT {
+			return nil, fmt.Errorf("'expect-regex' cannot be combined with 'expect-encoding' %v", cfg.ExpectEncoding)
+		}
+
+		regex, err := regexp.Compile(cfg.Expect)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to compile 'expect' regex: %v", err.Error())
+		}
+
+		return &PayloadMatcher{Regex: regex}, nil
+	}
+
+	expected, err := decodePayload(cfg.Expect, cfg.ExpectEncoding)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid 'expect': %v", err.Error())
+	}
+
+	return &PayloadMatcher{Expected: expected}, nil
+}
+
+func (p *PayloadMatcher) Match(data []byte) bool {
+	if p.Regex != nil {
+		return p.Regex.Match(data)
+	}
+
+	return bytes.Contains(data, p.Expected)
+}
+
+// Human readable description of what we expected, for error messages
+func (p *PayloadMatcher) String() string {
+	if p.Regex != nil {
+		return fmt.Sprintf("regex %v", p.Regex.String())
+	}
+
+	return fmt.Sprintf("%q", p.Expected)
+}
@@ -0,0 +1,597 @@
+package monitor
+
+import (
+	"bufio"
+	"bytes"
+	"crypto"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"math/big"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/9corp/9volt/util"
+)
+
+const (
+	DEFAULT_SSH_TIMEOUT = time.Duration(3) * time.Second
+	DEFAULT_SSH_PORT    = 22
+
+	SSH_CLIENT_VERSION = "SSH-2.0-9volt"
+
+	sshMsgDisconnect  = 1
+	sshMsgIgnore      = 2
+	sshMsgDebug       = 4
+	sshMsgKexInit     = 20
+	sshMsgKexECDHInit = 30
+	sshMsgKexECDHRply = 31
+
+	sshMaxPacketSize   = 256 * 1024
+	sshMaxVersionLines = 64
+)
+
+var (
+	// Supported key exchange algorithms, in order of preference
+	sshKexAlgorithms = []string{"curve25519-sha256", "curve25519-sha256@libssh.org", "ecdh-sha2-nistp256"}
+
+	// Supported host key algorithms, in order of preference
+	sshHostKeyAlgorithms = []string{
+		"ssh-ed25519", "ecdsa-sha2-nistp256", "ecdsa-sha2-nistp384", "ecdsa-sha2-nistp521",
+		"rsa-sha2-512", "rsa-sha2-256", "ssh-rsa",
+	}
+
+	// Never actually used (we disconnect right after the key exchange), but the
+	// server must find a common algorithm to proceed with the key exchange.
+	sshCiphers     = []string{"chacha20-poly1305@openssh.com", "aes128-gcm@openssh.com", "aes256-gcm@openssh.com", "aes128-ctr", "aes192-ctr", "aes256-ctr"}
+	sshMACs        = []string{"hmac-sha2-256-etm@openssh.com", "hmac-sha2-256", "hmac-sha2-512", "hmac-sha1"}
+	sshCompression = []string{"none"}
+)
+
+type SSHMonitor struct {
+	Base
+
+	Timeout           time.Duration
+	Port              int
+	HostKeyAlgorithms []string
+}
+
+func NewSSHMonitor(rmc *RootMonitorConfig) *SSHMonitor {
+	s := &SSHMonitor{
+		Base: Base{
+			RMC:        rmc,
+			Identifier: "ssh",
+		},
+		Timeout:           DEFAULT_SSH_TIMEOUT,
+		Port:              DEFAULT_SSH_PORT,
+		HostKeyAlgorithms: sshHostKeyAlgorithms,
+	}
+
+	if rmc.Config.Timeout != util.CustomDuration(0) {
+		s.Timeout = time.Duration(rmc.Config.Timeout)
+	}
+
+	if rmc.Config.Port != 0 {
+		s.Port = rmc.Config.Port
+	}
+
+	// Servers present a different host key per algorithm; pinning the algorithm
+	// keeps the fingerprint stable.
+	if rmc.Config.SSHHostKeyAlgorithm != "" {
+		s.HostKeyAlgorithms = []string{rmc.Config.SSHHostKeyAlgorithm}
+	}
+
+	s.MonitorFunc = s.sshCheck
+
+	return s
+}
+
+func (s *SSHMonitor) Validate() error {
+	s.RMC.Log.WithField("configName", s.RMC.ConfigName).Debug("Performing monitor config validation")
+
+	if s.RMC.Config.Host == "" {
+		return errors.New("'host' cannot be blank")
+	}
+
+	if s.RMC.Config.SSHHostKeyAlgorithm != "" && !sshContains(sshHostKeyAlgorithms, s.RMC.Config.SSHHostKeyAlgorithm) {
+		return fmt.Errorf("Unsupported 'ssh-host-key-algorithm' '%v' (supported: %v)",
+			s.RMC.Config.SSHHostKeyAlgorithm, strings.Join(sshHostKeyAlgorithms, ", "))
+	}
+
+	if s.Timeout >= time.Duration(s.RMC.Config.Interval) {
+		return fmt.Errorf("'timeout' (%v) cannot equal or exceed 'interval' (%v)", s.Timeout.String(), s.RMC.Config.Interval.String())
+	}
+
+	return nil
+}
+
+// Connect to the ssh server, read its identification string and optionally
+// complete a key exchange to verify the host key fingerprint.
+func (s *SSHMonitor) sshCheck() (*CheckResult, error) {
+	fullAddress := net.JoinHostPort(s.RMC.Config.Host, strconv.Itoa(s.Port))
+
+	s.RMC.Log.WithField("address", fullAddress).Debug("Performing ssh check")
+
+	conn, err := net.DialTimeout("tcp", fullAddress, s.Timeout)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to open connection to %v: %v", fullAddress, err.Error())
+	}
+	defer conn.Close()
+
+	if err := conn.SetDeadline(time.Now().Add(s.Timeout)); err != nil {
+		return nil, fmt.Errorf("Unable to set connection timeout (%v): %v", s.Timeout, err.Error())
+	}
+
+	t := newSSHTransport(conn)
+
+	if err := t.exchangeVersions(); err != nil {
+		return nil, fmt.Errorf("Unable to read server identification from %v: %v", fullAddress, err.Error())
+	}
+
+	if s.RMC.Config.Expect != "" && !strings.Contains(string(t.serverVersion), s.RMC.Config.Expect) {
+		return nil, fmt.Errorf("Server identification does not contain expected substring (Recv: [%v] Expected: [%v])",
+			string(t.serverVersion), s.RMC.Config.Expect)
+	}
+
+	if s.RMC.Config.SSHFingerprint == "" && !s.RMC.Config.SSHKeyExchange {
+		return nil, nil
+	}
+
+	hostKey, err := t.keyExchange(s.HostKeyAlgorithms)
+	if err != nil {
+		return nil, fmt.Errorf("Key exchange with %v failed: %v", fullAddress, err.Error())
+	}
+
+	t.disconnect()
+
+	fingerprint := sshFingerprint(hostKey)
+
+	if s.RMC.Config.SSHFingerprint != "" && fingerprint != normalizeSSHFingerprint(s.RMC.Config.SSHFingerprint) {
+		return nil, fmt.Errorf("Host key fingerprint for %v has changed (Recv: [%v] Expected: [%v])",
+			fullAddress, fingerprint, normalizeSSHFingerprint(s.RMC.Config.SSHFingerprint))
+	}
+
+	return nil, nil
+}
+
+// OpenSSH style SHA256 fingerprint of a wire-format host key
+func sshFingerprint(hostKey []byte) string {
+	sum := sha256.Sum256(hostKey)
+	return "SHA256:" + base64.RawStdEncoding.EncodeToString(sum[:])
+}
+
+// Allow fingerprints to be configured with or without the 'SHA256:' prefix and padding
+func normalizeSSHFingerprint(fingerprint string) string {
+	fingerprint = strings.TrimRight(strings.TrimPrefix(strings.TrimSpace(fingerprint), "SHA256:"), "=")
+	return "SHA256:" + fingerprint
+}
+
+// Bare-bones, unencrypted ssh transport; just enough to get through a key exchange
+type sshTransport struct {
+	conn          net.Conn
+	r             *bufio.Reader
+	clientVersion []byte
+	serverVersion []byte
+	clientKexInit []byte
+	serverKexInit []byte
+}
+
+func newSSHTransport(conn net.Conn) *sshTransport {
+	return &sshTransport{
+		conn:          conn,
+		r:             bufio.NewReader(conn),
+		clientVersion: []byte(SSH_CLIENT_VERSION),
+	}
+}
+
+// Send our identification string and read the server's. Servers are allowed
+// to send other lines of text before the identification string (RFC 4253 4.2).
+func (t *sshTransport) exchangeVersions() error {
+	if _, err := t.conn.Write(append(t.clientVersion, '\r', '\n')); err != nil {
+		return err
+	}
+
+	for i := 0; i < sshMaxVersionLines; i++ {
+		line, err := t.r.ReadString('\n')
+		if err != nil {
+			return err
+		}
+
+		line = strings.TrimRight(line, "\r\n")
+
+		if strings.HasPrefix(line, "SSH-") {
+			if !strings.HasPrefix(line, "SSH-2.0-") && !strings.HasPrefix(line, "SSH-1.99-") {
+				return fmt.Errorf("unsupported protocol version '%v'", line)
+			}
+
+			t.serverVersion = []byte(line)
+			return nil
+		}
+	}
+
+	return errors.New("no identification string received")
+}
+
+// Perform a key exchange; returns the server host key once its signature
+// over the exchange hash has been verified.
+func (t *sshTransport) keyExchange(hostKeyAlgorithms []string) ([]byte, error) {
+	t.clientKexInit = marshalKexInit(sshKexAlgorithms, hostKeyAlgorithms)
+
+	if err := t.writePacket(t.clientKexInit); err != nil {
+		return nil, err
+	}
+
+	serverKexInit, err := t.readPacket()
+	if err != nil {
+		return nil, err
+	}
+
+	if serverKexInit[0] != sshMsgKexInit {
+		return nil, fmt.Errorf("expected KEXINIT, received message type %v", serverKexInit[0])
+	}
+
+	t.serverKexInit = serverKexInit
+
+	serverKexAlgos, serverHostKeyAlgos, err := parseKexInit(serverKexInit)
+	if err != nil {
+		return nil, err
+	}
+
+	kexAlgo, ok := sshNegotiate(sshKexAlgorithms, serverKexAlgos)
+	if !ok {
+		return nil, fmt.Errorf("no common key exchange algorithm (server supports: %v)", strings.Join(serverKexAlgos, ","))
+	}
+
+	hostKeyAlgo, ok := sshNegotiate(hostKeyAlgorithms, serverHostKeyAlgos)
+	if !ok {
+		return nil, fmt.Errorf("no common host key algorithm (server supports: %v)", strings.Join(serverHostKeyAlgos, ","))
+	}
+
+	curve := ecdh.X25519()
+	if kexAlgo == "ecdh-sha2-nistp256" {
+		curve = ecdh.P256()
+	}
+
+	privKey, err := curve.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := t.writePacket(appendSSHString([]byte{sshMsgKexECDHInit}, privKey.PublicKey().Bytes())); err != nil {
+		return nil, err
+	}
+
+	reply, err := t.readPacket()
+	if err != nil {
+		return nil, err
+	}
+
+	if reply[0] != sshMsgKexECDHRply {
+		return nil, fmt.Errorf("expected KEX_ECDH_REPLY, received message type %v", reply[0])
+	}
+
+	r := &sshReader{b: reply[1:]}
+	hostKey, serverPub, signature := r.readString(), r.readString(), r.readString()
+
+	if r.err != nil {
+		return nil, fmt.Errorf("malformed KEX_ECDH_REPLY: %v", r.err)
+	}
+
+	peerKey, err := curve.NewPublicKey(serverPub)
+	if err != nil {
+		return nil, fmt.Errorf("invalid server ephemeral key: %v", err)
+	}
+
+	secret, err := privKey.ECDH(peerKey)
+	if err != nil {
+		return nil, err
+	}
+
+	exchangeHash := sshExchangeHash(t.clientVersion, t.serverVersion, t.clientKexInit, t.serverKexInit,
+		hostKey, privKey.PublicKey().Bytes(), serverPub, secret)
+
+	if err := verifySSHSignature(hostKeyAlgo, hostKey, signature, exchangeHash); err != nil {
+		return nil, fmt.Errorf("unable to verify host key signature: %v", err)
+	}
+
+	return hostKey, nil
+}
+
+// Politely let the server know we're done
+func (t *sshTransport) disconnect() {
+	msg := []byte{sshMsgDisconnect}
+	msg = binary.BigEndian.AppendUint32(msg, 11) // SSH_DISCONNECT_BY_APPLICATION
+	msg = appendSSHString(msg, []byte("9volt check complete"))
+	msg = appendSSHString(msg, nil)
+
+	t.writePacket(msg)
+}
+
+func (t *sshTransport) writePacket(payload []byte) error {
+	// Padding must be at least 4 bytes and total length a multiple of 8
+	padding := 8 - (len(payload)+5)%8
+	if padding < 4 {
+		padding += 8
+	}
+
+	packet := binary.BigEndian.AppendUint32(nil, uint32(len(payload)+padding+1))
+	packet = append(packet, byte(padding))
+	packet = append(packet, payload...)
+	packet = append(packet, make([]byte, padding)...)
+
+	_, err := t.conn.Write(packet)
+	return err
+}
+
+// Read the next packet, skipping IGNORE and DEBUG messages
+func (t *sshTransport) readPacket() ([]byte, error) {
+	for {
+		lengthBuf := make([]byte, 4)
+		if _, err := io.ReadFull(t.r, lengthBuf); err != nil {
+			return nil, err
+		}
+
+		length := binary.BigEndian.Uint32(lengthBuf)
+		if length < 2 || length > sshMaxPacketSize {
+			return nil, fmt.Errorf("invalid packet length %v", length)
+		}
+
+		packet := make([]byte, length)
+		if _, err := io.ReadFull(t.r, packet); err != nil {
+			return nil, err
+		}
+
+		padding := int(packet[0])
+		if padding+2 > len(packet) {
+			return nil, fmt.Errorf("invalid padding length %v", padding)
+		}
+
+		payload := packet[1 : len(packet)-padding]
+
+		switch payload[0] {
+		case sshMsgIgnore, sshMsgDebug:
+			continue
+		case sshMsgDisconnect:
+			r := &sshReader{b: payload[1:]}
+			r.readUint32()
+			return nil, fmt.Errorf("server disconnected: %v", string(r.readString()))
+		}
+
+		return payload, nil
+	}
+}
+
+func marshalKexInit(kexAlgorithms, hostKeyAlgorithms []string) []byte {
+	msg := []byte{sshMsgKexInit}
+
+	cookie := make([]byte, 16)
+	rand.Read(cookie)
+	msg = append(msg, cookie...)
+
+	for _, nameList := range [][]string{
+		kexAlgorithms, hostKeyAlgorithms,
+		sshCiphers, sshCiphers,
+		sshMACs, sshMACs,
+		sshCompression, sshCompression,
+		nil, nil,
+	} {
+		msg = appendSSHString(msg, []byte(strings.Join(nameList, ",")))
+	}
+
+	msg = append(msg, 0)                        // first_kex_packet_follows
+	msg = binary.BigEndian.AppendUint32(msg, 0) // reserved
+
+	return msg
+}
+
+// Returns the kex and host key algorithm name-lists from a KEXINIT message
+func parseKexInit(msg []byte) ([]string, []string, error) {
+	if len(msg) < 17 {
+		return nil, nil, errors.New("malformed KEXINIT")
+	}
+
+	r := &sshReader{b: msg[17:]}
+	kexAlgorithms, hostKeyAlgorithms := r.readString(), r.readString()
+
+	if r.err != nil {
+		return nil, nil, fmt.Errorf("malformed KEXINIT: %v", r.err)
+	}
+
+	return strings.Split(string(kexAlgorithms), ","), strings.Split(string(hostKeyAlgorithms), ","), nil
+}
+
+// The client's most preferred algorithm that the server also supports wins
+func sshNegotiate(client, server []string) (string, bool) {
+	for _, c := range client {
+		if sshContains(server, c) {
+			return c, true
+		}
+	}
+
+	return "", false
+}
+
+func sshContains(list []string, item string) bool {
+	for _, v := range list {
+		if v == item {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Both supported kex methods use SHA-256 for the exchange hash
+func sshExchangeHash(clientVersion, serverVersion, clientKexInit, serverKexInit, hostKey, clientPub, serverPub, secret []byte) []byte {
+	var buf []byte
+
+	for _, v := range [][]byte{clientVersion, serverVersion, clientKexInit, serverKexInit, hostKey, clientPub, serverPub} {
+		buf = appendSSHString(buf, v)
+	}
+
+	buf = appendSSHMpint(buf, secret)
+
+	sum := sha256.Sum256(buf)
+	return sum[:]
+}
+
+// Verify the host key's signature over the exchange hash
+func verifySSHSignature(hostKeyAlgo string, hostKey, signature, data []byte) error {
+	sr := &sshReader{b: signature}
+	sigFormat, sigBlob := string(sr.readString()), sr.readString()
+
+	if sr.err != nil {
+		return fmt.Errorf("malformed signature: %v", sr.err)
+	}
+
+	if sigFormat != hostKeyAlgo {
+		return fmt.Errorf("signature format '%v' does not match negotiated host key algorithm '%v'", sigFormat, hostKeyAlgo)
+	}
+
+	kr := &sshReader{b: hostKey}
+	keyType := string(kr.readString())
+
+	switch {
+	case keyType == "ssh-ed25519" && hostKeyAlgo == "ssh-ed25519":
+		pub := kr.readString()
+		if kr.err != nil || len(pub) != ed25519.PublicKeySize {
+			return errors.New("malformed ed25519 host key")
+		}
+
+		if !ed25519.Verify(ed25519.PublicKey(pub), data, sigBlob) {
+			return errors.New("invalid ed25519 signature")
+		}
+	case strings.HasPrefix(keyType, "ecdsa-sha2-") && keyType == hostKeyAlgo:
+		var curve elliptic.Curve
+		var h hash.Hash
+
+		switch keyType {
+		case "ecdsa-sha2-nistp256":
+			curve, h = elliptic.P256(), sha256.New()
+		case "ecdsa-sha2-nistp384":
+			curve, h = elliptic.P384(), sha512.New384()
+		case "ecdsa-sha2-nistp521":
+			curve, h = elliptic.P521(), sha512.New()
+		default:
+			return fmt.Errorf("unsupported ecdsa host key '%v'", keyType)
+		}
+
+		kr.readString() // curve identifier
+		point := kr.readString()
+
+		x, y := elliptic.Unmarshal(curve, point)
+		if kr.err != nil || x == nil {
+			return errors.New("malformed ecdsa host key")
+		}
+
+		br := &sshReader{b: sigBlob}
+		sigR, sigS := br.readMpint(), br.readMpint()
+		if br.err != nil {
+			return errors.New("malformed ecdsa signature")
+		}
+
+		h.Write(data)
+
+		if !ecdsa.Verify(&ecdsa.PublicKey{Curve: curve, X: x, Y: y}, h.Sum(nil), sigR, sigS) {
+			return errors.New("invalid ecdsa signature")
+		}
+	case keyType == "ssh-rsa" && sshContains([]string{"rsa-sha2-512", "rsa-sha2-256", "ssh-rsa"}, hostKeyAlgo):
+		e, n := kr.readMpint(), kr.readMpint()
+		if kr.err != nil || !e.IsInt64() {
+			return errors.New("malformed rsa host key")
+		}
+
+		hashFunc := map[string]crypto.Hash{
+			"rsa-sha2-512": crypto.SHA512,
+			"rsa-sha2-256": crypto.SHA256,
+			"ssh-rsa":      crypto.SHA1,
+		}[hostKeyAlgo]
+
+		var digest []byte
+		switch hashFunc {
+		case crypto.SHA512:
+			sum := sha512.Sum512(data)
+			digest = sum[:]
+		case crypto.SHA256:
+			sum := sha256.Sum256(data)
+			digest = sum[:]
+		default:
+			sum := sha1.Sum(data)
+			digest = sum[:]
+		}
+
+		if err := rsa.VerifyPKCS1v15(&rsa.PublicKey{N: n, E: int(e.Int64())}, hashFunc, digest, sigBlob); err != nil {
+			return fmt.Errorf("invalid rsa signature: %v", err)
+		}
+	default:
+		return fmt.Errorf("host key type '%v' does not match negotiated algorithm '%v'", keyType, hostKeyAlgo)
+	}
+
+	return nil
+}
+
+func appendSSHString(b, s []byte) []byte {
+	b = binary.BigEndian.AppendUint32(b, uint32(len(s)))
+	return append(b, s...)
+}
+
+// Append an unsigned big-endian integer in ssh 'mpint' encoding
+func appendSSHMpint(b, n []byte) []byte {
+	n = bytes.TrimLeft(n, "\x00")
+
+	if len(n) > 0 && n[0]&0x80 != 0 {
+		n = append([]byte{0}, n...)
+	}
+
+	return appendSSHString(b, n)
+}
+
+// Sequential reader for ssh wire encoded data; first error sticks
+type sshReader struct {
+	b   []byte
+	err error
+}
+
+func (r *sshReader) readUint32() uint32 {
+	if r.err != nil || len(r.b) < 4 {
+		r.err = errors.New("short read")
+		return 0
+	}
+
+	v := binary.BigEndian.Uint32(r.b)
+	r.b = r.b[4:]
+
+	return v
+}
+
+func (r *sshReader) readString() []byte {
+	length := r.readUint32()
+
+	if r.err != nil || uint32(len(r.b)) < length {
+		r.err = errors.New("short read")
+		return nil
+	}
+
+	v := r.b[:length]
+	r.b = r.b[length:]
+
+	return v
+}
+
+func (r *sshReader) readMpint() *big.Int {
+	return new(big.Int).SetBytes(r.readString())
+}
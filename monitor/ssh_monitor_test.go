@@ -0,0 +1,238 @@
+package monitor
+
+import (
+	"bufio"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/rand"
+	"net"
+	"strconv"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/9corp/9volt/util"
+)
+
+// Minimal ssh server that completes a curve25519/ed25519 key exchange
+func startFakeSSHServer(banner string, hostPriv ed25519.PrivateKey) net.Listener {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	Expect(err).To(BeNil())
+
+	hostKey := appendSSHString(appendSSHString(nil, []byte("ssh-ed25519")), hostPriv.Public().(ed25519.PublicKey))
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+
+			go func(conn net.Conn) {
+				defer conn.Close()
+
+				t := &sshTransport{conn: conn, r: bufio.NewReader(conn), serverVersion: []byte(banner)}
+				conn.Write([]byte("some pre-banner text\r\n" + banner + "\r\n"))
+
+				line, err := t.r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				t.clientVersion = []byte(line[:len(line)-2])
+
+				t.serverKexInit = marshalKexInit([]string{"curve25519-sha256"}, []string{"ssh-ed25519"})
+				t.writePacket(t.serverKexInit)
+
+				if t.clientKexInit, err = t.readPacket(); err != nil {
+					return
+				}
+
+				init, err := t.readPacket()
+				if err != nil {
+					return
+				}
+				clientPub := (&sshReader{b: init[1:]}).readString()
+
+				priv, _ := ecdh.X25519().GenerateKey(rand.Reader)
+				peer, _ := ecdh.X25519().NewPublicKey(clientPub)
+				secret, _ := priv.ECDH(peer)
+
+				h := sshExchangeHash(t.clientVersion, t.serverVersion, t.clientKexInit, t.serverKexInit,
+					hostKey, clientPub, priv.PublicKey().Bytes(), secret)
+				sig := appendSSHString(appendSSHString(nil, []byte("ssh-ed25519")), ed25519.Sign(hostPriv, h))
+
+				reply := appendSSHString([]byte{sshMsgKexECDHRply}, hostKey)
+				reply = appendSSHString(reply, priv.PublicKey().Bytes())
+				reply = appendSSHString(reply, sig)
+				t.writePacket(reply)
+
+				t.readPacket()
+			}(conn)
+		}
+	}()
+
+	return ln
+}
+
+var _ = Describe("ssh_monitor", func() {
+	var (
+		monitor *SSHMonitor
+		config  *RootMonitorConfig
+	)
+
+	BeforeEach(func() {
+		config = &RootMonitorConfig{
+			Config: &MonitorConfig{
+				Host:     "beowulf",
+				Interval: util.CustomDuration(5 * time.Second),
+			},
+			Log: log.New(),
+		}
+
+		monitor = NewSSHMonitor(config)
+	})
+
+	Context("NewSSHMonitor", func() {
+		It("returns a properly configured instance with defaults", func() {
+			Expect(monitor.Timeout).To(Equal(DEFAULT_SSH_TIMEOUT))
+			Expect(monitor.Port).To(Equal(DEFAULT_SSH_PORT))
+			Expect(monitor.HostKeyAlgorithms).To(Equal(sshHostKeyAlgorithms))
+			Expect(monitor.MonitorFunc).NotTo(BeNil())
+		})
+
+		It("pins host key algorithm if configured", func() {
+			config.Config.SSHHostKeyAlgorithm = "ssh-ed25519"
+			monitor = NewSSHMonitor(config)
+
+			Expect(monitor.HostKeyAlgorithms).To(Equal([]string{"ssh-ed25519"}))
+		})
+	})
+
+	Context("Validate", func() {
+		It("returns nil with correct settings", func() {
+			Expect(monitor.Validate()).To(BeNil())
+		})
+
+		It("errors with blank host", func() {
+			config.Config.Host = ""
+			err := monitor.Validate()
+
+			Expect(err).NotTo(BeNil())
+			Expect(err.Error()).To(ContainSubstring("'host' cannot be blank"))
+		})
+
+		It("errors with unsupported host key algorithm", func() {
+			config.Config.SSHHostKeyAlgorithm = "ssh-dss"
+			err := monitor.Validate()
+
+			Expect(err).NotTo(BeNil())
+			Expect(err.Error()).To(ContainSubstring("Unsupported 'ssh-host-key-algorithm'"))
+		})
+
+		It("errors with bad timeouts", func() {
+			config.Config.Interval = util.CustomDuration(time.Second)
+			err := monitor.Validate()
+
+			Expect(err).NotTo(BeNil())
+			Expect(err.Error()).To(ContainSubstring("cannot equal or exceed"))
+		})
+	})
+
+	Context("sshCheck", func() {
+		var (
+			ln       net.Listener
+			hostPriv ed25519.PrivateKey
+			hostKey  []byte
+		)
+
+		BeforeEach(func() {
+			hostPub, priv, _ := ed25519.GenerateKey(rand.Reader)
+			hostPriv = priv
+			hostKey = appendSSHString(appendSSHString(nil, []byte("ssh-ed25519")), hostPub)
+
+			ln = startFakeSSHServer("SSH-2.0-OpenSSH_7.4", hostPriv)
+
+			host, port, _ := net.SplitHostPort(ln.Addr().String())
+			config.Config.Host = host
+			config.Config.Port, _ = strconv.Atoi(port)
+			config.Config.Timeout = util.CustomDuration(time.Second)
+
+			monitor = NewSSHMonitor(config)
+		})
+
+		AfterEach(func() {
+			ln.Close()
+		})
+
+		It("succeeds when banner contains expected content", func() {
+			config.Config.Expect = "OpenSSH"
+			_, err := monitor.sshCheck()
+			Expect(err).To(BeNil())
+		})
+
+		It("fails when banner does not contain expected content", func() {
+			config.Config.Expect = "Dropbear"
+			_, err := monitor.sshCheck()
+
+			Expect(err).NotTo(BeNil())
+			Expect(err.Error()).To(ContainSubstring("does not contain expected substring"))
+		})
+
+		It("succeeds when host key fingerprint matches", func() {
+			config.Config.SSHFingerprint = sshFingerprint(hostKey)
+			_, err := monitor.sshCheck()
+			Expect(err).To(BeNil())
+		})
+
+		It("accepts fingerprints without the SHA256 prefix", func() {
+			config.Config.SSHFingerprint = sshFingerprint(hostKey)[len("SHA256:"):] + "="
+			_, err := monitor.sshCheck()
+			Expect(err).To(BeNil())
+		})
+
+		It("fails when host key fingerprint changed", func() {
+			config.Config.SSHFingerprint = "SHA256:nThbg6kXUpJWGl7E1IGOCspRomTxdCARLviKw6E5SY8"
+			_, err := monitor.sshCheck()
+
+			Expect(err).NotTo(BeNil())
+			Expect(err.Error()).To(ContainSubstring("fingerprint"))
+			Expect(err.Error()).To(ContainSubstring("has changed"))
+		})
+
+		It("fails when no common host key algorithm exists", func() {
+			config.Config.SSHHostKeyAlgorithm = "ssh-rsa"
+			config.Config.SSHKeyExchange = true
+			monitor = NewSSHMonitor(config)
+
+			_, err := monitor.sshCheck()
+
+			Expect(err).NotTo(BeNil())
+			Expect(err.Error()).To(ContainSubstring("no common host key algorithm"))
+		})
+
+		It("fails when nothing is listening", func() {
+			ln.Close()
+			_, err := monitor.sshCheck()
+
+			Expect(err).NotTo(BeNil())
+			Expect(err.Error()).To(ContainSubstring("Unable to open connection"))
+		})
+	})
+
+	Context("verifySSHSignature", func() {
+		It("rejects signatures made by another key", func() {
+			hostPub, _, _ := ed25519.GenerateKey(rand.Reader)
+			_, otherPriv, _ := ed25519.GenerateKey(rand.Reader)
+
+			hostKey := appendSSHString(appendSSHString(nil, []byte("ssh-ed25519")), hostPub)
+			sig := appendSSHString(appendSSHString(nil, []byte("ssh-ed25519")), ed25519.Sign(otherPriv, []byte("data")))
+
+			err := verifySSHSignature("ssh-ed25519", hostKey, sig, []byte("data"))
+
+			Expect(err).NotTo(BeNil())
+			Expect(err.Error()).To(ContainSubstring("invalid ed25519 signature"))
+		})
+	})
+})
@@ -1,12 +1,16 @@
 package monitor
 
 import (
+	"crypto/tls"
 	"fmt"
+	"io"
 	"net"
-	"strings"
+	"strconv"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
+
+	"github.com/9corp/9volt/util"
 )
 
 const (
@@ -18,11 +22,11 @@ const (
 
 type TCPMonitor struct {
 	Base
+	SocketSettings
 
-	ReadTimeout  time.Duration
-	WriteTimeout time.Duration
-	ConnTimeout  time.Duration
-	ReadSize     int
+	Payload   []byte
+	Matcher   *PayloadMatcher
+	TLSConfig *tls.Config
 }
 
 func NewTCPMonitor(rmc *RootMonitorConfig) *TCPMonitor {
@@ -35,7 +39,14 @@ func NewTCPMonitor(rmc *RootMonitorConfig) *TCPMonitor {
 
 	t.MonitorFunc = t.tcpCheck
 
-	t.updateSettings()
+	t.updateSettings(rmc.Config)
+
+	// An unset 'timeout' has always meant no connect timeout for tcp checks
+	// (only the read/write timeouts count against 'interval'); kept so that
+	// existing configs keep validating
+	if rmc.Config.Timeout == util.CustomDuration(0) {
+		t.ConnTimeout = 0
+	}
 
 	return t
 }
@@ -43,109 +54,140 @@ func NewTCPMonitor(rmc *RootMonitorConfig) *TCPMonitor {
 func (t *TCPMonitor) Validate() error {
 	t.RMC.Log.WithField("configName", t.RMC.ConfigName).Debug("Performing monitor config validation")
 
-	if t.ConnTimeout >= time.Duration(t.RMC.Config.Interval) {
-		return fmt.Errorf("'timeout' (%v) cannot equal or exceed 'interval' (%v)", t.ConnTimeout.String(), t.RMC.Config.Interval.String())
-	}
-
-	if t.ReadTimeout.String() != "0s" {
-		if t.ReadTimeout >= time.Duration(t.RMC.Config.Interval) {
-			return fmt.Errorf("'read-timeout' (%v) cannot equal or exceed 'interval' (%v)", t.ReadTimeout.String(), t.RMC.Config.Interval.String())
-		}
-	}
-
-	if t.WriteTimeout.String() != "0s" {
-		if t.WriteTimeout >= time.Duration(t.RMC.Config.Interval) {
-			return fmt.Errorf("'write-timeout' (%v) cannot equal or exceed 'interval' (%v)", t.WriteTimeout.String(), t.RMC.Config.Interval.String())
-		}
+	payload, err := decodePayload(t.RMC.Config.TCPSend, t.RMC.Config.SendEncoding)
+	if err != nil {
+		return fmt.Errorf("Invalid 'send': %v", err.Error())
 	}
 
-	// Check that the combination of timeouts does not exceed interval
-	totalTimeoutTime := t.ConnTimeout + t.ReadTimeout + t.WriteTimeout
+	t.Payload = payload
 
-	if totalTimeoutTime >= time.Duration(t.RMC.Config.Interval) {
-		return fmt.Errorf("Total timeout duration (%v) cannot equal or exceed 'interval' (%v)", totalTimeoutTime.String(), t.RMC.Config.Interval.String())
+	matcher, err := newPayloadMatcher(t.RMC.Config)
+	if err != nil {
+		return err
 	}
 
-	return nil
-}
-
-// Update timeout and read size related settings
-func (t *TCPMonitor) updateSettings() {
-	t.ConnTimeout = DEFAULT_CONN_TIMEOUT
-	t.ReadTimeout = DEFAULT_READ_TIMEOUT
-	t.WriteTimeout = DEFAULT_WRITE_TIMEOUT
-	t.ReadSize = DEFAULT_READ_SIZE
+	t.Matcher = matcher
 
-	if t.RMC.Config.Timeout.String() != "" {
-		t.ConnTimeout = time.Duration(t.RMC.Config.Timeout)
-	}
+	if t.RMC.Config.TCPTLS {
+		tlsConfig, err := newTLSClientConfig(t.RMC.Config)
+		if err != nil {
+			return err
+		}
 
-	if t.RMC.Config.TCPReadTimeout.String() != "0s" {
-		t.ReadTimeout = time.Duration(t.RMC.Config.TCPReadTimeout)
-	}
+		if tlsConfig.ServerName == "" {
+			tlsConfig.ServerName = t.RMC.Config.Host
+		}
 
-	if t.RMC.Config.TCPWriteTimeout.String() != "0s" {
-		t.WriteTimeout = time.Duration(t.RMC.Config.TCPWriteTimeout)
+		t.TLSConfig = tlsConfig
 	}
 
-	if t.RMC.Config.TCPReadSize != 0 {
-		t.ReadSize = t.RMC.Config.TCPReadSize
-	}
+	return t.validateTimeouts(t.RMC.Config.Interval)
 }
 
 // Perform a TCP connection to host:port using an optional connection timeout,
-// read timeout, read size and/or expected output. If `Send` is set, first send
-// data in `Send` on the opened connection.
-func (t *TCPMonitor) tcpCheck() error {
-	fullAddress := fmt.Sprintf("%v:%v", t.RMC.Config.Host, t.RMC.Config.Port)
+// read timeout, read size and/or expected output. If `tls` is set, perform a
+// TLS handshake right after connecting. If `Send` is set, first send data in
+// `Send` on the opened connection.
+func (t *TCPMonitor) tcpCheck() (*CheckResult, error) {
+	fullAddress := net.JoinHostPort(t.RMC.Config.Host, strconv.Itoa(t.RMC.Config.Port))
 
 	t.RMC.Log.WithField("address", fullAddress).Debug("Performing tcp check")
 
 	// Open the connection
-	conn, err := net.DialTimeout("tcp", fullAddress, t.ConnTimeout)
+	conn, err := t.dial(fullAddress)
 	if err != nil {
-		return fmt.Errorf("Unable to open connection to %v: %v", fullAddress, err.Error())
+		return nil, err
 	}
 
+	defer conn.Close()
+
 	// If set, send data first
-	if t.RMC.Config.TCPSend != "" {
+	if len(t.Payload) != 0 {
 		if err := conn.SetWriteDeadline(time.Now().Add(t.WriteTimeout)); err != nil {
-			return fmt.Errorf("Unable to set write timeout (%v): %v", t.WriteTimeout, err.Error())
+			return nil, fmt.Errorf("Unable to set write timeout (%v): %v", t.WriteTimeout, err.Error())
 		}
 
-		if _, err := conn.Write([]byte(t.RMC.Config.TCPSend)); err != nil {
-			return fmt.Errorf("Unable to send initial TCP data (%v): %v", t.RMC.Config.TCPSend, err.Error())
+		if _, err := conn.Write(t.Payload); err != nil {
+			return nil, fmt.Errorf("Unable to send initial TCP data (%v): %v", t.RMC.Config.TCPSend, err.Error())
 		}
 	}
 
 	// No expect set, we're done
-	if t.RMC.Config.Expect == "" {
-		return nil
+	if t.Matcher == nil {
+		return nil, nil
 	}
 
 	// Set read deadline
 	if err := conn.SetReadDeadline(time.Now().Add(t.ReadTimeout)); err != nil {
-		return fmt.Errorf("Unable to set read timeout (%v): %v", t.ReadTimeout, err.Error())
+		return nil, fmt.Errorf("Unable to set read timeout (%v): %v", t.ReadTimeout, err.Error())
 	}
 
-	// Read the actual data
+	// Responses may arrive in multiple segments; keep reading until we see
+	// what we expect, hit 'read-size' or run out of time
+	received := make([]byte, 0, t.ReadSize)
 	recvBuf := make([]byte, t.ReadSize)
 
-	if n, err := conn.Read(recvBuf); err != nil {
+	for {
+		n, err := conn.Read(recvBuf[:t.ReadSize-len(received)])
+		received = append(received, recvBuf[:n]...)
+
 		log.Debugf("%v-%v: Read %v bytes from %v", t.Identifier, t.RMC.GID, n, fullAddress)
 
-		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
-			return fmt.Errorf("Read timeout (after %v): %v", t.ReadTimeout, err.Error())
-		} else {
-			return fmt.Errorf("Unrecognized read error: %v", err.Error())
+		if t.Matcher.Match(received) {
+			return nil, nil
+		}
+
+		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				return nil, fmt.Errorf("Read timeout (after %v) before receiving expected data (Recv: [%q] Expected: [%v])",
+					t.ReadTimeout, received, t.Matcher)
+			}
+
+			if err == io.EOF {
+				return nil, fmt.Errorf("Connection closed before receiving expected data (Recv: [%q] Expected: [%v])",
+					received, t.Matcher)
+			}
+
+			return nil, fmt.Errorf("Unrecognized read error: %v", err.Error())
+		}
+
+		if len(received) >= t.ReadSize {
+			return nil, fmt.Errorf("Received data does not contain expected data within %v bytes (Recv: [%q] Expected: [%v])",
+				t.ReadSize, received, t.Matcher)
+		}
+	}
+}
+
+// Open a plain or TLS connection; the TLS handshake counts towards 'timeout'
+func (t *TCPMonitor) dial(fullAddress string) (net.Conn, error) {
+	conn, err := net.DialTimeout("tcp", fullAddress, t.ConnTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to open connection to %v: %v", fullAddress, err.Error())
+	}
+
+	if t.TLSConfig == nil {
+		return conn, nil
+	}
+
+	if t.ConnTimeout != 0 {
+		if err := conn.SetDeadline(time.Now().Add(t.ConnTimeout)); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("Unable to set handshake timeout (%v): %v", t.ConnTimeout, err.Error())
 		}
 	}
 
-	// Optionally, verify our received data contains our expected string
-	if !strings.Contains(string(recvBuf), t.RMC.Config.Expect) {
-		return fmt.Errorf("Received data does not contain expected substring (Recv: [%v] Expected: [%v]",
-			string(recvBuf), t.RMC.Config.Expect)
+	tlsConn := tls.Client(conn, t.TLSConfig)
+
+	if err := tlsConn.Handshake(); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("TLS handshake with %v failed: %v", fullAddress, err.Error())
+	}
+
+	// Clear the handshake deadline; read/write deadlines are set separately
+	if err := conn.SetDeadline(time.Time{}); err != nil {
+		tlsConn.Close()
+		return nil, fmt.Errorf("Unable to clear handshake timeout: %v", err.Error())
 	}
 
-	return nil
+	return tlsConn, nil
 }
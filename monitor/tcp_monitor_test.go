@@ -0,0 +1,228 @@
+package monitor
+
+import (
+	"crypto/tls"
+	"net"
+	"os"
+	"strconv"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/9corp/9volt/util"
+)
+
+var _ = Describe("tcp_monitor", func() {
+	var (
+		monitor *TCPMonitor
+		config  *RootMonitorConfig
+		ln      net.Listener
+		caFile  string
+	)
+
+	// Answer every connection by writing 'responses' one segment at a time
+	startServer := func(useTLS bool, responses ...[]byte) {
+		var err error
+
+		ln, err = net.Listen("tcp", "127.0.0.1:0")
+		Expect(err).To(BeNil())
+
+		if useTLS {
+			caCert, leaf := generateTestCerts([]string{"beowulf"}, time.Now().Add(24*time.Hour))
+			caFile = writeTestCAFile(caCert)
+			ln = tls.NewListener(ln, &tls.Config{Certificates: []tls.Certificate{leaf}})
+		}
+
+		go func() {
+			for {
+				conn, err := ln.Accept()
+				if err != nil {
+					return
+				}
+
+				go func(conn net.Conn) {
+					defer conn.Close()
+
+					buf := make([]byte, 64)
+					conn.Read(buf)
+
+					for _, response := range responses {
+						conn.Write(response)
+						time.Sleep(20 * time.Millisecond)
+					}
+				}(conn)
+			}
+		}()
+
+		_, port, _ := net.SplitHostPort(ln.Addr().String())
+		config.Config.Port, _ = strconv.Atoi(port)
+		monitor = NewTCPMonitor(config)
+	}
+
+	BeforeEach(func() {
+		caFile = ""
+
+		config = &RootMonitorConfig{
+			Config: &MonitorConfig{
+				Host:           "127.0.0.1",
+				TCPSend:        "HELLO\n",
+				Interval:       util.CustomDuration(10 * time.Second),
+				Timeout:        util.CustomDuration(time.Second),
+				TCPReadTimeout: util.CustomDuration(500 * time.Millisecond),
+			},
+			Log: log.New(),
+		}
+
+		monitor = NewTCPMonitor(config)
+	})
+
+	AfterEach(func() {
+		if ln != nil {
+			ln.Close()
+			ln = nil
+		}
+
+		if caFile != "" {
+			os.Remove(caFile)
+		}
+	})
+
+	Context("Validate", func() {
+		It("returns nil with correct settings", func() {
+			Expect(monitor.Validate()).To(BeNil())
+			Expect(monitor.Payload).To(Equal([]byte("HELLO\n")))
+			Expect(monitor.Matcher).To(BeNil())
+			Expect(monitor.TLSConfig).To(BeNil())
+		})
+
+		It("does not apply a connect timeout when 'timeout' is unset", func() {
+			// Pre-existing configs relying on this must keep validating
+			config.Config.Timeout = util.CustomDuration(0)
+			config.Config.TCPReadTimeout = util.CustomDuration(0)
+			config.Config.Interval = util.CustomDuration(5 * time.Second)
+			monitor = NewTCPMonitor(config)
+
+			Expect(monitor.ConnTimeout).To(Equal(time.Duration(0)))
+			Expect(monitor.ReadTimeout).To(Equal(DEFAULT_READ_TIMEOUT))
+			Expect(monitor.Validate()).To(BeNil())
+		})
+
+		It("defaults the TLS server name to the host", func() {
+			config.Config.TCPTLS = true
+			config.Config.Host = "beowulf"
+
+			Expect(monitor.Validate()).To(BeNil())
+			Expect(monitor.TLSConfig.ServerName).To(Equal("beowulf"))
+		})
+
+		It("rejects bad payloads and expectations", func() {
+			config.Config.SendEncoding = "base64"
+			config.Config.TCPSend = "not base64!"
+			Expect(monitor.Validate().Error()).To(ContainSubstring("Invalid 'send'"))
+
+			config.Config.SendEncoding = ""
+			config.Config.Expect = "zz"
+			config.Config.ExpectEncoding = "hex"
+			Expect(monitor.Validate().Error()).To(ContainSubstring("Invalid 'expect'"))
+
+			config.Config.ExpectRegex = true
+			Expect(monitor.Validate().Error()).To(ContainSubstring("cannot be combined"))
+
+			config.Config.ExpectEncoding = ""
+			config.Config.Expect = "["
+			Expect(monitor.Validate().Error()).To(ContainSubstring("Unable to compile"))
+		})
+	})
+
+	Context("tcpCheck", func() {
+		It("keeps reading until the expectation matches", func() {
+			config.Config.Expect = "OK ready"
+			startServer(false, []byte("* OK "), []byte("ready\r\n"))
+
+			Expect(monitor.Validate()).To(BeNil())
+			_, err := monitor.tcpCheck()
+			Expect(err).To(BeNil())
+		})
+
+		It("supports regex expectations", func() {
+			config.Config.Expect = `^\* OK \[CAPABILITY [A-Za-z0-9 ]+\]`
+			config.Config.ExpectRegex = true
+			startServer(false, []byte("* OK [CAPABILITY IMAP4rev1 STARTTLS] ready\r\n"))
+
+			Expect(monitor.Validate()).To(BeNil())
+			_, err := monitor.tcpCheck()
+			Expect(err).To(BeNil())
+		})
+
+		It("supports binary payloads", func() {
+			config.Config.TCPSend = "AAECAw=="
+			config.Config.SendEncoding = "base64"
+			config.Config.Expect = "0a0b"
+			config.Config.ExpectEncoding = "hex"
+			startServer(false, []byte{0x00, 0x0a}, []byte{0x0b, 0xff})
+
+			Expect(monitor.Validate()).To(BeNil())
+			Expect(monitor.Payload).To(Equal([]byte{0, 1, 2, 3}))
+			_, err := monitor.tcpCheck()
+			Expect(err).To(BeNil())
+		})
+
+		It("fails when the connection closes before a match", func() {
+			config.Config.Expect = "never"
+			startServer(false, []byte("goodbye"))
+
+			Expect(monitor.Validate()).To(BeNil())
+
+			_, err := monitor.tcpCheck()
+			Expect(err).NotTo(BeNil())
+			Expect(err.Error()).To(ContainSubstring("Connection closed"))
+			Expect(err.Error()).To(ContainSubstring("goodbye"))
+		})
+
+		It("stops reading at 'read-size'", func() {
+			config.Config.Expect = "never"
+			config.Config.TCPReadSize = 4
+			startServer(false, []byte("lots of data"))
+
+			Expect(monitor.Validate()).To(BeNil())
+
+			_, err := monitor.tcpCheck()
+			Expect(err).NotTo(BeNil())
+			Expect(err.Error()).To(ContainSubstring("within 4 bytes"))
+		})
+
+		Context("with tls", func() {
+			BeforeEach(func() {
+				config.Config.TCPTLS = true
+				config.Config.TLSServerName = "beowulf"
+				config.Config.Expect = "secure hello"
+			})
+
+			It("performs a TLS handshake before sending", func() {
+				startServer(true, []byte("secure hello"))
+				config.Config.TLSCAFile = caFile
+
+				Expect(monitor.Validate()).To(BeNil())
+				_, err := monitor.tcpCheck()
+				Expect(err).To(BeNil())
+			})
+
+			It("verifies the server certificate", func() {
+				startServer(true, []byte("secure hello"))
+
+				Expect(monitor.Validate()).To(BeNil())
+
+				_, err := monitor.tcpCheck()
+				Expect(err).NotTo(BeNil())
+				Expect(err.Error()).To(ContainSubstring("TLS handshake"))
+
+				config.Config.TLSInsecureSkipVerify = true
+				Expect(monitor.Validate()).To(BeNil())
+				_, err = monitor.tcpCheck()
+				Expect(err).To(BeNil())
+			})
+		})
+	})
+})
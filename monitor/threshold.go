@@ -0,0 +1,119 @@
+package monitor
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/9corp/9volt/state"
+	"github.com/9corp/9volt/util"
+)
+
+const (
+	COMPARISON_ABOVE = "above"
+	COMPARISON_BELOW = "below"
+)
+
+var (
+	thresholdComparisons = []string{COMPARISON_ABOVE, COMPARISON_BELOW}
+)
+
+// Verify the comparison and that optional (nil == disabled) warning and
+// critical thresholds are ordered properly for it; 'prefix' is prepended to the
+// config keys ('<prefix>warning', ...) in errors
+func validateThresholds(prefix string, warning, critical *float64, comparison string) error {
+	if comparison != "" && !util.StringSliceContains(thresholdComparisons, comparison) {
+		return fmt.Errorf("Unknown '%vcomparison' '%v' (supported: %v)",
+			prefix, comparison, strings.Join(thresholdComparisons, ", "))
+	}
+
+	if warning == nil || critical == nil {
+		return nil
+	}
+
+	if comparison != COMPARISON_BELOW && *warning > *critical {
+		return fmt.Errorf("'%vwarning' (%v) cannot exceed '%vcritical' (%v)", prefix, *warning, prefix, *critical)
+	}
+
+	if comparison == COMPARISON_BELOW && *warning < *critical {
+		return fmt.Errorf("'%vwarning' (%v) cannot be lower than '%vcritical' (%v) when comparing 'below'",
+			prefix, *warning, prefix, *critical)
+	}
+
+	return nil
+}
+
+// Determine whether 'value' is past an (optional) threshold; values above the
+// threshold cross it unless 'comparison' is 'below'
+func crossesThreshold(value float64, threshold *float64, comparison string) bool {
+	if threshold == nil {
+		return false
+	}
+
+	if comparison == COMPARISON_BELOW {
+		return value < *threshold
+	}
+
+	return value > *threshold
+}
+
+// Construct a metric (for the state message) including its optional thresholds
+func thresholdMetric(name string, value float64, unit string, warning, critical *float64) *state.Metric {
+	metric := &state.Metric{
+		Name:  name,
+		Value: value,
+		Unit:  unit,
+	}
+
+	if warning != nil {
+		metric.Warning = strconv.FormatFloat(*warning, 'g', -1, 64)
+	}
+
+	if critical != nil {
+		metric.Critical = strconv.FormatFloat(*critical, 'g', -1, 64)
+	}
+
+	return metric
+}
+
+// Compare 'value' against (optional) thresholds. Crossing 'critical' is a
+// regular check failure; crossing only 'warning' counts towards the attempt
+// thresholds as well, but never leads past WARNING.
+func checkThresholds(description string, value float64, unit string, warning, critical *float64, comparison string) error {
+	if comparison == "" {
+		comparison = COMPARISON_ABOVE
+	}
+
+	if crossesThreshold(value, critical, comparison) {
+		return fmt.Errorf("%v (%v%v) is %v critical threshold (%v%v)", description, value, unit, comparison, *critical, unit)
+	}
+
+	if crossesThreshold(value, warning, comparison) {
+		return NewCappedWarningError("%v (%v%v) is %v warning threshold (%v%v)", description, value, unit, comparison, *warning, unit)
+	}
+
+	return nil
+}
+
+// Return the most severe of several threshold check results (nil if all
+// passed); warnings only win if nothing else failed
+func mostSevere(errs ...error) error {
+	var worst error
+
+	isWarning := func(err error) bool {
+		stateErr, ok := err.(*StateError)
+		return ok && stateErr.State == WARNING
+	}
+
+	for _, err := range errs {
+		if err == nil {
+			continue
+		}
+
+		if worst == nil || (isWarning(worst) && !isWarning(err)) {
+			worst = err
+		}
+	}
+
+	return worst
+}
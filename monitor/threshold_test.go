@@ -0,0 +1,46 @@
+package monitor
+
+import (
+	"errors"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("threshold", func() {
+	float := func(f float64) *float64 {
+		return &f
+	}
+
+	Context("checkThresholds", func() {
+		It("fails when crossing the critical threshold and caps at warning otherwise", func() {
+			Expect(checkThresholds("Disk usage", 75, "%", float(80), float(90), "")).To(BeNil())
+
+			err := checkThresholds("Disk usage", 85, "%", float(80), float(90), "")
+			Expect(err.(*StateError).State).To(Equal(WARNING))
+			Expect(err.(*StateError).Capped).To(BeTrue())
+			Expect(err.Error()).To(Equal("Disk usage (85%) is above warning threshold (80%)"))
+
+			err = checkThresholds("Available memory", 4, "%", float(10), float(5), COMPARISON_BELOW)
+			Expect(err).NotTo(BeAssignableToTypeOf(&StateError{}))
+			Expect(err.Error()).To(Equal("Available memory (4%) is below critical threshold (5%)"))
+		})
+
+		It("treats 0 as a threshold and nil as disabled", func() {
+			Expect(checkThresholds("Queue depth", 1, "", float(0), nil, "")).NotTo(BeNil())
+			Expect(checkThresholds("Queue depth", 1, "", nil, nil, "")).To(BeNil())
+		})
+	})
+
+	Context("mostSevere", func() {
+		It("prefers failures over warnings", func() {
+			Expect(mostSevere(nil, nil)).To(BeNil())
+
+			err := mostSevere(nil, NewCappedWarningError("warning"), errors.New("critical"), NewCappedWarningError("other warning"))
+			Expect(err.Error()).To(Equal("critical"))
+
+			err = mostSevere(NewCappedWarningError("warning"), NewCappedWarningError("other warning"))
+			Expect(err.Error()).To(Equal("warning"))
+		})
+	})
+})
@@ -0,0 +1,475 @@
+package monitor
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/9corp/9volt/util"
+)
+
+const (
+	DEFAULT_TLS_TIMEOUT       = time.Duration(3) * time.Second
+	DEFAULT_TLS_PORT          = 443
+	DEFAULT_TLS_WARNING_DAYS  = 30
+	DEFAULT_TLS_CRITICAL_DAYS = 7
+	DEFAULT_TLS_MIN_VERSION   = "1.2"
+
+	postgresSSLRequestCode = 80877103
+)
+
+var (
+	tlsVersions = map[string]uint16{
+		"1.0": tls.VersionTLS10,
+		"1.1": tls.VersionTLS11,
+		"1.2": tls.VersionTLS12,
+		"1.3": tls.VersionTLS13,
+	}
+
+	weakSignatureAlgorithms = map[x509.SignatureAlgorithm]bool{
+		x509.MD2WithRSA:    true,
+		x509.MD5WithRSA:    true,
+		x509.SHA1WithRSA:   true,
+		x509.DSAWithSHA1:   true,
+		x509.ECDSAWithSHA1: true,
+	}
+
+	// STARTTLS negotiation per protocol; run on the plaintext connection
+	startTLSFuncs = map[string]func(net.Conn) error{
+		"smtp":     startTLSSMTP,
+		"imap":     startTLSIMAP,
+		"pop3":     startTLSPOP3,
+		"postgres": startTLSPostgres,
+		"ldap":     startTLSLDAP,
+	}
+)
+
+type TLSMonitor struct {
+	Base
+
+	Timeout      time.Duration
+	Port         int
+	ServerName   string
+	WarningDays  int
+	CriticalDays int
+	MinVersion   uint16
+}
+
+func NewTLSMonitor(rmc *RootMonitorConfig) *TLSMonitor {
+	t := &TLSMonitor{
+		Base: Base{
+			RMC:        rmc,
+			Identifier: "tls",
+		},
+		Timeout:      DEFAULT_TLS_TIMEOUT,
+		Port:         DEFAULT_TLS_PORT,
+		ServerName:   rmc.Config.Host,
+		WarningDays:  DEFAULT_TLS_WARNING_DAYS,
+		CriticalDays: DEFAULT_TLS_CRITICAL_DAYS,
+		MinVersion:   tlsVersions[DEFAULT_TLS_MIN_VERSION],
+	}
+
+	if rmc.Config.Timeout != util.CustomDuration(0) {
+		t.Timeout = time.Duration(rmc.Config.Timeout)
+	}
+
+	if rmc.Config.Port != 0 {
+		t.Port = rmc.Config.Port
+	}
+
+	if rmc.Config.TLSServerName != "" {
+		t.ServerName = rmc.Config.TLSServerName
+	}
+
+	if rmc.Config.TLSWarningDays != 0 {
+		t.WarningDays = rmc.Config.TLSWarningDays
+	}
+
+	if rmc.Config.TLSCriticalDays != 0 {
+		t.CriticalDays = rmc.Config.TLSCriticalDays
+	}
+
+	if version, ok := tlsVersions[rmc.Config.TLSMinVersion]; ok {
+		t.MinVersion = version
+	}
+
+	t.MonitorFunc = t.tlsCheck
+
+	return t
+}
+
+func (t *TLSMonitor) Validate() error {
+	t.RMC.Log.WithField("configName", t.RMC.ConfigName).Debug("Performing monitor config validation")
+
+	if t.RMC.Config.Host == "" {
+		return errors.New("'host' cannot be blank")
+	}
+
+	if t.WarningDays < t.CriticalDays {
+		return fmt.Errorf("'tls-warning-days' (%v) cannot be smaller than 'tls-critical-days' (%v)", t.WarningDays, t.CriticalDays)
+	}
+
+	if t.RMC.Config.TLSMinVersion != "" {
+		if _, ok := tlsVersions[t.RMC.Config.TLSMinVersion]; !ok {
+			return fmt.Errorf("Unknown 'tls-min-version' '%v' (supported: 1.0, 1.1, 1.2, 1.3)", t.RMC.Config.TLSMinVersion)
+		}
+	}
+
+	if t.RMC.Config.TLSStartTLS != "" {
+		if _, ok := startTLSFuncs[t.RMC.Config.TLSStartTLS]; !ok {
+			return fmt.Errorf("Unsupported 'tls-starttls' protocol '%v' (supported: smtp, imap, pop3, postgres, ldap)", t.RMC.Config.TLSStartTLS)
+		}
+	}
+
+	// The bundle itself is (re)loaded on every check
+	if t.RMC.Config.TLSCAFile != "" {
+		if _, err := loadCertPool(t.RMC.Config.TLSCAFile); err != nil {
+			return err
+		}
+	}
+
+	if t.Timeout >= time.Duration(t.RMC.Config.Interval) {
+		return fmt.Errorf("'timeout' (%v) cannot equal or exceed 'interval' (%v)", t.Timeout.String(), t.RMC.Config.Interval.String())
+	}
+
+	return nil
+}
+
+// Perform a TLS handshake (optionally after STARTTLS) and inspect the certificate
+// chain the server presents. Handshake, chain, hostname, signature and protocol
+// problems are regular check failures; only certificate expiry sets the state
+// directly (critical once expired or within 'tls-critical-days', warning within
+// 'tls-warning-days'). 'tls-insecure-skip-verify' skips chain verification only.
+func (t *TLSMonitor) tlsCheck() (*CheckResult, error) {
+	fullAddress := net.JoinHostPort(t.RMC.Config.Host, strconv.Itoa(t.Port))
+
+	t.RMC.Log.WithField("address", fullAddress).Debug("Performing tls check")
+
+	var roots *x509.CertPool // nil = system CA bundle
+
+	if t.RMC.Config.TLSCAFile != "" {
+		pool, err := loadCertPool(t.RMC.Config.TLSCAFile)
+		if err != nil {
+			return nil, err
+		}
+
+		roots = pool
+	}
+
+	conn, err := net.DialTimeout("tcp", fullAddress, t.Timeout)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to open connection to %v: %v", fullAddress, err.Error())
+	}
+	defer conn.Close()
+
+	if err := conn.SetDeadline(time.Now().Add(t.Timeout)); err != nil {
+		return nil, fmt.Errorf("Unable to set connection timeout (%v): %v", t.Timeout, err.Error())
+	}
+
+	if t.RMC.Config.TLSStartTLS != "" {
+		if err := startTLSFuncs[t.RMC.Config.TLSStartTLS](conn); err != nil {
+			return nil, fmt.Errorf("Unable to negotiate %v STARTTLS with %v: %v", t.RMC.Config.TLSStartTLS, fullAddress, err.Error())
+		}
+	}
+
+	// Verification is done by hand below so that we can tell exactly what is wrong
+	tlsConn := tls.Client(conn, &tls.Config{
+		ServerName:         t.ServerName,
+		InsecureSkipVerify: true,
+		MinVersion:         tls.VersionTLS10,
+	})
+
+	if err := tlsConn.Handshake(); err != nil {
+		return nil, fmt.Errorf("TLS handshake with %v failed: %v", fullAddress, err.Error())
+	}
+
+	return nil, t.inspect(tlsConn.ConnectionState(), roots, time.Now())
+}
+
+// Evaluate the negotiated connection state; split out for testing
+func (t *TLSMonitor) inspect(cs tls.ConnectionState, roots *x509.CertPool, now time.Time) error {
+	if len(cs.PeerCertificates) == 0 {
+		return errors.New("Server did not present any certificates")
+	}
+
+	if cs.Version < t.MinVersion {
+		return fmt.Errorf("Negotiated TLS version %v is older than minimum allowed version %v",
+			tlsVersionName(cs.Version), tlsVersionName(t.MinVersion))
+	}
+
+	// Checked ahead of chain verification, which rejects most weak signatures
+	// with a less helpful error. Self-signed roots are skipped (they are trusted
+	// by virtue of being in the pool).
+	for _, cert := range cs.PeerCertificates {
+		if weakSignatureAlgorithms[cert.SignatureAlgorithm] && !bytes.Equal(cert.RawSubject, cert.RawIssuer) {
+			return fmt.Errorf("Certificate '%v' uses weak signature algorithm %v", cert.Subject.CommonName, cert.SignatureAlgorithm)
+		}
+	}
+
+	leaf := cs.PeerCertificates[0]
+	daysLeft := int(leaf.NotAfter.Sub(now).Hours() / 24)
+
+	// Checked ahead of (and regardless of) chain verification, which would
+	// otherwise reject an expired leaf with a regular check failure
+	if daysLeft <= 0 {
+		return NewCriticalError("Certificate for '%v' expired or expires within a day (%v)", leaf.Subject.CommonName, leaf.NotAfter.UTC())
+	}
+
+	if !t.RMC.Config.TLSInsecureSkipVerify {
+		intermediates := x509.NewCertPool()
+		for _, cert := range cs.PeerCertificates[1:] {
+			intermediates.AddCert(cert)
+		}
+
+		if _, err := leaf.Verify(x509.VerifyOptions{
+			Roots:         roots,
+			Intermediates: intermediates,
+			CurrentTime:   now,
+		}); err != nil {
+			return fmt.Errorf("Certificate chain verification failed: %v", err.Error())
+		}
+	}
+
+	for _, name := range append([]string{t.ServerName}, t.RMC.Config.TLSExpectedNames...) {
+		if err := leaf.VerifyHostname(name); err != nil {
+			return fmt.Errorf("Certificate does not cover expected hostname: %v", err.Error())
+		}
+	}
+
+	if daysLeft < t.CriticalDays {
+		return NewCriticalError("Certificate for '%v' expires in %v day(s) (%v)", leaf.Subject.CommonName, daysLeft, leaf.NotAfter.UTC())
+	}
+
+	if daysLeft < t.WarningDays {
+		return NewWarningError("Certificate for '%v' expires in %v day(s) (%v)", leaf.Subject.CommonName, daysLeft, leaf.NotAfter.UTC())
+	}
+
+	return nil
+}
+
+func tlsVersionName(version uint16) string {
+	for name, v := range tlsVersions {
+		if v == version {
+			return name
+		}
+	}
+
+	return fmt.Sprintf("0x%04x", version)
+}
+
+// Load a PEM encoded CA bundle
+func loadCertPool(caFile string) (*x509.CertPool, error) {
+	data, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read CA bundle '%v': %v", caFile, err.Error())
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("No valid certificates found in CA bundle '%v'", caFile)
+	}
+
+	return pool, nil
+}
+
+// Build a client TLS config from the shared 'tls-*' settings
+func newTLSClientConfig(cfg *MonitorConfig) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		ServerName:         cfg.TLSServerName,
+		InsecureSkipVerify: cfg.TLSInsecureSkipVerify,
+	}
+
+	if cfg.TLSCAFile != "" {
+		pool, err := loadCertPool(cfg.TLSCAFile)
+		if err != nil {
+			return nil, err
+		}
+
+		tlsConfig.RootCAs = pool
+	}
+
+	if cfg.TLSClientCert != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.TLSClientCert, cfg.TLSClientKey)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to load client certificate '%v': %v", cfg.TLSClientCert, err.Error())
+		}
+
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
+
+// Connect to 'address' (performing a TLS handshake right away if 'tlsConfig' is
+// set); the whole conversation has to complete before 'deadline'
+func dialWithDeadline(address string, tlsConfig *tls.Config, deadline time.Time) (net.Conn, error) {
+	conn, err := net.DialTimeout("tcp", address, time.Until(deadline))
+	if err != nil {
+		return nil, fmt.Errorf("Unable to open connection to %v: %v", address, err.Error())
+	}
+
+	if err := conn.SetDeadline(deadline); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("Unable to set connection deadline: %v", err.Error())
+	}
+
+	if tlsConfig == nil {
+		return conn, nil
+	}
+
+	tlsConn := tls.Client(conn, tlsConfig)
+
+	if err := tlsConn.Handshake(); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("TLS handshake with %v failed: %v", address, err.Error())
+	}
+
+	return tlsConn, nil
+}
+
+// Read a (potentially multi-line) SMTP reply; returns the reply code and all lines
+func readSMTPReply(r *bufio.Reader) (int, []string, error) {
+	var lines []string
+
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return 0, nil, err
+		}
+
+		line = strings.TrimRight(line, "\r\n")
+		if len(line) < 3 {
+			return 0, nil, fmt.Errorf("malformed reply '%v'", line)
+		}
+
+		code, err := strconv.Atoi(line[:3])
+		if err != nil {
+			return 0, nil, fmt.Errorf("malformed reply '%v'", line)
+		}
+
+		lines = append(lines, strings.TrimSpace(line[3:]))
+
+		// '250-' means more lines follow, '250 ' is the last line
+		if len(line) == 3 || line[3] != '-' {
+			return code, lines, nil
+		}
+	}
+}
+
+func startTLSSMTP(conn net.Conn) error {
+	r := bufio.NewReader(conn)
+
+	if code, _, err := readSMTPReply(r); err != nil || code != 220 {
+		return fmt.Errorf("unexpected greeting (code: %v, err: %v)", code, err)
+	}
+
+	if _, err := io.WriteString(conn, "EHLO 9volt\r\n"); err != nil {
+		return err
+	}
+
+	code, extensions, err := readSMTPReply(r)
+	if err != nil || code != 250 {
+		return fmt.Errorf("EHLO rejected (code: %v, err: %v)", code, err)
+	}
+
+	supported := false
+	for _, ext := range extensions {
+		if strings.EqualFold(ext, "STARTTLS") {
+			supported = true
+		}
+	}
+
+	if !supported {
+		return errors.New("server does not advertise STARTTLS")
+	}
+
+	if _, err := io.WriteString(conn, "STARTTLS\r\n"); err != nil {
+		return err
+	}
+
+	if code, _, err := readSMTPReply(r); err != nil || code != 220 {
+		return fmt.Errorf("STARTTLS rejected (code: %v, err: %v)", code, err)
+	}
+
+	return nil
+}
+
+func startTLSIMAP(conn net.Conn) error {
+	r := bufio.NewReader(conn)
+
+	if line, err := r.ReadString('\n'); err != nil || !strings.HasPrefix(line, "* OK") {
+		return fmt.Errorf("unexpected greeting '%v' (err: %v)", strings.TrimSpace(line), err)
+	}
+
+	if _, err := io.WriteString(conn, "a001 STARTTLS\r\n"); err != nil {
+		return err
+	}
+
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return err
+		}
+
+		// Skip any untagged responses
+		if strings.HasPrefix(line, "* ") {
+			continue
+		}
+
+		if !strings.HasPrefix(line, "a001 OK") {
+			return fmt.Errorf("STARTTLS rejected: %v", strings.TrimSpace(line))
+		}
+
+		return nil
+	}
+}
+
+func startTLSPOP3(conn net.Conn) error {
+	r := bufio.NewReader(conn)
+
+	if line, err := r.ReadString('\n'); err != nil || !strings.HasPrefix(line, "+OK") {
+		return fmt.Errorf("unexpected greeting '%v' (err: %v)", strings.TrimSpace(line), err)
+	}
+
+	if _, err := io.WriteString(conn, "STLS\r\n"); err != nil {
+		return err
+	}
+
+	if line, err := r.ReadString('\n'); err != nil || !strings.HasPrefix(line, "+OK") {
+		return fmt.Errorf("STLS rejected: '%v' (err: %v)", strings.TrimSpace(line), err)
+	}
+
+	return nil
+}
+
+// Send an SSLRequest message; server answers with a single 'S' or 'N' byte
+func startTLSPostgres(conn net.Conn) error {
+	request := make([]byte, 8)
+	binary.BigEndian.PutUint32(request[0:4], 8)
+	binary.BigEndian.PutUint32(request[4:8], postgresSSLRequestCode)
+
+	if _, err := conn.Write(request); err != nil {
+		return err
+	}
+
+	response := make([]byte, 1)
+	if _, err := io.ReadFull(conn, response); err != nil {
+		return err
+	}
+
+	if response[0] != 'S' {
+		return errors.New("server does not support SSL")
+	}
+
+	return nil
+}
@@ -0,0 +1,330 @@
+package monitor
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"strconv"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/9corp/9volt/util"
+)
+
+// Generate a CA and a leaf certificate (for 'names') signed by it
+func generateTestCerts(names []string, notAfter time.Time) (*x509.Certificate, tls.Certificate) {
+	caKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "9volt test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(365 * 24 * time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	Expect(err).To(BeNil())
+
+	caCert, _ := x509.ParseCertificate(caDER)
+
+	leafKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	leafTemplate := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: names[0]},
+		DNSNames:     names,
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     notAfter,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+
+	leafDER, err := x509.CreateCertificate(rand.Reader, leafTemplate, caCert, &leafKey.PublicKey, caKey)
+	Expect(err).To(BeNil())
+
+	return caCert, tls.Certificate{Certificate: [][]byte{leafDER}, PrivateKey: leafKey}
+}
+
+func writeTestCAFile(caCert *x509.Certificate) string {
+	f, err := ioutil.TempFile("", "9volt-ca")
+	Expect(err).To(BeNil())
+	defer f.Close()
+
+	pem.Encode(f, &pem.Block{Type: "CERTIFICATE", Bytes: caCert.Raw})
+
+	return f.Name()
+}
+
+var _ = Describe("tls_monitor", func() {
+	var (
+		monitor *TLSMonitor
+		config  *RootMonitorConfig
+	)
+
+	BeforeEach(func() {
+		config = &RootMonitorConfig{
+			Config: &MonitorConfig{
+				Host:     "beowulf",
+				Interval: util.CustomDuration(5 * time.Second),
+			},
+			Log: log.New(),
+		}
+
+		monitor = NewTLSMonitor(config)
+	})
+
+	Context("NewTLSMonitor", func() {
+		It("returns a properly configured instance with defaults", func() {
+			Expect(monitor.Timeout).To(Equal(DEFAULT_TLS_TIMEOUT))
+			Expect(monitor.Port).To(Equal(DEFAULT_TLS_PORT))
+			Expect(monitor.ServerName).To(Equal("beowulf"))
+			Expect(monitor.WarningDays).To(Equal(DEFAULT_TLS_WARNING_DAYS))
+			Expect(monitor.CriticalDays).To(Equal(DEFAULT_TLS_CRITICAL_DAYS))
+			Expect(monitor.MinVersion).To(Equal(uint16(tls.VersionTLS12)))
+			Expect(monitor.MonitorFunc).NotTo(BeNil())
+		})
+
+		It("sources settings from the main config", func() {
+			config.Config.TLSServerName = "grendel"
+			config.Config.TLSMinVersion = "1.3"
+			config.Config.Port = 8443
+
+			monitor = NewTLSMonitor(config)
+
+			Expect(monitor.ServerName).To(Equal("grendel"))
+			Expect(monitor.MinVersion).To(Equal(uint16(tls.VersionTLS13)))
+			Expect(monitor.Port).To(Equal(8443))
+		})
+	})
+
+	Context("Validate", func() {
+		It("returns nil with correct settings", func() {
+			Expect(monitor.Validate()).To(BeNil())
+		})
+
+		It("errors when warning window is smaller than critical window", func() {
+			config.Config.TLSWarningDays = 1
+			monitor = NewTLSMonitor(config)
+			err := monitor.Validate()
+
+			Expect(err).NotTo(BeNil())
+			Expect(err.Error()).To(ContainSubstring("cannot be smaller than"))
+		})
+
+		It("errors with unknown starttls protocol", func() {
+			config.Config.TLSStartTLS = "gopher"
+			err := monitor.Validate()
+
+			Expect(err).NotTo(BeNil())
+			Expect(err.Error()).To(ContainSubstring("Unsupported 'tls-starttls'"))
+		})
+
+		It("errors with unknown min version", func() {
+			config.Config.TLSMinVersion = "2.0"
+			err := monitor.Validate()
+
+			Expect(err).NotTo(BeNil())
+			Expect(err.Error()).To(ContainSubstring("Unknown 'tls-min-version'"))
+		})
+
+		It("errors with unreadable CA bundle", func() {
+			config.Config.TLSCAFile = "/does/not/exist"
+			err := monitor.Validate()
+
+			Expect(err).NotTo(BeNil())
+			Expect(err.Error()).To(ContainSubstring("Unable to read CA bundle"))
+		})
+
+		It("errors with bad timeouts", func() {
+			config.Config.Interval = util.CustomDuration(time.Second)
+			err := monitor.Validate()
+
+			Expect(err).NotTo(BeNil())
+			Expect(err.Error()).To(ContainSubstring("cannot equal or exceed"))
+		})
+	})
+
+	Context("tlsCheck", func() {
+		var (
+			ln     net.Listener
+			caFile string
+			smtp   bool
+		)
+
+		startServer := func(notAfter time.Time) {
+			caCert, leaf := generateTestCerts([]string{"beowulf", "www.beowulf"}, notAfter)
+			caFile = writeTestCAFile(caCert)
+
+			var err error
+			ln, err = net.Listen("tcp", "127.0.0.1:0")
+			Expect(err).To(BeNil())
+
+			// The listener is passed in; 'ln' is reassigned by the next test
+			go func(ln net.Listener) {
+				for {
+					conn, err := ln.Accept()
+					if err != nil {
+						return
+					}
+
+					if smtp {
+						r := bufio.NewReader(conn)
+						conn.Write([]byte("220 mail.beowulf ESMTP\r\n"))
+						r.ReadString('\n')
+						conn.Write([]byte("250-mail.beowulf\r\n250-PIPELINING\r\n250 STARTTLS\r\n"))
+						r.ReadString('\n')
+						conn.Write([]byte("220 Go ahead\r\n"))
+					}
+
+					tlsConn := tls.Server(conn, &tls.Config{Certificates: []tls.Certificate{leaf}})
+					tlsConn.Handshake()
+					tlsConn.Close()
+				}
+			}(ln)
+
+			_, port, _ := net.SplitHostPort(ln.Addr().String())
+			config.Config.Host = "127.0.0.1"
+			config.Config.Port, _ = strconv.Atoi(port)
+			config.Config.TLSServerName = "beowulf"
+			config.Config.TLSCAFile = caFile
+
+			monitor = NewTLSMonitor(config)
+			Expect(monitor.Validate()).To(BeNil())
+		}
+
+		BeforeEach(func() {
+			smtp = false
+		})
+
+		AfterEach(func() {
+			ln.Close()
+			os.Remove(caFile)
+		})
+
+		It("succeeds with a valid certificate", func() {
+			startServer(time.Now().Add(90 * 24 * time.Hour))
+			_, err := monitor.tlsCheck()
+			Expect(err).To(BeNil())
+		})
+
+		It("succeeds after SMTP STARTTLS", func() {
+			smtp = true
+			startServer(time.Now().Add(90 * 24 * time.Hour))
+			config.Config.TLSStartTLS = "smtp"
+
+			_, err := monitor.tlsCheck()
+			Expect(err).To(BeNil())
+		})
+
+		It("returns a warning when certificate expires within warning window", func() {
+			startServer(time.Now().Add(10 * 24 * time.Hour))
+			_, err := monitor.tlsCheck()
+
+			Expect(err).NotTo(BeNil())
+			Expect(err.(*StateError).State).To(Equal(WARNING))
+			Expect(err.Error()).To(ContainSubstring("expires in 9 day(s)"))
+		})
+
+		It("returns a critical when certificate expires within critical window", func() {
+			startServer(time.Now().Add(3 * 24 * time.Hour))
+			_, err := monitor.tlsCheck()
+
+			Expect(err).NotTo(BeNil())
+			Expect(err.(*StateError).State).To(Equal(CRITICAL))
+		})
+
+		It("returns a critical when certificate has already expired", func() {
+			startServer(time.Now().Add(-24 * time.Hour))
+			_, err := monitor.tlsCheck()
+
+			Expect(err).NotTo(BeNil())
+			Expect(err.(*StateError).State).To(Equal(CRITICAL))
+			Expect(err.Error()).To(ContainSubstring("expired"))
+		})
+
+		It("skips chain verification with 'tls-insecure-skip-verify'", func() {
+			startServer(time.Now().Add(90 * 24 * time.Hour))
+
+			otherCA, _ := generateTestCerts([]string{"grendel"}, time.Now().Add(90*24*time.Hour))
+			otherCAFile := writeTestCAFile(otherCA)
+			defer os.Remove(otherCAFile)
+
+			config.Config.TLSCAFile = otherCAFile
+			config.Config.TLSInsecureSkipVerify = true
+
+			_, err := monitor.tlsCheck()
+			Expect(err).To(BeNil())
+		})
+
+		It("fails (leaving state to thresholds) when an expected name is not covered", func() {
+			startServer(time.Now().Add(90 * 24 * time.Hour))
+			config.Config.TLSExpectedNames = []string{"www.beowulf", "grendel"}
+
+			_, err := monitor.tlsCheck()
+
+			Expect(err).NotTo(BeNil())
+			Expect(err).NotTo(BeAssignableToTypeOf(&StateError{}))
+			Expect(err.Error()).To(ContainSubstring("grendel"))
+		})
+
+		It("fails (leaving state to thresholds) when chain does not verify", func() {
+			startServer(time.Now().Add(90 * 24 * time.Hour))
+
+			otherCA, _ := generateTestCerts([]string{"grendel"}, time.Now().Add(90*24*time.Hour))
+			otherCAFile := writeTestCAFile(otherCA)
+			defer os.Remove(otherCAFile)
+
+			config.Config.TLSCAFile = otherCAFile
+
+			_, err := monitor.tlsCheck()
+
+			Expect(err).NotTo(BeNil())
+			Expect(err).NotTo(BeAssignableToTypeOf(&StateError{}))
+			Expect(err.Error()).To(ContainSubstring("verification failed"))
+		})
+	})
+
+	Context("inspect", func() {
+		var cert *x509.Certificate
+
+		BeforeEach(func() {
+			_, leaf := generateTestCerts([]string{"beowulf"}, time.Now().Add(90*24*time.Hour))
+			cert, _ = x509.ParseCertificate(leaf.Certificate[0])
+		})
+
+		It("fails when an old protocol version was negotiated", func() {
+			err := monitor.inspect(tls.ConnectionState{
+				Version:          tls.VersionTLS10,
+				PeerCertificates: []*x509.Certificate{cert},
+			}, nil, time.Now())
+
+			Expect(err).NotTo(BeNil())
+			Expect(err.Error()).To(ContainSubstring("older than minimum allowed version 1.2"))
+		})
+
+		It("reports weak signatures ahead of chain verification", func() {
+			cert.SignatureAlgorithm = x509.SHA1WithRSA
+
+			err := monitor.inspect(tls.ConnectionState{
+				Version:          tls.VersionTLS12,
+				PeerCertificates: []*x509.Certificate{cert},
+			}, x509.NewCertPool(), time.Now())
+
+			Expect(err).NotTo(BeNil())
+			Expect(err.Error()).To(ContainSubstring("uses weak signature algorithm SHA1-RSA"))
+		})
+	})
+})
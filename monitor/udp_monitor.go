@@ -0,0 +1,147 @@
+package monitor
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+const (
+	// Without 'expect', only wait this long (at most) for a rejection
+	UDP_REJECT_WAIT = time.Duration(500) * time.Millisecond
+)
+
+type UDPMonitor struct {
+	Base
+	SocketSettings
+
+	Payload []byte
+	Matcher *PayloadMatcher
+}
+
+func NewUDPMonitor(rmc *RootMonitorConfig) *UDPMonitor {
+	u := &UDPMonitor{
+		Base: Base{
+			RMC:        rmc,
+			Identifier: "udp",
+		},
+	}
+
+	u.MonitorFunc = u.udpCheck
+
+	u.updateSettings(rmc.Config)
+
+	return u
+}
+
+func (u *UDPMonitor) Validate() error {
+	u.RMC.Log.WithField("configName", u.RMC.ConfigName).Debug("Performing monitor config validation")
+
+	if u.RMC.Config.Host == "" {
+		return errors.New("'host' must be set")
+	}
+
+	if u.RMC.Config.Port == 0 {
+		return errors.New("'port' must be set")
+	}
+
+	payload, err := decodePayload(u.RMC.Config.TCPSend, u.RMC.Config.SendEncoding)
+	if err != nil {
+		return fmt.Errorf("Invalid 'send': %v", err.Error())
+	}
+
+	u.Payload = payload
+
+	matcher, err := newPayloadMatcher(u.RMC.Config)
+	if err != nil {
+		return err
+	}
+
+	u.Matcher = matcher
+
+	return u.validateTimeouts(u.RMC.Config.Interval)
+}
+
+// Send the payload to host:port and wait up to 'read-timeout' for a datagram
+// that matches 'expect'. Without 'expect', the check only fails if the remote
+// end actively rejects the datagram (ie. ICMP port unreachable); as rejections
+// arrive within a round trip, the wait is limited to 'UDP_REJECT_WAIT'.
+func (u *UDPMonitor) udpCheck() (*CheckResult, error) {
+	fullAddress := net.JoinHostPort(u.RMC.Config.Host, strconv.Itoa(u.RMC.Config.Port))
+
+	u.RMC.Log.WithField("address", fullAddress).Debug("Performing udp check")
+
+	conn, err := net.DialTimeout("udp", fullAddress, u.ConnTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to open connection to %v: %v", fullAddress, err.Error())
+	}
+
+	defer conn.Close()
+
+	if err := conn.SetWriteDeadline(time.Now().Add(u.WriteTimeout)); err != nil {
+		return nil, fmt.Errorf("Unable to set write timeout (%v): %v", u.WriteTimeout, err.Error())
+	}
+
+	if _, err := conn.Write(u.Payload); err != nil {
+		return nil, fmt.Errorf("Unable to send UDP data to %v: %v", fullAddress, err.Error())
+	}
+
+	readTimeout := u.ReadTimeout
+	if u.Matcher == nil && readTimeout > UDP_REJECT_WAIT {
+		readTimeout = UDP_REJECT_WAIT
+	}
+
+	if err := conn.SetReadDeadline(time.Now().Add(readTimeout)); err != nil {
+		return nil, fmt.Errorf("Unable to set read timeout (%v): %v", readTimeout, err.Error())
+	}
+
+	recvBuf := make([]byte, u.ReadSize)
+
+	// Servers may send more than one datagram; keep reading until one matches
+	// or we run out of time
+	for {
+		n, err := conn.Read(recvBuf)
+		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				if u.Matcher == nil {
+					return nil, nil
+				}
+
+				return nil, fmt.Errorf("Read timeout (after %v) waiting for a response from %v", u.ReadTimeout, fullAddress)
+			}
+
+			if isConnRefused(err) {
+				return nil, fmt.Errorf("Port unreachable: %v rejected the datagram", fullAddress)
+			}
+
+			return nil, fmt.Errorf("Unrecognized read error: %v", err.Error())
+		}
+
+		u.RMC.Log.Debugf("%v-%v: Read %v bytes from %v", u.Identifier, u.RMC.GID, n, fullAddress)
+
+		if u.Matcher == nil || u.Matcher.Match(recvBuf[:n]) {
+			return nil, nil
+		}
+
+		u.RMC.Log.Debugf("%v-%v: Received non-matching datagram from %v: %q", u.Identifier, u.RMC.GID, fullAddress, recvBuf[:n])
+	}
+}
+
+// A previous datagram triggered an ICMP port unreachable
+func isConnRefused(err error) bool {
+	opErr, ok := err.(*net.OpError)
+	if !ok {
+		return false
+	}
+
+	sysErr, ok := opErr.Err.(*os.SyscallError)
+	if !ok {
+		return false
+	}
+
+	return sysErr.Err == syscall.ECONNREFUSED
+}
@@ -0,0 +1,179 @@
+package monitor
+
+import (
+	"bytes"
+	"net"
+	"strconv"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/9corp/9volt/util"
+)
+
+// Start a UDP server that answers 'ping' with a status datagram followed by 'pong'
+func startTestUDPServer() (net.PacketConn, int) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	Expect(err).To(BeNil())
+
+	go func() {
+		buf := make([]byte, 1024)
+
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+
+			if bytes.Equal(buf[:n], []byte{0xde, 0xad, 0xbe, 0xef}) {
+				pc.WriteTo([]byte{0xca, 0xfe, 0xba, 0xbe}, addr)
+				continue
+			}
+
+			if string(buf[:n]) == "ping" {
+				pc.WriteTo([]byte("status: ok"), addr)
+				pc.WriteTo([]byte("pong 42"), addr)
+			}
+		}
+	}()
+
+	return pc, pc.LocalAddr().(*net.UDPAddr).Port
+}
+
+var _ = Describe("udp_monitor", func() {
+	var (
+		monitor *UDPMonitor
+		config  *RootMonitorConfig
+		server  net.PacketConn
+		port    int
+	)
+
+	BeforeEach(func() {
+		server, port = startTestUDPServer()
+
+		config = &RootMonitorConfig{
+			Config: &MonitorConfig{
+				Host:           "127.0.0.1",
+				Port:           port,
+				TCPSend:        "ping",
+				Expect:         "pong",
+				Interval:       util.CustomDuration(10 * time.Second),
+				Timeout:        util.CustomDuration(time.Second),
+				TCPReadTimeout: util.CustomDuration(500 * time.Millisecond),
+			},
+			Log: log.New(),
+		}
+
+		monitor = NewUDPMonitor(config)
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	Context("Validate", func() {
+		It("returns nil with correct settings", func() {
+			Expect(monitor.Validate()).To(BeNil())
+			Expect(monitor.Payload).To(Equal([]byte("ping")))
+			Expect(monitor.Matcher).NotTo(BeNil())
+		})
+
+		It("uses the default timeouts when unset", func() {
+			config.Config.Timeout = util.CustomDuration(0)
+			config.Config.TCPReadTimeout = util.CustomDuration(0)
+			monitor = NewUDPMonitor(config)
+
+			Expect(monitor.ConnTimeout).To(Equal(DEFAULT_CONN_TIMEOUT))
+			Expect(monitor.ReadTimeout).To(Equal(DEFAULT_READ_TIMEOUT))
+			Expect(monitor.WriteTimeout).To(Equal(DEFAULT_WRITE_TIMEOUT))
+		})
+
+		It("requires a port", func() {
+			config.Config.Port = 0
+			Expect(monitor.Validate().Error()).To(ContainSubstring("'port' must be set"))
+		})
+
+		It("enforces the same timeout rules as the tcp monitor", func() {
+			config.Config.TCPReadTimeout = util.CustomDuration(10 * time.Second)
+			monitor = NewUDPMonitor(config)
+
+			Expect(monitor.Validate().Error()).To(ContainSubstring("'read-timeout'"))
+
+			config.Config.TCPReadTimeout = util.CustomDuration(5 * time.Second)
+			config.Config.TCPWriteTimeout = util.CustomDuration(5 * time.Second)
+			monitor = NewUDPMonitor(config)
+
+			Expect(monitor.Validate().Error()).To(ContainSubstring("Total timeout duration"))
+		})
+
+		It("rejects bad payloads", func() {
+			config.Config.SendEncoding = "hex"
+			Expect(monitor.Validate().Error()).To(ContainSubstring("Invalid 'send'"))
+		})
+	})
+
+	Context("udpCheck", func() {
+		It("matches a later datagram", func() {
+			Expect(monitor.Validate()).To(BeNil())
+			_, err := monitor.udpCheck()
+			Expect(err).To(BeNil())
+		})
+
+		It("supports regex expectations", func() {
+			config.Config.Expect = `pong \d+`
+			config.Config.ExpectRegex = true
+
+			Expect(monitor.Validate()).To(BeNil())
+			_, err := monitor.udpCheck()
+			Expect(err).To(BeNil())
+		})
+
+		It("supports hex payloads and expectations", func() {
+			config.Config.TCPSend = "de ad be ef"
+			config.Config.SendEncoding = "hex"
+			config.Config.Expect = "CAFEBABE"
+			config.Config.ExpectEncoding = "hex"
+
+			Expect(monitor.Validate()).To(BeNil())
+			_, err := monitor.udpCheck()
+			Expect(err).To(BeNil())
+		})
+
+		It("times out when nothing matches", func() {
+			config.Config.Expect = "nope"
+
+			Expect(monitor.Validate()).To(BeNil())
+
+			_, err := monitor.udpCheck()
+			Expect(err).NotTo(BeNil())
+			Expect(err.Error()).To(ContainSubstring("Read timeout"))
+		})
+
+		It("succeeds without 'expect' as long as the port is not unreachable", func() {
+			config.Config.Expect = ""
+			config.Config.TCPSend = "fire and forget"
+			config.Config.TCPReadTimeout = util.CustomDuration(5 * time.Second)
+			monitor = NewUDPMonitor(config)
+
+			Expect(monitor.Validate()).To(BeNil())
+
+			start := time.Now()
+			_, err := monitor.udpCheck()
+			Expect(err).To(BeNil())
+			Expect(time.Since(start)).To(BeNumerically("<", 2*UDP_REJECT_WAIT))
+		})
+
+		It("detects closed ports", func() {
+			server.Close()
+
+			config.Config.Expect = ""
+			Expect(monitor.Validate()).To(BeNil())
+
+			_, err := monitor.udpCheck()
+			Expect(err).NotTo(BeNil())
+			Expect(err.Error()).To(ContainSubstring("127.0.0.1:" + strconv.Itoa(port)))
+		})
+	})
+})
@@ -0,0 +1,310 @@
+package monitor
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/net/websocket"
+
+	"github.com/9corp/9volt/util"
+)
+
+const (
+	DEFAULT_WEBSOCKET_TIMEOUT = time.Duration(5) * time.Second
+
+	websocketMaxStatusLineSize = 512
+)
+
+type WebSocketMonitor struct {
+	Base
+
+	Timeout   time.Duration
+	Location  *url.URL
+	Origin    *url.URL
+	Payload   []byte
+	Matcher   *PayloadMatcher
+	TLSConfig *tls.Config
+}
+
+func NewWebSocketMonitor(rmc *RootMonitorConfig) *WebSocketMonitor {
+	w := &WebSocketMonitor{
+		Base: Base{
+			RMC:        rmc,
+			Identifier: "websocket",
+		},
+		Timeout: DEFAULT_WEBSOCKET_TIMEOUT,
+	}
+
+	if rmc.Config.Timeout != util.CustomDuration(0) {
+		w.Timeout = time.Duration(rmc.Config.Timeout)
+	}
+
+	w.MonitorFunc = w.websocketCheck
+
+	return w
+}
+
+func (w *WebSocketMonitor) Validate() error {
+	w.RMC.Log.WithField("configName", w.RMC.ConfigName).Debug("Performing monitor config validation")
+
+	cfg := w.RMC.Config
+
+	if w.Timeout >= time.Duration(cfg.Interval) {
+		return fmt.Errorf("'timeout' (%v) cannot equal or exceed 'interval' (%v)", w.Timeout.String(), cfg.Interval.String())
+	}
+
+	location, err := w.constructURL()
+	if err != nil {
+		return err
+	}
+
+	origin, err := w.constructOrigin(location)
+	if err != nil {
+		return err
+	}
+
+	if err := validateHTTPRequestOptions(cfg); err != nil {
+		return err
+	}
+
+	payload, err := decodePayload(cfg.TCPSend, cfg.SendEncoding)
+	if err != nil {
+		return fmt.Errorf("Invalid 'send': %v", err.Error())
+	}
+
+	matcher, err := newPayloadMatcher(cfg)
+	if err != nil {
+		return err
+	}
+
+	if location.Scheme == "wss" {
+		tlsConfig, err := newTLSClientConfig(cfg)
+		if err != nil {
+			return err
+		}
+
+		if tlsConfig.ServerName == "" {
+			tlsConfig.ServerName = location.Hostname()
+		}
+
+		w.TLSConfig = tlsConfig
+	}
+
+	w.Location = location
+	w.Origin = origin
+	w.Payload = payload
+	w.Matcher = matcher
+
+	return nil
+}
+
+// Perform the WebSocket upgrade handshake (with custom headers); if 'send' is
+// set, send it as a single message (binary if 'send-encoding' is 'hex' or
+// 'base64'). If 'expect' is set, wait for a message matching it. Messages that
+// do not match (ie. welcome or keepalive messages) are skipped. The whole
+// exchange must complete within 'timeout'.
+func (w *WebSocketMonitor) websocketCheck() (*CheckResult, error) {
+	if w.Location == nil {
+		if err := w.Validate(); err != nil {
+			return nil, err
+		}
+	}
+
+	fullURL := w.Location.String()
+
+	w.RMC.Log.WithField("fullURL", fullURL).Debug("Performing websocket check")
+
+	deadline := time.Now().Add(w.Timeout)
+
+	conn, err := net.DialTimeout("tcp", websocketAddress(w.Location), w.Timeout)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to connect to %v: %v", fullURL, err.Error())
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(deadline)
+
+	if w.TLSConfig != nil {
+		tlsConn := tls.Client(conn, w.TLSConfig)
+
+		if err := tlsConn.Handshake(); err != nil {
+			return nil, fmt.Errorf("TLS handshake with %v failed: %v", fullURL, err.Error())
+		}
+
+		conn = tlsConn
+	}
+
+	recorder := &statusLineRecorder{Conn: conn}
+
+	ws, err := websocket.NewClient(w.newConfig(), recorder)
+	if err != nil {
+		if err == websocket.ErrBadStatus {
+			return nil, fmt.Errorf("Upgrade to WebSocket rejected by %v: received '%v' instead of '101 Switching Protocols'",
+				fullURL, recorder.statusLine())
+		}
+
+		return nil, fmt.Errorf("WebSocket handshake with %v failed: %v", fullURL, err.Error())
+	}
+	defer ws.Close()
+
+	if len(w.Payload) != 0 {
+		if isBinaryEncoding(w.RMC.Config.SendEncoding) {
+			ws.PayloadType = websocket.BinaryFrame
+		}
+
+		if _, err := ws.Write(w.Payload); err != nil {
+			return nil, fmt.Errorf("Unable to send message to %v: %v", fullURL, err.Error())
+		}
+	}
+
+	if w.Matcher == nil {
+		return nil, nil
+	}
+
+	var last []byte
+
+	for {
+		var msg []byte
+
+		if err := websocket.Message.Receive(ws, &msg); err != nil {
+			if last == nil {
+				return nil, fmt.Errorf("No message matching %v received from %v: %v", w.Matcher, fullURL, err.Error())
+			}
+
+			return nil, fmt.Errorf("No message matching %v received from %v (last message: %q): %v",
+				w.Matcher, fullURL, last, err.Error())
+		}
+
+		if w.Matcher.Match(msg) {
+			return nil, nil
+		}
+
+		last = msg
+	}
+}
+
+// Assemble the handshake config; request options (headers, auth) are applied
+// the same way as for the 'http' monitor
+func (w *WebSocketMonitor) newConfig() *websocket.Config {
+	req := &http.Request{Header: make(http.Header)}
+
+	applyHTTPRequestOptions(req, w.RMC.Config)
+
+	return &websocket.Config{
+		Location:  w.Location,
+		Origin:    w.Origin,
+		Protocol:  w.RMC.Config.WebSocketProtocols,
+		Version:   websocket.ProtocolVersionHybi13,
+		TlsConfig: w.TLSConfig,
+		Header:    req.Header,
+	}
+}
+
+// Use 'url' as-is if it is a full ws:// or wss:// URL; otherwise combine 'ssl'
+// (for wss), 'host' and 'port' with 'url' as the path
+func (w *WebSocketMonitor) constructURL() (*url.URL, error) {
+	cfg := w.RMC.Config
+	rawURL := cfg.HTTPURL
+
+	if !strings.Contains(rawURL, "://") {
+		if cfg.Host == "" {
+			return nil, errors.New("Either 'host' or a full ws:// or wss:// 'url' must be set")
+		}
+
+		rawURL = buildHTTPURL(cfg, rawURL)
+		rawURL = "ws" + strings.TrimPrefix(rawURL, "http")
+	}
+
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to parse 'url' '%v': %v", rawURL, err.Error())
+	}
+
+	if u.Scheme != "ws" && u.Scheme != "wss" {
+		return nil, fmt.Errorf("Unsupported scheme '%v' in 'url' (supported: ws, wss)", u.Scheme)
+	}
+
+	if u.Host == "" {
+		return nil, fmt.Errorf("'url' '%v' is missing a host", rawURL)
+	}
+
+	return u, nil
+}
+
+// Browsers always send an Origin; default to the http(s) equivalent of the URL
+func (w *WebSocketMonitor) constructOrigin(location *url.URL) (*url.URL, error) {
+	if w.RMC.Config.WebSocketOrigin != "" {
+		origin, err := url.ParseRequestURI(w.RMC.Config.WebSocketOrigin)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to parse 'websocket-origin' '%v': %v", w.RMC.Config.WebSocketOrigin, err.Error())
+		}
+
+		return origin, nil
+	}
+
+	scheme := "http"
+	if location.Scheme == "wss" {
+		scheme = "https"
+	}
+
+	return &url.URL{Scheme: scheme, Host: location.Host}, nil
+}
+
+// host:port for a ws:// or wss:// URL, using the default port if none is set
+func websocketAddress(location *url.URL) string {
+	if location.Port() != "" {
+		return location.Host
+	}
+
+	port := "80"
+	if location.Scheme == "wss" {
+		port = "443"
+	}
+
+	return net.JoinHostPort(location.Hostname(), port)
+}
+
+func isBinaryEncoding(encoding string) bool {
+	encoding = strings.ToLower(encoding)
+
+	return encoding == PAYLOAD_ENCODING_HEX || encoding == PAYLOAD_ENCODING_BASE64
+}
+
+// Keeps the beginning of the server response, so that a rejected upgrade can
+// report the actual status (the websocket package only returns ErrBadStatus)
+type statusLineRecorder struct {
+	net.Conn
+
+	buf bytes.Buffer
+}
+
+func (s *statusLineRecorder) Read(p []byte) (int, error) {
+	n, err := s.Conn.Read(p)
+
+	if remaining := websocketMaxStatusLineSize - s.buf.Len(); remaining > 0 && n > 0 {
+		if n < remaining {
+			remaining = n
+		}
+
+		s.buf.Write(p[:remaining])
+	}
+
+	return n, err
+}
+
+func (s *statusLineRecorder) statusLine() string {
+	line := s.buf.String()
+
+	if idx := strings.Index(line, "\r\n"); idx != -1 {
+		line = line[:idx]
+	}
+
+	return line
+}
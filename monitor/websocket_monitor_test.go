@@ -0,0 +1,171 @@
+package monitor
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"golang.org/x/net/websocket"
+
+	"github.com/9corp/9volt/util"
+)
+
+// Sends a welcome message, then echoes every received message (prefixed with
+// 'echo: ') along with the Authorization header it saw during the handshake
+func newTestWebSocketHandler() http.Handler {
+	return websocket.Handler(func(ws *websocket.Conn) {
+		auth := ws.Request().Header.Get("Authorization")
+
+		websocket.Message.Send(ws, "welcome")
+
+		for {
+			var msg []byte
+
+			if err := websocket.Message.Receive(ws, &msg); err != nil {
+				return
+			}
+
+			websocket.Message.Send(ws, "echo: "+string(msg)+" auth: "+auth)
+		}
+	})
+}
+
+var _ = Describe("websocket_monitor", func() {
+	var (
+		monitor *WebSocketMonitor
+		config  *RootMonitorConfig
+		server  *httptest.Server
+	)
+
+	start := func() {
+		monitor = NewWebSocketMonitor(config)
+		Expect(monitor.Validate()).To(BeNil())
+	}
+
+	BeforeEach(func() {
+		server = httptest.NewServer(newTestWebSocketHandler())
+
+		config = &RootMonitorConfig{
+			Config: &MonitorConfig{
+				HTTPURL:  "ws" + strings.TrimPrefix(server.URL, "http") + "/gateway",
+				Interval: util.CustomDuration(10 * time.Second),
+			},
+			Log: log.New(),
+		}
+
+		monitor = NewWebSocketMonitor(config)
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	Context("Validate", func() {
+		It("returns nil with correct settings", func() {
+			Expect(monitor.Validate()).To(BeNil())
+			Expect(monitor.Timeout).To(Equal(DEFAULT_WEBSOCKET_TIMEOUT))
+			Expect(monitor.Origin.String()).To(Equal(strings.TrimSuffix(server.URL, "/")))
+		})
+
+		It("builds the URL from 'host', 'port', 'ssl' and 'url'", func() {
+			config.Config.HTTPURL = "/gateway"
+			config.Config.Host = "realtime"
+			config.Config.Port = 8443
+			config.Config.HTTPSSL = true
+			start()
+
+			Expect(monitor.Location.String()).To(Equal("wss://realtime:8443/gateway"))
+			Expect(monitor.Origin.String()).To(Equal("https://realtime:8443"))
+			Expect(monitor.TLSConfig.ServerName).To(Equal("realtime"))
+		})
+
+		It("rejects non-websocket URLs", func() {
+			config.Config.HTTPURL = "http://realtime/gateway"
+			Expect(monitor.Validate().Error()).To(ContainSubstring("Unsupported scheme 'http'"))
+
+			config.Config.HTTPURL = "/gateway"
+			Expect(monitor.Validate().Error()).To(ContainSubstring("Either 'host' or a full ws:// or wss:// 'url' must be set"))
+		})
+
+		It("verifies 'send' and 'expect'", func() {
+			config.Config.TCPSend = "zz"
+			config.Config.SendEncoding = "hex"
+			Expect(monitor.Validate().Error()).To(ContainSubstring("Invalid 'send'"))
+
+			config.Config.TCPSend = ""
+			config.Config.Expect = "("
+			config.Config.ExpectRegex = true
+			Expect(monitor.Validate().Error()).To(ContainSubstring("Unable to compile 'expect' regex"))
+		})
+	})
+
+	Context("websocketCheck", func() {
+		It("performs the upgrade handshake", func() {
+			start()
+			_, err := monitor.websocketCheck()
+			Expect(err).To(BeNil())
+		})
+
+		It("sends a message and waits for a matching reply, skipping others", func() {
+			config.Config.TCPSend = "ping"
+			config.Config.Expect = "echo: ping auth: Bearer hunter2"
+			config.Config.HTTPBearerToken = "hunter2"
+			start()
+			_, err := monitor.websocketCheck()
+			Expect(err).To(BeNil())
+
+			config.Config.Expect = `^echo: \w+ auth: Bearer`
+			config.Config.ExpectRegex = true
+			start()
+			_, err = monitor.websocketCheck()
+			Expect(err).To(BeNil())
+		})
+
+		It("fails if no matching reply arrives within the timeout", func() {
+			config.Config.Expect = "pong"
+			config.Config.Timeout = util.CustomDuration(200 * time.Millisecond)
+			start()
+
+			_, err := monitor.websocketCheck()
+			Expect(err).NotTo(BeNil())
+			Expect(err.Error()).To(ContainSubstring(`No message matching "pong" received`))
+			Expect(err.Error()).To(ContainSubstring(`(last message: "welcome")`))
+		})
+
+		It("reports the status of a rejected upgrade", func() {
+			server.Close()
+			server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte("OK"))
+			}))
+
+			config.Config.HTTPURL = "ws" + strings.TrimPrefix(server.URL, "http")
+			start()
+
+			_, err := monitor.websocketCheck()
+			Expect(err).NotTo(BeNil())
+			Expect(err.Error()).To(ContainSubstring("received 'HTTP/1.1 200 OK' instead of '101 Switching Protocols'"))
+		})
+
+		It("supports wss://", func() {
+			server.Close()
+			server = httptest.NewTLSServer(newTestWebSocketHandler())
+
+			config.Config.HTTPURL = "wss" + strings.TrimPrefix(server.URL, "https")
+			config.Config.Expect = "welcome"
+			start()
+
+			_, err := monitor.websocketCheck()
+			Expect(err).NotTo(BeNil())
+			Expect(err.Error()).To(ContainSubstring("TLS handshake"))
+
+			config.Config.TLSInsecureSkipVerify = true
+			start()
+			_, err = monitor.websocketCheck()
+			Expect(err).To(BeNil())
+		})
+	})
+})
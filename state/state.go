@@ -31,6 +31,23 @@ type Message struct {
 	Message string          `json:"message"`
 	Date    time.Time       `json:"date"`
 	Config  json.RawMessage `json:"config"`
+
+	// Details of the latest check run; 'duration' is in seconds
+	Duration float64           `json:"duration"`
+	Metrics  []*Metric         `json:"metrics,omitempty"`
+	Labels   map[string]string `json:"labels,omitempty"`
+}
+
+// A single measurement reported by a check (ie. a nagios plugin perfdata entry);
+// thresholds are kept as strings since they may be nagios style ranges (ie. '10:20')
+type Metric struct {
+	Name     string  `json:"name"`
+	Value    float64 `json:"value"`
+	Unit     string  `json:"unit,omitempty"`
+	Warning  string  `json:"warning,omitempty"`
+	Critical string  `json:"critical,omitempty"`
+	Min      string  `json:"min,omitempty"`
+	Max      string  `json:"max,omitempty"`
 }
 
 type State struct {